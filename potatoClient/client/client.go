@@ -1,17 +1,40 @@
 package client
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// NoExpiry is a TTL of keys that never expire
+const NoExpiry time.Duration = -1
+
 // CommandMessage is a message that we send to the server
 type CommandMessage struct {
 	Name      string
 	Arguments []string
 	TTL       time.Duration
+	Stream    bool
+	Binary    bool
+	Async     bool
+	TTLJitter int
+	// IdempotencyKey makes retries of a mutating command safe
+	IdempotencyKey string
+	// After is a causality token, the command waits for its write
+	After string `json:",omitempty"`
+	// Seq numbers writes of the connection from 1, writes out of sequence
+	// are rejected
+	Seq uint64 `json:",omitempty"`
+	// Protocol is the version of the protocol, set by UseProtocol
+	Protocol uint `json:",omitempty"`
+	// RequestID is echoed in the responses, see Pipeline
+	RequestID uint64 `json:",omitempty"`
 }
 
 // ResponseMessage is a message sent back to user
@@ -19,13 +42,148 @@ type ResponseMessage struct {
 	Code          uint
 	StatusMessage string
 	Value         string
+	More          bool
+	Binary        bool
+	// Token is a causality token of a write
+	Token string `json:",omitempty"`
+	// Nil is set by protocol 2 when there is no value at all
+	Nil bool `json:",omitempty"`
+	// Clamped is set when a write got a shorter TTL than it asked for
+	Clamped bool `json:",omitempty"`
+	// Lag is how far behind its primary a replica that served a read is
+	Lag time.Duration `json:",omitempty"`
+	// RequestID is the one of the command
+	RequestID uint64 `json:",omitempty"`
 }
 
 // Server is a structure that represents a potatoSlave
 type Server struct {
-	encoder  *json.Encoder
-	decoder  *json.Decoder
+	encoder  encoder
+	decoder  decoder
 	response ResponseMessage
+	protocol uint
+	// requestID is the last RequestID given by Pipeline
+	requestID uint64
+}
+
+// encoder and decoder are json.Encoder and json.Decoder or a frameCodec
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+type decoder interface {
+	Decode(v interface{}) error
+}
+
+// protocolVersion is the newest version of the protocol the client speaks
+const protocolVersion = 2
+
+// unknownCommand is the status of the slave for a command it doesn't have
+const unknownCommand = 7
+
+// Hello agrees with the slave on the version of the protocol, which is then
+// used like with UseProtocol, and returns its features. With features only
+// those are returned. A slave that doesn't know HELLO speaks protocol 1 and
+// has no features
+func (s *Server) Hello(features ...string) (map[string]bool, error) {
+	s.send(CommandMessage{
+		Name:      "HELLO",
+		Arguments: append([]string{strconv.Itoa(protocolVersion)}, features...),
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code == unknownCommand {
+		s.protocol = 1
+		return map[string]bool{}, nil
+	}
+	if s.response.Code != 0 {
+		return nil, errors.New(s.response.StatusMessage)
+	}
+	var info struct {
+		Protocol uint
+		Features map[string]bool
+	}
+	if err := json.Unmarshal([]byte(s.response.Value), &info); err != nil {
+		return nil, err
+	}
+	s.protocol = info.Protocol
+	return info.Features, nil
+}
+
+// UseProtocol sets the version of the protocol for all following commands,
+// with 2 IsNil tells a missing value from an empty string
+func (s *Server) UseProtocol(version uint) {
+	s.protocol = version
+}
+
+// IsNil tells if the last response had no value at all, e. g. Get of a key that
+// doesn't exist. It's only known with UseProtocol(2)
+func (s *Server) IsNil() bool {
+	return s.response.Nil
+}
+
+// WasClamped tells if the last write was applied with the maximum TTL of the
+// server instead of the one it asked for.
+func (s *Server) WasClamped() bool {
+	return s.response.Clamped
+}
+
+// Status returns the status code and the message of the last response, 0 is
+// success
+func (s *Server) Status() (uint, string) {
+	return s.response.Code, s.response.StatusMessage
+}
+
+// Staleness returns how far behind its primary the replica that served the
+// last read was, 0 for a primary or a replica without REPORTLAG and -1 for a
+// replica that hasn't synced yet.
+func (s *Server) Staleness() time.Duration {
+	return s.response.Lag
+}
+
+// send sends a command with the protocol of the connection. The last response
+// is cleared, so fields missing in the next one aren't left from it
+func (s *Server) send(mes CommandMessage) {
+	s.response = ResponseMessage{}
+	mes.Protocol = s.protocol
+	s.encoder.Encode(mes)
+}
+
+// Pipeline sends commands without waiting for each response and returns the
+// responses in the order of the commands, matched by RequestID. A command
+// without a response, e. g. if the connection fails, gets a zero
+// ResponseMessage. Streams aren't pipelined, Stream is ignored
+func (s *Server) Pipeline(commands []CommandMessage) []ResponseMessage {
+
+	base := s.requestID
+	s.requestID += uint64(len(commands))
+
+	// Commands are written while responses are read, so neither side blocks
+	// on a full buffer
+	done := make(chan struct{})
+	go func() {
+		for i, mes := range commands {
+			mes.Stream = false
+			mes.Protocol = s.protocol
+			mes.RequestID = base + uint64(i) + 1
+			if s.encoder.Encode(mes) != nil {
+				break
+			}
+		}
+		close(done)
+	}()
+
+	responses := make([]ResponseMessage, len(commands))
+	for range commands {
+		var response ResponseMessage
+		if s.decoder.Decode(&response) != nil {
+			break
+		}
+		if i := response.RequestID - base - 1; response.RequestID > base && i < uint64(len(commands)) {
+			responses[i] = response
+		}
+	}
+	<-done
+	return responses
 }
 
 // Connect
@@ -39,20 +197,153 @@ func (s *Server) Connect(path string) {
 	s.decoder = json.NewDecoder(conn)
 }
 
+// ConnectTLS connects like Connect, but over TLS, for slaves with TLSPORT.
+// config may have a certificate of the client and CAs of the slave, nil
+// trusts the system ones
+func (s *Server) ConnectTLS(path string, config *tls.Config) {
+
+	conn, err := tls.Dial("tcp", path, config)
+	if err != nil {
+		panic(err)
+	}
+	s.encoder = json.NewEncoder(conn)
+	s.decoder = json.NewDecoder(conn)
+}
+
+// Auth logs the connection in as a user of a slave with USERSPATH, commands
+// other than Ping fail before it
+func (s *Server) Auth(name string, password string) error {
+	s.send(CommandMessage{
+		Name:      "AUTH",
+		Arguments: []string{name, password},
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return errors.New(s.response.StatusMessage)
+	}
+	return nil
+}
+
+// AuthToken logs the connection in with an API token of CreateToken
+func (s *Server) AuthToken(token string) error {
+	s.send(CommandMessage{
+		Name:      "AUTH",
+		Arguments: []string{token},
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return errors.New(s.response.StatusMessage)
+	}
+	return nil
+}
+
+// CreateToken makes an API token of a user, "" for the logged in one, that
+// expires after ttl, never if it's 0. The token is only returned here
+func (s *Server) CreateToken(name string, ttl time.Duration) (string, error) {
+	args := []string{"CREATE"}
+	if name != "" || ttl != 0 {
+		args = append(args, name, strconv.FormatInt(int64(ttl/time.Second), 10))
+	}
+	s.send(CommandMessage{
+		Name:      "TOKEN",
+		Arguments: args,
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return "", errors.New(s.response.StatusMessage)
+	}
+	return s.response.Value, nil
+}
+
+// RevokeToken revokes an API token by its ID, the part between "ptk_" and
+// the dot
+func (s *Server) RevokeToken(id string) error {
+	s.send(CommandMessage{
+		Name:      "TOKEN",
+		Arguments: []string{"REVOKE", id},
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return errors.New(s.response.StatusMessage)
+	}
+	return nil
+}
+
+// Use makes the next commands read keys of another user, which has granted
+// some of them with Grant. Use("") goes back to the own keys
+func (s *Server) Use(owner string) error {
+	var args []string
+	if owner != "" {
+		args = []string{owner}
+	}
+	s.send(CommandMessage{
+		Name:      "USE",
+		Arguments: args,
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return errors.New(s.response.StatusMessage)
+	}
+	return nil
+}
+
+// Grant lets user read keys of owner under prefix, admins only
+func (s *Server) Grant(owner string, prefix string, user string) error {
+	s.send(CommandMessage{
+		Name:      "GRANT",
+		Arguments: []string{"ADD", owner, prefix, user},
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return errors.New(s.response.StatusMessage)
+	}
+	return nil
+}
+
+// Ungrant takes back a grant of Grant
+func (s *Server) Ungrant(owner string, prefix string, user string) error {
+	s.send(CommandMessage{
+		Name:      "GRANT",
+		Arguments: []string{"DEL", owner, prefix, user},
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return errors.New(s.response.StatusMessage)
+	}
+	return nil
+}
+
 // Get
 func (s *Server) Get(key string) string {
-	s.encoder.Encode(CommandMessage{
+	s.send(CommandMessage{
+		Name:      "GET",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// GetAfter gets a key once the write of a causality token is seen
+func (s *Server) GetAfter(key string, token string) string {
+	s.send(CommandMessage{
 		Name:      "GET",
 		Arguments: []string{key},
+		After:     token,
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
 	return s.response.Value
 }
 
+// Token returns the causality token of the last write
+func (s *Server) Token() string {
+	return s.response.Token
+}
+
 // Set
 func (s *Server) Set(key string, value string, ttl time.Duration) {
-	s.encoder.Encode(CommandMessage{
+	s.send(CommandMessage{
 		Name:      "SET",
 		Arguments: []string{key, value},
 		TTL:       ttl,
@@ -61,74 +352,996 @@ func (s *Server) Set(key string, value string, ttl time.Duration) {
 	//fmt.Println(s.response.StatusMessage)
 }
 
-// Del
-func (s *Server) Del(key string) {
-	s.encoder.Encode(CommandMessage{
-		Name:      "DEL",
+// GetBytes is Get for values that aren't text
+func (s *Server) GetBytes(key string) []byte {
+	s.send(CommandMessage{
+		Name:      "GET",
+		Arguments: []string{base64.StdEncoding.EncodeToString([]byte(key))},
+		Binary:    true,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	value, _ := base64.StdEncoding.DecodeString(s.response.Value)
+	return value
+}
+
+// SetBytes is Set for values that aren't text
+func (s *Server) SetBytes(key string, value []byte, ttl time.Duration) {
+	s.send(CommandMessage{
+		Name: "SET",
+		Arguments: []string{
+			base64.StdEncoding.EncodeToString([]byte(key)),
+			base64.StdEncoding.EncodeToString(value),
+		},
+		TTL:    ttl,
+		Binary: true,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Expire sets a new TTL of a key
+func (s *Server) Expire(key string, ttl time.Duration) {
+	s.send(CommandMessage{
+		Name:      "PEXPIRE",
+		Arguments: []string{key, strconv.FormatInt(int64(ttl/time.Millisecond), 10)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// ExpireAt makes a key expire at the given moment
+func (s *Server) ExpireAt(key string, at time.Time) {
+	s.send(CommandMessage{
+		Name:      "PEXPIREAT",
+		Arguments: []string{key, strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Persist makes a key live until it's deleted
+func (s *Server) Persist(key string) {
+	s.send(CommandMessage{
+		Name:      "PERSIST",
 		Arguments: []string{key},
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
 }
 
-// Keys
-func (s *Server) Keys() string {
-	s.encoder.Encode(CommandMessage{
-		Name: "KEYS",
+// Expireprefix sets a TTL for every key under a prefix
+func (s *Server) Expireprefix(prefix string, ttl time.Duration) int {
+	s.send(CommandMessage{
+		Name:      "EXPIREPREFIX",
+		Arguments: []string{prefix, strconv.FormatInt(int64(ttl/time.Second), 10)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	n, _ := strconv.Atoi(s.response.Value)
+	return n
+}
+
+// Persistprefix makes every key under a prefix live until it's deleted
+func (s *Server) Persistprefix(prefix string) int {
+	s.send(CommandMessage{
+		Name:      "PERSISTPREFIX",
+		Arguments: []string{prefix},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	n, _ := strconv.Atoi(s.response.Value)
+	return n
+}
+
+// TTL returns time left until a key expires, -1 if it never expires and -2
+// if there is no such key
+func (s *Server) TTL(key string) time.Duration {
+	s.send(CommandMessage{
+		Name:      "PTTL",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	if s.response.Code != 0 {
+		return -2
+	}
+	ms, _ := strconv.ParseInt(s.response.Value, 10, 64)
+	if ms == -1 {
+		return -1
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// CommandsDocs returns names of the commands and the status codes as JSON
+func (s *Server) CommandsDocs() string {
+	s.send(CommandMessage{
+		Name:      "COMMANDS",
+		Arguments: []string{"DOCS"},
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
 	return s.response.Value
 }
 
-// Lpush
-func (s *Server) Lpush(key string, val string, ttl time.Duration) {
-	s.encoder.Encode(CommandMessage{
-		Name:      "LPUSH",
-		Arguments: []string{key, val},
+// Expirestats returns metrics of the ttl checker as JSON
+func (s *Server) Expirestats() string {
+	s.send(CommandMessage{
+		Name: "EXPIRESTATS",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Memorystats returns heap, peaks and the estimate of stored bytes as JSON
+func (s *Server) Memorystats() string {
+	s.send(CommandMessage{
+		Name: "MEMORYSTATS",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Version returns build info and features of the server as JSON
+func (s *Server) Version() string {
+	s.send(CommandMessage{
+		Name: "VERSION",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// EraseuserAsync starts erasure of a user as a job and returns its ID
+func (s *Server) EraseuserAsync(user string) string {
+	s.send(CommandMessage{
+		Name:      "ERASEUSER",
+		Arguments: []string{user},
+		Async:     true,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// MovekeysAsync starts moving keys of a user that match a pattern to another
+// user as a job and returns its ID, the job's result is the number of moved
+// keys
+func (s *Server) MovekeysAsync(from string, to string, pattern string) string {
+	s.send(CommandMessage{
+		Name:      "MOVEKEYS",
+		Arguments: []string{from, to, pattern},
+		Async:     true,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Save saves a snapshot on the server and waits until it's written
+func (s *Server) Save() uint {
+	s.send(CommandMessage{
+		Name: "SAVE",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Code
+}
+
+// Dump returns a serialized object stored at the key
+func (s *Server) Dump(key string) string {
+	s.send(CommandMessage{
+		Name:      "DUMP",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Migrate moves a key with its TTL to the slave at addr and returns the status
+// code, the key stays here unless it's 0
+func (s *Server) Migrate(key string, addr string) uint {
+	s.send(CommandMessage{
+		Name:      "MIGRATE",
+		Arguments: []string{key, addr},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Code
+}
+
+// Wait blocks until numreplicas replicas have every write of the user so far,
+// or timeout passes, 0 waits for as long as it takes; it returns how many
+// replicas have them
+func (s *Server) Wait(numreplicas int, timeout time.Duration) int {
+	s.send(CommandMessage{
+		Name:      "WAIT",
+		Arguments: []string{strconv.Itoa(numreplicas), strconv.FormatInt(timeout.Milliseconds(), 10)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	n, _ := strconv.Atoi(s.response.Value)
+	return n
+}
+
+// Restore creates a key from a dump, an existing key is only replaced if
+// replace is set
+func (s *Server) Restore(key string, dump string, ttl time.Duration, replace bool) uint {
+	arguments := []string{key, dump}
+	if replace {
+		arguments = append(arguments, "REPLACE")
+	}
+	s.send(CommandMessage{
+		Name:      "RESTORE",
+		Arguments: arguments,
 		TTL:       ttl,
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
+	return s.response.Code
 }
 
-// Lget
-func (s *Server) Lget(key string, position int) string {
-	s.encoder.Encode(CommandMessage{
-		Name:      "LGET",
-		Arguments: []string{key, strconv.Itoa(position)},
+// BackupEntry is a key of a backup, it's put back with Restore(Key, Dump, TTL, true)
+type BackupEntry struct {
+	Key  string
+	Dump string
+	TTL  time.Duration
+}
+
+// Backup streams a copy of all keys of the user, calling f for each of them
+func (s *Server) Backup(f func(BackupEntry)) {
+	s.stream(CommandMessage{
+		Name:   "BACKUP",
+		Stream: true,
+	}, func(frame string) {
+		for _, line := range strings.Split(frame, "\n") {
+			var entry BackupEntry
+			if line != "" && json.Unmarshal([]byte(line), &entry) == nil {
+				f(entry)
+			}
+		}
+	})
+}
+
+// Bgsave starts saving a snapshot on the server as a job and returns its ID
+func (s *Server) Bgsave() string {
+	s.send(CommandMessage{
+		Name: "BGSAVE",
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
 	return s.response.Value
 }
 
-// Lset
-func (s *Server) Lset(key string, position int, val string) {
-	s.encoder.Encode(CommandMessage{
-		Name:      "LSET",
-		Arguments: []string{key, strconv.Itoa(position), val},
+// Bgrewriteaof starts a rewrite of the append-only log on the server as a job
+// and returns its ID
+func (s *Server) Bgrewriteaof() string {
+	s.send(CommandMessage{
+		Name: "BGREWRITEAOF",
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
 }
 
-// Hget
-func (s *Server) Hget(key string, innerKey string) string {
-	s.encoder.Encode(CommandMessage{
-		Name:      "HGET",
-		Arguments: []string{key, innerKey},
+// ProposalConfirm runs a destructive command proposed earlier and returns its
+// result
+func (s *Server) ProposalConfirm(id string) string {
+	s.send(CommandMessage{
+		Name:      "PROPOSAL",
+		Arguments: []string{"CONFIRM", id},
 	})
 	s.decoder.Decode(&s.response)
 	//fmt.Println(s.response.StatusMessage)
 	return s.response.Value
 }
 
-// Hset
-func (s *Server) Hset(key string, innerKey string, val string, ttl time.Duration) {
-	s.encoder.Encode(CommandMessage{
-		Name:      "HSET",
-		Arguments: []string{key, innerKey, val},
+// ProposalList returns pending proposals as JSON
+func (s *Server) ProposalList() string {
+	s.send(CommandMessage{
+		Name:      "PROPOSAL",
+		Arguments: []string{"LIST"},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// JobStatus returns state, progress and result of a job as JSON
+func (s *Server) JobStatus(id string) string {
+	s.send(CommandMessage{
+		Name:      "JOB",
+		Arguments: []string{"STATUS", id},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// JobCancel asks a job to stop
+func (s *Server) JobCancel(id string) {
+	s.send(CommandMessage{
+		Name:      "JOB",
+		Arguments: []string{"CANCEL", id},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Del
+func (s *Server) Del(key string) {
+	s.send(CommandMessage{
+		Name:      "DEL",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Keys
+func (s *Server) Keys() string {
+	s.send(CommandMessage{
+		Name: "KEYS",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// KeysStream receives keys in chunks, calling f for each of them
+func (s *Server) KeysStream(f func(string)) {
+	s.stream(CommandMessage{
+		Name:   "KEYS",
+		Stream: true,
+	}, f)
+}
+
+// GetStream writes the value of a key to w in pieces as they come, so a big
+// value is never held whole. The value may be any bytes
+func (s *Server) GetStream(key string, w io.Writer) error {
+	s.send(CommandMessage{
+		Name:      "GET",
+		Arguments: []string{base64.StdEncoding.EncodeToString([]byte(key))},
+		Stream:    true,
+		Binary:    true,
+	})
+	for {
+		if err := s.decoder.Decode(&s.response); err != nil {
+			return err
+		}
+		if s.response.Code != 0 {
+			return errors.New(s.response.StatusMessage)
+		}
+		// Every frame is base64 of its own
+		b, err := base64.StdEncoding.DecodeString(s.response.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if !s.response.More {
+			return nil
+		}
+	}
+}
+
+// stream sends a streamed command and calls f for each received frame
+func (s *Server) stream(mes CommandMessage, f func(string)) {
+	s.send(mes)
+	for {
+		if err := s.decoder.Decode(&s.response); err != nil {
+			return
+		}
+		if s.response.Value != "" {
+			f(s.response.Value)
+		}
+		if !s.response.More {
+			return
+		}
+	}
+}
+
+// SubscribeExpired calls f with every expired key under prefix. It blocks
+// until the connection is closed, so it needs a connection of its own
+func (s *Server) SubscribeExpired(prefix string, f func(string)) {
+	s.stream(CommandMessage{
+		Name:      "SUBSCRIBE",
+		Arguments: []string{"EXPIRED", prefix},
+	}, f)
+}
+
+// SetJittered is Set with TTL shortened by a random part of up to jitter
+// percent, so that keys set together don't expire together
+func (s *Server) SetJittered(key string, value string, ttl time.Duration, jitter int) {
+	s.send(CommandMessage{
+		Name:      "SET",
+		Arguments: []string{key, value},
+		TTL:       ttl,
+		TTLJitter: jitter,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// CincrOnce is Cincr that can be retried with the same idempotency key
+// without counting twice
+func (s *Server) CincrOnce(idempotencyKey string, key string, amount int64, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:           "CINCR",
+		Arguments:      []string{key, strconv.FormatInt(amount, 10)},
+		TTL:            ttl,
+		IdempotencyKey: idempotencyKey,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Lpush
+func (s *Server) Lpush(key string, val string, ttl time.Duration) {
+	s.send(CommandMessage{
+		Name:      "LPUSH",
+		Arguments: []string{key, val},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// LpushSeq is Lpush with the sequence number of the write, it returns the
+// status code so rejected writes can be sent again in order
+func (s *Server) LpushSeq(key string, val string, ttl time.Duration, seq uint64) uint {
+	s.send(CommandMessage{
+		Name:      "LPUSH",
+		Arguments: []string{key, val},
+		TTL:       ttl,
+		Seq:       seq,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Code
+}
+
+// Lget
+func (s *Server) Lget(key string, position int) string {
+	s.send(CommandMessage{
+		Name:      "LGET",
+		Arguments: []string{key, strconv.Itoa(position)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Lset
+func (s *Server) Lset(key string, position int, val string) {
+	s.send(CommandMessage{
+		Name:      "LSET",
+		Arguments: []string{key, strconv.Itoa(position), val},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Hget
+func (s *Server) Hget(key string, innerKey string) string {
+	s.send(CommandMessage{
+		Name:      "HGET",
+		Arguments: []string{key, innerKey},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Hset
+func (s *Server) Hset(key string, innerKey string, val string, ttl time.Duration) {
+	s.send(CommandMessage{
+		Name:      "HSET",
+		Arguments: []string{key, innerKey, val},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Hgetall
+func (s *Server) Hgetall(key string) string {
+	s.send(CommandMessage{
+		Name:      "HGETALL",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// HgetallStream receives fields of a hash in chunks, calling f for each of them
+func (s *Server) HgetallStream(key string, f func(string)) {
+	s.stream(CommandMessage{
+		Name:      "HGETALL",
+		Arguments: []string{key},
+		Stream:    true,
+	}, f)
+}
+
+// Hexpire sets a TTL for a single field of a hash, it's rounded down to
+// seconds
+func (s *Server) Hexpire(key string, innerKey string, ttl time.Duration) {
+	s.send(CommandMessage{
+		Name:      "HEXPIRE",
+		Arguments: []string{key, innerKey, strconv.FormatInt(int64(ttl/time.Second), 10)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Ping
+func (s *Server) Ping() string {
+	s.send(CommandMessage{
+		Name: "PING",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Echo
+func (s *Server) Echo(message string) string {
+	s.send(CommandMessage{
+		Name:      "ECHO",
+		Arguments: []string{message},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Hgetdel returns a field of a hash and removes it
+func (s *Server) Hgetdel(key string, innerKey string) string {
+	s.send(CommandMessage{
+		Name:      "HGETDEL",
+		Arguments: []string{key, innerKey},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Hgetex returns a field of a hash and updates the TTL of the hash
+func (s *Server) Hgetex(key string, innerKey string, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:      "HGETEX",
+		Arguments: []string{key, innerKey},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sadd adds members to a set and returns the number of added ones
+func (s *Server) Sadd(key string, ttl time.Duration, members ...string) string {
+	s.send(CommandMessage{
+		Name:      "SADD",
+		Arguments: append([]string{key}, members...),
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Srem removes members from a set and returns the number of removed ones
+func (s *Server) Srem(key string, members ...string) string {
+	s.send(CommandMessage{
+		Name:      "SREM",
+		Arguments: append([]string{key}, members...),
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Smembers
+func (s *Server) Smembers(key string) string {
+	s.send(CommandMessage{
+		Name:      "SMEMBERS",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sismember
+func (s *Server) Sismember(key string, member string) bool {
+	s.send(CommandMessage{
+		Name:      "SISMEMBER",
+		Arguments: []string{key, member},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value == "1"
+}
+
+// Scard
+func (s *Server) Scard(key string) int {
+	s.send(CommandMessage{
+		Name:      "SCARD",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	n, _ := strconv.Atoi(s.response.Value)
+	return n
+}
+
+// Eraseuser deletes all data of a user and returns the erasure report
+func (s *Server) Eraseuser(user string) string {
+	s.send(CommandMessage{
+		Name:      "ERASEUSER",
+		Arguments: []string{user},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sinter
+func (s *Server) Sinter(keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "SINTER",
+		Arguments: keys,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sinterstore writes the result to dest and returns its cardinality
+func (s *Server) Sinterstore(dest string, ttl time.Duration, keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "SINTERSTORE",
+		Arguments: append([]string{dest}, keys...),
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sunion
+func (s *Server) Sunion(keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "SUNION",
+		Arguments: keys,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sunionstore writes the result to dest and returns its cardinality
+func (s *Server) Sunionstore(dest string, ttl time.Duration, keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "SUNIONSTORE",
+		Arguments: append([]string{dest}, keys...),
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sdiff
+func (s *Server) Sdiff(keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "SDIFF",
+		Arguments: keys,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Sdiffstore writes the result to dest and returns its cardinality
+func (s *Server) Sdiffstore(dest string, ttl time.Duration, keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "SDIFFSTORE",
+		Arguments: append([]string{dest}, keys...),
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Zadd sets the score of a member of a sorted set
+func (s *Server) Zadd(key string, score float64, member string, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:      "ZADD",
+		Arguments: []string{key, strconv.FormatFloat(score, 'g', -1, 64), member},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Zrange returns members between two ranks
+func (s *Server) Zrange(key string, start int, stop int) string {
+	s.send(CommandMessage{
+		Name:      "ZRANGE",
+		Arguments: []string{key, strconv.Itoa(start), strconv.Itoa(stop)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Zrangebyscore returns members which scores are between min and max
+func (s *Server) Zrangebyscore(key string, min float64, max float64) string {
+	s.send(CommandMessage{
+		Name:      "ZRANGEBYSCORE",
+		Arguments: []string{key, strconv.FormatFloat(min, 'g', -1, 64), strconv.FormatFloat(max, 'g', -1, 64)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Zincrby adds increment to the score of a member and returns the new score
+func (s *Server) Zincrby(key string, increment float64, member string, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:      "ZINCRBY",
+		Arguments: []string{key, strconv.FormatFloat(increment, 'g', -1, 64), member},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Zrank returns the rank of a member counting from the lowest score
+func (s *Server) Zrank(key string, member string) string {
+	s.send(CommandMessage{
+		Name:      "ZRANK",
+		Arguments: []string{key, member},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Zrevrank returns the rank of a member counting from the highest score
+func (s *Server) Zrevrank(key string, member string) string {
+	s.send(CommandMessage{
+		Name:      "ZREVRANK",
+		Arguments: []string{key, member},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Cincr increments a counter by amount and returns the new value
+func (s *Server) Cincr(key string, amount int64, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:      "CINCR",
+		Arguments: []string{key, strconv.FormatInt(amount, 10)},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Cdecr decrements a counter by amount and returns the new value
+func (s *Server) Cdecr(key string, amount int64, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:      "CDECR",
+		Arguments: []string{key, strconv.FormatInt(amount, 10)},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Cget
+func (s *Server) Cget(key string) string {
+	s.send(CommandMessage{
+		Name:      "CGET",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Query runs a query over hashes and returns matching rows as JSON
+func (s *Server) Query(query string) string {
+	s.send(CommandMessage{
+		Name:      "QUERY",
+		Arguments: []string{query},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Setbit sets a bit of a bitmap and returns its previous value
+func (s *Server) Setbit(key string, offset uint64, value bool, ttl time.Duration) string {
+	bit := "0"
+	if value {
+		bit = "1"
+	}
+	s.send(CommandMessage{
+		Name:      "SETBIT",
+		Arguments: []string{key, strconv.FormatUint(offset, 10), bit},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Getbit
+func (s *Server) Getbit(key string, offset uint64) string {
+	s.send(CommandMessage{
+		Name:      "GETBIT",
+		Arguments: []string{key, strconv.FormatUint(offset, 10)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Bitcount
+func (s *Server) Bitcount(key string) string {
+	s.send(CommandMessage{
+		Name:      "BITCOUNT",
+		Arguments: []string{key},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Aggcreate declares an aggregation, kind is "COUNT" or "SUM", field is only
+// needed for sums
+func (s *Server) Aggcreate(name string, kind string, prefix string, field string) {
+	args := []string{name, kind, prefix}
+	if field != "" {
+		args = append(args, field)
+	}
+	s.send(CommandMessage{
+		Name:      "AGGCREATE",
+		Arguments: args,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Aggget returns the current value of an aggregation
+func (s *Server) Aggget(name string) string {
+	s.send(CommandMessage{
+		Name:      "AGGGET",
+		Arguments: []string{name},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Aggdrop
+func (s *Server) Aggdrop(name string) {
+	s.send(CommandMessage{
+		Name:      "AGGDROP",
+		Arguments: []string{name},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Pfadd adds elements to an approximate distinct counter
+func (s *Server) Pfadd(key string, ttl time.Duration, elements ...string) string {
+	s.send(CommandMessage{
+		Name:      "PFADD",
+		Arguments: append([]string{key}, elements...),
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Pfcount returns the approximate number of distinct elements in the counters
+func (s *Server) Pfcount(keys ...string) string {
+	s.send(CommandMessage{
+		Name:      "PFCOUNT",
+		Arguments: keys,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Pfmerge merges counters into dest
+func (s *Server) Pfmerge(dest string, keys ...string) {
+	s.send(CommandMessage{
+		Name:      "PFMERGE",
+		Arguments: append([]string{dest}, keys...),
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+}
+
+// Stats returns server counters as JSON
+func (s *Server) Stats() string {
+	s.send(CommandMessage{
+		Name: "STATS",
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Xadd appends a value to a stream and returns the id of the new entry
+func (s *Server) Xadd(key string, value string, ttl time.Duration) string {
+	s.send(CommandMessage{
+		Name:      "XADD",
+		Arguments: []string{key, value},
+		TTL:       ttl,
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Xrange returns entries between two ids, "-" and "+" can be used as bounds
+func (s *Server) Xrange(key string, start string, end string) string {
+	s.send(CommandMessage{
+		Name:      "XRANGE",
+		Arguments: []string{key, start, end},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Xread returns at most count entries that the consumer hasn't read yet
+func (s *Server) Xread(key string, consumer string, count int) string {
+	s.send(CommandMessage{
+		Name:      "XREAD",
+		Arguments: []string{key, consumer, strconv.Itoa(count)},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Jget returns JSON of the part of a document at path
+func (s *Server) Jget(key string, path string) string {
+	s.send(CommandMessage{
+		Name:      "JGET",
+		Arguments: []string{key, path},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// Jset puts JSON value at path of a document
+func (s *Server) Jset(key string, path string, value string, ttl time.Duration) {
+	s.send(CommandMessage{
+		Name:      "JSET",
+		Arguments: []string{key, path, value},
 		TTL:       ttl,
 	})
 	s.decoder.Decode(&s.response)
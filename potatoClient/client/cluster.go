@@ -0,0 +1,64 @@
+package client
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Slot is a range of key hashes, both ends included, served by a slave, see
+// ClusterSlots
+type Slot struct {
+	Start uint32
+	End   uint32
+	Slave string
+	// Down is set while the slave is failing over
+	Down bool `json:",omitempty"`
+}
+
+// ClusterSlots asks a master which slave serves which hashes of keys, so
+// commands can be sent to slaves directly. The slots change when slaves come
+// and go, so they should be asked for again on errors
+func (s *Server) ClusterSlots() ([]Slot, error) {
+	s.send(CommandMessage{
+		Name:      "CLUSTER",
+		Arguments: []string{"SLOTS"},
+	})
+	s.decoder.Decode(&s.response)
+	if s.response.Code != 0 {
+		return nil, errors.New(s.response.StatusMessage)
+	}
+	var slots []Slot
+	err := json.Unmarshal([]byte(s.response.Value), &slots)
+	return slots, err
+}
+
+// ClusterInfo returns what a master knows about the cluster as JSON
+func (s *Server) ClusterInfo() string {
+	s.send(CommandMessage{
+		Name:      "CLUSTER",
+		Arguments: []string{"INFO"},
+	})
+	s.decoder.Decode(&s.response)
+	//fmt.Println(s.response.StatusMessage)
+	return s.response.Value
+}
+
+// HashOf is the hash of a key the master routes it by
+func HashOf(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// SlaveFor returns the address of the slave that serves key according to slots
+// of ClusterSlots, "" if there are none
+func SlaveFor(slots []Slot, key string) string {
+	h := HashOf(key)
+	i := sort.Search(len(slots), func(i int) bool { return slots[i].End >= h })
+	if i == len(slots) {
+		return ""
+	}
+	return slots[i].Slave
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Seeds is a list of slave addresses behind a DNS name. SRV records of the
+// name are used if there are any, otherwise its A records with Port. The
+// name is resolved again every Interval, so nodes can move around
+type Seeds struct {
+	Name     string
+	Port     string
+	Interval time.Duration
+	// Resolver looks the name up, net.DefaultResolver if nil
+	Resolver Resolver
+
+	mu    sync.Mutex
+	addrs []string
+	stop  chan bool
+}
+
+// Resolver is what seeds are looked up with, *net.Resolver is one
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// NewSeeds resolves name and keeps re-resolving it every interval until Stop
+// is called. Interval of 0 means that name is resolved only once
+func NewSeeds(name string, port string, interval time.Duration) (*Seeds, error) {
+
+	seeds := &Seeds{Name: name, Port: port, Interval: interval, stop: make(chan bool)}
+	if err := seeds.Resolve(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go func() {
+			for {
+				select {
+				case <-seeds.stop:
+					return
+				case <-time.After(seeds.Interval):
+					// Old addresses are kept if DNS is unavailable for a while
+					seeds.Resolve()
+				}
+			}
+		}()
+	}
+
+	return seeds, nil
+}
+
+// Resolve looks the name up now
+func (s *Seeds) Resolve() error {
+
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx := context.Background()
+
+	var addrs []string
+
+	if _, records, err := resolver.LookupSRV(ctx, "", "", s.Name); err == nil {
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(r.Target, strconv.Itoa(int(r.Port))))
+		}
+	}
+
+	if len(addrs) == 0 {
+		hosts, err := resolver.LookupHost(ctx, s.Name)
+		if err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, s.Port))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return errors.New("no seeds found for " + s.Name)
+	}
+
+	s.mu.Lock()
+	s.addrs = addrs
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Addrs returns the last resolved addresses
+func (s *Seeds) Addrs() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.addrs...)
+}
+
+// Stop stops re-resolving
+func (s *Seeds) Stop() {
+	close(s.stop)
+}
+
+// ConnectSeeds connects to the first seed that answers
+func (s *Server) ConnectSeeds(seeds *Seeds) {
+
+	for _, addr := range seeds.Addrs() {
+		conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+		if err != nil {
+			continue
+		}
+		s.encoder = json.NewEncoder(conn)
+		s.decoder = json.NewDecoder(conn)
+		return
+	}
+
+	panic("none of the seeds of " + seeds.Name + " answered")
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// stubResolver answers lookups from maps, a name that isn't there fails
+type stubResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+
+	if records, ok := r.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, errors.New("no SRV records of " + name)
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, errors.New("no such host " + host)
+}
+
+func TestSeeds(t *testing.T) {
+
+	resolver := &stubResolver{}
+	seeds := &Seeds{Name: "seeds.potato", Port: "7000", Resolver: resolver}
+
+	check := func(what string, want ...string) {
+		got := seeds.Addrs()
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: seeds are %v, not %v", what, got, want)
+		}
+	}
+
+	// Nothing resolves
+	if err := seeds.Resolve(); err == nil {
+		t.Fatal("a name without records resolved")
+	}
+	check("never resolved")
+
+	// A records get Port
+	resolver.hosts = map[string][]string{"seeds.potato": {"10.0.0.1", "10.0.0.2"}}
+	if err := seeds.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	check("A records", "10.0.0.1:7000", "10.0.0.2:7000")
+
+	// SRV records win over A records and have ports of their own
+	resolver.srv = map[string][]*net.SRV{"seeds.potato": {{Target: "a.potato", Port: 7001}, {Target: "b.potato", Port: 7002}}}
+	if err := seeds.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	check("SRV records", "a.potato:7001", "b.potato:7002")
+
+	// No records at all is an error too
+	resolver.srv = nil
+	resolver.hosts = map[string][]string{"seeds.potato": {}}
+	if err := seeds.Resolve(); err == nil {
+		t.Fatal("a name without addresses resolved")
+	}
+	check("no addresses", "a.potato:7001", "b.potato:7002")
+
+	// DNS going away keeps the old addresses
+	resolver.hosts = nil
+	if err := seeds.Resolve(); err == nil {
+		t.Fatal("a name resolved without DNS")
+	}
+	check("DNS unavailable", "a.potato:7001", "b.potato:7002")
+}
+
+func TestConnectSeeds(t *testing.T) {
+
+	// The first seed is gone, the second one answers
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+
+	seeds := &Seeds{Name: "seeds.potato", addrs: []string{gone.Addr().String(), live.Addr().String()}}
+	var s Server
+	s.ConnectSeeds(seeds)
+	if s.encoder == nil || s.decoder == nil {
+		t.Fatal("didn't connect to the seed that answers")
+	}
+
+	live.Close()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("connected to none of the seeds")
+		}
+	}()
+	var none Server
+	none.ConnectSeeds(&Seeds{Name: "seeds.potato", addrs: []string{gone.Addr().String()}})
+}
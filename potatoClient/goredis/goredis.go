@@ -0,0 +1,541 @@
+package goredis
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"potatoClient/client"
+	"sync"
+	"time"
+)
+
+//////////
+// go-redis adapter
+//////////
+
+// TODO: the types here only mirror go-redis v8, so code that names
+// redis.UniversalClient or *redis.StringCmd in its own signatures still has to
+// change the import. Implementing the interface itself needs go-redis as a
+// dependency and the rest of its methods.
+// TODO: SMembers, HGetAll and KEYS aren't here, their values come as one
+// string without separators.
+
+// Error is an error of the server, like redis.Error.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Nil is returned for a key or a field that doesn't exist, like redis.Nil.
+const Nil = Error("redis: nil")
+
+// Status codes of the slave the adapter maps on its own: a command of a
+// missing key answers noKey, HGET of a missing field and LGET of a missing
+// position answer wrongArguments.
+const (
+	noKey          = 2
+	wrongArguments = 3
+)
+
+// Options are the options of NewClient that potato understands.
+type Options struct {
+	// Addr is host:port of a potatoSlave
+	Addr string
+}
+
+// Client is a drop-in replacement of *redis.Client for the commands below. It
+// may be used by many goroutines, commands are sent one by one over a single
+// connection, see Pipeline for sending many at once. A context is only checked
+// before a command is sent.
+type Client struct {
+	mu     sync.Mutex
+	server *client.Server
+}
+
+// NewClient connects to opt.Addr like redis.NewClient, but at once, it panics
+// if the slave can't be reached.
+func NewClient(opt *Options) *Client {
+
+	c := &Client{server: &client.Server{}}
+	c.server.Connect(opt.Addr)
+	c.server.UseProtocol(2)
+	return c
+}
+
+// do runs f for the connection, err is the error of the response as result
+// maps it.
+func (c *Client) do(ctx context.Context, f func(s *client.Server), missing ...uint) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f(c.server)
+	code, message := c.server.Status()
+	return result(c.server.IsNil(), code, message, missing)
+}
+
+// result is nil for success, Nil for a response without a value of a missing
+// key or of one of the missing codes, and the status message for anything
+// else. The slave marks any failure without a value as nil, so a key of a
+// different type isn't taken for a missing one.
+func result(isNil bool, code uint, message string, missing []uint) error {
+
+	if code == 0 {
+		return nil
+	}
+	if isNil {
+		if code == noKey {
+			return Nil
+		}
+		for _, m := range missing {
+			if code == m {
+				return Nil
+			}
+		}
+	}
+	return Error(fmt.Sprintf("potato: %d %s", code, message))
+}
+
+// ttl turns an expiration of go-redis, where 0 is none, into a TTL of potato.
+func ttl(expiration time.Duration) time.Duration {
+
+	if expiration <= 0 {
+		return client.NoExpiry
+	}
+	return expiration
+}
+
+// str formats a value the way go-redis writes it to the wire.
+func str(value interface{}) string {
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// StringCmd is a result of a command that returns a string.
+type StringCmd struct {
+	val string
+	err error
+}
+
+func (cmd *StringCmd) Val() string             { return cmd.val }
+func (cmd *StringCmd) Err() error              { return cmd.err }
+func (cmd *StringCmd) Result() (string, error) { return cmd.val, cmd.err }
+func (cmd *StringCmd) Bytes() ([]byte, error)  { return []byte(cmd.val), cmd.err }
+func (cmd *StringCmd) String() string          { return cmd.val }
+func (cmd *StringCmd) Scan(dest interface{}) error {
+
+	if cmd.err != nil {
+		return cmd.err
+	}
+	switch d := dest.(type) {
+	case *string:
+		*d = cmd.val
+	case *[]byte:
+		*d = []byte(cmd.val)
+	default:
+		_, err := fmt.Sscan(cmd.val, dest)
+		return err
+	}
+	return nil
+}
+
+// StatusCmd is a result of a command that returns a status like OK.
+type StatusCmd struct {
+	val string
+	err error
+}
+
+func (cmd *StatusCmd) Val() string             { return cmd.val }
+func (cmd *StatusCmd) Err() error              { return cmd.err }
+func (cmd *StatusCmd) Result() (string, error) { return cmd.val, cmd.err }
+
+// IntCmd is a result of a command that returns a number.
+type IntCmd struct {
+	val int64
+	err error
+}
+
+func (cmd *IntCmd) Val() int64             { return cmd.val }
+func (cmd *IntCmd) Err() error             { return cmd.err }
+func (cmd *IntCmd) Result() (int64, error) { return cmd.val, cmd.err }
+
+// BoolCmd is a result of a command that returns a boolean.
+type BoolCmd struct {
+	val bool
+	err error
+}
+
+func (cmd *BoolCmd) Val() bool             { return cmd.val }
+func (cmd *BoolCmd) Err() error            { return cmd.err }
+func (cmd *BoolCmd) Result() (bool, error) { return cmd.val, cmd.err }
+
+// DurationCmd is a result of a command that returns a duration.
+type DurationCmd struct {
+	val time.Duration
+	err error
+}
+
+func (cmd *DurationCmd) Val() time.Duration             { return cmd.val }
+func (cmd *DurationCmd) Err() error                     { return cmd.err }
+func (cmd *DurationCmd) Result() (time.Duration, error) { return cmd.val, cmd.err }
+
+// Ping
+func (c *Client) Ping(ctx context.Context) *StatusCmd {
+
+	cmd := &StatusCmd{}
+	cmd.err = c.do(ctx, func(s *client.Server) { cmd.val = s.Ping() })
+	return cmd
+}
+
+// Echo
+func (c *Client) Echo(ctx context.Context, message interface{}) *StringCmd {
+
+	cmd := &StringCmd{}
+	cmd.err = c.do(ctx, func(s *client.Server) { cmd.val = s.Echo(str(message)) })
+	return cmd
+}
+
+// Get returns Nil for a key that doesn't exist
+func (c *Client) Get(ctx context.Context, key string) *StringCmd {
+
+	cmd := &StringCmd{}
+	cmd.err = c.do(ctx, func(s *client.Server) { cmd.val = s.Get(key) })
+	return cmd
+}
+
+// Set writes any value that go-redis would, []byte as it is
+func (c *Client) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *StatusCmd {
+
+	cmd := &StatusCmd{}
+	cmd.err = c.do(ctx, func(s *client.Server) {
+		if b, ok := value.([]byte); ok {
+			s.SetBytes(key, b, ttl(expiration))
+		} else {
+			s.Set(key, str(value), ttl(expiration))
+		}
+	})
+	if cmd.err == nil {
+		cmd.val = "OK"
+	}
+	return cmd
+}
+
+// Del returns the number of deleted keys
+func (c *Client) Del(ctx context.Context, keys ...string) *IntCmd {
+
+	cmd := &IntCmd{}
+	for _, key := range keys {
+		err := c.do(ctx, func(s *client.Server) { s.Del(key) })
+		if err == nil {
+			cmd.val++
+		} else if err != Nil {
+			cmd.err = err
+			break
+		}
+	}
+	return cmd
+}
+
+// expire runs f and tells if the key existed
+func (c *Client) expire(ctx context.Context, f func(s *client.Server)) *BoolCmd {
+
+	cmd := &BoolCmd{}
+	err := c.do(ctx, f)
+	if err == nil {
+		cmd.val = true
+	} else if err != Nil {
+		cmd.err = err
+	}
+	return cmd
+}
+
+// Expire
+func (c *Client) Expire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	return c.expire(ctx, func(s *client.Server) { s.Expire(key, expiration) })
+}
+
+// ExpireAt
+func (c *Client) ExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd {
+	return c.expire(ctx, func(s *client.Server) { s.ExpireAt(key, tm) })
+}
+
+// Persist
+func (c *Client) Persist(ctx context.Context, key string) *BoolCmd {
+	return c.expire(ctx, func(s *client.Server) { s.Persist(key) })
+}
+
+// TTL returns -1 for a key without a TTL and -2 for a missing one like go-redis
+func (c *Client) TTL(ctx context.Context, key string) *DurationCmd {
+
+	cmd := &DurationCmd{}
+	err := c.do(ctx, func(s *client.Server) { cmd.val = s.TTL(key) })
+	if err != nil && cmd.val != -2 {
+		cmd.err = err
+	}
+	return cmd
+}
+
+// HGet returns Nil for a missing hash or field
+func (c *Client) HGet(ctx context.Context, key string, field string) *StringCmd {
+
+	cmd := &StringCmd{}
+	cmd.err = c.do(ctx, func(s *client.Server) { cmd.val = s.Hget(key, field) }, wrongArguments)
+	return cmd
+}
+
+// HSet takes pairs of fields and values like go-redis, one pair at a time
+func (c *Client) HSet(ctx context.Context, key string, values ...interface{}) *IntCmd {
+
+	cmd := &IntCmd{}
+	if len(values)%2 != 0 {
+		cmd.err = Error("potato: HSET wants pairs of fields and values")
+		return cmd
+	}
+	for i := 0; i < len(values); i += 2 {
+		field, value := str(values[i]), str(values[i+1])
+		if cmd.err = c.do(ctx, func(s *client.Server) { s.Hset(key, field, value, client.NoExpiry) }); cmd.err != nil {
+			break
+		}
+		cmd.val++
+	}
+	return cmd
+}
+
+// LPush pushes values one by one
+func (c *Client) LPush(ctx context.Context, key string, values ...interface{}) *IntCmd {
+
+	cmd := &IntCmd{}
+	for _, value := range values {
+		if cmd.err = c.do(ctx, func(s *client.Server) { s.Lpush(key, str(value), client.NoExpiry) }); cmd.err != nil {
+			break
+		}
+		cmd.val++
+	}
+	return cmd
+}
+
+// LIndex returns Nil for a missing list or position
+func (c *Client) LIndex(ctx context.Context, key string, index int64) *StringCmd {
+
+	cmd := &StringCmd{}
+	cmd.err = c.do(ctx, func(s *client.Server) { cmd.val = s.Lget(key, int(index)) }, wrongArguments)
+	return cmd
+}
+
+// SAdd returns the number of added members
+func (c *Client) SAdd(ctx context.Context, key string, members ...interface{}) *IntCmd {
+	return c.setCount(ctx, func(s *client.Server, m []string) string { return s.Sadd(key, client.NoExpiry, m...) }, members)
+}
+
+// SRem returns the number of removed members
+func (c *Client) SRem(ctx context.Context, key string, members ...interface{}) *IntCmd {
+	return c.setCount(ctx, func(s *client.Server, m []string) string { return s.Srem(key, m...) }, members)
+}
+
+func (c *Client) setCount(ctx context.Context, f func(s *client.Server, m []string) string, members []interface{}) *IntCmd {
+
+	m := make([]string, len(members))
+	for i, member := range members {
+		m[i] = str(member)
+	}
+
+	cmd := &IntCmd{}
+	var n string
+	if cmd.err = c.do(ctx, func(s *client.Server) { n = f(s, m) }); cmd.err == nil {
+		_, cmd.err = fmt.Sscan(n, &cmd.val)
+	}
+	return cmd
+}
+
+// SIsMember
+func (c *Client) SIsMember(ctx context.Context, key string, member interface{}) *BoolCmd {
+
+	cmd := &BoolCmd{}
+	err := c.do(ctx, func(s *client.Server) { cmd.val = s.Sismember(key, str(member)) })
+	if err != nil && err != Nil {
+		cmd.err = err
+	}
+	return cmd
+}
+
+// SCard
+func (c *Client) SCard(ctx context.Context, key string) *IntCmd {
+
+	cmd := &IntCmd{}
+	err := c.do(ctx, func(s *client.Server) { cmd.val = int64(s.Scard(key)) })
+	if err != nil && err != Nil {
+		cmd.err = err
+	}
+	return cmd
+}
+
+// Cmder is any of the results above, like redis.Cmder.
+type Cmder interface {
+	Err() error
+}
+
+// Pipeline queues commands until Exec like redis.Pipeliner, they are sent at
+// once with client.Server.Pipeline. Contexts of queued commands aren't
+// checked, the one of Exec is.
+type Pipeline struct {
+	c        *Client
+	commands []client.CommandMessage
+	// done fill the results from the responses of commands
+	done []func(client.ResponseMessage)
+	cmds []Cmder
+}
+
+// Pipeline starts queueing commands.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Pipelined queues the commands of fn and runs them like Exec.
+func (c *Client) Pipelined(ctx context.Context, fn func(*Pipeline) error) ([]Cmder, error) {
+
+	p := c.Pipeline()
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	return p.Exec(ctx)
+}
+
+// queue adds a command whose response goes to done with its error as result
+// maps it.
+func (p *Pipeline) queue(mes client.CommandMessage, done func(client.ResponseMessage, error), missing ...uint) {
+
+	p.commands = append(p.commands, mes)
+	p.done = append(p.done, func(response client.ResponseMessage) {
+		if response.RequestID == 0 {
+			done(response, Error("potato: no response in the pipeline"))
+			return
+		}
+		done(response, result(response.Nil, response.Code, response.StatusMessage, missing))
+	})
+}
+
+// Exec sends the queued commands and returns their results in order, the
+// error is the first error of them. The pipeline is empty again then.
+func (p *Pipeline) Exec(ctx context.Context) ([]Cmder, error) {
+
+	commands, done, cmds := p.commands, p.done, p.cmds
+	p.Discard()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	p.c.mu.Lock()
+	responses := p.c.server.Pipeline(commands)
+	p.c.mu.Unlock()
+
+	for i, response := range responses {
+		done[i](response)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return cmds, err
+		}
+	}
+	return cmds, nil
+}
+
+// Discard drops the queued commands.
+func (p *Pipeline) Discard() {
+	p.commands, p.done, p.cmds = nil, nil, nil
+}
+
+// Get is Client.Get in a pipeline
+func (p *Pipeline) Get(ctx context.Context, key string) *StringCmd {
+
+	cmd := &StringCmd{}
+	p.cmds = append(p.cmds, cmd)
+	p.queue(client.CommandMessage{Name: "GET", Arguments: []string{key}}, func(response client.ResponseMessage, err error) {
+		cmd.val, cmd.err = response.Value, err
+	})
+	return cmd
+}
+
+// Set is Client.Set in a pipeline
+func (p *Pipeline) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *StatusCmd {
+
+	mes := client.CommandMessage{Name: "SET", Arguments: []string{key, str(value)}, TTL: ttl(expiration)}
+	if b, ok := value.([]byte); ok {
+		mes.Arguments = []string{base64.StdEncoding.EncodeToString([]byte(key)), base64.StdEncoding.EncodeToString(b)}
+		mes.Binary = true
+	}
+
+	cmd := &StatusCmd{}
+	p.cmds = append(p.cmds, cmd)
+	p.queue(mes, func(response client.ResponseMessage, err error) {
+		if cmd.err = err; err == nil {
+			cmd.val = "OK"
+		}
+	})
+	return cmd
+}
+
+// Del is Client.Del in a pipeline, with a command for every key
+func (p *Pipeline) Del(ctx context.Context, keys ...string) *IntCmd {
+
+	cmd := &IntCmd{}
+	p.cmds = append(p.cmds, cmd)
+	for _, key := range keys {
+		p.queue(client.CommandMessage{Name: "DEL", Arguments: []string{key}}, func(response client.ResponseMessage, err error) {
+			if err == nil {
+				cmd.val++
+			} else if err != Nil && cmd.err == nil {
+				cmd.err = err
+			}
+		})
+	}
+	return cmd
+}
+
+// HGet is Client.HGet in a pipeline
+func (p *Pipeline) HGet(ctx context.Context, key string, field string) *StringCmd {
+
+	cmd := &StringCmd{}
+	p.cmds = append(p.cmds, cmd)
+	p.queue(client.CommandMessage{Name: "HGET", Arguments: []string{key, field}}, func(response client.ResponseMessage, err error) {
+		cmd.val, cmd.err = response.Value, err
+	}, wrongArguments)
+	return cmd
+}
+
+// HSet is Client.HSet in a pipeline, with a command for every pair
+func (p *Pipeline) HSet(ctx context.Context, key string, values ...interface{}) *IntCmd {
+
+	cmd := &IntCmd{}
+	p.cmds = append(p.cmds, cmd)
+	if len(values)%2 != 0 {
+		cmd.err = Error("potato: HSET wants pairs of fields and values")
+		return cmd
+	}
+	for i := 0; i < len(values); i += 2 {
+		mes := client.CommandMessage{Name: "HSET", Arguments: []string{key, str(values[i]), str(values[i+1])}, TTL: client.NoExpiry}
+		p.queue(mes, func(response client.ResponseMessage, err error) {
+			if err == nil {
+				cmd.val++
+			} else if cmd.err == nil {
+				cmd.err = err
+			}
+		})
+	}
+	return cmd
+}
@@ -0,0 +1,302 @@
+package goredis
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"potatoClient/client"
+)
+
+// Status codes of the slave the fake one answers
+const (
+	statusOK = iota
+	statusWrongType
+	statusNoKey
+	statusWrongArguments
+	statusUnknownCommand = 7
+)
+
+// fakeSlave speaks the JSON protocol of potatoSlave over loopback for the
+// commands of the adapter: strings, hashes and TTLs of one user. Failures
+// without a value are nil for protocol 2 as the slave marks them.
+type fakeSlave struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	ttls    map[string]time.Duration
+}
+
+func startFakeSlave(t *testing.T) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeSlave{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		ttls:    make(map[string]time.Duration),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (f *fakeSlave) serve(conn net.Conn) {
+
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var mes client.CommandMessage
+		if decoder.Decode(&mes) != nil {
+			return
+		}
+		response := f.invoke(mes)
+		if mes.Protocol >= 2 && response.Code != statusOK && response.Value == "" {
+			response.Nil = true
+		}
+		response.RequestID = mes.RequestID
+		encoder.Encode(response)
+	}
+}
+
+func (f *fakeSlave) invoke(mes client.CommandMessage) client.ResponseMessage {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var response client.ResponseMessage
+	args := mes.Arguments
+	if mes.Binary {
+		for i, arg := range args {
+			b, _ := base64.StdEncoding.DecodeString(arg)
+			args[i] = string(b)
+		}
+	}
+	exists := func(key string) bool {
+		_, s := f.strings[key]
+		_, h := f.hashes[key]
+		return s || h
+	}
+
+	switch mes.Name {
+	case "PING":
+		response.Value = "PONG"
+	case "ECHO":
+		response.Value = args[0]
+	case "GET":
+		if v, ok := f.strings[args[0]]; ok {
+			response.Value = v
+		} else if _, ok := f.hashes[args[0]]; ok {
+			response.Code = statusWrongType
+		} else {
+			response.Code = statusNoKey
+		}
+	case "SET":
+		delete(f.hashes, args[0])
+		f.strings[args[0]] = args[1]
+		f.ttls[args[0]] = mes.TTL
+	case "DEL":
+		delete(f.strings, args[0])
+		delete(f.hashes, args[0])
+	case "HGET":
+		if h, ok := f.hashes[args[0]]; !ok {
+			response.Code = statusNoKey
+		} else if v, ok := h[args[1]]; !ok {
+			response.Code = statusWrongArguments
+		} else {
+			response.Value = v
+		}
+	case "HSET":
+		if _, ok := f.strings[args[0]]; ok {
+			response.Code = statusWrongType
+		} else {
+			if f.hashes[args[0]] == nil {
+				f.hashes[args[0]] = make(map[string]string)
+				f.ttls[args[0]] = mes.TTL
+			}
+			f.hashes[args[0]][args[1]] = args[2]
+		}
+	case "PEXPIRE", "PERSIST":
+		if !exists(args[0]) {
+			response.Code = statusNoKey
+		} else if mes.Name == "PERSIST" {
+			f.ttls[args[0]] = client.NoExpiry
+		} else {
+			ms, _ := strconv.ParseInt(args[1], 10, 64)
+			f.ttls[args[0]] = time.Duration(ms) * time.Millisecond
+		}
+	case "PTTL":
+		if !exists(args[0]) {
+			response.Code = statusNoKey
+		} else if ttl := f.ttls[args[0]]; ttl < 0 {
+			response.Value = "-1"
+		} else {
+			response.Value = strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+		}
+	default:
+		response.Code = statusUnknownCommand
+	}
+	if response.Code == statusOK {
+		response.StatusMessage = "OK"
+	} else {
+		response.StatusMessage = "failed"
+	}
+	return response
+}
+
+func TestClient(t *testing.T) {
+
+	ctx := context.Background()
+	c := NewClient(&Options{Addr: startFakeSlave(t)})
+
+	if v, err := c.Ping(ctx).Result(); err != nil || v != "PONG" {
+		t.Fatalf("PING is %q, %v", v, err)
+	}
+	if v, err := c.Echo(ctx, 42).Result(); err != nil || v != "42" {
+		t.Fatalf("ECHO is %q, %v", v, err)
+	}
+
+	// Results
+	if v, err := c.Set(ctx, "a", 7, 0).Result(); err != nil || v != "OK" {
+		t.Fatalf("SET is %q, %v", v, err)
+	}
+	var n int
+	if err := c.Get(ctx, "a").Scan(&n); err != nil || n != 7 {
+		t.Fatalf("GET scanned %d, %v", n, err)
+	}
+	if err := c.Set(ctx, "bin", []byte{0, 1, 2}, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "bin").Bytes(); err != nil || string(v) != "\x00\x01\x02" {
+		t.Fatalf("GET of bytes is %q, %v", v, err)
+	}
+	if v, err := c.HSet(ctx, "h", "f", 1, "g", 2).Result(); err != nil || v != 2 {
+		t.Fatalf("HSET is %d, %v", v, err)
+	}
+	if v, err := c.HGet(ctx, "h", "g").Result(); err != nil || v != "2" {
+		t.Fatalf("HGET is %q, %v", v, err)
+	}
+
+	// TTLs
+	if v, err := c.TTL(ctx, "a").Result(); err != nil || v != -1 {
+		t.Fatalf("TTL without expiration is %v, %v", v, err)
+	}
+	if v, err := c.Expire(ctx, "a", time.Minute).Result(); err != nil || !v {
+		t.Fatalf("EXPIRE is %v, %v", v, err)
+	}
+	if v, err := c.TTL(ctx, "a").Result(); err != nil || v != time.Minute {
+		t.Fatalf("TTL is %v, %v", v, err)
+	}
+	if v, err := c.Persist(ctx, "a").Result(); err != nil || !v {
+		t.Fatalf("PERSIST is %v, %v", v, err)
+	}
+	if v, err := c.Expire(ctx, "missing", time.Minute).Result(); err != nil || v {
+		t.Fatalf("EXPIRE of a missing key is %v, %v", v, err)
+	}
+	if v, err := c.TTL(ctx, "missing").Result(); err != nil || v != -2 {
+		t.Fatalf("TTL of a missing key is %v, %v", v, err)
+	}
+
+	// Errors
+	if err := c.Get(ctx, "missing").Err(); err != Nil {
+		t.Fatalf("GET of a missing key failed with %v", err)
+	}
+	if err := c.HGet(ctx, "h", "missing").Err(); err != Nil {
+		t.Fatalf("HGET of a missing field failed with %v", err)
+	}
+	if err := c.HGet(ctx, "missing", "f").Err(); err != Nil {
+		t.Fatalf("HGET of a missing hash failed with %v", err)
+	}
+	err := c.Get(ctx, "h").Err()
+	if _, ok := err.(Error); !ok || err == Nil {
+		t.Fatalf("GET of a hash failed with %v", err)
+	}
+	if err := c.HSet(ctx, "a", "f").Err(); err == nil {
+		t.Fatal("HSET without a value succeeded")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Get(cancelled, "a").Err(); err != context.Canceled {
+		t.Fatalf("GET with a cancelled context failed with %v", err)
+	}
+
+	if v, err := c.Del(ctx, "a", "h").Result(); err != nil || v != 2 {
+		t.Fatalf("DEL is %d, %v", v, err)
+	}
+	if err := c.Get(ctx, "a").Err(); err != Nil {
+		t.Fatalf("GET of a deleted key failed with %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+
+	ctx := context.Background()
+	c := NewClient(&Options{Addr: startFakeSlave(t)})
+
+	var set *StatusCmd
+	var get, bin, missing *StringCmd
+	var hset *IntCmd
+	cmds, err := c.Pipelined(ctx, func(p *Pipeline) error {
+		set = p.Set(ctx, "a", "1", time.Minute)
+		p.Set(ctx, "bin", []byte{0, 1}, 0)
+		get = p.Get(ctx, "a")
+		bin = p.Get(ctx, "bin")
+		hset = p.HSet(ctx, "h", "f", 1, "g", 2)
+		missing = p.HGet(ctx, "h", "missing")
+		return nil
+	})
+	if len(cmds) != 6 || err != Nil {
+		t.Fatalf("the pipeline ran %d commands and failed with %v", len(cmds), err)
+	}
+	if v, err := set.Result(); v != "OK" || err != nil {
+		t.Fatalf("SET is %q, %v", v, err)
+	}
+	if v, err := get.Result(); v != "1" || err != nil {
+		t.Fatalf("GET is %q, %v", v, err)
+	}
+	if v, err := bin.Result(); v != "\x00\x01" || err != nil {
+		t.Fatalf("GET of bytes is %q, %v", v, err)
+	}
+	if v, err := hset.Result(); v != 2 || err != nil {
+		t.Fatalf("HSET is %d, %v", v, err)
+	}
+	if err := missing.Err(); err != Nil {
+		t.Fatalf("HGET of a missing field failed with %v", err)
+	}
+
+	// Errors of the slave come in order, a pipeline is empty after Exec
+	p := c.Pipeline()
+	wrong := p.Get(ctx, "h")
+	del := p.Del(ctx, "a", "h")
+	if _, err := p.Exec(ctx); err != wrong.Err() || err == nil || err == Nil {
+		t.Fatalf("the pipeline failed with %v", err)
+	}
+	if v, err := del.Result(); v != 2 || err != nil {
+		t.Fatalf("DEL is %d, %v", v, err)
+	}
+	if cmds, err := p.Exec(ctx); cmds != nil || err != nil {
+		t.Fatalf("an empty pipeline ran %d commands and failed with %v", len(cmds), err)
+	}
+
+	// The connection is still in step after the pipelines
+	if err := c.Get(ctx, "a").Err(); err != Nil {
+		t.Fatalf("GET of a deleted key failed with %v", err)
+	}
+}
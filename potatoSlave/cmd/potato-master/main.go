@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"os"
+	"potatoSlave/master"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// potato-master serves clients on PORT and routes their commands to slaves
+// that register with it or are listed in SLAVES, separated by commas.
+func main() {
+
+	m := master.NewMaster()
+
+	if uc, err := strconv.Atoi(os.Getenv("UPSTREAMCONNS")); err == nil {
+		m.UPSTREAMCONNS = uc
+	}
+	// UPSTREAMIDLE must be less than STALETIME of slaves, in milliseconds
+	if ui, err := strconv.Atoi(os.Getenv("UPSTREAMIDLE")); err == nil {
+		m.UPSTREAMIDLE = time.Millisecond * time.Duration(ui)
+	}
+
+	// Every slave has VNODES points on the hash ring
+	if vn, err := strconv.Atoi(os.Getenv("VNODES")); err == nil {
+		m.VNODES = vn
+	}
+
+	// Slaves are pinged every PROBEINTERVAL milliseconds, a primary that
+	// doesn't answer in PROBETIMEOUT milliseconds PROBEFAILURES times is failed
+	// over to its replica
+	if pi, err := strconv.Atoi(os.Getenv("PROBEINTERVAL")); err == nil {
+		m.PROBEINTERVAL = time.Millisecond * time.Duration(pi)
+	}
+	if pt, err := strconv.Atoi(os.Getenv("PROBETIMEOUT")); err == nil {
+		m.PROBETIMEOUT = time.Millisecond * time.Duration(pt)
+	}
+	if pf, err := strconv.Atoi(os.Getenv("PROBEFAILURES")); err == nil {
+		m.PROBEFAILURES = pf
+	}
+
+	if slaves := os.Getenv("SLAVES"); slaves != "" {
+		for _, addr := range strings.Split(slaves, ",") {
+			m.Register(addr)
+		}
+	}
+	go m.Probe(nil)
+
+	listener, err := net.Listen("tcp", ":"+os.Getenv("PORT"))
+	if err != nil {
+		panic(err)
+	}
+	panic(m.Serve(listener))
+}
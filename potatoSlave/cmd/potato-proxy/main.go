@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"potatoSlave/slave"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// potato-proxy serves clients of the slave at UPSTREAM on PORT and, if it's
+// set, over HTTP on HTTPPORT. "potato-proxy share key|prefix target ttl"
+// prints a shared URL signed with URLKEY instead, e. g. for a day with ttl
+// "24h".
+func main() {
+
+	p := slave.NewProxy(os.Getenv("UPSTREAM"))
+	p.URLKEY = []byte(os.Getenv("URLKEY"))
+
+	if len(os.Args) == 5 && os.Args[1] == "share" {
+		ttl, err := time.ParseDuration(os.Args[4])
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(p.SharedURL(os.Args[2], os.Args[3], ttl))
+		return
+	}
+
+	if uc, err := strconv.Atoi(os.Getenv("UPSTREAMCONNS")); err == nil {
+		p.UPSTREAMCONNS = uc
+	}
+	// UPSTREAMIDLE must be less than STALETIME of the slave, in milliseconds
+	if ui, err := strconv.Atoi(os.Getenv("UPSTREAMIDLE")); err == nil {
+		p.UPSTREAMIDLE = time.Millisecond * time.Duration(ui)
+	}
+
+	// Clients can send RATELIMIT commands per second in bursts of RATEBURST
+	if rl, err := strconv.ParseFloat(os.Getenv("RATELIMIT"), 64); err == nil {
+		p.RATELIMIT = rl
+	}
+	if rb, err := strconv.Atoi(os.Getenv("RATEBURST")); err == nil {
+		p.RATEBURST = rb
+	}
+
+	// Pages from ORIGINS (separated by commas) can open a WebSocket at /ws of
+	// HTTPPORT and send messages of up to WSMAXMESSAGE bytes
+	if origins := os.Getenv("ORIGINS"); origins != "" {
+		p.ORIGINS = strings.Split(origins, ",")
+	}
+	if wm, err := strconv.Atoi(os.Getenv("WSMAXMESSAGE")); err == nil {
+		p.WSMAXMESSAGE = wm
+	}
+
+	if port := os.Getenv("HTTPPORT"); port != "" {
+		go func() {
+			panic(http.ListenAndServe(":"+port, p.HTTPHandler()))
+		}()
+	}
+
+	listener, err := net.Listen("tcp", ":"+os.Getenv("PORT"))
+	if err != nil {
+		panic(err)
+	}
+	panic(p.Serve(listener))
+}
@@ -1,14 +1,34 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
 	"os"
 	"potatoSlave/slave"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func main() {
 
+	// go run main.go simulate workload.jsonl replays a recorded workload with
+	// NUMWORKERS workers and prints what was measured
+	if len(os.Args) == 3 && os.Args[1] == "simulate" {
+		simulate(os.Args[2])
+		return
+	}
+	// go run main.go hashpassword secret prints a hash of the password for
+	// USERSPATH
+	if len(os.Args) == 3 && os.Args[1] == "hashpassword" {
+		fmt.Println(slave.HashPassword(os.Args[2]))
+		return
+	}
+	// potato-slave --doctor checks the environment with the configuration
+	// below, prints what it found and exits instead of serving
+	doctor := len(os.Args) == 2 && os.Args[1] == "--doctor"
+
 	port := os.Getenv("PORT")
 	ip := os.Getenv("IP")
 	st, _ := strconv.Atoi(os.Getenv("STALETIME"))
@@ -16,6 +36,353 @@ func main() {
 	ttl, _ := strconv.Atoi(os.Getenv("DEFAULTTTL"))
 	defaultttl := time.Second * time.Duration(ttl)
 
-	s := slave.NewSlave(ip, port, staletime, defaultttl, time.Millisecond, 1000)
+	cleanuptime := time.Second
+	if ct, err := strconv.Atoi(os.Getenv("CLEANUPTIME")); err == nil {
+		cleanuptime = time.Millisecond * time.Duration(ct)
+	}
+
+	s := slave.NewSlave(ip, port, staletime, defaultttl, cleanuptime, -1)
+	// NUMWORKERS commands are served at once and MAXCONNECTIONS connections
+	// are open, others wait WORKERWAIT milliseconds for a worker, commands get
+	// _NW then and connections cheap commands only
+	if nw, err := strconv.Atoi(os.Getenv("NUMWORKERS")); err == nil && nw > 0 {
+		s.SetWorkers(nw)
+	}
+	if mc, err := strconv.Atoi(os.Getenv("MAXCONNECTIONS")); err == nil && mc > 0 {
+		s.SetMaxConnections(mc)
+	}
+	if ww, err := strconv.Atoi(os.Getenv("WORKERWAIT")); err == nil {
+		s.WORKERWAIT = time.Millisecond * time.Duration(ww)
+	}
+	// The slave listens on BINDADDRS (separated by commas, e. g.
+	// "10.0.0.1,[::1]:6000" or "[::]" for IPv4 and IPv6), PORT is added to
+	// those without a port. Without it PORT is served on all IPv4 interfaces
+	if addrs := os.Getenv("BINDADDRS"); addrs != "" {
+		s.BINDADDRS = strings.Split(addrs, ",")
+	}
+	// Clients are also served with TLS on TLSPORT, TLSCERT and TLSKEY are PEM
+	// files; with TLSCLIENTCA clients need a certificate signed by its CAs
+	s.TLSPORT = os.Getenv("TLSPORT")
+	s.TLSCERT = os.Getenv("TLSCERT")
+	s.TLSKEY = os.Getenv("TLSKEY")
+	s.TLSCLIENTCA = os.Getenv("TLSCLIENTCA")
+	// With USERSPATH clients log in with AUTH as one of its users
+	s.USERSPATH = os.Getenv("USERSPATH")
+	// API tokens made with TOKEN CREATE are kept in TOKENSPATH
+	s.TOKENSPATH = os.Getenv("TOKENSPATH")
+	// Grants of keys between users made with GRANT are kept in GRANTSPATH
+	s.GRANTSPATH = os.Getenv("GRANTSPATH")
+	// A host failing AUTH AUTHMAXFAILURES times can't log in for AUTHBANTIME
+	// seconds
+	if mf, err := strconv.Atoi(os.Getenv("AUTHMAXFAILURES")); err == nil {
+		s.AUTHMAXFAILURES = mf
+	}
+	if bt, err := strconv.Atoi(os.Getenv("AUTHBANTIME")); err == nil {
+		s.AUTHBANTIME = time.Second * time.Duration(bt)
+	}
+	// Writes and admin commands are audited, AUDIT returns the last AUDITSIZE
+	// of them and AUDITPATH gets all of them
+	if as, err := strconv.Atoi(os.Getenv("AUDITSIZE")); err == nil {
+		s.AUDITSIZE = as
+	}
+	s.AUDITPATH = os.Getenv("AUDITPATH")
+	if sb, err := strconv.Atoi(os.Getenv("STREAMBATCH")); err == nil {
+		s.STREAMBATCH = sb
+	}
+	// A frame of a stream is sent once it has STREAMCHUNK bytes
+	if sc, err := strconv.Atoi(os.Getenv("STREAMCHUNK")); err == nil {
+		s.STREAMCHUNK = sc
+	}
+	if rc, err := strconv.Atoi(os.Getenv("RETENTIONCHECKTIME")); err == nil {
+		s.RETENTIONCHECKTIME = time.Second * time.Duration(rc)
+	}
+
+	s.REPORTKEY = []byte(os.Getenv("REPORTKEY"))
+	s.COUNTERWRAP = os.Getenv("COUNTEROVERFLOW") == "wrap"
+	s.RECOVERPANICS = os.Getenv("RECOVERPANICS") != "false"
+	if wt, err := strconv.Atoi(os.Getenv("WATCHDOGTHRESHOLD")); err == nil {
+		s.WATCHDOGTHRESHOLD = time.Millisecond * time.Duration(wt)
+	}
+	if es, err := strconv.Atoi(os.Getenv("EXPIRESAMPLE")); err == nil {
+		s.EXPIRESAMPLE = es
+	}
+	// Over MAXKEYS keys are evicted, the least recently used of
+	// EVICTIONSAMPLES random ones every time
+	if mk, err := strconv.Atoi(os.Getenv("MAXKEYS")); err == nil {
+		s.MAXKEYS = mk
+	}
+	if es, err := strconv.Atoi(os.Getenv("EVICTIONSAMPLES")); err == nil {
+		s.EVICTION = slave.NewSampledLRU(es)
+	}
+	// Responses of CACHECOMMANDS (separated by commas) are cached, up to
+	// CACHESIZE of them
+	if commands := os.Getenv("CACHECOMMANDS"); commands != "" {
+		for _, name := range strings.Split(commands, ",") {
+			s.CACHECOMMANDS[name] = true
+		}
+	}
+	if cs, err := strconv.Atoi(os.Getenv("CACHESIZE")); err == nil {
+		s.CACHESIZE = cs
+	}
+	if mk, err := strconv.Atoi(os.Getenv("SWEEPMAXKEYS")); err == nil {
+		s.SWEEPMAXKEYS = mk
+	}
+	if mh, err := strconv.Atoi(os.Getenv("SWEEPMAXHOLD")); err == nil {
+		s.SWEEPMAXHOLD = time.Millisecond * time.Duration(mh)
+	}
+
+	// Storage is saved to SNAPSHOTPATH every SNAPSHOTINTERVAL seconds, with
+	// DELTASNAPSHOTS delta snapshots between full ones
+	s.SNAPSHOTPATH = os.Getenv("SNAPSHOTPATH")
+	if si, err := strconv.Atoi(os.Getenv("SNAPSHOTINTERVAL")); err == nil {
+		s.SNAPSHOTINTERVAL = time.Second * time.Duration(si)
+	}
+	if ds, err := strconv.Atoi(os.Getenv("DELTASNAPSHOTS")); err == nil {
+		s.DELTASNAPSHOTS = ds
+	}
+
+	// Commands are appended to AOFPATH and synced as AOFFSYNC says
+	s.AOFPATH = os.Getenv("AOFPATH")
+	if fsync := os.Getenv("AOFFSYNC"); fsync != "" {
+		s.AOFFSYNC = fsync
+	}
+	if rs, err := strconv.ParseInt(os.Getenv("AOFREWRITESIZE"), 10, 64); err == nil {
+		s.AOFREWRITESIZE = rs
+	}
+
+	// The log is shipped to the ARCHIVEPATH directory every ARCHIVEINTERVAL
+	// seconds with a base snapshot every BASEINTERVAL seconds; with
+	// RESTOREFROM the storage is restored from that one as it was at
+	// RESTOREUNTIL (RFC 3339) instead
+	if path := os.Getenv("ARCHIVEPATH"); path != "" {
+		s.ARCHIVE = slave.DirArchive(path)
+	}
+	if ai, err := strconv.Atoi(os.Getenv("ARCHIVEINTERVAL")); err == nil {
+		s.ARCHIVEINTERVAL = time.Second * time.Duration(ai)
+	}
+	if bi, err := strconv.Atoi(os.Getenv("BASEINTERVAL")); err == nil {
+		s.BASEINTERVAL = time.Second * time.Duration(bi)
+	}
+	if from := os.Getenv("RESTOREFROM"); from != "" {
+		if from == os.Getenv("ARCHIVEPATH") {
+			panic("RESTOREFROM can't be ARCHIVEPATH, a restored slave ships a new history")
+		}
+		until, err := time.Parse(time.RFC3339Nano, os.Getenv("RESTOREUNTIL"))
+		if err != nil {
+			panic("malformed RESTOREUNTIL: " + err.Error())
+		}
+		s.RESTOREFROM, s.RESTOREUNTIL = slave.DirArchive(from), until
+	}
+
+	// Storage is kept in the DISKPATH file and flushed every DISKFLUSHINTERVAL
+	// milliseconds instead of living in memory
+	s.DISKPATH = os.Getenv("DISKPATH")
+	if fi, err := strconv.Atoi(os.Getenv("DISKFLUSHINTERVAL")); err == nil {
+		s.DISKFLUSHINTERVAL = time.Millisecond * time.Duration(fi)
+	}
+
+	// Memory alerts are logged over MEMORYALERTBYTES of peak heap and over
+	// FRAGMENTATIONALERT bytes of heap per stored byte
+	if mb, err := strconv.ParseUint(os.Getenv("MEMORYALERTBYTES"), 10, 64); err == nil {
+		s.MEMORYALERTBYTES = mb
+	}
+	if fa, err := strconv.ParseFloat(os.Getenv("FRAGMENTATIONALERT"), 64); err == nil {
+		s.FRAGMENTATIONALERT = fa
+	}
+
+	// NODEIDPATH keeps the id of the node between restarts, HEALTHPORT serves
+	// liveness and readiness probes
+	if path := os.Getenv("NODEIDPATH"); path != "" {
+		id, err := slave.LoadNodeID(path)
+		if err != nil {
+			panic(err)
+		}
+		s.NODEID = id
+	}
+	if port := os.Getenv("HEALTHPORT"); port != "" {
+		go func() {
+			panic(s.ServeHealth(":" + port))
+		}()
+	}
+
+	// Redis clients are served with RESP2 on RESPPORT
+	if port := os.Getenv("RESPPORT"); port != "" {
+		go func() {
+			listener, err := net.Listen("tcp", ":"+port)
+			if err != nil {
+				panic(err)
+			}
+			panic(s.ServeRESP(listener))
+		}()
+	}
+
+	// Destructive commands have to be confirmed APPROVALDELAY seconds later
+	if ad, err := strconv.Atoi(os.Getenv("APPROVALDELAY")); err == nil {
+		s.APPROVALDELAY = time.Second * time.Duration(ad)
+	}
+	if shard := os.Getenv("SHARD"); shard != "" {
+		s.SHARD = shard
+	}
+
+	// A standby mirrors STANDBYOF every MIRRORINTERVAL milliseconds until
+	// PROMOTE
+	s.STANDBYOF = os.Getenv("STANDBYOF")
+	if mi, err := strconv.Atoi(os.Getenv("MIRRORINTERVAL")); err == nil {
+		s.MIRRORINTERVAL = time.Millisecond * time.Duration(mi)
+	}
+	// MIGRATE waits for the target for MIGRATETIMEOUT milliseconds
+	if mt, err := strconv.Atoi(os.Getenv("MIGRATETIMEOUT")); err == nil {
+		s.MIGRATETIMEOUT = time.Millisecond * time.Duration(mt)
+	}
+
+	// A replica follows the primary at REPLICAOF, which drops it when it's
+	// REPLICABUFFER writes behind
+	s.REPLICAOF = os.Getenv("REPLICAOF")
+	if rb, err := strconv.Atoi(os.Getenv("REPLICABUFFER")); err == nil {
+		s.REPLICABUFFER = rb
+	}
+	// Both send or expect a heartbeat every REPLICAHEARTBEAT milliseconds,
+	// with REPORTLAG a replica tells in reads how far behind it is
+	if rh, err := strconv.Atoi(os.Getenv("REPLICAHEARTBEAT")); err == nil {
+		s.REPLICAHEARTBEAT = time.Millisecond * time.Duration(rh)
+	}
+	s.REPORTLAG = os.Getenv("REPORTLAG") == "true"
+
+	// The slave registers at MASTER as IP:PORT every REGISTERINTERVAL
+	// milliseconds
+	s.MASTER = os.Getenv("MASTER")
+	if ri, err := strconv.Atoi(os.Getenv("REGISTERINTERVAL")); err == nil {
+		s.REGISTERINTERVAL = time.Millisecond * time.Duration(ri)
+	}
+
+	// Slaves find each other by gossip starting from SEEDS (separated by
+	// commas) or from what SEEDSNAME resolves to in DNS, every GOSSIPINTERVAL
+	// milliseconds; a slave that isn't heard of for PEERTIMEOUT milliseconds
+	// is down
+	if seeds := os.Getenv("SEEDS"); seeds != "" {
+		s.SEEDS = strings.Split(seeds, ",")
+	}
+	s.SEEDSNAME = os.Getenv("SEEDSNAME")
+	if gi, err := strconv.Atoi(os.Getenv("GOSSIPINTERVAL")); err == nil {
+		s.GOSSIPINTERVAL = time.Millisecond * time.Duration(gi)
+	}
+	if pt, err := strconv.Atoi(os.Getenv("PEERTIMEOUT")); err == nil {
+		s.PEERTIMEOUT = time.Millisecond * time.Duration(pt)
+	}
+
+	// Keys under RAFTPREFIXES (separated by commas) are kept by a Raft group
+	// with RAFTPEERS (separated by commas), its state is kept in RAFTPATH;
+	// RAFTHEARTBEAT, RAFTELECTION and RAFTTIMEOUT are in milliseconds
+	s.RAFTPATH = os.Getenv("RAFTPATH")
+	if peers := os.Getenv("RAFTPEERS"); peers != "" {
+		s.RAFTPEERS = strings.Split(peers, ",")
+	}
+	if prefixes := os.Getenv("RAFTPREFIXES"); prefixes != "" {
+		s.RAFTPREFIXES = strings.Split(prefixes, ",")
+	}
+	if rh, err := strconv.Atoi(os.Getenv("RAFTHEARTBEAT")); err == nil {
+		s.RAFTHEARTBEAT = time.Millisecond * time.Duration(rh)
+	}
+	if re, err := strconv.Atoi(os.Getenv("RAFTELECTION")); err == nil {
+		s.RAFTELECTION = time.Millisecond * time.Duration(re)
+	}
+	if rt, err := strconv.Atoi(os.Getenv("RAFTTIMEOUT")); err == nil {
+		s.RAFTTIMEOUT = time.Millisecond * time.Duration(rt)
+	}
+
+	// REPLICAONLY lists commands (separated by commas) that a primary rejects
+	if role := os.Getenv("ROLE"); role != "" {
+		s.ROLE = role
+	}
+	if commands := os.Getenv("REPLICAONLY"); commands != "" {
+		for _, name := range strings.Split(commands, ",") {
+			s.REPLICAONLY[name] = true
+		}
+	}
+
+	// Values of keys under ENCRYPTEDPREFIXES (separated by commas) are
+	// encrypted with keys derived from ENCRYPTIONKEY
+	if key := os.Getenv("ENCRYPTIONKEY"); key != "" {
+		s.EnableEncryption([]byte(key), strings.Split(os.Getenv("ENCRYPTEDPREFIXES"), ","))
+	}
+
+	// Retention rules are given as "prefix=duration" pairs separated by commas,
+	// e. g. "logs:=168h,tmp:=1h"
+	if rules := os.Getenv("RETENTION"); rules != "" {
+		for _, rule := range strings.Split(rules, ",") {
+			i := strings.LastIndex(rule, "=")
+			if i == -1 {
+				panic("malformed retention rule: " + rule)
+			}
+			maxTTL, err := time.ParseDuration(rule[i+1:])
+			if err != nil {
+				panic(err)
+			}
+			s.AddRetentionRule(rule[:i], maxTTL)
+		}
+	}
+
+	// Writes live at most MAXTTL, e. g. "720h", USERMAXTTL overrides it for
+	// users given as "user=duration" pairs separated by commas. TTLPOLICY is
+	// "clamp" or "reject".
+	if mt := os.Getenv("MAXTTL"); mt != "" {
+		maxTTL, err := time.ParseDuration(mt)
+		if err != nil {
+			panic(err)
+		}
+		s.MAXTTL = maxTTL
+	}
+	if limits := os.Getenv("USERMAXTTL"); limits != "" {
+		for _, limit := range strings.Split(limits, ",") {
+			i := strings.LastIndex(limit, "=")
+			if i == -1 {
+				panic("malformed user TTL limit: " + limit)
+			}
+			maxTTL, err := time.ParseDuration(limit[i+1:])
+			if err != nil {
+				panic(err)
+			}
+			s.USERMAXTTL[limit[:i]] = maxTTL
+		}
+	}
+	if policy := os.Getenv("TTLPOLICY"); policy != "" {
+		if policy != "clamp" && policy != "reject" {
+			panic("unknown TTL policy: " + policy)
+		}
+		s.TTLPOLICY = policy
+	}
+
+	if doctor {
+		failed := false
+		for _, f := range s.Doctor() {
+			fmt.Printf("%-8s %-24s %s\n", f.Level, f.Check, f.Message)
+			failed = failed || f.Level == "error"
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
 	s.StartServing()
 }
+
+func simulate(path string) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	workload, err := slave.ReadWorkload(f)
+	if err != nil {
+		panic(err)
+	}
+
+	var config slave.SimConfig
+	config.Workers, _ = strconv.Atoi(os.Getenv("NUMWORKERS"))
+
+	body, _ := json.MarshalIndent(slave.Simulate(workload, config), "", "  ")
+	fmt.Println(string(body))
+}
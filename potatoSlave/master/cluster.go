@@ -0,0 +1,125 @@
+package master
+
+import (
+	"encoding/json"
+	"math"
+	"potatoSlave/slave"
+	"strings"
+)
+
+//////////
+// Cluster topology
+//////////
+
+// Slot is a range of key hashes, both ends included, served by a slave. The
+// hash of a key is the first four bytes of its MD5 as a big-endian number.
+type Slot struct {
+	Start uint32
+	End   uint32
+	Slave string
+	// Down is set while the slave is failing over
+	Down bool `json:",omitempty"`
+}
+
+// ClusterInfo is what CLUSTER INFO returns.
+type ClusterInfo struct {
+	Shards   int
+	Slaves   []string
+	Replicas map[string][]string
+	Down     []string
+	VNODES   int
+	Hash     string
+}
+
+// Slots returns the ranges of hashes that every slave serves in the order of
+// hashes, adjacent ranges of one slave are merged.
+func (m *Master) Slots() []Slot {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.ring) == 0 {
+		return nil
+	}
+
+	var slots []Slot
+	add := func(start uint32, end uint32, shard string) {
+		addr := m.primary[shard]
+		if last := len(slots) - 1; last >= 0 && slots[last].Slave == addr && slots[last].End+1 == start {
+			slots[last].End = end
+			return
+		}
+		slots = append(slots, Slot{Start: start, End: end, Slave: addr, Down: m.down(addr)})
+	}
+
+	// A key belongs to the first point at or after its hash
+	var start uint32
+	for _, p := range m.ring {
+		if p.hash < start {
+			// A point with the same hash as the previous one gets nothing
+			continue
+		}
+		add(start, p.hash, p.addr)
+		if p.hash == math.MaxUint32 {
+			return slots
+		}
+		start = p.hash + 1
+	}
+	add(start, math.MaxUint32, m.ring[0].addr)
+
+	return slots
+}
+
+// Info returns what the master knows about the cluster.
+func (m *Master) Info() ClusterInfo {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	slaves := make([]string, len(m.order))
+	for i, shard := range m.order {
+		slaves[i] = m.primary[shard]
+	}
+	info := ClusterInfo{
+		Shards:   len(m.order),
+		Slaves:   slaves,
+		Replicas: make(map[string][]string),
+		VNODES:   m.VNODES,
+		Hash:     "md5-32",
+	}
+	for _, addr := range slaves {
+		if len(m.replicas[addr]) != 0 {
+			info.Replicas[addr] = append([]string(nil), m.replicas[addr]...)
+		}
+	}
+	for addr := range m.slaves {
+		if m.down(addr) {
+			info.Down = append(info.Down, addr)
+		}
+	}
+
+	return info
+}
+
+// cluster is CLUSTER INFO or CLUSTER SLOTS, both return JSON.
+func (m *Master) cluster(mes slave.CommandMessage) slave.ResponseMessage {
+
+	if len(mes.Arguments) != 1 {
+		return slave.NewStatus(slave.StatusWrongArguments)
+	}
+
+	var v interface{}
+	switch strings.ToUpper(mes.Arguments[0]) {
+	case "INFO":
+		v = m.Info()
+	case "SLOTS":
+		v = m.Slots()
+	default:
+		return slave.NewStatus(slave.StatusWrongArguments)
+	}
+
+	body, _ := json.Marshal(v)
+	response := slave.NewStatus(slave.StatusOK)
+	response.Value = string(body)
+	return response
+}
@@ -0,0 +1,438 @@
+package master
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"potatoSlave/slave"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////
+// Master
+//////////
+
+// TODO: nothing is moved when the set of slaves changes, keys that now hash to
+// another slave are lost for clients until they're written again.
+// TODO: after a failover other replicas still follow the old primary, and the
+// old primary isn't made a replica of the new one once it's back.
+// TODO: commands that work on many keys (KEYS, QUERY, MGET, SINTERSTORE and
+// the like) go to the slave of their first argument, they should be fanned
+// out. SUBSCRIBE isn't served.
+
+// Master accepts client connections, hashes the key of every command, its
+// first argument, to one of the registered slaves, forwards the command there
+// and relays the responses back. Slaves register themselves with REGISTER or
+// are added with Register.
+//
+// Keys are hashed with a consistent hash: every slave has VNODES points on a
+// ring and a key belongs to the first point after its hash, so a slave that
+// joins or leaves takes or gives away only about its share of keys.
+//
+// The keys of a slave are its shard, named after the address it first
+// registered with. Replicas register with the address of their primary and
+// get no keys. Probe pings every slave, and once a primary is down one of
+// its replicas is promoted and serves the shard, until then commands of the
+// shard get StatusRetry.
+type Master struct {
+	// UPSTREAMCONNS is how many connections are kept to every slave, see
+	// slave.Proxy.
+	UPSTREAMCONNS int
+	// UPSTREAMIDLE must be less than STALETIME of the slaves.
+	UPSTREAMIDLE time.Duration
+	// VNODES is how many points every slave has on the ring, more of them
+	// spread keys more evenly. Must be set before slaves are registered.
+	VNODES int
+	// PROBEINTERVAL is how often Probe pings slaves, a slave that doesn't
+	// answer in PROBETIMEOUT PROBEFAILURES times in a row is down.
+	PROBEINTERVAL time.Duration
+	PROBETIMEOUT  time.Duration
+	PROBEFAILURES int
+
+	mu sync.RWMutex
+	// slaves is every known slave, primaries and replicas
+	slaves map[string]*slave.Proxy
+	// order is the sorted names of shards
+	order []string
+	// ring is the points of all the shards sorted by hash
+	ring []point
+	// primary is the slave that serves a shard now
+	primary map[string]string
+	// replicas are the replicas of every primary
+	replicas map[string][]string
+	// failures is how many probes in a row a slave has failed
+	failures map[string]int
+}
+
+// point is a virtual node of a slave on the ring.
+type point struct {
+	hash uint32
+	addr string
+}
+
+// hash is the first bytes of MD5 like in ketama, FNV spreads addresses that
+// differ only at the end badly over the ring.
+func hash(s string) uint32 {
+
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// NewMaster creates a master without slaves.
+func NewMaster() *Master {
+
+	return &Master{
+		UPSTREAMCONNS: 4,
+		UPSTREAMIDLE:  time.Second,
+		VNODES:        160,
+		PROBEINTERVAL: time.Second,
+		PROBETIMEOUT:  time.Second,
+		PROBEFAILURES: 3,
+		slaves:        make(map[string]*slave.Proxy),
+		primary:       make(map[string]string),
+		replicas:      make(map[string][]string),
+		failures:      make(map[string]int),
+	}
+}
+
+// proxy makes a pool of connections to a slave. Should be called under mu.
+func (m *Master) proxy(addr string) *slave.Proxy {
+
+	p := slave.NewProxy(addr)
+	p.UPSTREAMCONNS = m.UPSTREAMCONNS
+	p.UPSTREAMIDLE = m.UPSTREAMIDLE
+	return p
+}
+
+// Register adds a shard served by the slave at addr, it's a no-op for a known
+// slave.
+func (m *Master) Register(addr string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.slaves[addr]; ok {
+		return
+	}
+
+	m.slaves[addr] = m.proxy(addr)
+	m.primary[addr] = addr
+	m.order = append(m.order, addr)
+	sort.Strings(m.order)
+
+	for i := 0; i < m.VNODES || i == 0; i++ {
+		m.ring = append(m.ring, point{hash: hash(addr + "#" + strconv.Itoa(i)), addr: addr})
+	}
+	sort.Slice(m.ring, func(i, j int) bool {
+		if m.ring[i].hash != m.ring[j].hash {
+			return m.ring[i].hash < m.ring[j].hash
+		}
+		return m.ring[i].addr < m.ring[j].addr
+	})
+}
+
+// RegisterReplica adds a replica at addr of the primary at primaryAddr, it's
+// a no-op for a known slave.
+func (m *Master) RegisterReplica(addr string, primaryAddr string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.slaves[addr]; ok {
+		return
+	}
+
+	m.slaves[addr] = m.proxy(addr)
+	m.replicas[primaryAddr] = append(m.replicas[primaryAddr], addr)
+}
+
+// Unregister removes a slave at addr, and its shard if it has one.
+func (m *Master) Unregister(addr string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.slaves[addr]; !ok {
+		return
+	}
+	delete(m.slaves, addr)
+	delete(m.failures, addr)
+	for primary, replicas := range m.replicas {
+		m.replicas[primary] = without(replicas, addr)
+	}
+	if _, ok := m.primary[addr]; !ok {
+		return
+	}
+	delete(m.primary, addr)
+	for i, a := range m.order {
+		if a == addr {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+
+	ring := m.ring[:0]
+	for _, p := range m.ring {
+		if p.addr != addr {
+			ring = append(ring, p)
+		}
+	}
+	m.ring = ring
+}
+
+func without(addrs []string, addr string) []string {
+
+	left := addrs[:0]
+	for _, a := range addrs {
+		if a != addr {
+			left = append(left, a)
+		}
+	}
+	return left
+}
+
+// Slaves returns the addresses of the slaves that serve shards now, in the
+// order of the shards.
+func (m *Master) Slaves() []string {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	slaves := make([]string, len(m.order))
+	for i, shard := range m.order {
+		slaves[i] = m.primary[shard]
+	}
+	return slaves
+}
+
+// addrFor returns the shard of key, "" if there are no slaves. Should be
+// called under mu.
+func (m *Master) addrFor(key string) string {
+
+	if len(m.ring) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(m.ring), func(i int) bool { return m.ring[i].hash >= h })
+	if i == len(m.ring) {
+		i = 0
+	}
+	return m.ring[i].addr
+}
+
+// slaveFor returns the slave that keeps key, nil if there are no slaves, and
+// whether it's down.
+func (m *Master) slaveFor(key string) (*slave.Proxy, bool) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	addr := m.primary[m.addrFor(key)]
+	return m.slaves[addr], m.down(addr)
+}
+
+// down tells if a slave failed the last PROBEFAILURES probes. Should be called
+// under mu.
+func (m *Master) down(addr string) bool {
+	return m.failures[addr] >= m.PROBEFAILURES
+}
+
+// Probe pings every slave each PROBEINTERVAL and fails over primaries that are
+// down, until stopped by someone.
+func (m *Master) Probe(shutdownChan chan bool) {
+
+	for {
+		m.probe()
+
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(m.PROBEINTERVAL):
+		}
+	}
+}
+
+// probe pings all the slaves at once.
+func (m *Master) probe() {
+
+	m.mu.RLock()
+	addrs := make([]string, 0, len(m.slaves))
+	for addr := range m.slaves {
+		addrs = append(addrs, addr)
+	}
+	m.mu.RUnlock()
+
+	alive := make([]bool, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			alive[i] = m.ping(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	for i, addr := range addrs {
+		if _, ok := m.slaves[addr]; !ok {
+			continue
+		}
+		if alive[i] {
+			m.failures[addr] = 0
+		} else {
+			m.failures[addr]++
+		}
+	}
+	var failing []string
+	for _, shard := range m.order {
+		if m.down(m.primary[shard]) {
+			failing = append(failing, shard)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, shard := range failing {
+		m.failover(shard)
+	}
+}
+
+// ping tells if a slave answers PING in PROBETIMEOUT. It has a connection of
+// its own, a pooled one could wait for a slow command.
+func (m *Master) ping(addr string) bool {
+
+	conn, err := net.DialTimeout("tcp", addr, m.PROBETIMEOUT)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(m.PROBETIMEOUT))
+
+	var response slave.ResponseMessage
+	if json.NewEncoder(conn).Encode(slave.CommandMessage{Name: "PING"}) != nil ||
+		json.NewDecoder(conn).Decode(&response) != nil {
+		return false
+	}
+	return response.Code == slave.StatusOK
+}
+
+// failover promotes the first live replica of the primary of shard that
+// accepts PROMOTE, which then serves the shard. Without one the shard stays
+// down until its primary is back.
+func (m *Master) failover(shard string) {
+
+	m.mu.RLock()
+	old := m.primary[shard]
+	var candidates []string
+	for _, addr := range m.replicas[old] {
+		if !m.down(addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	proxies := make([]*slave.Proxy, len(candidates))
+	for i, addr := range candidates {
+		proxies[i] = m.slaves[addr]
+	}
+	m.mu.RUnlock()
+
+	for i, addr := range candidates {
+		responses := proxies[i].RoundTrip(slave.CommandMessage{Name: "PROMOTE"})
+		if responses[len(responses)-1].Code != slave.StatusOK {
+			continue
+		}
+
+		m.mu.Lock()
+		if m.primary[shard] == old {
+			m.primary[shard] = addr
+			m.replicas[old] = without(m.replicas[old], addr)
+		}
+		m.mu.Unlock()
+
+		log.Printf("master: %s is down, %s is promoted", old, addr)
+		return
+	}
+}
+
+// route forwards a command to its slave, commands of the master itself are
+// served here.
+func (m *Master) route(mes slave.CommandMessage) []slave.ResponseMessage {
+
+	switch mes.Name {
+	case "REGISTER":
+		switch len(mes.Arguments) {
+		case 1:
+			m.Register(mes.Arguments[0])
+		case 2:
+			m.RegisterReplica(mes.Arguments[0], mes.Arguments[1])
+		default:
+			return []slave.ResponseMessage{slave.NewStatus(slave.StatusWrongArguments)}
+		}
+		return []slave.ResponseMessage{slave.NewStatus(slave.StatusOK)}
+	case "SLAVES":
+		response := slave.NewStatus(slave.StatusOK)
+		response.Value = strings.Join(m.Slaves(), ",")
+		return []slave.ResponseMessage{response}
+	case "CLUSTER":
+		return []slave.ResponseMessage{m.cluster(mes)}
+	case "SUBSCRIBE":
+		return []slave.ResponseMessage{slave.NewStatus(slave.StatusUnknownCommand)}
+	}
+
+	var key string
+	if len(mes.Arguments) != 0 {
+		key = mes.Arguments[0]
+	}
+	p, down := m.slaveFor(key)
+	if p == nil {
+		return []slave.ResponseMessage{slave.NewStatus(slave.StatusUpstream)}
+	}
+	if down {
+		return []slave.ResponseMessage{slave.NewStatus(slave.StatusRetry)}
+	}
+	return p.RoundTrip(mes)
+}
+
+// Serve accepts clients from listener until it fails.
+func (m *Master) Serve(listener net.Listener) error {
+
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go m.handleClient(c)
+	}
+}
+
+// handleClient serves commands of a client one by one. Seq is checked here, as
+// slaves see writes of many clients on one connection.
+func (m *Master) handleClient(connection net.Conn) {
+
+	defer connection.Close()
+
+	decoder := json.NewDecoder(connection)
+	encoder := json.NewEncoder(connection)
+	var seq uint64
+
+	for {
+		var mes slave.CommandMessage
+		if err := decoder.Decode(&mes); err != nil {
+			return
+		}
+
+		if response, ok := slave.SequenceWrite(&seq, &mes); !ok {
+			encoder.Encode(response)
+			continue
+		}
+
+		for _, response := range m.route(mes) {
+			encoder.Encode(response)
+		}
+	}
+}
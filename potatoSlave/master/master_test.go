@@ -0,0 +1,282 @@
+package master
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"potatoSlave/slave"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startSlave serves a slave on a local port and returns its address.
+func startSlave(t *testing.T) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := slave.NewSlave("127.0.0.1", "0", time.Second*5, time.Minute, time.Millisecond*100, -1)
+	go s.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+func ask(t *testing.T, addr string, mes slave.CommandMessage) slave.ResponseMessage {
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var response slave.ResponseMessage
+	json.NewEncoder(conn).Encode(mes)
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestRouting(t *testing.T) {
+
+	m := NewMaster()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go m.Serve(listener)
+	addr := listener.Addr().String()
+
+	if response := ask(t, addr, slave.CommandMessage{Name: "GET", Arguments: []string{"key"}}); response.Code != slave.StatusUpstream {
+		t.Errorf("a command without slaves got %+v", response)
+	}
+
+	slaves := []string{startSlave(t), startSlave(t)}
+	m.Register(slaves[0])
+	if response := ask(t, addr, slave.CommandMessage{Name: "REGISTER", Arguments: []string{slaves[1]}}); response.Code != slave.StatusOK {
+		t.Fatalf("REGISTER failed: %+v", response)
+	}
+	if len(m.Slaves()) != 2 {
+		t.Fatalf("expected 2 slaves, got %v", m.Slaves())
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		encoder.Encode(slave.CommandMessage{Name: "SET", Arguments: []string{key, strconv.Itoa(i)}})
+		var response slave.ResponseMessage
+		if err := decoder.Decode(&response); err != nil || response.Code != slave.StatusOK {
+			t.Fatalf("SET through the master failed: %v %+v", err, response)
+		}
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		encoder.Encode(slave.CommandMessage{Name: "GET", Arguments: []string{key}})
+		var response slave.ResponseMessage
+		if err := decoder.Decode(&response); err != nil || response.Value != strconv.Itoa(i) {
+			t.Errorf("GET %s through the master: %v %+v", key, err, response)
+		}
+
+		// Exactly one slave has the key
+		found := 0
+		for _, s := range slaves {
+			if ask(t, s, slave.CommandMessage{Name: "GET", Arguments: []string{key}}).Code == slave.StatusOK {
+				found++
+				used[s] = true
+			}
+		}
+		if found != 1 {
+			t.Errorf("%s is on %d slaves", key, found)
+		}
+	}
+	if len(used) != 2 {
+		t.Error("keys weren't spread over both slaves")
+	}
+
+	// Writes are numbered by client connection
+	encoder.Encode(slave.CommandMessage{Name: "SET", Arguments: []string{"a", "1"}, Seq: 2})
+	var response slave.ResponseMessage
+	decoder.Decode(&response)
+	if response.Code == slave.StatusOK || response.Value != "1" {
+		t.Errorf("a write out of sequence got %+v", response)
+	}
+}
+
+func TestConsistentHashing(t *testing.T) {
+
+	m := NewMaster()
+	for i := 0; i < 4; i++ {
+		m.Register("10.0.0." + strconv.Itoa(i) + ":5000")
+	}
+
+	const keys = 10000
+	before := make([]string, keys)
+	counts := make(map[string]int)
+	for i := range before {
+		before[i] = m.addrFor("key" + strconv.Itoa(i))
+		counts[before[i]]++
+	}
+	for addr, n := range counts {
+		if n < keys/8 || n > keys/2 {
+			t.Errorf("%s has %d keys out of %d", addr, n, keys)
+		}
+	}
+
+	// A new slave takes about its share from the others and nothing else moves
+	m.Register("10.0.0.4:5000")
+	moved := 0
+	for i, addr := range before {
+		now := m.addrFor("key" + strconv.Itoa(i))
+		if now != addr {
+			moved++
+			if now != "10.0.0.4:5000" {
+				t.Fatalf("key%d moved from %s to %s", i, addr, now)
+			}
+		}
+	}
+	if moved == 0 || moved > keys*35/100 {
+		t.Errorf("%d keys out of %d moved to a new slave", moved, keys)
+	}
+
+	// Once it's gone its keys go back
+	m.Unregister("10.0.0.4:5000")
+	for i, addr := range before {
+		if now := m.addrFor("key" + strconv.Itoa(i)); now != addr {
+			t.Fatalf("key%d is on %s instead of %s", i, now, addr)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+
+	primaryListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := slave.NewSlave("127.0.0.1", "0", time.Second*5, time.Minute, time.Millisecond*100, -1)
+	go func() {
+		defer func() { recover() }()
+		primary.Serve(primaryListener)
+	}()
+	primaryAddr := primaryListener.Addr().String()
+
+	replicaListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaListener.Close()
+	replica := slave.NewSlave("127.0.0.1", "0", time.Second*5, time.Minute, time.Millisecond*100, -1)
+	replica.REPLICAOF = primaryAddr
+	replica.ROLE = "replica"
+	go func() {
+		defer func() { recover() }()
+		replica.Serve(replicaListener)
+	}()
+	replicaAddr := replicaListener.Addr().String()
+
+	m := NewMaster()
+	m.PROBEINTERVAL = time.Millisecond * 20
+	m.PROBETIMEOUT = time.Millisecond * 200
+	m.PROBEFAILURES = 2
+	m.Register(primaryAddr)
+	m.RegisterReplica(replicaAddr, primaryAddr)
+	shutdownChan := make(chan bool)
+	go m.Probe(shutdownChan)
+	defer func() { shutdownChan <- true }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go m.Serve(listener)
+	addr := listener.Addr().String()
+
+	if response := ask(t, addr, slave.CommandMessage{Name: "SET", Arguments: []string{"key", "1"}}); response.Code != slave.StatusOK {
+		t.Fatalf("SET through the master failed: %+v", response)
+	}
+	if response := ask(t, replicaAddr, slave.CommandMessage{Name: "SET", Arguments: []string{"key", "2"}}); response.Code == slave.StatusOK {
+		t.Fatal("a replica took a write before a failover")
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for ask(t, replicaAddr, slave.CommandMessage{Name: "GET", Arguments: []string{"key"}}).Value != "1" {
+		if time.Now().After(deadline) {
+			t.Fatal("the write didn't get to the replica")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// The primary stops taking connections
+	primaryListener.Close()
+
+	deadline = time.Now().Add(time.Second * 5)
+	for {
+		response := ask(t, addr, slave.CommandMessage{Name: "GET", Arguments: []string{"key"}})
+		if response.Code == slave.StatusOK && response.Value == "1" && m.Slaves()[0] == replicaAddr {
+			break
+		}
+		if response.Code != slave.StatusOK && response.Code != slave.StatusRetry && response.Code != slave.StatusUpstream {
+			t.Fatalf("unexpected response during a failover: %+v", response)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no failover, slaves are %v", m.Slaves())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if response := ask(t, addr, slave.CommandMessage{Name: "SET", Arguments: []string{"key", "3"}}); response.Code != slave.StatusOK {
+		t.Errorf("the promoted replica refused a write: %+v", response)
+	}
+}
+
+func TestClusterSlots(t *testing.T) {
+
+	m := NewMaster()
+	for i := 0; i < 3; i++ {
+		m.Register("10.0.0." + strconv.Itoa(i) + ":5000")
+	}
+
+	response := m.route(slave.CommandMessage{Name: "CLUSTER", Arguments: []string{"SLOTS"}})[0]
+	var slots []Slot
+	if err := json.Unmarshal([]byte(response.Value), &slots); err != nil || response.Code != slave.StatusOK {
+		t.Fatalf("CLUSTER SLOTS: %v %+v", err, response)
+	}
+
+	// Slots cover every hash once
+	if slots[0].Start != 0 || slots[len(slots)-1].End != math.MaxUint32 {
+		t.Fatalf("slots don't cover all hashes: %v .. %v", slots[0], slots[len(slots)-1])
+	}
+	for i := 1; i < len(slots); i++ {
+		if slots[i].Start != slots[i-1].End+1 || slots[i].Slave == slots[i-1].Slave {
+			t.Fatalf("slots %v and %v", slots[i-1], slots[i])
+		}
+	}
+
+	// A client that routes by slots gets the same slave as the master
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		h := hash(key)
+		j := sort.Search(len(slots), func(j int) bool { return slots[j].End >= h })
+		if want := m.addrFor(key); slots[j].Slave != want {
+			t.Fatalf("%s is in a slot of %s, the master sends it to %s", key, slots[j].Slave, want)
+		}
+	}
+
+	response = m.route(slave.CommandMessage{Name: "CLUSTER", Arguments: []string{"INFO"}})[0]
+	var info ClusterInfo
+	if err := json.Unmarshal([]byte(response.Value), &info); err != nil || info.Shards != 3 || len(info.Slaves) != 3 {
+		t.Errorf("CLUSTER INFO: %v %s", err, response.Value)
+	}
+}
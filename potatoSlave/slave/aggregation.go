@@ -0,0 +1,157 @@
+package slave
+
+import (
+	"strconv"
+	"strings"
+)
+
+//////////
+// Materialized aggregations
+//////////
+
+// aggregation is either a count of keys under a prefix or a sum of a numeric
+// field over hashes under a prefix. Every key contributes something to the
+// value, contributions are remembered so that the value can be updated
+// incrementally when a key changes.
+type aggregation struct {
+	kind   string
+	prefix string
+	field  string
+
+	value   float64
+	contrib map[string]float64
+}
+
+// contribution computes what an object stored at key adds to the aggregation,
+// val is nil if the key doesn't exist.
+func (s *PotatoSlave) contribution(a *aggregation, userID string, key string, val potat) float64 {
+
+	if val == nil {
+		return 0
+	}
+
+	switch a.kind {
+	case "COUNT":
+		return 1
+	case "SUM":
+		m, ok := val.(*pmap)
+		if !ok {
+			return 0
+		}
+		content, err := m.getContent(a.field)
+		if err != nil {
+			return 0
+		}
+		if content, err = s.unseal(userID, key, content); err != nil {
+			return 0
+		}
+		number, err := strconv.ParseFloat(content, 64)
+		if err != nil {
+			return 0
+		}
+		return number
+	}
+
+	return 0
+}
+
+// reconcile updates the aggregations of a user and drops cached responses
+// after the key has changed. Should be called under storageMutex or lockUser.
+func (s *PotatoSlave) reconcile(userID string, key string) {
+
+	s.invalidateKey(userID, key)
+	val := s.storage.Get(userID, key)
+
+	for _, a := range s.aggregations[userID] {
+
+		if !strings.HasPrefix(key, a.prefix) {
+			continue
+		}
+
+		c := s.contribution(a, userID, key, val)
+		a.value += c - a.contrib[key]
+		if c == 0 {
+			delete(a.contrib, key)
+		} else {
+			a.contrib[key] = c
+		}
+	}
+}
+
+// aggcreate declares an aggregation: "name COUNT prefix" counts keys under the
+// prefix and "name SUM prefix field" sums a field of hashes under the prefix.
+// The keys that already exist are scanned once at creation.
+func (s *PotatoSlave) aggcreate(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+	var a aggregation
+
+	switch {
+	case len(mes.Arguments) == 3 && strings.ToUpper(mes.Arguments[1]) == "COUNT":
+		a = aggregation{kind: "COUNT", prefix: mes.Arguments[2]}
+	case len(mes.Arguments) == 4 && strings.ToUpper(mes.Arguments[1]) == "SUM":
+		a = aggregation{kind: "SUM", prefix: mes.Arguments[2], field: mes.Arguments[3]}
+	default:
+		setStatus(&response, _WA)
+		return response
+	}
+	a.contrib = make(map[string]float64)
+
+	s.storageMutex.Lock()
+
+	if _, ok := s.aggregations[userID]; !ok {
+		s.aggregations[userID] = make(map[string]*aggregation)
+	}
+	s.aggregations[userID][mes.Arguments[0]] = &a
+
+	s.storage.Iterate(userID, func(key string, _ potat) bool {
+		if strings.HasPrefix(key, a.prefix) {
+			s.reconcile(userID, key)
+		}
+		return true
+	})
+
+	s.storageMutex.Unlock()
+
+	setStatus(&response, _OK)
+	return response
+}
+
+// aggget returns the current value of an aggregation.
+func (s *PotatoSlave) aggget(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	if a, ok := s.aggregations[userID][mes.Arguments[0]]; ok {
+		response.Value = strconv.FormatFloat(a.value, 'g', -1, 64)
+		setStatus(&response, _OK)
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
+
+	return response
+}
+
+func (s *PotatoSlave) aggdrop(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	delete(s.aggregations[userID], mes.Arguments[0])
+	s.storageMutex.Unlock()
+
+	setStatus(&response, _OK)
+	return response
+}
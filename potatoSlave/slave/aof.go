@@ -0,0 +1,480 @@
+package slave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////////
+// Append-only log
+//////////
+
+// loggedCommands are the commands that are written to the append-only log,
+// every command that changes the storage has to be here.
+var loggedCommands = map[string]bool{
+	"PERSIST":       true,
+	"EXPIREPREFIX":  true,
+	"PERSISTPREFIX": true,
+	"AGGCREATE":     true,
+	"AGGDROP":       true,
+	"ERASEUSER":     true,
+	"MOVEKEYS":      true,
+}
+
+func init() {
+	for name := range mutatingCommands {
+		loggedCommands[name] = true
+	}
+}
+
+// logEntry is a line of the append-only log. Commands go there the way they
+// were applied: jitter is already in TTL and the default TTL is written
+// explicitly. Arguments of commands on encrypted keys, except the key itself,
+// are sealed into Sealed. A rewritten log starts with an entry that has a
+// snapshot in Base instead of a command, see rewriteLog.
+type logEntry struct {
+	Seq     uint64
+	Time    time.Time
+	User    string
+	Command CommandMessage
+	Sealed  string `json:",omitempty"`
+	Base    []byte `json:",omitempty"`
+}
+
+// appendLog is an open append-only log. mutex is held from applying a command
+// until it is written, so the log has the same order of commands as the
+// storage had, it also serializes all logged commands.
+type appendLog struct {
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+	fsync string
+	dirty bool
+	// size of the file and its size after the last rewrite
+	size      int64
+	rewritten int64
+}
+
+// openAppendLog replays the log at AOFPATH over what was loaded from a
+// snapshot and opens it for appending. A line cut by a crash at the end of the
+// log is dropped, anything else that can't be read is an error.
+func (s *PotatoSlave) openAppendLog() error {
+
+	switch s.AOFFSYNC {
+	case "always", "everysec", "no":
+	default:
+		return errors.New("unknown fsync policy " + s.AOFFSYNC)
+	}
+
+	file, err := os.OpenFile(s.AOFPATH, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	seq, good, err := s.replayLog(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// Appending after a cut line would make the next one unreadable too
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	if seq < s.snapshotSeq {
+		seq = s.snapshotSeq
+	}
+	s.aof = &appendLog{file: file, seq: seq, fsync: s.AOFFSYNC, size: good, rewritten: good}
+	// Tokens given out before a restart stay valid
+	s.applied.offset = seq
+
+	return nil
+}
+
+// replayLog applies entries of the log that came after the loaded snapshot.
+// It returns the last sequence number and the size of the readable part.
+func (s *PotatoSlave) replayLog(r io.Reader) (seq uint64, good int64, err error) {
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) != 0 {
+				log.Printf("append-only log: dropping incomplete line %d", line)
+			}
+			return seq, good, nil
+		}
+		if err != nil {
+			return seq, good, err
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return seq, good, errors.New("append-only log: malformed line " + strconv.Itoa(line))
+		}
+		good += int64(len(b))
+		seq = entry.Seq
+
+		if entry.Seq <= s.snapshotSeq {
+			continue
+		}
+
+		if entry.Base != nil {
+			s.resetStorage()
+			if err := s.readSnapshot(bytes.NewReader(entry.Base)); err != nil {
+				return seq, good, err
+			}
+			continue
+		}
+
+		mes, err := s.replayed(entry)
+		if err != nil {
+			return seq, good, err
+		}
+
+		s.storageMutex.Lock()
+		s.storage.AddUser(entry.User)
+		s.storageMutex.Unlock()
+
+		s.invoke(entry.User, mes)
+		s.stats.add("aof_replayed", 1)
+	}
+}
+
+// replayed turns an entry back into a command that does the same now as it
+// did when it was logged: TTLs are shortened by the time passed since then.
+func (s *PotatoSlave) replayed(entry logEntry) (CommandMessage, error) {
+
+	mes := entry.Command
+	// Commands held for approval are logged once they're confirmed
+	mes.confirmed = true
+	if mes.Binary {
+		for i, arg := range mes.Arguments {
+			b, err := base64.StdEncoding.DecodeString(arg)
+			if err != nil {
+				return mes, err
+			}
+			mes.Arguments[i] = string(b)
+		}
+		mes.Binary = false
+	}
+
+	if entry.Sealed != "" && len(mes.Arguments) != 0 {
+		plain, err := s.unseal(entry.User, mes.Arguments[0], entry.Sealed)
+		if err != nil {
+			return mes, err
+		}
+		var rest []string
+		if err := json.Unmarshal([]byte(plain), &rest); err != nil {
+			return mes, err
+		}
+		mes.Arguments = append(mes.Arguments[:1:1], rest...)
+	}
+
+	passed := time.Since(entry.Time)
+
+	if mes.TTL > 0 {
+		// Keys that are due by now still have to be written, so that they
+		// replace older values, and are expired right away
+		if mes.TTL -= passed; mes.TTL <= 0 {
+			mes.TTL = time.Nanosecond
+		}
+	}
+
+	// EXPIRE and PEXPIRE are logged as PEXPIREAT, EXPIREPREFIX and HEXPIRE
+	// can't be and get at least a second
+	if i := len(mes.Arguments) - 1; mes.Name == "EXPIREPREFIX" && i == 1 || mes.Name == "HEXPIRE" && i == 2 {
+		if n, err := strconv.ParseInt(mes.Arguments[i], 10, 64); err == nil {
+			if n -= int64(passed / time.Second); n < 1 {
+				n = 1
+			}
+			mes.Arguments[i] = strconv.FormatInt(n, 10)
+		}
+	}
+
+	return mes, nil
+}
+
+// logged is how a command with decoded arguments goes to the log, see
+// logEntry.
+func (s *PotatoSlave) logged(mes CommandMessage, now time.Time) CommandMessage {
+
+	mes.TTLJitter = 0
+	mes.IdempotencyKey = ""
+	mes.Async = false
+	mes.Stream = false
+	if mes.TTL == 0 {
+		mes.TTL = s.DEFAULTTTL
+	}
+
+	if (mes.Name == "EXPIRE" || mes.Name == "PEXPIRE") && len(mes.Arguments) == 2 {
+		unit := time.Second
+		if mes.Name == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		// The command has succeeded, so the number is valid
+		n, _ := strconv.ParseInt(mes.Arguments[1], 10, 64)
+		at := now.Add(time.Duration(n)*unit).UnixNano() / int64(time.Millisecond)
+		mes.Name = "PEXPIREAT"
+		mes.Arguments = []string{mes.Arguments[0], strconv.FormatInt(at, 10)}
+	}
+
+	return mes
+}
+
+// appendCommand writes a command that was applied for the user to the log,
+// its arguments must be already decoded. Must be called under s.aof.mutex.
+func (s *PotatoSlave) appendCommand(userID string, mes CommandMessage) {
+
+	body, err := s.logLine(s.aof.seq+1, userID, mes)
+	if err == nil {
+		err = s.aof.write(body)
+	}
+	if err != nil {
+		log.Printf("append-only log: %s", err)
+		s.stats.add("aof_errors", 1)
+		return
+	}
+
+	if s.archive != nil {
+		s.archive.add(s.aof.seq+1, body)
+	}
+	s.aof.seq++
+	s.stats.add("aof_appended", 1)
+}
+
+// logLine encodes a command as a line of the log with the given number.
+func (s *PotatoSlave) logLine(seq uint64, userID string, mes CommandMessage) ([]byte, error) {
+
+	now := time.Now()
+	entry := logEntry{Seq: seq, Time: now, User: userID, Command: s.logged(mes, now)}
+	args := entry.Command.Arguments
+
+	if len(args) > 1 && s.isEncrypted(args[0]) {
+		rest, _ := json.Marshal(args[1:])
+		entry.Sealed = s.seal(userID, args[0], string(rest))
+		args = args[:1]
+	}
+
+	// Arguments that aren't valid UTF-8 wouldn't survive JSON
+	if mes.Binary {
+		encoded := make([]string, len(args))
+		for i, arg := range args {
+			encoded[i] = base64.StdEncoding.EncodeToString([]byte(arg))
+		}
+		args = encoded
+	}
+	entry.Command.Arguments = args
+
+	body, err := json.Marshal(entry)
+	return append(body, '\n'), err
+}
+
+// write puts a line into the file and syncs it if the policy says so.
+func (l *appendLog) write(line []byte) error {
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if l.fsync == "always" {
+		return l.file.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// sync flushes what was written since the last sync to the disk.
+func (l *appendLog) sync() error {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// close syncs the log and closes the file.
+func (l *appendLog) close() error {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// aofRoutine syncs the log every second for the "everysec" policy and starts
+// a rewrite when the log has grown over AOFREWRITESIZE and twice the size it
+// had after the last one, until stopped by someone.
+func (s *PotatoSlave) aofRoutine(shutdownChan chan bool) {
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(time.Second):
+		}
+
+		if s.aof.fsync == "everysec" {
+			if err := s.aof.sync(); err != nil {
+				log.Printf("append-only log: %s", err)
+				s.stats.add("aof_errors", 1)
+			}
+		}
+
+		s.aof.mutex.Lock()
+		grown := s.AOFREWRITESIZE != 0 && s.aof.size > s.AOFREWRITESIZE && s.aof.size > 2*s.aof.rewritten
+		s.aof.mutex.Unlock()
+
+		// A snapshot that is being saved makes it fail, it's retried later
+		if grown {
+			if err := s.rewriteLog(nil); err != nil {
+				log.Printf("append-only log rewrite: %s", err)
+				s.stats.add("aof_rewrites_failed", 1)
+			}
+		}
+	}
+}
+
+//// Rewrite
+
+// rewriteLog replaces the log with a snapshot of the storage followed by the
+// commands that came after it. Commands can't be used for all of the state:
+// registers of hyperloglogs and ids of stream entries can't be set by them,
+// so the state goes in a snapshot, see logEntry.Base. The snapshot is taken
+// without blocking commands and they are appended to the old log meanwhile,
+// the new log gets them when it replaces the old one.
+func (s *PotatoSlave) rewriteLog(j *job) error {
+
+	// Lines that the rewrite drops can't be shipped after a crash
+	if s.archive != nil {
+		if err := s.archiveSegment(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.startSnapshot(); err != nil {
+		return err
+	}
+	offset := s.saving.logOffset
+
+	snap, err := s.finishSnapshot(j)
+	if err != nil {
+		return err
+	}
+
+	var base bytes.Buffer
+	if err := encodeSnapshot(&base, snap); err != nil {
+		return err
+	}
+	line, err := json.Marshal(logEntry{Seq: snap.LogSeq, Time: snap.Taken, Base: base.Bytes()})
+	if err != nil {
+		return err
+	}
+
+	path := s.AOFPATH + ".rewrite"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	size, err := file.Write(append(line, '\n'))
+	if err != nil {
+		return fail(err)
+	}
+
+	// Nothing can be appended from here until the new log is in place
+	s.aof.mutex.Lock()
+	defer s.aof.mutex.Unlock()
+
+	copied, err := io.Copy(file, io.NewSectionReader(s.aof.file, offset, s.aof.size-offset))
+	if err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(path, s.AOFPATH); err != nil {
+		return fail(err)
+	}
+
+	s.aof.file.Close()
+	s.aof.file = file
+	s.aof.size = int64(size) + copied
+	s.aof.rewritten = s.aof.size
+	s.aof.dirty = false
+	s.stats.add("aof_rewrites", 1)
+
+	return nil
+}
+
+// resetStorage forgets everything stored, before a base snapshot is loaded.
+func (s *PotatoSlave) resetStorage() {
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	s.storage.Reset()
+	s.aggregations = make(map[string]map[string]*aggregation)
+	s.expiries = nil
+	s.scheduled = make(map[string]time.Time)
+	s.invalidateUser("")
+	s.deltas.forget()
+}
+
+// bgrewriteaof starts a rewrite of the log in background and returns the ID
+// of the job, see JOB.
+func (s *PotatoSlave) bgrewriteaof(userID string, mes CommandMessage) ResponseMessage {
+	return s.startJob(userID, mes)
+}
+
+// bgrewriteaofJob rewrites the log.
+func (s *PotatoSlave) bgrewriteaofJob(j *job, userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 || s.aof == nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	if err := s.rewriteLog(j); err != nil {
+		response.Value = err.Error()
+		setStatus(&response, _SV)
+		s.stats.add("aof_rewrites_failed", 1)
+		return response
+	}
+	setStatus(&response, _OK)
+
+	return response
+}
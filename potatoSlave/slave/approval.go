@@ -0,0 +1,153 @@
+package slave
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+//////////
+// Approval of destructive commands
+//////////
+
+// approvalCommands can't be undone, with APPROVALDELAY set they only make a
+// proposal that has to be confirmed. Cluster-wide flushes and removal of
+// nodes belong here once there is a cluster.
+var approvalCommands = map[string]bool{
+	"ERASEUSER": true,
+}
+
+// proposal is a destructive command waiting for confirmation. It can be
+// confirmed after NotBefore and until Expires.
+// TODO: a second admin should be able to confirm a proposal at once instead
+// of waiting for the delay.
+type proposal struct {
+	ID        string
+	Command   string
+	Arguments []string
+	NotBefore time.Time
+	Expires   time.Time
+
+	user string
+	mes  CommandMessage
+}
+
+// proposals are pending proposals by ID.
+type proposals struct {
+	mu    sync.Mutex
+	items map[string]*proposal
+}
+
+// prune forgets expired proposals, must be called under mu.
+func (p *proposals) prune(now time.Time) {
+
+	for id, pr := range p.items {
+		if now.After(pr.Expires) {
+			delete(p.items, id)
+		}
+	}
+}
+
+// propose keeps a destructive command until it's confirmed and returns _AP
+// with the ID of the proposal.
+func (s *PotatoSlave) propose(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		setStatus(&response, _IE)
+		return response
+	}
+
+	now := time.Now()
+	pr := &proposal{
+		ID:        hex.EncodeToString(b),
+		Command:   mes.Name,
+		Arguments: mes.Arguments,
+		NotBefore: now.Add(s.APPROVALDELAY),
+		Expires:   now.Add(s.APPROVALDELAY + s.APPROVALWINDOW),
+		user:      userID,
+		mes:       mes,
+	}
+
+	s.proposals.mu.Lock()
+	s.proposals.prune(now)
+	s.proposals.items[pr.ID] = pr
+	s.proposals.mu.Unlock()
+
+	s.stats.add("proposals_made", 1)
+
+	response.Value = pr.ID
+	setStatus(&response, _AP)
+
+	return response
+}
+
+// proposalcommand is PROPOSAL LIST, PROPOSAL CONFIRM id and PROPOSAL DISCARD
+// id. Users only see their own proposals. A confirmed command runs as if it
+// was sent now and its response is returned.
+func (s *PotatoSlave) proposalcommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) == 1 && mes.Arguments[0] == "LIST" {
+		list := []*proposal{}
+		s.proposals.mu.Lock()
+		s.proposals.prune(time.Now())
+		for _, pr := range s.proposals.items {
+			if pr.user == userID {
+				list = append(list, pr)
+			}
+		}
+		body, _ := json.Marshal(list)
+		s.proposals.mu.Unlock()
+
+		response.Value = string(body)
+		setStatus(&response, _OK)
+		return response
+	}
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	now := time.Now()
+
+	s.proposals.mu.Lock()
+	s.proposals.prune(now)
+	pr, ok := s.proposals.items[mes.Arguments[1]]
+	if !ok || pr.user != userID {
+		s.proposals.mu.Unlock()
+		setStatus(&response, _NK)
+		return response
+	}
+
+	switch mes.Arguments[0] {
+	case "CONFIRM":
+		if now.Before(pr.NotBefore) {
+			s.proposals.mu.Unlock()
+			setStatus(&response, _TE)
+			return response
+		}
+		delete(s.proposals.items, pr.ID)
+		s.proposals.mu.Unlock()
+
+		s.stats.add("proposals_confirmed", 1)
+		confirmed := pr.mes
+		confirmed.confirmed = true
+		return s.invoke(userID, confirmed)
+	case "DISCARD":
+		delete(s.proposals.items, pr.ID)
+		s.proposals.mu.Unlock()
+		setStatus(&response, _OK)
+	default:
+		s.proposals.mu.Unlock()
+		setStatus(&response, _WA)
+	}
+
+	return response
+}
@@ -0,0 +1,346 @@
+package slave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////
+// Point-in-time recovery
+//////////
+
+// TODO: only DirArchive is there, a bucket of a cloud has to be mounted or
+// wrapped into an Archive.
+
+// Archive is object storage the append-only log is shipped to. Objects are
+// written whole under a name, Put of a name that is there replaces it.
+type Archive interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	// List returns the names that start with prefix in order
+	List(prefix string) ([]string, error)
+}
+
+// DirArchive is an Archive in a directory, objects are files.
+type DirArchive string
+
+func (d DirArchive) Put(name string, data []byte) error {
+
+	path := filepath.Join(string(d), name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d DirArchive) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), name))
+}
+
+func (d DirArchive) List(prefix string) ([]string, error) {
+
+	files, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if name := f.Name(); strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Objects of an archive are named so that they are listed in order:
+//
+//	base-<LogSeq>-<Taken in ns>          a snapshot
+//	segment-<first Seq>-<last Seq>       lines of the log
+//
+// with numbers padded to 20 digits.
+const (
+	basePrefix    = "base-"
+	segmentPrefix = "segment-"
+)
+
+// archiveLog is what of the append-only log isn't shipped yet, guarded by the
+// mutex of the log. shipped is the last line in the archive.
+type archiveLog struct {
+	lines   []byte
+	first   uint64
+	last    uint64
+	shipped uint64
+}
+
+// add takes a line of the log that was written.
+func (a *archiveLog) add(seq uint64, line []byte) {
+
+	if len(a.lines) == 0 {
+		a.first = seq
+	}
+	a.lines = append(a.lines, line...)
+	a.last = seq
+}
+
+// archiveNumbers parses the numbers in a name of an object.
+func archiveNumbers(name string, prefix string) (uint64, uint64, error) {
+
+	parts := strings.Split(strings.TrimPrefix(name, prefix), "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("malformed name of an archived object " + name)
+	}
+	a, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.ParseUint(parts[1], 10, 64)
+	return a, b, err
+}
+
+// startArchive ships a base snapshot and starts shipping the log to ARCHIVE.
+// Lines of the log that aren't in the archive yet, e. g. those of a crash
+// before they were shipped, are shipped with the next segment. Must be called
+// after the log is opened.
+func (s *PotatoSlave) startArchive() error {
+
+	if s.aof == nil {
+		return errors.New("ARCHIVE needs AOFPATH")
+	}
+
+	segments, err := s.ARCHIVE.List(segmentPrefix)
+	if err != nil {
+		return err
+	}
+	a := &archiveLog{}
+	if len(segments) != 0 {
+		if _, a.shipped, err = archiveNumbers(segments[len(segments)-1], segmentPrefix); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(s.AOFPATH)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		if entry.Base == nil && entry.Seq > a.shipped {
+			a.add(entry.Seq, line)
+		}
+	}
+
+	s.aof.mutex.Lock()
+	s.archive = a
+	s.aof.mutex.Unlock()
+
+	// Lines rewritten out of the log before they were shipped are in it
+	return s.archiveBase()
+}
+
+// archiveSegment ships the lines written since the last segment. Lines that
+// failed to be shipped are shipped with the next one.
+func (s *PotatoSlave) archiveSegment() error {
+
+	s.aof.mutex.Lock()
+	a := s.archive
+	lines, first, last := a.lines, a.first, a.last
+	a.lines = nil
+	s.aof.mutex.Unlock()
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	err := s.ARCHIVE.Put(fmt.Sprintf("%s%020d-%020d", segmentPrefix, first, last), lines)
+
+	s.aof.mutex.Lock()
+	defer s.aof.mutex.Unlock()
+
+	if err != nil {
+		if len(a.lines) != 0 {
+			last = a.last
+		}
+		a.lines = append(lines, a.lines...)
+		a.first, a.last = first, last
+		return err
+	}
+	a.shipped = last
+	s.stats.add("archive_segments", 1)
+	return nil
+}
+
+// archiveBase ships a snapshot, commands are replayed on top of it.
+func (s *PotatoSlave) archiveBase() error {
+
+	snap, err := s.takeSnapshot(nil)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	if err := encodeSnapshot(&body, snap); err != nil {
+		return err
+	}
+	if err := s.ARCHIVE.Put(fmt.Sprintf("%s%020d-%020d", basePrefix, snap.LogSeq, snap.Taken.UnixNano()), body.Bytes()); err != nil {
+		return err
+	}
+	s.stats.add("archive_bases", 1)
+	return nil
+}
+
+// archiveRoutine ships a segment every ARCHIVEINTERVAL and a base snapshot
+// every BASEINTERVAL until stopped by someone. Serve ships the last
+// segment itself when all connections are served.
+func (s *PotatoSlave) archiveRoutine(shutdownChan chan bool) {
+
+	lastBase := time.Now()
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.ARCHIVEINTERVAL):
+		}
+
+		if err := s.archiveSegment(); err != nil {
+			log.Printf("archive: %s", err)
+			s.stats.add("archive_errors", 1)
+		}
+		if time.Since(lastBase) >= s.BASEINTERVAL {
+			if err := s.archiveBase(); err != nil {
+				log.Printf("archive: %s", err)
+				s.stats.add("archive_errors", 1)
+			} else {
+				lastBase = time.Now()
+			}
+		}
+	}
+}
+
+// RestoreArchive loads the storage as it was at until from an archive: the
+// last base snapshot taken by then and the logged commands after it that were
+// applied by then. TTLs run by the clock of now, like when the log is
+// replayed.
+func (s *PotatoSlave) RestoreArchive(archive Archive, until time.Time) error {
+
+	bases, err := archive.List(basePrefix)
+	if err != nil {
+		return err
+	}
+	base := ""
+	for _, name := range bases {
+		_, taken, err := archiveNumbers(name, basePrefix)
+		if err != nil {
+			return err
+		}
+		if taken <= uint64(until.UnixNano()) {
+			base = name
+		}
+	}
+	if base == "" {
+		return fmt.Errorf("there is no base snapshot taken by %s", until.Format(time.RFC3339Nano))
+	}
+
+	data, err := archive.Get(base)
+	if err != nil {
+		return err
+	}
+	if err := s.readSnapshot(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	seq := s.snapshotSeq
+
+	segments, err := archive.List(segmentPrefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		_, last, err := archiveNumbers(name, segmentPrefix)
+		if err != nil {
+			return err
+		}
+		if last <= seq {
+			continue
+		}
+		data, err := archive.Get(name)
+		if err != nil {
+			return err
+		}
+		done, err := s.restoreSegment(data, until, &seq)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if done {
+			break
+		}
+	}
+
+	s.snapshotSeq = seq
+	return nil
+}
+
+// restoreSegment applies the lines of a segment that follow seq and were
+// applied by until, it tells if a line after until was found.
+func (s *PotatoSlave) restoreSegment(data []byte, until time.Time, seq *uint64) (bool, error) {
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return false, err
+		}
+		if entry.Seq <= *seq {
+			continue
+		}
+		if entry.Seq != *seq+1 {
+			return false, fmt.Errorf("lines %d to %d are missing", *seq+1, entry.Seq-1)
+		}
+		if entry.Time.After(until) {
+			return true, nil
+		}
+
+		mes, err := s.replayed(entry)
+		if err != nil {
+			return false, err
+		}
+		s.storageMutex.Lock()
+		s.storage.AddUser(entry.User)
+		s.storageMutex.Unlock()
+
+		s.invoke(entry.User, mes)
+		*seq = entry.Seq
+		s.stats.add("archive_replayed", 1)
+	}
+}
@@ -0,0 +1,148 @@
+package slave
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////////
+// Audit log
+//////////
+
+// TODO: commands of RESP that aren't potato commands, e. g. QUIT, aren't
+// audited, nor are failed logins, see auth_failures of STATS for them.
+
+// auditEntry is who ran an audited command, when and how it ended. Keys are
+// the keys of a write, values aren't kept. Arguments are kept whole for
+// adminCommands and TOKEN, they have no values.
+type auditEntry struct {
+	Time      time.Time
+	User      string
+	Keyspace  string `json:",omitempty"`
+	Host      string `json:",omitempty"`
+	Command   string
+	Arguments []string `json:",omitempty"`
+	Keys      []string `json:",omitempty"`
+	Code      uint
+}
+
+// auditLog keeps the last AUDITSIZE entries, the oldest one at next once it's
+// full, and appends every entry to AUDITPATH as a JSON line.
+type auditLog struct {
+	mutex   sync.Mutex
+	entries []auditEntry
+	next    int
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// heartbeatCommands are adminCommands that nodes send all the time, they
+// would push everything else out of the audit log.
+var heartbeatCommands = map[string]bool{
+	"MIRROR":     true,
+	"GOSSIP":     true,
+	"RAFTVOTE":   true,
+	"RAFTAPPEND": true,
+}
+
+// audited tells if a command goes to the audit log: writes, adminCommands but
+// heartbeats and changes of tokens.
+func audited(mes CommandMessage) bool {
+
+	if mes.Name == "TOKEN" {
+		return len(mes.Arguments) == 0 || mes.Arguments[0] != "LIST"
+	}
+	return loggedCommands[mes.Name] || adminCommands[mes.Name] && !heartbeatCommands[mes.Name]
+}
+
+// openAudit opens AUDITPATH for appending.
+func (s *PotatoSlave) openAudit() error {
+
+	file, err := os.OpenFile(s.AUDITPATH, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.audit.mutex.Lock()
+	s.audit.file, s.audit.encoder = file, json.NewEncoder(file)
+	s.audit.mutex.Unlock()
+	return nil
+}
+
+// record puts a command of a session to the audit log if it's audited, with
+// the response it got.
+func (s *PotatoSlave) record(sess *session, mes CommandMessage, response ResponseMessage) {
+
+	if !audited(mes) || s.AUDITSIZE <= 0 && s.AUDITPATH == "" {
+		return
+	}
+
+	entry := auditEntry{
+		Time:    s.clock(),
+		User:    sess.login,
+		Host:    sess.host,
+		Command: mes.Name,
+		Code:    response.Code,
+	}
+	if sess.keyspace != sess.login {
+		entry.Keyspace = sess.keyspace
+	}
+	if adminCommands[mes.Name] || mes.Name == "TOKEN" {
+		entry.Arguments = mes.Arguments
+	} else {
+		entry.Keys = commandKeys(mes)
+	}
+
+	s.audit.mutex.Lock()
+	defer s.audit.mutex.Unlock()
+
+	if s.AUDITSIZE > 0 {
+		if len(s.audit.entries) < s.AUDITSIZE {
+			s.audit.entries = append(s.audit.entries, entry)
+		} else {
+			s.audit.entries[s.audit.next] = entry
+			s.audit.next = (s.audit.next + 1) % len(s.audit.entries)
+		}
+	}
+	if s.audit.encoder != nil {
+		if err := s.audit.encoder.Encode(entry); err != nil {
+			s.stats.add("audit_write_errors", 1)
+		}
+	}
+	s.stats.add("audit_entries", 1)
+}
+
+// auditcommand is AUDIT [count], it returns the last count entries of the
+// audit log or all that are kept, the oldest first, as JSON.
+func (s *PotatoSlave) auditcommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) > 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+	count := -1
+	if len(mes.Arguments) == 1 {
+		var err error
+		if count, err = strconv.Atoi(mes.Arguments[0]); err != nil || count < 0 {
+			setStatus(&response, _WA)
+			return response
+		}
+	}
+
+	s.audit.mutex.Lock()
+	entries := append(append([]auditEntry{}, s.audit.entries[s.audit.next:]...), s.audit.entries[:s.audit.next]...)
+	s.audit.mutex.Unlock()
+
+	if count >= 0 && count < len(entries) {
+		entries = entries[len(entries)-count:]
+	}
+	body, _ := json.Marshal(entries)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,314 @@
+package slave
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+//////////
+// Users and ACLs
+//////////
+
+// TODO: nodes don't log in to each other, so USERSPATH can't be used with
+// replication, standbys, gossip, Raft or a master yet.
+
+// userACL is a user of USERSPATH. Password is a hash made by HashPassword.
+// The user works with the keys of Keyspace, its own name when it's empty.
+// Only an Admin may run adminCommands and manage tokens of others. ReadOnly
+// forbids writes, Prefixes allow only commands on keys under one of them and
+// Commands, if set, is the allowlist of commands, for admins too.
+type userACL struct {
+	Password string
+	Keyspace string   `json:",omitempty"`
+	Admin    bool     `json:",omitempty"`
+	ReadOnly bool     `json:",omitempty"`
+	Prefixes []string `json:",omitempty"`
+	Commands []string `json:",omitempty"`
+}
+
+// users are the users that may log in, by name, their API tokens by ID and
+// grants of keys to them. Without users there is no authentication and
+// everyone is served as "user".
+type users struct {
+	mutex  sync.Mutex
+	byName map[string]userACL
+	tokens map[string]apiToken
+	grants []keyGrant
+}
+
+// connectionCommands are served before AUTH and to every user.
+var connectionCommands = map[string]bool{
+	"AUTH":    true,
+	"PING":    true,
+	"ECHO":    true,
+	"TIME":    true,
+	"HELLO":   true,
+	"VERSION": true,
+}
+
+// adminCommands are what other nodes of the cluster ask a slave for, they
+// see keys of every user, and commands that work with the whole slave or
+// with keys of other users.
+var adminCommands = map[string]bool{
+	"SYNC":         true,
+	"MIRROR":       true,
+	"PROMOTE":      true,
+	"GOSSIP":       true,
+	"RAFTVOTE":     true,
+	"RAFTAPPEND":   true,
+	"SAVE":         true,
+	"BGSAVE":       true,
+	"BGREWRITEAOF": true,
+	"BACKUP":       true,
+	"MIGRATE":      true,
+	"MOVEKEYS":     true,
+	"ERASEUSER":    true,
+	"PROPOSAL":     true,
+	"AUDIT":        true,
+	"GRANT":        true,
+}
+
+// multiKeyCommands have keys in all of their arguments.
+var multiKeyCommands = map[string]bool{
+	"SINTERSTORE": true,
+	"SUNIONSTORE": true,
+	"SDIFFSTORE":  true,
+	"PFMERGE":     true,
+	"PFCOUNT":     true,
+}
+
+// session is who a connection is served for. Before AUTH login is empty,
+// host is where the connection comes from.
+type session struct {
+	login    string
+	keyspace string
+	acl      *userACL
+	host     string
+}
+
+// HashPassword makes a hash of a password for USERSPATH, a random salt and
+// SHA-256 of the salt and the password.
+func HashPassword(password string) string {
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return hex.EncodeToString(salt) + "$" + saltedHash(salt, password)
+}
+
+func saltedHash(salt []byte, password string) string {
+
+	sum := sha256.Sum256(append(append([]byte{}, salt...), password...))
+	return hex.EncodeToString(sum[:])
+}
+
+// passwordMatches compares a password with a hash of HashPassword in
+// constant time.
+func passwordMatches(hash string, password string) bool {
+
+	i := strings.IndexByte(hash, '$')
+	if i < 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(hash[:i])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(saltedHash(salt, password)), []byte(hash[i+1:])) == 1
+}
+
+// LoadUsers reads users from a JSON object of userACL by name, they replace
+// the ones loaded before.
+func (s *PotatoSlave) LoadUsers(path string) error {
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	byName := map[string]userACL{}
+	if err := json.Unmarshal(body, &byName); err != nil {
+		return err
+	}
+
+	s.users.mutex.Lock()
+	s.users.byName = byName
+	s.users.mutex.Unlock()
+	return nil
+}
+
+// authRequired tells if clients have to log in.
+func (s *PotatoSlave) authRequired() bool {
+
+	s.users.mutex.Lock()
+	defer s.users.mutex.Unlock()
+	return s.users.byName != nil
+}
+
+// auth is AUTH name password or AUTH token, it logs the connection in as the
+// user, see TOKEN for tokens. A banned host fails without a check, see
+// authFailed.
+func (s *PotatoSlave) auth(sess *session, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 && len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+	if !s.authRequired() {
+		response.Value = "there are no users, everyone is served without AUTH"
+		setStatus(&response, _WA)
+		return response
+	}
+
+	if s.authBanned(sess.host) {
+		s.stats.add("auth_failures", 1)
+		s.stats.add("auth_banned", 1)
+		response.Value = "too many failed logins, try again later"
+		setStatus(&response, _AU)
+		return response
+	}
+
+	name, ok := "", false
+	if len(mes.Arguments) == 1 {
+		name, ok = s.tokenUser(mes.Arguments[0])
+	} else {
+		name = mes.Arguments[0]
+	}
+
+	s.users.mutex.Lock()
+	acl, known := s.users.byName[name]
+	s.users.mutex.Unlock()
+
+	if len(mes.Arguments) == 2 {
+		ok = known && passwordMatches(acl.Password, mes.Arguments[1])
+	}
+	if !ok || !known {
+		s.stats.add("auth_failures", 1)
+		s.authFailed(sess.host)
+		setStatus(&response, _AU)
+		return response
+	}
+
+	keyspace := acl.Keyspace
+	if keyspace == "" {
+		keyspace = name
+	}
+	s.storageMutex.Lock()
+	s.storage.AddUser(keyspace)
+	s.storageMutex.Unlock()
+
+	*sess = session{login: name, keyspace: keyspace, acl: &acl, host: sess.host}
+	s.stats.add("auth_logins", 1)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// permit checks if the session may run a command, _AU before AUTH and _NP if
+// its user isn't allowed to. In a keyspace of another user only grants allow
+// commands, see USE.
+func (s *PotatoSlave) permit(sess *session, mes CommandMessage) (ResponseMessage, bool) {
+
+	var response ResponseMessage
+
+	if connectionCommands[mes.Name] {
+		return response, true
+	}
+	if sess.login == "" {
+		setStatus(&response, _AU)
+		return response, false
+	}
+	if sess.acl == nil {
+		return response, true
+	}
+	foreign := sess.keyspace != sess.ownKeyspace()
+	if foreign && !s.granted(sess, mes) || !foreign && !sess.acl.allows(mes) {
+		s.stats.add("acl_denials", 1)
+		setStatus(&response, _NP)
+		return response, false
+	}
+	return response, true
+}
+
+// allows tells if the user may run a command.
+func (acl *userACL) allows(mes CommandMessage) bool {
+
+	if adminCommands[mes.Name] && !acl.Admin {
+		return false
+	}
+	if acl.ReadOnly && loggedCommands[mes.Name] {
+		return false
+	}
+	if len(acl.Commands) != 0 && !containsString(acl.Commands, mes.Name) {
+		return false
+	}
+	if len(acl.Prefixes) != 0 {
+		keys := commandKeys(mes)
+		if len(keys) == 0 {
+			return false
+		}
+		for _, key := range keys {
+			if !hasAnyPrefix(key, acl.Prefixes) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// commandKeys returns the keys a command works on, nil if it isn't known to
+// work on keys only, e. g. KEYS. Prefixes of EXPIREPREFIX and PERSISTPREFIX
+// are keys here, they have to be under a prefix of the user too.
+func commandKeys(mes CommandMessage) []string {
+
+	args := mes.Arguments
+	if mes.Binary {
+		args = make([]string, len(mes.Arguments))
+		for i, arg := range mes.Arguments {
+			b, err := base64.StdEncoding.DecodeString(arg)
+			if err != nil {
+				return nil
+			}
+			args[i] = string(b)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch {
+	case multiKeyCommands[mes.Name]:
+		return args
+	case mutatingCommands[mes.Name] || sharedCommands[mes.Name],
+		mes.Name == "EXPIREPREFIX", mes.Name == "PERSISTPREFIX":
+		return args[:1]
+	}
+	return nil
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
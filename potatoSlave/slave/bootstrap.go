@@ -0,0 +1,125 @@
+package slave
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//////////
+// Cluster bootstrap
+//////////
+
+// TODO: slaves register with the master by address, not by NODEID, and get no
+// shard assignments, the master spreads keys over whoever is registered. The
+// master could be found the way the client finds slaves
+// (potatoClient/client/seeds.go).
+
+// LoadNodeID reads the id of the node from path, on the first start a random
+// one is generated and written there. Keep the file on a persistent volume, so
+// the node keeps its identity when it's rescheduled.
+func LoadNodeID(path string) (string, error) {
+
+	body, err := ioutil.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(body)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	if err := ioutil.WriteFile(path+".tmp", []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, os.Rename(path+".tmp", path)
+}
+
+// healthHandler serves probes for an orchestrator:
+//
+//	/livez   fails when the storage lock is held longer than LIVENESSTHRESHOLD,
+//	         the slave is stuck and should be restarted
+//	/readyz  fails until the slave has loaded persisted data and accepts
+//	         connections, after it stops and while it's a standby
+func (s *PotatoSlave) healthHandler() http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		if held, _ := s.storageMutex.heldFor(); held > s.LIVENESSTHRESHOLD {
+			http.Error(w, "storage lock is held for "+held.String(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.serving) == 0 {
+			http.Error(w, "not serving", http.StatusServiceUnavailable)
+			return
+		}
+		if atomic.LoadInt32(&s.standby) == 1 {
+			http.Error(w, "standby", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	return mux
+}
+
+// ServeHealth serves probes of healthHandler over HTTP on addr, it blocks like
+// http.ListenAndServe.
+func (s *PotatoSlave) ServeHealth(addr string) error {
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      s.healthHandler(),
+		ReadTimeout:  time.Second * 5,
+		WriteTimeout: time.Second * 5,
+	}
+	return server.ListenAndServe()
+}
+
+// registerRoutine registers the slave with MASTER every REGISTERINTERVAL until
+// stopped by someone. A standby isn't registered until it's promoted, a
+// replica is registered with its REPLICAOF, which must be the address its
+// primary is registered with.
+func (s *PotatoSlave) registerRoutine(shutdownChan chan bool) {
+
+	for {
+		if atomic.LoadInt32(&s.standby) == 0 {
+			args := []string{s.advertised()}
+			if s.isReplica() {
+				args = append(args, s.REPLICAOF)
+			}
+			response, err := askNode(s.MASTER, CommandMessage{Name: "REGISTER", Arguments: args}, 0)
+			if err == nil && response.Code != _OK {
+				err = errors.New(response.StatusMessage)
+			}
+			if err != nil {
+				log.Printf("can't register with the master: %s", err)
+				s.stats.add("register_errors", 1)
+			}
+		}
+
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.REGISTERINTERVAL):
+		}
+	}
+}
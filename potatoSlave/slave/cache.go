@@ -0,0 +1,256 @@
+package slave
+
+import (
+	"strings"
+	"sync"
+)
+
+//////////
+// Result cache
+//////////
+
+// TODO: a key that has expired but isn't removed yet still counts in cached
+// results, until the cleanup removes it in at most CLEANUPTIME.
+
+// cacheScope is what keys of the user a command reads: keys and, with scan,
+// every key under prefix.
+type cacheScope struct {
+	keys   []string
+	prefix string
+	scan   bool
+}
+
+// cacheScopes are the commands that can be cached.
+var cacheScopes = map[string]func(args []string) (cacheScope, bool){
+	"SINTER":        allKeys,
+	"SUNION":        allKeys,
+	"SDIFF":         allKeys,
+	"ZRANGE":        firstKey,
+	"ZRANGEBYSCORE": firstKey,
+	"QUERY": func(args []string) (cacheScope, bool) {
+		if len(args) != 1 {
+			return cacheScope{}, false
+		}
+		q, err := parseQuery(args[0])
+		if err != nil {
+			return cacheScope{}, false
+		}
+		return cacheScope{prefix: q.prefix, scan: true}, true
+	},
+}
+
+// reads tells if a command of the scope reads the key.
+func (scope cacheScope) reads(key string) bool {
+
+	for _, k := range scope.keys {
+		if k == key {
+			return true
+		}
+	}
+	return scope.scan && strings.HasPrefix(key, scope.prefix)
+}
+
+func allKeys(args []string) (cacheScope, bool) {
+	return cacheScope{keys: args}, len(args) != 0
+}
+
+func firstKey(args []string) (cacheScope, bool) {
+
+	if len(args) == 0 {
+		return cacheScope{}, false
+	}
+	return cacheScope{keys: args[:1]}, true
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	response ResponseMessage
+	user     string
+	scope    cacheScope
+}
+
+// cacheChange is a change of a key, or of every key of user with all.
+type cacheChange struct {
+	user string
+	key  string
+	all  bool
+}
+
+// recentChanges is how many last changes are kept to check responses that
+// were computed while they happened.
+const recentChanges = 256
+
+// resultCache keeps responses of the commands from CACHECOMMANDS until a key
+// they read changes. gen is the number of changes so far, a response that was
+// computed while a key it reads changed isn't stored, as it may have read the
+// old value. So isn't one computed while too many changes happened.
+type resultCache struct {
+	mutex    sync.Mutex
+	entries  map[string]*cacheEntry
+	byKey    map[UserKey]map[string]bool
+	prefixed map[string]map[string]bool
+	gen      uint64
+	changes  [recentChanges]cacheChange
+}
+
+// changed counts a change. Should be called under mutex.
+func (c *resultCache) changed(change cacheChange) {
+
+	c.gen++
+	c.changes[c.gen%recentChanges] = change
+}
+
+// changedSince tells if anything the scope reads may have changed since gen.
+// Should be called under mutex.
+func (c *resultCache) changedSince(gen uint64, userID string, scope cacheScope) bool {
+
+	if c.gen-gen >= recentChanges {
+		return true
+	}
+	for g := gen + 1; g <= c.gen; g++ {
+		change := c.changes[g%recentChanges]
+		if change.user == "" || (change.user == userID && (change.all || scope.reads(change.key))) {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheID(userID string, mes CommandMessage) string {
+	return userID + "\x00" + mes.Name + "\x00" + strings.Join(mes.Arguments, "\x00")
+}
+
+// callCached calls f through the cache if the command is in CACHECOMMANDS.
+func (s *PotatoSlave) callCached(f func(string, CommandMessage) ResponseMessage, userID string,
+	mes CommandMessage) ResponseMessage {
+
+	// Items of a streamed command are sent, not kept in Value
+	if !s.CACHECOMMANDS[mes.Name] || cacheScopes[mes.Name] == nil || mes.stream != nil {
+		return s.call(f, userID, mes)
+	}
+
+	response, ok, gen := s.cached(userID, mes)
+	if !ok {
+		response = s.call(f, userID, mes)
+		s.storeCached(userID, mes, response, gen)
+	}
+	return response
+}
+
+// cached returns a cached response of a command, and if there is none the
+// generation to store a new one with.
+func (s *PotatoSlave) cached(userID string, mes CommandMessage) (ResponseMessage, bool, uint64) {
+
+	c := &s.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.entries[cacheID(userID, mes)]; ok {
+		s.stats.add("cache_hits", 1)
+		return e.response, true, 0
+	}
+	s.stats.add("cache_misses", 1)
+	return ResponseMessage{}, false, c.gen
+}
+
+// storeCached keeps a response if nothing has changed since gen. A random
+// entry goes away when there are CACHESIZE of them.
+func (s *PotatoSlave) storeCached(userID string, mes CommandMessage, response ResponseMessage, gen uint64) {
+
+	scope, ok := cacheScopes[mes.Name](mes.Arguments)
+	if !ok || response.Code != _OK {
+		return
+	}
+
+	c := &s.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.changedSince(gen, userID, scope) {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+		c.byKey = make(map[UserKey]map[string]bool)
+		c.prefixed = make(map[string]map[string]bool)
+	}
+	for id := range c.entries {
+		if len(c.entries) < s.CACHESIZE {
+			break
+		}
+		c.drop(id)
+	}
+	if s.CACHESIZE <= 0 {
+		return
+	}
+
+	id := cacheID(userID, mes)
+	c.entries[id] = &cacheEntry{response: response, user: userID, scope: scope}
+	for _, key := range scope.keys {
+		k := UserKey{User: userID, Key: key}
+		if c.byKey[k] == nil {
+			c.byKey[k] = make(map[string]bool)
+		}
+		c.byKey[k][id] = true
+	}
+	if scope.scan {
+		if c.prefixed[userID] == nil {
+			c.prefixed[userID] = make(map[string]bool)
+		}
+		c.prefixed[userID][id] = true
+	}
+}
+
+// drop removes an entry. Should be called under mutex.
+func (c *resultCache) drop(id string) {
+
+	e := c.entries[id]
+	delete(c.entries, id)
+	for _, key := range e.scope.keys {
+		k := UserKey{User: e.user, Key: key}
+		delete(c.byKey[k], id)
+		if len(c.byKey[k]) == 0 {
+			delete(c.byKey, k)
+		}
+	}
+	delete(c.prefixed[e.user], id)
+	if len(c.prefixed[e.user]) == 0 {
+		delete(c.prefixed, e.user)
+	}
+}
+
+// invalidateKey drops the responses that read the key.
+func (s *PotatoSlave) invalidateKey(userID string, key string) {
+
+	c := &s.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.changed(cacheChange{user: userID, key: key})
+	for id := range c.byKey[UserKey{User: userID, Key: key}] {
+		c.drop(id)
+		s.stats.add("cache_invalidations", 1)
+	}
+	for id := range c.prefixed[userID] {
+		if strings.HasPrefix(key, c.entries[id].scope.prefix) {
+			c.drop(id)
+			s.stats.add("cache_invalidations", 1)
+		}
+	}
+}
+
+// invalidateUser drops the responses of a user, all of them if userID is "".
+func (s *PotatoSlave) invalidateUser(userID string) {
+
+	c := &s.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.changed(cacheChange{user: userID, all: true})
+	for id, e := range c.entries {
+		if userID == "" || e.user == userID {
+			c.drop(id)
+			s.stats.add("cache_invalidations", 1)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package slave
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////
+// Causality tokens
+//////////
+
+// appliedLog counts commands that changed the storage of the shard. Every
+// write gets the offset it was applied at, readers can wait for an offset.
+type appliedLog struct {
+	mu      sync.Mutex
+	offset  uint64
+	changed chan struct{}
+}
+
+// advance counts a write and returns its offset.
+func (a *appliedLog) advance() uint64 {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.offset++
+	if a.changed != nil {
+		close(a.changed)
+		a.changed = nil
+	}
+	return a.offset
+}
+
+// wait blocks until offset is applied or timeout passes, it tells if it was
+// applied.
+func (a *appliedLog) wait(offset uint64, timeout time.Duration) bool {
+
+	deadline := time.After(timeout)
+	for {
+		a.mu.Lock()
+		if a.offset >= offset {
+			a.mu.Unlock()
+			return true
+		}
+		if a.changed == nil {
+			a.changed = make(chan struct{})
+		}
+		changed := a.changed
+		a.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// shard is the name of the shard in tokens: SHARD if it's set, otherwise the
+// node itself.
+func (s *PotatoSlave) shard() string {
+
+	if s.SHARD != "" {
+		return s.SHARD
+	}
+	if s.NODEID != "" {
+		return s.NODEID
+	}
+	return s.advertised()
+}
+
+// causalityToken is "shard:offset" of a write.
+func (s *PotatoSlave) causalityToken(offset uint64) string {
+	return s.shard() + ":" + strconv.FormatUint(offset, 10)
+}
+
+// waitToken waits until the write of a token is applied by this node. Tokens
+// of other shards say nothing about this one and are passed. It returns _WA
+// for a malformed token and _CT if the write isn't applied within
+// CAUSALITYTIMEOUT.
+// TODO: once there are replicas, they should proxy to the primary instead of
+// failing.
+func (s *PotatoSlave) waitToken(token string) uint {
+
+	i := strings.LastIndex(token, ":")
+	if i == -1 {
+		return _WA
+	}
+	offset, err := strconv.ParseUint(token[i+1:], 10, 64)
+	if err != nil {
+		return _WA
+	}
+	if token[:i] != s.shard() {
+		return _OK
+	}
+
+	if !s.applied.wait(offset, s.CAUSALITYTIMEOUT) {
+		s.stats.add("causality_timeouts", 1)
+		return _CT
+	}
+	return _OK
+}
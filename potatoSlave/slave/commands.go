@@ -0,0 +1,148 @@
+package slave
+
+import (
+	"time"
+)
+
+//////////
+// Commands of one key
+//////////
+
+// TODO: only commands of strings, lists and hashes are declared in
+// keyCommands so far, the others still check their arguments, lock and look
+// up their keys on their own. HGETALL and KEYS are streamed by their
+// functions of items, so they stay as they are.
+
+// keyCommand is a command that passed the checks of its commandSpec, with the
+// live object at its key, nil if there's none, the TTL a write gives a new
+// object and the sealed value if the spec has one.
+type keyCommand struct {
+	userID string
+	mes    CommandMessage
+	key    string
+	val    potat
+	ttl    time.Duration
+	value  string
+}
+
+// commandSpec declares what a command of one key takes and does, handle
+// makes the checks its handler would otherwise make on its own. The key is
+// the first argument.
+type commandSpec struct {
+	// arity is the exact number of arguments
+	arity int
+	// valid checks the rest of the message before anything is locked, nil if
+	// there's nothing to check
+	valid func(CommandMessage) bool
+	// value is the argument that's stored, it's sealed before the lock, 0 if
+	// there's none
+	value int
+	// write locks the keys of the user for writing and takes a TTL, reads
+	// share the lock
+	write bool
+	// kind is the type the key must hold as typeOf names it, _WT otherwise,
+	// empty for any type
+	kind string
+	// missing lets a key that isn't there reach the handler, _NK otherwise
+	missing bool
+	handler func(s *PotatoSlave, c *keyCommand, response *ResponseMessage)
+}
+
+// keyCommands are the commands that are served by handle.
+var keyCommands = map[string]commandSpec{
+	"GET": {arity: 1, kind: "string", handler: (*PotatoSlave).get},
+	"SET": {arity: 2, value: 1, write: true, missing: true, handler: (*PotatoSlave).set},
+	"DEL": {arity: 1, write: true, missing: true, handler: (*PotatoSlave).del},
+	// currently we don't support addition of multiple elements...
+	"LPUSH":   {arity: 2, value: 1, write: true, missing: true, handler: (*PotatoSlave).lpush},
+	"LSET":    {arity: 3, value: 2, write: true, kind: "list", handler: (*PotatoSlave).lset},
+	"LGET":    {arity: 2, kind: "list", handler: (*PotatoSlave).lget},
+	"LLEN":    {arity: 1, kind: "list", handler: (*PotatoSlave).llen},
+	"HGET":    {arity: 2, kind: "hash", handler: (*PotatoSlave).hget},
+	"HSET":    {arity: 3, value: 2, write: true, missing: true, handler: (*PotatoSlave).hset},
+	"HGETDEL": {arity: 2, write: true, kind: "hash", handler: (*PotatoSlave).hgetdel},
+	"HGETEX":  {arity: 2, write: true, kind: "hash", handler: (*PotatoSlave).hgetex},
+	"HEXPIRE": {
+		arity: 3,
+		valid: func(mes CommandMessage) bool {
+			_, ok := hexpireTTL(mes.Arguments[2])
+			return ok
+		},
+		write:   true,
+		kind:    "hash",
+		handler: (*PotatoSlave).hexpire,
+	},
+}
+
+// typeOf names the type of an object as snapshots do.
+func typeOf(val potat) string {
+
+	switch val.(type) {
+	case *pstring:
+		return "string"
+	case *plist:
+		return "list"
+	case *pmap:
+		return "hash"
+	case *pset:
+		return "set"
+	case *pzset:
+		return "zset"
+	case *pcounter:
+		return "counter"
+	case *pbitmap:
+		return "bitmap"
+	case *papprox:
+		return "hll"
+	case *pstream:
+		return "stream"
+	case *pjson:
+		return "json"
+	}
+	return ""
+}
+
+// handle turns a commandSpec into an invocable function. It checks the
+// arguments, computes what doesn't need the lock, locks the keys of the user
+// for the spec, takes the live object at the key and checks it before the
+// handler runs. Reads leave dead objects to dropDead.
+func (s *PotatoSlave) handle(spec commandSpec) func(string, CommandMessage) ResponseMessage {
+
+	return func(userID string, mes CommandMessage) ResponseMessage {
+
+		var response ResponseMessage
+
+		if len(mes.Arguments) != spec.arity || spec.valid != nil && !spec.valid(mes) {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		c := keyCommand{userID: userID, mes: mes, key: mes.Arguments[0]}
+		if spec.value != 0 {
+			c.value = s.seal(userID, c.key, mes.Arguments[spec.value])
+		}
+
+		if spec.write {
+			// ttlFor locks storageMutex for reading of its own
+			c.ttl = s.ttlFor(c.key, mes.TTL)
+			defer s.lockUser(userID)()
+			c.val = s.live(userID, c.key)
+		} else {
+			var dead []string
+			defer func() { s.dropDead(userID, dead) }()
+			defer s.rlockUser(userID)()
+			c.val = s.peek(userID, c.key, &dead)
+		}
+
+		switch {
+		case c.val == nil && !spec.missing:
+			setStatus(&response, _NK)
+		case c.val != nil && spec.kind != "" && typeOf(c.val) != spec.kind:
+			setStatus(&response, _WT)
+		default:
+			spec.handler(s, &c, &response)
+		}
+
+		return response
+	}
+}
@@ -0,0 +1,256 @@
+package slave
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//////////
+// Delta snapshots
+//////////
+
+// A delta snapshot has only the keys changed since the last full snapshot of
+// the same path: logged commands mark the keys they change in invoke, next to
+// preserve, and eviction marks the keys it deletes. Every delta has all the
+// changes since the full snapshot, so the last one is all LoadSnapshot needs.
+// TTLs are in the objects, so keys that only expired aren't marked, they're
+// dead in the full snapshot as well.
+
+// errNoDeltaBase is returned for a delta snapshot before any full one.
+var errNoDeltaBase = errors.New("there is no full snapshot to take a delta of")
+
+// deltaBase is the full snapshot deltas are of: its path, when it was taken,
+// zero if there is none, and the keys changed since.
+type deltaBase struct {
+	path    string
+	taken   time.Time
+	changed map[string]map[string]bool
+}
+
+// deltaTracker tracks changes since the last full snapshot. Nothing is
+// tracked until the first one is started.
+type deltaTracker struct {
+	mutex sync.Mutex
+	deltaBase
+}
+
+// deltaPath is the file of the delta snapshots of the full one at path.
+func deltaPath(path string) string {
+	return path + ".delta"
+}
+
+// mark marks a changed key.
+func (d *deltaTracker) mark(user string, key string) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.changed == nil {
+		return
+	}
+	if d.changed[user] == nil {
+		d.changed[user] = make(map[string]bool)
+	}
+	d.changed[user][key] = true
+}
+
+// tracking tells if changes are tracked.
+func (d *deltaTracker) tracking() bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.changed != nil
+}
+
+// restart tracks changes from the moment a full snapshot is of, no delta is
+// taken until it's saved. It returns what was tracked before for keep, if the
+// snapshot fails.
+func (d *deltaTracker) restart() deltaBase {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	before := d.deltaBase
+	d.deltaBase = deltaBase{changed: make(map[string]map[string]bool)}
+	return before
+}
+
+// keep goes back to the full snapshot before a failed one, with the changes
+// since both.
+func (d *deltaTracker) keep(before deltaBase) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if before.changed == nil {
+		return
+	}
+	for user, keys := range d.changed {
+		if before.changed[user] == nil {
+			before.changed[user] = make(map[string]bool, len(keys))
+		}
+		for key := range keys {
+			before.changed[user][key] = true
+		}
+	}
+	d.deltaBase = before
+}
+
+// saved makes the full snapshot saved at path the one deltas are of.
+func (d *deltaTracker) saved(path string, taken time.Time) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.path, d.taken = path, taken
+}
+
+// loaded makes the full snapshot loaded from path the one deltas are of, with
+// the keys of the delta that was loaded after it as changed.
+func (d *deltaTracker) loaded(path string, taken time.Time, delta snapshot) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.deltaBase = deltaBase{path: path, taken: taken, changed: make(map[string]map[string]bool)}
+	keys := delta.Deleted
+	for _, o := range delta.Objects {
+		keys = append(keys, UserKey{User: o.User, Key: o.Key})
+	}
+	for _, k := range keys {
+		if d.changed[k.User] == nil {
+			d.changed[k.User] = make(map[string]bool)
+		}
+		d.changed[k.User][k.Key] = true
+	}
+}
+
+// forget drops the full snapshot, the storage doesn't come from it anymore.
+func (d *deltaTracker) forget() {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.path, d.taken = "", time.Time{}
+}
+
+// of tells if deltas of the full snapshot at path can be taken.
+func (d *deltaTracker) of(path string) bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.path == path && !d.taken.IsZero()
+}
+
+// pending makes the changed keys pending in a delta snapshot and returns when
+// the full snapshot was taken.
+func (d *deltaTracker) pending(p *snapshotProgress) (time.Time, error) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.taken.IsZero() {
+		return time.Time{}, errNoDeltaBase
+	}
+	for user, keys := range d.changed {
+		p.pending[user] = make(map[string]bool, len(keys))
+		for key := range keys {
+			p.pending[user][key] = true
+		}
+		p.left += len(keys)
+	}
+	return d.taken, nil
+}
+
+// markChanged marks the keys a logged command is going to change, the way
+// preserve copies them. It must be called under saveMutex.RLock with preserve.
+func (s *PotatoSlave) markChanged(userID string, mes CommandMessage) {
+
+	d := &s.deltas
+	if len(mes.Arguments) == 0 || !d.tracking() {
+		return
+	}
+
+	markUser := func(user string, to ...string) {
+		s.storage.Iterate(user, func(key string, _ potat) bool {
+			for _, u := range to {
+				d.mark(u, key)
+			}
+			return true
+		})
+	}
+
+	switch mes.Name {
+	case "MOVEKEYS":
+		if len(mes.Arguments) < 2 {
+			break
+		}
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
+		for _, user := range mes.Arguments[:2] {
+			markUser(user, mes.Arguments[:2]...)
+		}
+	case "ERASEUSER":
+		userID = mes.Arguments[0]
+		fallthrough
+	case "EXPIREPREFIX", "PERSISTPREFIX":
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
+		markUser(userID, userID)
+	default:
+		d.mark(userID, mes.Arguments[0])
+	}
+}
+
+// applyDelta is the full snapshot base with a delta of it applied.
+func applyDelta(base snapshot, delta snapshot) snapshot {
+
+	changed := make(map[UserKey]bool, len(delta.Objects)+len(delta.Deleted))
+	for _, o := range delta.Objects {
+		changed[UserKey{User: o.User, Key: o.Key}] = true
+	}
+	for _, k := range delta.Deleted {
+		changed[k] = true
+	}
+
+	merged := snapshot{Taken: delta.Taken, Aggregations: delta.Aggregations, LogSeq: delta.LogSeq}
+	for _, o := range base.Objects {
+		if !changed[UserKey{User: o.User, Key: o.Key}] {
+			merged.Objects = append(merged.Objects, o)
+		}
+	}
+	merged.Objects = append(merged.Objects, delta.Objects...)
+	return merged
+}
+
+// SaveDeltaSnapshot writes the keys changed since the last SaveSnapshot of
+// path to a file next to it, LoadSnapshot applies it on top of the full
+// snapshot. Without a full snapshot of path to take a delta of, a full one is
+// saved instead.
+func (s *PotatoSlave) SaveDeltaSnapshot(path string) error {
+
+	if !s.deltas.of(path) {
+		return s.SaveSnapshot(path)
+	}
+
+	err := s.startSnapshotOf(true, nil)
+	if err == errNoDeltaBase {
+		return s.SaveSnapshot(path)
+	}
+	if err != nil {
+		return err
+	}
+	snap, err := s.finishSnapshot(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshot(deltaPath(path), snap); err != nil {
+		return err
+	}
+	s.stats.add("delta_snapshots_saved", 1)
+	return nil
+}
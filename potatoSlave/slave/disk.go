@@ -0,0 +1,440 @@
+package slave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+//////////
+// Disk storage
+//////////
+
+// TODO: BoltDB or Badger would do the job of this file better, but the slave
+// has no dependencies outside of the standard library, so this is a small
+// log-structured store of its own.
+
+// diskRecord is a record of the data file of diskStorage: the latest version
+// of an object or a tombstone of a deleted one.
+type diskRecord struct {
+	Object  snapshotObject
+	Deleted bool
+}
+
+// diskRef is where the latest record of a key is in the data file.
+type diskRef struct {
+	offset int64
+	size   int64
+}
+
+// diskStorage is a Storage that keeps objects in a data file, only keys and
+// offsets of their records stay in memory, so a dataset can be larger than
+// RAM. Records are only appended: every record is a length followed by gob of
+// diskRecord and the last record of a key wins.
+//
+// Objects that were asked for are cached until the next flush, as handlers
+// change them in place. flush writes every cached object and empties the
+// cache, so writes made since the last flush are lost on a crash. The file is
+// compacted on flush once it's more than twice as big as its live records.
+type diskStorage struct {
+	path  string
+	file  *os.File
+	size  int64
+	live  int64
+	index map[string]map[string]diskRef
+	cache map[string]map[string]potat
+	users map[string]bool
+}
+
+// openDiskStorage opens the data file at path, it's created if there is none.
+// The index is rebuilt by reading the whole file, a partial record at the end
+// is cut off.
+func openDiskStorage(path string) (*diskStorage, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &diskStorage{
+		path:  path,
+		file:  file,
+		index: make(map[string]map[string]diskRef),
+		cache: make(map[string]map[string]potat),
+		users: make(map[string]bool),
+	}
+
+	r := bufio.NewReader(file)
+	for {
+		record, size, err := readDiskRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		d.indexRecord(record.Object.User, record.Object.Key, diskRef{offset: d.size, size: size}, record.Deleted)
+		d.size += size
+	}
+
+	if err := file.Truncate(d.size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(d.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// readDiskRecord reads the next record and tells its size in the file.
+func readDiskRecord(r io.Reader) (diskRecord, int64, error) {
+
+	var record diskRecord
+
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return record, 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return record, 0, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&record); err != nil {
+		return record, 0, err
+	}
+
+	return record, int64(len(length) + len(body)), nil
+}
+
+// indexRecord points the key to its latest record.
+func (d *diskStorage) indexRecord(user string, key string, ref diskRef, deleted bool) {
+
+	if old, ok := d.index[user][key]; ok {
+		d.live -= old.size
+		delete(d.index[user], key)
+	}
+	if deleted {
+		return
+	}
+	if _, ok := d.index[user]; !ok {
+		d.index[user] = make(map[string]diskRef)
+	}
+	d.index[user][key] = ref
+	d.live += ref.size
+}
+
+// write appends a record to the data file and indexes it.
+func (d *diskStorage) write(record diskRecord) error {
+
+	var body bytes.Buffer
+	body.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&body).Encode(record); err != nil {
+		return err
+	}
+	b := body.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	if _, err := d.file.Write(b); err != nil {
+		return err
+	}
+	d.indexRecord(record.Object.User, record.Object.Key, diskRef{offset: d.size, size: int64(len(b))}, record.Deleted)
+	d.size += int64(len(b))
+
+	return nil
+}
+
+// load reads the object of a key from the data file, nil if there is none.
+func (d *diskStorage) load(user string, key string) (potat, error) {
+
+	ref, ok := d.index[user][key]
+	if !ok {
+		return nil, nil
+	}
+
+	record, _, err := readDiskRecord(io.NewSectionReader(d.file, ref.offset, ref.size))
+	if err != nil {
+		return nil, err
+	}
+	return record.Object.restore()
+}
+
+func (d *diskStorage) Get(user, key string) potat {
+
+	if val, ok := d.cache[user][key]; ok {
+		return val
+	}
+
+	val, err := d.load(user, key)
+	if err != nil {
+		log.Printf("disk storage: can't read %s of %s: %s", key, user, err)
+		return nil
+	}
+	if val != nil {
+		d.cacheObject(user, key, val)
+	}
+	return val
+}
+
+func (d *diskStorage) cacheObject(user string, key string, val potat) {
+
+	if _, ok := d.cache[user]; !ok {
+		d.cache[user] = make(map[string]potat)
+	}
+	d.cache[user][key] = val
+}
+
+func (d *diskStorage) Set(user, key string, val potat) {
+
+	d.users[user] = true
+	d.cacheObject(user, key, val)
+}
+
+func (d *diskStorage) Delete(user, key string) {
+
+	delete(d.cache[user], key)
+	if _, ok := d.index[user][key]; !ok {
+		return
+	}
+	err := d.write(diskRecord{Object: snapshotObject{User: user, Key: key}, Deleted: true})
+	if err != nil {
+		log.Printf("disk storage: can't delete %s of %s: %s", key, user, err)
+	}
+}
+
+// Iterate passes objects that aren't cached without caching them, so going
+// over the whole dataset doesn't bring it into memory. Changes made to them in
+// place are lost, Set or Expire has to be used.
+func (d *diskStorage) Iterate(user string, fn func(key string, val potat) bool) {
+
+	keys := make([]string, 0, len(d.index[user])+len(d.cache[user]))
+	for key := range d.cache[user] {
+		keys = append(keys, key)
+	}
+	for key := range d.index[user] {
+		if _, ok := d.cache[user][key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		val, ok := d.cache[user][key]
+		if !ok {
+			var err error
+			if val, err = d.load(user, key); err != nil {
+				log.Printf("disk storage: can't read %s of %s: %s", key, user, err)
+				continue
+			}
+		}
+		// Deleted by fn in an earlier call
+		if val == nil {
+			continue
+		}
+		if !fn(key, val) {
+			return
+		}
+	}
+}
+
+func (d *diskStorage) Expire(user, key string, death time.Time) bool {
+
+	val := d.Get(user, key)
+	if val == nil {
+		return false
+	}
+	val.setTimeOfDeath(death)
+	return true
+}
+
+func (d *diskStorage) AddUser(user string) {
+	d.users[user] = true
+}
+
+func (d *diskStorage) HasUser(user string) bool {
+	return d.users[user] || len(d.index[user]) != 0
+}
+
+func (d *diskStorage) Users() []string {
+
+	users := make([]string, 0, len(d.users))
+	for user := range d.users {
+		users = append(users, user)
+	}
+	for user := range d.index {
+		if !d.users[user] {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+func (d *diskStorage) Len(user string) int {
+
+	n := len(d.index[user])
+	for key := range d.cache[user] {
+		if _, ok := d.index[user][key]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *diskStorage) Reset() {
+
+	d.index = make(map[string]map[string]diskRef)
+	d.cache = make(map[string]map[string]potat)
+	d.users = make(map[string]bool)
+	if err := d.file.Truncate(0); err != nil {
+		log.Printf("disk storage: can't reset: %s", err)
+	}
+	d.file.Seek(0, io.SeekStart)
+	d.size, d.live = 0, 0
+}
+
+// flush writes cached objects to the data file, syncs it and empties the
+// cache. Must be called under storageMutex.
+func (d *diskStorage) flush() error {
+
+	for user, objects := range d.cache {
+		for key, val := range objects {
+			o, err := snapshotOf(user, key, val)
+			if err != nil {
+				return err
+			}
+			if err := d.write(diskRecord{Object: o}); err != nil {
+				return err
+			}
+		}
+	}
+	d.cache = make(map[string]map[string]potat)
+
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+
+	if d.size > 1<<20 && d.size > 2*d.live {
+		return d.compact()
+	}
+	return nil
+}
+
+// compact writes live records into a new data file and replaces the old one
+// with it. The cache must be empty.
+func (d *diskStorage) compact() error {
+
+	if len(d.cache) != 0 {
+		return errors.New("disk storage: compacting with cached objects")
+	}
+
+	file, err := os.Create(d.path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	old, index, size, live := d.file, d.index, d.size, d.live
+	d.file, d.index = file, make(map[string]map[string]diskRef)
+	d.size, d.live = 0, 0
+
+	for _, refs := range index {
+		for _, ref := range refs {
+			record, _, err := readDiskRecord(io.NewSectionReader(old, ref.offset, ref.size))
+			if err == nil {
+				err = d.write(record)
+			}
+			if err != nil {
+				file.Close()
+				d.file, d.index, d.size, d.live = old, index, size, live
+				return err
+			}
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(d.path+".tmp", d.path); err != nil {
+		return err
+	}
+	old.Close()
+
+	return nil
+}
+
+// close flushes and closes the data file.
+func (d *diskStorage) close() error {
+
+	err := d.flush()
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openDiskStorage puts the storage into the data file at DISKPATH, keys that
+// are already there are scheduled to expire.
+func (s *PotatoSlave) openDiskStorage() error {
+
+	d, err := openDiskStorage(s.DISKPATH)
+	if err != nil {
+		return err
+	}
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	s.storage = d
+	for _, user := range d.Users() {
+		d.Iterate(user, func(key string, val potat) bool {
+			s.scheduleObject(user, key, val)
+			return true
+		})
+	}
+
+	return nil
+}
+
+// closeDiskStorage flushes the disk storage and closes its data file.
+func (s *PotatoSlave) closeDiskStorage() {
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	if d, ok := s.storage.(*diskStorage); ok {
+		if err := d.close(); err != nil {
+			log.Printf("disk storage: close failed: %s", err)
+		}
+	}
+}
+
+// diskRoutine flushes the disk storage every DISKFLUSHINTERVAL until stopped
+// by someone.
+func (s *PotatoSlave) diskRoutine(d *diskStorage, shutdownChan chan bool) {
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.DISKFLUSHINTERVAL):
+		}
+
+		s.storageMutex.Lock()
+		err := d.flush()
+		s.storageMutex.Unlock()
+
+		if err != nil {
+			log.Printf("disk storage: flush failed: %s", err)
+			s.stats.add("disk_flush_errors", 1)
+		} else {
+			s.stats.add("disk_flushes", 1)
+		}
+	}
+}
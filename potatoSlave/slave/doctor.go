@@ -0,0 +1,145 @@
+package slave
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////
+// Doctor
+//////////
+
+// TODO: check the validity window of certificates once slaves speak TLS.
+
+// Finding is a result of a check of Doctor.
+type Finding struct {
+	// Level is "ok", "warning" or "error", a slave with errors shouldn't be
+	// started.
+	Level   string
+	Check   string
+	Message string
+}
+
+// Thresholds of Doctor.
+const (
+	doctorMinOpenFiles = 4096
+	doctorMinFreeBytes = 1 << 30
+	doctorMaxFsync     = time.Millisecond * 20
+	doctorMaxSkew      = time.Millisecond * 500
+)
+
+// Doctor checks the environment the slave is going to run in with its
+// configuration and returns what it found, see Finding.
+func (s *PotatoSlave) Doctor() []Finding {
+
+	var findings []Finding
+	findings = append(findings, s.checkPort())
+	findings = append(findings, checkOpenFiles())
+	for _, path := range []string{s.SNAPSHOTPATH, s.AOFPATH, s.DISKPATH} {
+		if path != "" {
+			findings = append(findings, checkDisk(filepath.Dir(path))...)
+		}
+	}
+	for _, peer := range []string{s.STANDBYOF, s.REPLICAOF} {
+		if peer != "" {
+			findings = append(findings, checkClock(peer))
+		}
+	}
+
+	return findings
+}
+
+func (s *PotatoSlave) checkPort() Finding {
+
+	listener, err := s.listen()
+	if err != nil {
+		return Finding{"error", "port", fmt.Sprintf("can't listen on %s: %s, stop what uses it or change PORT or BINDADDRS", strings.Join(append(s.bindAddrs(), s.tlsAddrs()...), ", "), err)}
+	}
+	listener.Close()
+	return Finding{"ok", "port", strings.Join(append(s.bindAddrs(), s.tlsAddrs()...), ", ") + " is free"}
+}
+
+// checkDisk writes and syncs a file in dir to see it's writable and how fast
+// it syncs, and how much space is left there.
+func checkDisk(dir string) []Finding {
+
+	check := "disk " + dir
+	f, err := ioutil.TempFile(dir, ".potato-doctor-")
+	if err != nil {
+		return []Finding{{"error", check, fmt.Sprintf("can't write there: %s", err)}}
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	start := time.Now()
+	_, err = f.Write(make([]byte, 4096))
+	if err == nil {
+		err = f.Sync()
+	}
+	took := time.Since(start)
+
+	var findings []Finding
+	switch {
+	case err != nil:
+		findings = append(findings, Finding{"error", check, fmt.Sprintf("can't sync a file there: %s", err)})
+	case took > doctorMaxFsync:
+		findings = append(findings, Finding{"warning", check, fmt.Sprintf("a sync took %s, every AOF write waits for one, use a faster disk", took)})
+	default:
+		findings = append(findings, Finding{"ok", check, fmt.Sprintf("a sync took %s", took)})
+	}
+
+	free, err := freeBytes(dir)
+	switch {
+	case err != nil:
+		findings = append(findings, Finding{"warning", check, fmt.Sprintf("can't tell free space: %s", err)})
+	case free < doctorMinFreeBytes:
+		findings = append(findings, Finding{"warning", check, fmt.Sprintf("only %d MB free, snapshots and the log may not fit", free>>20)})
+	default:
+		findings = append(findings, Finding{"ok", check, fmt.Sprintf("%d MB free", free>>20)})
+	}
+
+	return findings
+}
+
+func checkOpenFiles() Finding {
+
+	limit, err := openFilesLimit()
+	switch {
+	case err != nil:
+		return Finding{"warning", "open files", fmt.Sprintf("can't tell the limit: %s", err)}
+	case limit < doctorMinOpenFiles:
+		return Finding{"warning", "open files", fmt.Sprintf("the limit is %d, every client takes one, raise it with ulimit -n", limit)}
+	}
+	return Finding{"ok", "open files", fmt.Sprintf("the limit is %d", limit)}
+}
+
+// checkClock compares the clock of a peer with the local one, TTLs of
+// EXPIREAT and replication lag depend on both.
+func checkClock(peer string) Finding {
+
+	check := "clock " + peer
+	start := time.Now()
+	response, err := askNode(peer, CommandMessage{Name: "TIME"}, time.Second*2)
+	rtt := time.Since(start)
+	if err == nil && response.Code != _OK {
+		err = fmt.Errorf("%s", response.StatusMessage)
+	}
+	var remote int64
+	if err == nil {
+		remote, err = strconv.ParseInt(response.Value, 10, 64)
+	}
+	if err != nil {
+		return Finding{"warning", check, fmt.Sprintf("can't ask the peer for its time: %s", err)}
+	}
+
+	skew := time.Unix(0, remote).Sub(start.Add(rtt / 2))
+	if skew > doctorMaxSkew || skew < -doctorMaxSkew {
+		return Finding{"warning", check, fmt.Sprintf("clocks differ by %s, sync them with NTP", skew)}
+	}
+	return Finding{"ok", check, fmt.Sprintf("clocks differ by %s", skew)}
+}
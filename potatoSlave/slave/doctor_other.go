@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package slave
+
+import "errors"
+
+var errNotSupported = errors.New("not supported on this system")
+
+func openFilesLimit() (uint64, error) {
+	return 0, errNotSupported
+}
+
+func freeBytes(dir string) (uint64, error) {
+	return 0, errNotSupported
+}
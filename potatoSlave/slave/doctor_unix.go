@@ -0,0 +1,24 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package slave
+
+import "syscall"
+
+func openFilesLimit() (uint64, error) {
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return uint64(limit.Cur), nil
+}
+
+func freeBytes(dir string) (uint64, error) {
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,133 @@
+package slave
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+//////////
+// Value encryption
+//////////
+
+// EnableEncryption makes values under the given prefixes be stored encrypted
+// with AES-GCM. Each user gets his own key derived from masterKey, so a value
+// can only be decrypted for the user that owns it. Only strings, lists and
+// hashes are sealed, commands that write other types are refused under the
+// prefixes, see unsealedCommands.
+// Should be called before StartServing.
+func (s *PotatoSlave) EnableEncryption(masterKey []byte, prefixes []string) {
+	s.encryptionKey = masterKey
+	s.encryptedPrefixes = prefixes
+}
+
+// unsealedCommands write values that aren't sealed: members of sets and sorted
+// sets, counters, bitmaps, HyperLogLogs, streams and documents. They get _WT
+// on keys under encrypted prefixes instead of keeping the values there in
+// plain text, RESTORE checks the type of the dump itself.
+var unsealedCommands = map[string]bool{
+	"SADD":        true,
+	"SINTERSTORE": true,
+	"SUNIONSTORE": true,
+	"SDIFFSTORE":  true,
+	"ZADD":        true,
+	"ZINCRBY":     true,
+	"CINCR":       true,
+	"CDECR":       true,
+	"SETBIT":      true,
+	"PFADD":       true,
+	"PFMERGE":     true,
+	"XADD":        true,
+	"JSET":        true,
+}
+
+// isSealed tells if values of a type are sealed under encrypted prefixes, it
+// takes names of typeOf.
+func isSealed(kind string) bool {
+	return kind == "string" || kind == "list" || kind == "hash"
+}
+
+// isEncrypted checks if values of a key have to be encrypted.
+func (s *PotatoSlave) isEncrypted(key string) bool {
+
+	if len(s.encryptionKey) == 0 {
+		return false
+	}
+	for _, prefix := range s.encryptedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// userCipher creates an AEAD with a key that belongs to a user.
+func (s *PotatoSlave) userCipher(userID string) (cipher.AEAD, error) {
+
+	mac := hmac.New(sha256.New, s.encryptionKey)
+	mac.Write([]byte("potato-tenant:" + userID))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a value that is going to be stored at key, values of keys that
+// aren't covered by encrypted prefixes are returned as is. The ciphertext is
+// bound to the user and the key, so it can't be moved to another one.
+func (s *PotatoSlave) seal(userID string, key string, value string) string {
+
+	if !s.isEncrypted(key) {
+		return value
+	}
+
+	aead, err := s.userCipher(userID)
+	if err != nil {
+		panic(err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(userID+"\x00"+key))
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+// unseal decrypts a value that was stored at key by seal.
+func (s *PotatoSlave) unseal(userID string, key string, value string) (string, error) {
+
+	if !s.isEncrypted(key) {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := s.userCipher(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("de")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(userID+"\x00"+key))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
@@ -0,0 +1,145 @@
+package slave
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+//////////
+// Tenant data erasure
+//////////
+
+// ErasureReport describes what was erased by an ERASEUSER command. If the
+// slave has REPORTKEY set, the report is signed with HMAC-SHA256 over the
+// rest of its fields.
+// Erased values stay in the append-only log until it's rewritten and in the
+// snapshot until the next one is saved.
+// TODO: once there are replicas and shards, erasure has to reach them too and
+// be listed in the report.
+type ErasureReport struct {
+	User      string
+	Node      string
+	Keys      []string
+	ErasedAt  time.Time
+	Signature string
+	// Cancelled is set if erasure was run as a job and cancelled before all
+	// the keys were erased, Keys has only the erased ones then.
+	Cancelled bool `json:",omitempty"`
+}
+
+// sign computes a signature of the report.
+func (r ErasureReport) sign(key []byte) string {
+
+	r.Signature = ""
+	body, _ := json.Marshal(r)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyErasureReport checks that the report was signed with key and wasn't
+// changed afterwards.
+func VerifyErasureReport(r ErasureReport, key []byte) bool {
+	return hmac.Equal([]byte(r.Signature), []byte(r.sign(key)))
+}
+
+// eraseuser deletes every key of the user given in arguments and returns an
+// ErasureReport as JSON.
+func (s *PotatoSlave) eraseuser(userID string, mes CommandMessage) ResponseMessage {
+	return s.eraseUserJob(nil, userID, mes)
+}
+
+// eraseUserJob is eraseuser that can run as a job. Without a job everything is
+// erased at once, with a job keys are erased in batches of STREAMBATCH and the
+// lock is released between them, so the slave keeps serving and the job can
+// be cancelled. Keys written during the job are not erased.
+func (s *PotatoSlave) eraseUserJob(j *job, userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	report := ErasureReport{
+		User: mes.Arguments[0],
+		Node: s.advertised(),
+		Keys: []string{},
+	}
+
+	s.storageMutex.Lock()
+
+	ok := s.storage.HasUser(report.User)
+	var keys []string
+	if ok {
+		s.storage.Iterate(report.User, func(key string, _ potat) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}
+	if ok && j == nil {
+		// The user itself is kept as he could still be connected
+		for _, key := range keys {
+			s.storage.Delete(report.User, key)
+		}
+		report.Keys = append(report.Keys, keys...)
+		keys = nil
+		delete(s.aggregations, report.User)
+	}
+
+	s.storageMutex.Unlock()
+
+	if !ok {
+		setStatus(&response, _NK)
+		return response
+	}
+
+	for start := 0; start < len(keys); start += s.STREAMBATCH {
+
+		if j.cancelled() {
+			report.Cancelled = true
+			break
+		}
+
+		end := start + s.STREAMBATCH
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		unlock := s.lockWrite()
+		s.storageMutex.Lock()
+		for _, key := range keys[start:end] {
+			if s.saving != nil {
+				s.saving.copyPending(s, report.User, key)
+			}
+			s.storage.Delete(report.User, key)
+			s.reconcile(report.User, key)
+		}
+		s.storageMutex.Unlock()
+		// Cancelled jobs erase only a part, so batches are logged as they are
+		for _, key := range keys[start:end] {
+			s.logWrite(report.User, CommandMessage{Name: "DEL", Arguments: []string{key}})
+		}
+		unlock()
+
+		report.Keys = append(report.Keys, keys[start:end]...)
+		j.setProgress(end, len(keys))
+	}
+
+	report.ErasedAt = time.Now().UTC()
+	if len(s.REPORTKEY) != 0 {
+		report.Signature = report.sign(s.REPORTKEY)
+	}
+
+	body, _ := json.Marshal(report)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
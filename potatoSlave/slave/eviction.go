@@ -0,0 +1,156 @@
+package slave
+
+import "sync"
+
+//////////
+// Eviction
+//////////
+
+// UserKey is a key of a user.
+type UserKey struct {
+	User string
+	Key  string
+}
+
+// EvictionPolicy chooses keys to evict once there are more than MAXKEYS
+// of them. The slave tells it about reads and writes of existing keys and
+// about keys that are gone. A policy may still suggest keys that are already
+// gone, e. g. expired ones, they are skipped and passed to OnDelete.
+type EvictionPolicy interface {
+	// OnAccess is called after a command reads a key.
+	OnAccess(k UserKey)
+	// OnWrite is called after a command writes a key, with the estimated
+	// size of its object in bytes.
+	OnWrite(k UserKey, size int64)
+	// OnDelete is called for a key that was deleted or evicted.
+	OnDelete(k UserKey)
+	// PickVictims returns up to n keys that should be evicted first.
+	PickVictims(n int) []UserKey
+}
+
+// sampledLRU is the default policy: for every victim it takes a few random
+// keys and evicts the one used least recently of them, like Redis does. It's
+// safe for concurrent use.
+type sampledLRU struct {
+	mu      sync.Mutex
+	samples int
+	clock   uint64
+	used    map[UserKey]uint64
+}
+
+// NewSampledLRU makes a policy that picks every victim out of samples random
+// keys, more samples are closer to a true LRU and slower.
+func NewSampledLRU(samples int) EvictionPolicy {
+
+	if samples < 1 {
+		samples = 1
+	}
+	return &sampledLRU{samples: samples, used: make(map[UserKey]uint64)}
+}
+
+func (p *sampledLRU) touch(k UserKey) {
+
+	p.mu.Lock()
+	p.clock++
+	p.used[k] = p.clock
+	p.mu.Unlock()
+}
+
+func (p *sampledLRU) OnAccess(k UserKey) {
+	p.touch(k)
+}
+
+func (p *sampledLRU) OnWrite(k UserKey, size int64) {
+	p.touch(k)
+}
+
+func (p *sampledLRU) OnDelete(k UserKey) {
+
+	p.mu.Lock()
+	delete(p.used, k)
+	p.mu.Unlock()
+}
+
+// PickVictims relies on the random order of map iteration for sampling.
+func (p *sampledLRU) PickVictims(n int) []UserKey {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	picked := make(map[UserKey]bool, n)
+	victims := make([]UserKey, 0, n)
+	for len(victims) < n && len(victims) < len(p.used) {
+		var victim UserKey
+		var oldest uint64
+		found, sampled := false, 0
+		for k, used := range p.used {
+			if picked[k] {
+				continue
+			}
+			if !found || used < oldest {
+				victim, oldest, found = k, used, true
+			}
+			if sampled++; sampled == p.samples {
+				break
+			}
+		}
+		picked[victim] = true
+		victims = append(victims, victim)
+	}
+
+	return victims
+}
+
+// keyCount is how many keys all the users have. Should be called under
+// storageMutex.
+func (s *PotatoSlave) keyCount() int {
+
+	n := 0
+	for _, user := range s.storage.Users() {
+		n += s.storage.Len(user)
+	}
+	return n
+}
+
+// tellEviction passes a command on the key to EVICTION. Should be called under
+// storageMutex.
+func (s *PotatoSlave) tellEviction(userID string, key string, write bool) {
+
+	k := UserKey{User: userID, Key: key}
+	val := s.storage.Get(userID, key)
+	switch {
+	case val == nil:
+		s.EVICTION.OnDelete(k)
+	case write:
+		s.EVICTION.OnWrite(k, sizeOf(key, val))
+	default:
+		s.EVICTION.OnAccess(k)
+	}
+}
+
+// evict deletes keys picked by EVICTION until there are at most MAXKEYS of
+// them. It gives up when a round evicts nothing, the next write tries again.
+// Should be called under storageMutex.
+// TODO: evictions aren't written to the append-only log, a replay evicts the
+// same way only as long as the policy is deterministic.
+func (s *PotatoSlave) evict() {
+
+	over := s.keyCount() - s.MAXKEYS
+	for over > 0 {
+		evicted := 0
+		for _, k := range s.EVICTION.PickVictims(over) {
+			if s.storage.Get(k.User, k.Key) != nil {
+				s.storage.Delete(k.User, k.Key)
+				s.reconcile(k.User, k.Key)
+				s.deltas.mark(k.User, k.Key)
+				evicted++
+			}
+			s.EVICTION.OnDelete(k)
+		}
+		if evicted == 0 {
+			return
+		}
+		s.stats.add("evicted_keys", int64(evicted))
+		over -= evicted
+	}
+}
@@ -0,0 +1,282 @@
+package slave
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// neverDies is the time of death of keys without expiration. The zero time
+// can't be used for it as ttlCheckRoutine would delete such keys at once.
+var neverDies = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// live returns the object stored at the key or nil if there is none. Objects
+// that are already dead are deleted right away, so reads don't depend on when
+// ttlCheckRoutine runs. Must be called under storageMutex or lockUser.
+func (s *PotatoSlave) live(userID string, key string) potat {
+
+	val := s.storage.Get(userID, key)
+	if val == nil {
+		return nil
+	}
+
+	if !val.getTimeOfDeath().After(time.Now()) {
+		s.storage.Delete(userID, key)
+		s.reconcile(userID, key)
+		s.notifyExpired(userID, key)
+		s.stats.add("expired_on_read", 1)
+		return nil
+	}
+
+	return val
+}
+
+// forever is the TTL of keys that never expire, deathAfter turns it into
+// neverDies. A negative TTL in a CommandMessage asks for it.
+const forever = time.Duration(math.MaxInt64)
+
+// deathAfter returns the time of death of a key written now with ttl.
+func deathAfter(ttl time.Duration) time.Time {
+
+	if ttl == forever {
+		return neverDies
+	}
+	return time.Now().Add(ttl)
+}
+
+// jitter shortens ttl by a random part of up to percent of it. DEFAULTTTL is
+// jittered if ttl is 0, keys that never expire are left as they are.
+func (s *PotatoSlave) jitter(ttl time.Duration, percent int) time.Duration {
+
+	if ttl == 0 {
+		ttl = s.DEFAULTTTL
+	}
+	if ttl < 0 {
+		return ttl
+	}
+
+	spread := int64(ttl) / 100 * int64(percent)
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Int63n(spread+1))
+}
+
+//// Expiration functions
+
+// expireCommand makes EXPIRE and PEXPIRE, they differ only in the unit of the
+// ttl argument.
+func (s *PotatoSlave) expireCommand(unit time.Duration) func(string, CommandMessage) ResponseMessage {
+
+	return func(userID string, mes CommandMessage) ResponseMessage {
+
+		var response ResponseMessage
+
+		if len(mes.Arguments) != 2 {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		n, err := strconv.ParseInt(mes.Arguments[1], 10, 64)
+		if err != nil || n <= 0 || n > int64(neverDies.Sub(time.Now())/unit) {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		ttl := s.ttlFor(mes.Arguments[0], time.Duration(n)*unit)
+
+		s.storageMutex.Lock()
+		if val := s.live(userID, mes.Arguments[0]); val != nil {
+			val.setTimeOfDeath(deathAfter(ttl))
+			setStatus(&response, _OK)
+		} else {
+			setStatus(&response, _NK)
+		}
+		s.storageMutex.Unlock()
+
+		return response
+	}
+}
+
+// expireatCommand makes EXPIREAT and PEXPIREAT that take a unix timestamp in
+// seconds or milliseconds. A key with a timestamp in the past is deleted.
+func (s *PotatoSlave) expireatCommand(unit time.Duration) func(string, CommandMessage) ResponseMessage {
+
+	return func(userID string, mes CommandMessage) ResponseMessage {
+
+		var response ResponseMessage
+
+		if len(mes.Arguments) != 2 {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		n, err := strconv.ParseInt(mes.Arguments[1], 10, 64)
+		if err != nil || n < 0 || n > math.MaxInt64/int64(unit) {
+			setStatus(&response, _WA)
+			return response
+		}
+		death := time.Unix(0, n*int64(unit))
+
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
+
+		val := s.live(userID, mes.Arguments[0])
+		if val == nil {
+			setStatus(&response, _NK)
+			return response
+		}
+
+		if max := s.maxTTLFor(mes.Arguments[0]); max != 0 && death.After(time.Now().Add(max)) {
+			death = time.Now().Add(max)
+		}
+
+		if death.After(time.Now()) {
+			val.setTimeOfDeath(death)
+		} else {
+			s.storage.Delete(userID, mes.Arguments[0])
+		}
+		setStatus(&response, _OK)
+
+		return response
+	}
+}
+
+// persist removes the expiration of a key. Retention rules still apply to
+// it on their next check.
+func (s *PotatoSlave) persist(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+		val.setTimeOfDeath(neverDies)
+		setStatus(&response, _OK)
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
+
+	return response
+}
+
+// ttlCommand makes TTL and PTTL which return time left until a key expires
+// in seconds or milliseconds, "-1" if it never expires.
+func (s *PotatoSlave) ttlCommand(unit time.Duration) func(string, CommandMessage) ResponseMessage {
+
+	return func(userID string, mes CommandMessage) ResponseMessage {
+
+		var response ResponseMessage
+
+		if len(mes.Arguments) != 1 {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		s.storageMutex.Lock()
+		val := s.live(userID, mes.Arguments[0])
+		var death time.Time
+		if val != nil {
+			death = val.getTimeOfDeath()
+		}
+		s.storageMutex.Unlock()
+
+		left := time.Until(death)
+		switch {
+		case val == nil:
+			setStatus(&response, _NK)
+		case death.Equal(neverDies):
+			response.Value = "-1"
+			setStatus(&response, _OK)
+		default:
+			response.Value = strconv.FormatInt(int64((left+unit/2)/unit), 10)
+			setStatus(&response, _OK)
+		}
+
+		return response
+	}
+}
+
+// expireprefix sets a TTL in seconds for every key of the user under a prefix
+// and returns the number of changed keys.
+// TODO: there is no index of keys yet, so all the keys of the user are scanned.
+func (s *PotatoSlave) expireprefix(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	n, err := strconv.ParseInt(mes.Arguments[1], 10, 64)
+	if err != nil || n <= 0 || n > int64(neverDies.Sub(time.Now())/time.Second) {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	changed := s.setPrefixDeath(userID, mes.Arguments[0], func(key string) time.Time {
+		ttl := time.Duration(n) * time.Second
+		if max := s.maxTTLFor(key); max != 0 && ttl > max {
+			ttl = max
+		}
+		return deathAfter(ttl)
+	})
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.Itoa(changed)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// persistprefix removes expiration of every key of the user under a prefix
+// and returns the number of changed keys.
+func (s *PotatoSlave) persistprefix(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	changed := s.setPrefixDeath(userID, mes.Arguments[0], func(string) time.Time {
+		return neverDies
+	})
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.Itoa(changed)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// setPrefixDeath sets time of death given by death for every live key under
+// the prefix, must be called under storageMutex.
+func (s *PotatoSlave) setPrefixDeath(userID string, prefix string, death func(string) time.Time) int {
+
+	changed := 0
+	s.storage.Iterate(userID, func(key string, _ potat) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		if s.live(userID, key) != nil {
+			s.storage.Expire(userID, key, death(key))
+			s.schedule(userID, key)
+			changed++
+		}
+		return true
+	})
+
+	return changed
+}
@@ -0,0 +1,116 @@
+package slave
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+//////////
+// CSV export
+//////////
+
+// exportTables lists columns of every CSV file produced by ExportCSV, there's a
+// file per type of stored objects.
+var exportTables = map[string][]string{
+	"strings":        {"user", "key", "value", "time_of_death"},
+	"lists":          {"user", "key", "index", "value", "time_of_death"},
+	"hashes":         {"user", "key", "field", "value", "field_time_of_death", "time_of_death"},
+	"sets":           {"user", "key", "member", "time_of_death"},
+	"zsets":          {"user", "key", "member", "score", "time_of_death"},
+	"counters":       {"user", "key", "value", "time_of_death"},
+	"bitmaps":        {"user", "key", "hex", "time_of_death"},
+	"approx":         {"user", "key", "registers_hex", "time_of_death"},
+	"streams":        {"user", "key", "id", "value", "time_of_death"},
+	"stream_offsets": {"user", "key", "consumer", "last_read_id"},
+	"json":           {"user", "key", "document", "time_of_death"},
+}
+
+// ExportCSV writes contents of the storage to dir as a set of CSV files, one
+// per type. Encrypted values are written as they are stored.
+// TODO: it should be run against a loaded snapshot rather than a live slave,
+// and Parquet output would be nice to have as well.
+func (s *PotatoSlave) ExportCSV(dir string) error {
+
+	writers := make(map[string]*csv.Writer)
+	for table, columns := range exportTables {
+
+		f, err := os.Create(filepath.Join(dir, table+".csv"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		writers[table] = csv.NewWriter(f)
+		writers[table].Write(columns)
+	}
+
+	s.storageMutex.Lock()
+
+	for _, user := range s.storage.Users() {
+		s.storage.Iterate(user, func(key string, val potat) bool {
+
+			death := formatTime(val.getTimeOfDeath())
+
+			switch v := val.(type) {
+			case *pstring:
+				writers["strings"].Write([]string{user, key, v.content, death})
+			case *plist:
+				for i, el := range v.list {
+					writers["lists"].Write([]string{user, key, strconv.Itoa(i), el, death})
+				}
+			case *pmap:
+				for field, el := range v.ourmap {
+					fieldDeath := ""
+					if t, ok := v.fieldDeath[field]; ok {
+						fieldDeath = formatTime(t)
+					}
+					writers["hashes"].Write([]string{user, key, field, el, fieldDeath, death})
+				}
+			case *pset:
+				for member := range v.members {
+					writers["sets"].Write([]string{user, key, member, death})
+				}
+			case *pzset:
+				for _, m := range v.ordered {
+					writers["zsets"].Write([]string{user, key, m.member, strconv.FormatFloat(m.score, 'g', -1, 64), death})
+				}
+			case *pcounter:
+				writers["counters"].Write([]string{user, key, strconv.FormatInt(v.value, 10), death})
+			case *pbitmap:
+				writers["bitmaps"].Write([]string{user, key, hex.EncodeToString(v.bits), death})
+			case *papprox:
+				writers["approx"].Write([]string{user, key, hex.EncodeToString(v.registers), death})
+			case *pjson:
+				document, _ := v.getContent("$")
+				writers["json"].Write([]string{user, key, document, death})
+			case *pstream:
+				for _, e := range v.entries {
+					writers["streams"].Write([]string{user, key, strconv.FormatUint(e.id, 10), e.value, death})
+				}
+				for consumer, id := range v.offsets {
+					writers["stream_offsets"].Write([]string{user, key, consumer, strconv.FormatUint(id, 10)})
+				}
+			}
+			return true
+		})
+	}
+
+	s.storageMutex.Unlock()
+
+	for _, w := range writers {
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
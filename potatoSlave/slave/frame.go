@@ -0,0 +1,313 @@
+package slave
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+//////////
+// Binary framing
+//////////
+
+// A client that sends framePreamble first speaks frames instead of JSON, the
+// slave answers with the preamble too. A frame is a 4 byte big-endian length
+// and a message of fields. A field is a uvarint key, the number of the field
+// shifted by 3 with the wire type in the low bits, and a value: a uvarint for
+// wireVarint, a uvarint length and bytes for wireBytes. Missing fields are
+// zero, Arguments is a repeated field, signed numbers are zigzag encoded and
+// fields of unknown numbers are skipped, so the format can grow.
+const framePreamble = "\x00PTB1"
+
+// maxFrame is the largest frame a client may send. framePrealloc of it is
+// allocated when its length comes, the rest as its bytes arrive, so lengths
+// alone can't take the memory.
+const (
+	maxFrame      = 512 << 20
+	framePrealloc = 64 << 10
+)
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Field numbers of CommandMessage
+const (
+	fieldName = iota + 1
+	fieldArguments
+	fieldTTL
+	fieldStream
+	fieldBinary
+	fieldAsync
+	fieldTTLJitter
+	fieldIdempotencyKey
+	fieldAfter
+	fieldSeq
+	fieldProtocol
+	fieldRequestID
+)
+
+// Field numbers of ResponseMessage
+const (
+	fieldCode = iota + 1
+	fieldStatusMessage
+	fieldValue
+	fieldMore
+	fieldResponseBinary
+	fieldToken
+	fieldNil
+	fieldClamped
+	fieldLag
+	fieldResponseRequestID
+)
+
+var errMalformedFrame = errors.New("malformed frame")
+
+// frameWriter builds a message.
+type frameWriter struct {
+	b []byte
+}
+
+func (w *frameWriter) uvarint(field uint64, v uint64) {
+
+	if v == 0 {
+		return
+	}
+	w.b = appendUvarint(w.b, field<<3|wireVarint)
+	w.b = appendUvarint(w.b, v)
+}
+
+func (w *frameWriter) varint(field uint64, v int64) {
+	w.uvarint(field, uint64(v<<1)^uint64(v>>63))
+}
+
+func (w *frameWriter) flag(field uint64, v bool) {
+
+	if v {
+		w.uvarint(field, 1)
+	}
+}
+
+func (w *frameWriter) bytes(field uint64, v string) {
+
+	w.b = appendUvarint(w.b, field<<3|wireBytes)
+	w.b = appendUvarint(w.b, uint64(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *frameWriter) str(field uint64, v string) {
+
+	if v != "" {
+		w.bytes(field, v)
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// readFields calls f for every field of a message, with the number for a
+// varint or the bytes.
+func readFields(b []byte, f func(field uint64, n uint64, s string)) error {
+
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		if k <= 0 {
+			return errMalformedFrame
+		}
+		b = b[k:]
+		n, k := binary.Uvarint(b)
+		if k <= 0 {
+			return errMalformedFrame
+		}
+		b = b[k:]
+
+		switch key & 7 {
+		case wireVarint:
+			f(key>>3, n, "")
+		case wireBytes:
+			if n > uint64(len(b)) {
+				return errMalformedFrame
+			}
+			f(key>>3, 0, string(b[:n]))
+			b = b[n:]
+		default:
+			return errMalformedFrame
+		}
+	}
+	return nil
+}
+
+func unzigzag(n uint64) int64 {
+	return int64(n>>1) ^ -int64(n&1)
+}
+
+func encodeCommand(mes CommandMessage) []byte {
+
+	var w frameWriter
+	w.str(fieldName, mes.Name)
+	for _, arg := range mes.Arguments {
+		w.bytes(fieldArguments, arg)
+	}
+	w.varint(fieldTTL, int64(mes.TTL))
+	w.flag(fieldStream, mes.Stream)
+	w.flag(fieldBinary, mes.Binary)
+	w.flag(fieldAsync, mes.Async)
+	w.varint(fieldTTLJitter, int64(mes.TTLJitter))
+	w.str(fieldIdempotencyKey, mes.IdempotencyKey)
+	w.str(fieldAfter, mes.After)
+	w.uvarint(fieldSeq, mes.Seq)
+	w.uvarint(fieldProtocol, uint64(mes.Protocol))
+	w.uvarint(fieldRequestID, mes.RequestID)
+	return w.b
+}
+
+func decodeCommand(b []byte) (CommandMessage, error) {
+
+	var mes CommandMessage
+	err := readFields(b, func(field uint64, n uint64, s string) {
+		switch field {
+		case fieldName:
+			mes.Name = s
+		case fieldArguments:
+			mes.Arguments = append(mes.Arguments, s)
+		case fieldTTL:
+			mes.TTL = time.Duration(unzigzag(n))
+		case fieldStream:
+			mes.Stream = n != 0
+		case fieldBinary:
+			mes.Binary = n != 0
+		case fieldAsync:
+			mes.Async = n != 0
+		case fieldTTLJitter:
+			mes.TTLJitter = int(unzigzag(n))
+		case fieldIdempotencyKey:
+			mes.IdempotencyKey = s
+		case fieldAfter:
+			mes.After = s
+		case fieldSeq:
+			mes.Seq = n
+		case fieldProtocol:
+			mes.Protocol = uint(n)
+		case fieldRequestID:
+			mes.RequestID = n
+		}
+	})
+	return mes, err
+}
+
+func encodeResponse(response ResponseMessage) []byte {
+
+	var w frameWriter
+	w.uvarint(fieldCode, uint64(response.Code))
+	w.str(fieldStatusMessage, response.StatusMessage)
+	w.str(fieldValue, response.Value)
+	w.flag(fieldMore, response.More)
+	w.flag(fieldResponseBinary, response.Binary)
+	w.str(fieldToken, response.Token)
+	w.flag(fieldNil, response.Nil)
+	w.flag(fieldClamped, response.Clamped)
+	w.varint(fieldLag, int64(response.Lag))
+	w.uvarint(fieldResponseRequestID, response.RequestID)
+	return w.b
+}
+
+func decodeResponse(b []byte) (ResponseMessage, error) {
+
+	var response ResponseMessage
+	err := readFields(b, func(field uint64, n uint64, s string) {
+		switch field {
+		case fieldCode:
+			response.Code = uint(n)
+		case fieldStatusMessage:
+			response.StatusMessage = s
+		case fieldValue:
+			response.Value = s
+		case fieldMore:
+			response.More = n != 0
+		case fieldResponseBinary:
+			response.Binary = n != 0
+		case fieldToken:
+			response.Token = s
+		case fieldNil:
+			response.Nil = n != 0
+		case fieldClamped:
+			response.Clamped = n != 0
+		case fieldLag:
+			response.Lag = time.Duration(unzigzag(n))
+		case fieldResponseRequestID:
+			response.RequestID = n
+		}
+	})
+	return response, err
+}
+
+// messageDecoder and messageEncoder are what a connection is served with,
+// json.Decoder and json.Encoder or a frameCodec.
+type messageDecoder interface {
+	Decode(v interface{}) error
+}
+
+type messageEncoder interface {
+	Encode(v interface{}) error
+}
+
+// frameCodec reads commands and writes responses in frames, it has the
+// methods of json.Decoder and json.Encoder that serving needs.
+type frameCodec struct {
+	reader *bufio.Reader
+	conn   net.Conn
+}
+
+func (c *frameCodec) Decode(v interface{}) error {
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrame {
+		return errMalformedFrame
+	}
+	b, err := readAtMost(c.reader, int(n), framePrealloc)
+	if err != nil {
+		return err
+	}
+
+	mes, err := decodeCommand(b)
+	if err != nil {
+		return err
+	}
+	*v.(*CommandMessage) = mes
+	return nil
+}
+
+func (c *frameCodec) Encode(v interface{}) error {
+
+	body := encodeResponse(v.(ResponseMessage))
+	frame := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	_, err := c.conn.Write(append(frame, body...))
+	return err
+}
+
+// framed tells if the client on a connection asks for frames and answers it
+// if it does. JSON never starts with a zero byte.
+func framed(connection net.Conn, reader *bufio.Reader) bool {
+
+	if b, err := reader.Peek(1); err != nil || b[0] != framePreamble[0] {
+		return false
+	}
+	if b, err := reader.Peek(len(framePreamble)); err != nil || string(b) != framePreamble {
+		return false
+	}
+	reader.Discard(len(framePreamble))
+	_, err := connection.Write([]byte(framePreamble))
+	return err == nil
+}
@@ -0,0 +1,303 @@
+package slave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////////
+// Gossip
+//////////
+
+// TODO: the master still learns slaves from REGISTER, it could ask any of
+// them for MEMBERS instead.
+
+// Member is a slave as the gossip knows it. Heartbeat is counted by the slave
+// itself, a member is alive while it keeps growing. Shard is the address of
+// the primary whose keys the member has, its own one for a primary.
+type Member struct {
+	Addr      string
+	Heartbeat uint64
+	Role      string
+	Shard     string
+	// Alive is what this slave thinks, it isn't gossiped
+	Alive bool `json:",omitempty"`
+}
+
+// membership is what a slave knows about the others. seen is when the
+// heartbeat of a member grew last by the local clock, so clocks of the
+// members don't matter.
+type membership struct {
+	mutex   sync.Mutex
+	members map[string]*Member
+	seen    map[string]time.Time
+	// seeds are the addresses SEEDSNAME resolved to last
+	seeds []string
+}
+
+// seedResolver is what seeds are looked up with, *net.Resolver is one.
+type seedResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// heartbeat returns the member of the slave itself in members. Should be
+// called under mutex.
+func (g *membership) heartbeat(addr string) *Member {
+
+	if g.members == nil {
+		g.members = make(map[string]*Member)
+		g.seen = make(map[string]time.Time)
+	}
+	if g.members[addr] == nil {
+		g.members[addr] = &Member{Addr: addr}
+	}
+	return g.members[addr]
+}
+
+// self is the member of the slave itself.
+func (s *PotatoSlave) self() Member {
+
+	m := Member{Addr: s.advertised(), Role: "primary"}
+	m.Shard = m.Addr
+	if s.isReplica() {
+		m.Role = "replica"
+		m.Shard = s.REPLICAOF
+	}
+	return m
+}
+
+// gossipState is every member that isn't forgotten with the slave itself first.
+func (s *PotatoSlave) gossipState() []Member {
+
+	g := &s.gossip
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	me := s.self()
+	g.heartbeat(me.Addr).Heartbeat++
+	me.Heartbeat = g.heartbeat(me.Addr).Heartbeat
+
+	state := []Member{me}
+	for addr, m := range g.members {
+		if addr != me.Addr {
+			state = append(state, Member{Addr: m.Addr, Heartbeat: m.Heartbeat, Role: m.Role, Shard: m.Shard})
+		}
+	}
+	return state
+}
+
+// mergeGossip takes what another member knows, newer heartbeats win. Members
+// not heard of for 10 PEERTIMEOUT are forgotten.
+func (s *PotatoSlave) mergeGossip(state []Member) {
+
+	g := &s.gossip
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	me := s.advertised()
+	g.heartbeat(me)
+	now := time.Now()
+	for _, m := range state {
+		if m.Addr == "" || m.Addr == me {
+			continue
+		}
+		known, ok := g.members[m.Addr]
+		if !ok || m.Heartbeat > known.Heartbeat {
+			m := m
+			m.Alive = false
+			g.members[m.Addr] = &m
+			g.seen[m.Addr] = now
+		}
+	}
+	for addr, seen := range g.seen {
+		if now.Sub(seen) > s.PEERTIMEOUT*10 {
+			delete(g.members, addr)
+			delete(g.seen, addr)
+		}
+	}
+}
+
+// gossipcommand is GOSSIP state, state is a JSON array of members the sender
+// knows. The slave merges it and answers with what it knows.
+func (s *PotatoSlave) gossipcommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	var state []Member
+	if len(mes.Arguments) != 1 || json.Unmarshal([]byte(mes.Arguments[0]), &state) != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+	s.mergeGossip(state)
+
+	body, _ := json.Marshal(s.gossipState())
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// members is MEMBERS, every known member sorted by address as JSON. A member
+// whose heartbeat hasn't grown for PEERTIMEOUT isn't Alive.
+func (s *PotatoSlave) members(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	g := &s.gossip
+	g.mutex.Lock()
+	me := s.self()
+	members := []Member{me}
+	members[0].Heartbeat = g.heartbeat(me.Addr).Heartbeat
+	members[0].Alive = true
+	for addr, m := range g.members {
+		if addr != me.Addr {
+			m := *m
+			m.Alive = time.Since(g.seen[addr]) <= s.PEERTIMEOUT
+			members = append(members, m)
+		}
+	}
+	g.mutex.Unlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	body, _ := json.Marshal(members)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// alivePeers are the members other than the slave itself that are alive.
+func (s *PotatoSlave) alivePeers() []string {
+
+	g := &s.gossip
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	me := s.advertised()
+	var alive []string
+	for addr := range g.members {
+		if addr != me && time.Since(g.seen[addr]) <= s.PEERTIMEOUT {
+			alive = append(alive, addr)
+		}
+	}
+	return alive
+}
+
+// lookupSeeds resolves SEEDSNAME: its SRV records if there are any, otherwise
+// its A records with the port of the slave.
+func (s *PotatoSlave) lookupSeeds() ([]string, error) {
+
+	resolver := s.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.GOSSIPINTERVAL)
+	defer cancel()
+
+	var addrs []string
+	if _, records, err := resolver.LookupSRV(ctx, "", "", s.SEEDSNAME); err == nil {
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(r.Target, strconv.Itoa(int(r.Port))))
+		}
+	}
+
+	if len(addrs) == 0 {
+		hosts, err := resolver.LookupHost(ctx, s.SEEDSNAME)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, s.port))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no seeds found for " + s.SEEDSNAME)
+	}
+	return addrs, nil
+}
+
+// seedAddrs are the seeds of the gossip. SEEDSNAME is looked up again each
+// time, if it doesn't resolve the addresses it resolved to last are used, or
+// SEEDS if it never did.
+func (s *PotatoSlave) seedAddrs() []string {
+
+	if s.SEEDSNAME == "" {
+		return s.SEEDS
+	}
+
+	g := &s.gossip
+	addrs, err := s.lookupSeeds()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("gossip: seeds: %s", err)
+		s.stats.add("seed_lookup_errors", 1)
+		if g.seeds != nil {
+			return g.seeds
+		}
+		return s.SEEDS
+	}
+	g.seeds = addrs
+	return addrs
+}
+
+// gossipPeer picks a random member that is alive, or a random seed if none
+// is.
+func (s *PotatoSlave) gossipPeer() string {
+
+	alive := s.alivePeers()
+	if len(alive) == 0 {
+		alive = s.seedAddrs()
+	}
+	if len(alive) == 0 {
+		return ""
+	}
+	return alive[rand.Intn(len(alive))]
+}
+
+// gossipRoutine exchanges what the slave knows with a random peer every
+// GOSSIPINTERVAL until stopped by someone.
+func (s *PotatoSlave) gossipRoutine(shutdownChan chan bool) {
+
+	for {
+		if peer := s.gossipPeer(); peer != "" {
+			body, _ := json.Marshal(s.gossipState())
+			response, err := askNode(peer, CommandMessage{Name: "GOSSIP", Arguments: []string{string(body)}}, s.GOSSIPINTERVAL)
+			if err == nil && response.Code != _OK {
+				err = errors.New(response.StatusMessage)
+			}
+			var state []Member
+			if err == nil {
+				err = json.Unmarshal([]byte(response.Value), &state)
+			}
+			if err != nil {
+				log.Printf("gossip: %s: %s", peer, err)
+				s.stats.add("gossip_errors", 1)
+			}
+			s.mergeGossip(state)
+		}
+
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.GOSSIPINTERVAL):
+		}
+	}
+}
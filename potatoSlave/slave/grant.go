@@ -0,0 +1,235 @@
+package slave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+//////////
+// Grants
+//////////
+
+// TODO: RESP has no USE yet, Redis clients only read their own keys.
+
+// keyGrant lets User read the keys of the keyspace Owner under Prefix with
+// sharedCommands, after USE Owner.
+type keyGrant struct {
+	Owner  string
+	Prefix string
+	User   string
+}
+
+// LoadGrants reads grants saved to GRANTSPATH, a missing file has none.
+func (s *PotatoSlave) LoadGrants(path string) error {
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var grants []keyGrant
+	if err := json.Unmarshal(body, &grants); err != nil {
+		return err
+	}
+
+	s.users.mutex.Lock()
+	s.users.grants = grants
+	s.users.mutex.Unlock()
+	return nil
+}
+
+// saveGrants writes grants to GRANTSPATH, must be called under the mutex of
+// users. Without GRANTSPATH they live until the slave stops.
+func (s *PotatoSlave) saveGrants() error {
+
+	if s.GRANTSPATH == "" {
+		return nil
+	}
+	body, _ := json.Marshal(s.users.grants)
+
+	tmp := s.GRANTSPATH + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.GRANTSPATH)
+}
+
+// ownKeyspace is the keyspace of the logged in user.
+func (sess *session) ownKeyspace() string {
+
+	if sess.acl != nil && sess.acl.Keyspace != "" {
+		return sess.acl.Keyspace
+	}
+	return sess.login
+}
+
+// grantedReads are the reads a grant allows besides sharedCommands, they read
+// every key in their arguments.
+var grantedReads = map[string]bool{
+	"PFCOUNT": true,
+}
+
+// granted tells if a session that uses a keyspace of another user may run a
+// command there: a read of sharedCommands or grantedReads, every key of which
+// is under a prefix granted to the user. Prefixes and ReadOnly of the user
+// don't matter there, Commands does.
+func (s *PotatoSlave) granted(sess *session, mes CommandMessage) bool {
+
+	if !sharedCommands[mes.Name] && !grantedReads[mes.Name] {
+		return false
+	}
+	if sess.acl != nil && len(sess.acl.Commands) != 0 && !containsString(sess.acl.Commands, mes.Name) {
+		return false
+	}
+	keys := commandKeys(mes)
+	if len(keys) == 0 {
+		return false
+	}
+
+	s.users.mutex.Lock()
+	defer s.users.mutex.Unlock()
+
+	for _, key := range keys {
+		if !s.grantCovers(sess, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// grantCovers tells if a key of the keyspace a session uses is under a prefix
+// granted to its user, must be called under the mutex of users.
+func (s *PotatoSlave) grantCovers(sess *session, key string) bool {
+
+	for _, grant := range s.users.grants {
+		if grant.Owner == sess.keyspace && grant.User == sess.login && strings.HasPrefix(key, grant.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// use is USE owner, the commands of the connection after it work with the
+// keys of the keyspace owner, see granted. USE without arguments or with the
+// own keyspace goes back to it. It needs a grant of owner to the user, but
+// may be run before the prefix is read, grants are checked by every command.
+func (s *PotatoSlave) use(sess *session, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if sess.login == "" {
+		setStatus(&response, _AU)
+		return response
+	}
+	if !s.authRequired() || len(mes.Arguments) > 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	owner := sess.ownKeyspace()
+	if len(mes.Arguments) == 1 {
+		owner = mes.Arguments[0]
+	}
+	if owner != sess.ownKeyspace() {
+		s.users.mutex.Lock()
+		found := false
+		for _, grant := range s.users.grants {
+			if grant.Owner == owner && grant.User == sess.login {
+				found = true
+				break
+			}
+		}
+		s.users.mutex.Unlock()
+		if !found {
+			setStatus(&response, _NP)
+			return response
+		}
+	}
+
+	sess.keyspace = owner
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// grantcommand is GRANT ADD owner prefix user, GRANT DEL owner prefix user and
+// GRANT LIST. ADD lets user read keys of owner under prefix, DEL takes it back
+// and LIST returns all grants as JSON.
+func (s *PotatoSlave) grantcommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if !s.authRequired() || len(mes.Arguments) == 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	switch mes.Arguments[0] {
+	case "ADD", "DEL":
+		if len(mes.Arguments) != 4 || mes.Arguments[1] == "" || mes.Arguments[3] == "" {
+			setStatus(&response, _WA)
+			return response
+		}
+		grant := keyGrant{Owner: mes.Arguments[1], Prefix: mes.Arguments[2], User: mes.Arguments[3]}
+
+		s.users.mutex.Lock()
+		defer s.users.mutex.Unlock()
+
+		if _, ok := s.users.byName[grant.User]; !ok {
+			setStatus(&response, _NK)
+			return response
+		}
+		old := s.users.grants
+		grants := make([]keyGrant, 0, len(old)+1)
+		for _, g := range old {
+			if g != grant {
+				grants = append(grants, g)
+			}
+		}
+		if mes.Arguments[0] == "ADD" {
+			grants = append(grants, grant)
+		} else if len(grants) == len(old) {
+			setStatus(&response, _NK)
+			return response
+		}
+		sort.Slice(grants, func(i, j int) bool {
+			a, b := grants[i], grants[j]
+			if a.Owner != b.Owner {
+				return a.Owner < b.Owner
+			}
+			if a.Prefix != b.Prefix {
+				return a.Prefix < b.Prefix
+			}
+			return a.User < b.User
+		})
+
+		s.users.grants = grants
+		if err := s.saveGrants(); err != nil {
+			s.users.grants = old
+			setStatus(&response, _IE)
+			return response
+		}
+		setStatus(&response, _OK)
+
+	case "LIST":
+		if len(mes.Arguments) != 1 {
+			setStatus(&response, _WA)
+			return response
+		}
+		s.users.mutex.Lock()
+		body, _ := json.Marshal(append([]keyGrant{}, s.users.grants...))
+		s.users.mutex.Unlock()
+		response.Value = string(body)
+		setStatus(&response, _OK)
+
+	default:
+		setStatus(&response, _WA)
+	}
+
+	return response
+}
@@ -0,0 +1,92 @@
+package slave
+
+import (
+	"log"
+	"time"
+)
+
+//////////
+// Mutation hooks
+//////////
+
+// Mutation is a change of a key made by a successful command.
+type Mutation struct {
+	// Seq numbers writes in the order they were applied since the start of
+	// the slave. Hooks of concurrent writes can be called out of order, the
+	// greater Seq is the later value.
+	Seq  uint64
+	User string
+	Key  string
+	// Command is the name of the command that changed the key.
+	Command string
+	// Deleted tells that the key is gone, Type and Dump are empty then.
+	Deleted bool
+	// Type is the type of the object as in snapshots: "string", "hash" and
+	// so on.
+	Type string
+	// Dump is the object as DUMP returns it, RESTORE puts it back.
+	Dump string
+	// TTL is what is left of the key's life, negative if it never expires.
+	TTL time.Duration
+}
+
+// MutationHook is told about every change of a key made by a command, e. g.
+// to write it behind to a database. OnMutation is called after the command is
+// applied, outside of the storage lock, but before the client gets its
+// response, so a slow hook slows the writes down and should queue the work.
+// Expiration of keys isn't a mutation, see SUBSCRIBE EXPIRED. Writes replayed
+// from the append-only log on start are reported again, so a hook has to put
+// up with repeats.
+type MutationHook interface {
+	OnMutation(m Mutation)
+}
+
+// AddMutationHook makes h be called for every mutation. Hooks have to be added
+// before StartServing.
+// TODO: only mutatingCommands are reported, prefix commands like EXPIREPREFIX
+// change many keys at once and aren't.
+func (s *PotatoSlave) AddMutationHook(h MutationHook) {
+	s.mutationHooks = append(s.mutationHooks, h)
+}
+
+// mutationOf describes what a command left at the key. Should be called under
+// storageMutex.
+func (s *PotatoSlave) mutationOf(userID string, key string, command string, seq uint64) (Mutation, snapshotObject, error) {
+
+	m := Mutation{Seq: seq, User: userID, Key: key, Command: command}
+
+	val := s.live(userID, key)
+	if val == nil {
+		m.Deleted = true
+		return m, snapshotObject{}, nil
+	}
+	o, err := snapshotOf(userID, key, val)
+	m.Type = o.Type
+
+	return m, o, err
+}
+
+// runMutationHooks encodes a mutation taken by mutationOf and passes it to
+// every hook.
+func (s *PotatoSlave) runMutationHooks(m Mutation, o snapshotObject, err error) {
+
+	if !m.Deleted {
+		if o.TimeOfDeath.Equal(neverDies) {
+			m.TTL = -1
+		} else {
+			m.TTL = time.Until(o.TimeOfDeath)
+		}
+		if err == nil {
+			m.Dump, err = encodeDump(o)
+		}
+	}
+	if err != nil {
+		log.Printf("mutation of %s of %s isn't reported: %s", m.Key, m.User, err)
+		s.stats.add("mutation_hook_errors", 1)
+		return
+	}
+
+	for _, h := range s.mutationHooks {
+		h.OnMutation(m)
+	}
+}
@@ -0,0 +1,74 @@
+package slave
+
+import (
+	"sync"
+	"time"
+)
+
+//////////
+// Idempotent retries
+//////////
+
+// idempotentResult is a result of a command sent with an idempotency key.
+// done is closed when response is set, so a duplicate that comes while the
+// command is still running waits for it.
+type idempotentResult struct {
+	id       string
+	done     chan struct{}
+	response ResponseMessage
+	at       time.Time
+}
+
+// idempotencyCache remembers results for IDEMPOTENCYWINDOW. Results are kept
+// in order of arrival as the window is the same for all of them.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	results map[string]*idempotentResult
+	order   []*idempotentResult
+}
+
+// claim returns the result stored for id and false, or a new result that the
+// caller has to fill and true.
+func (c *idempotencyCache) claim(id string, now time.Time, window time.Duration) (*idempotentResult, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results == nil {
+		c.results = make(map[string]*idempotentResult)
+	}
+
+	for len(c.order) != 0 && now.Sub(c.order[0].at) > window {
+		if c.results[c.order[0].id] == c.order[0] {
+			delete(c.results, c.order[0].id)
+		}
+		c.order = c.order[1:]
+	}
+
+	if r, ok := c.results[id]; ok {
+		return r, false
+	}
+
+	r := &idempotentResult{id: id, done: make(chan struct{}), at: now}
+	c.results[id] = r
+	c.order = append(c.order, r)
+
+	return r, true
+}
+
+// invokeOnce runs a mutating command sent with an IdempotencyKey only once
+// per user and window, retries get the stored response.
+func (s *PotatoSlave) invokeOnce(userID string, mes CommandMessage, run func() ResponseMessage) ResponseMessage {
+
+	r, first := s.idempotency.claim(userID+"\x00"+mes.IdempotencyKey, time.Now(), s.IDEMPOTENCYWINDOW)
+	if !first {
+		<-r.done
+		s.stats.add("idempotent_replays", 1)
+		return r.response
+	}
+
+	r.response = run()
+	close(r.done)
+
+	return r.response
+}
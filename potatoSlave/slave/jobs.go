@@ -0,0 +1,197 @@
+package slave
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////
+// Async jobs
+//////////
+
+// job is a command running in background. It's started by sending the command
+// with Async set, the client gets its ID at once and polls JOB STATUS.
+type job struct {
+	ID      string
+	Command string
+	user    string
+
+	// progress is in percents, updated atomically
+	progress int64
+	// cancellable jobs check cancel between steps of their work, the rest
+	// always run to the end.
+	cancellable bool
+	cancel      chan struct{}
+	cancelOnce  sync.Once
+
+	// done is closed when response and finished are set
+	done     chan struct{}
+	response ResponseMessage
+	finished time.Time
+}
+
+// jobStatus is what JOB STATUS returns.
+type jobStatus struct {
+	ID       string
+	Command  string
+	State    string
+	Progress int64
+	Result   *ResponseMessage `json:",omitempty"`
+}
+
+// setProgress reports that done out of total steps are completed. It's safe to
+// call on a nil job, so the same code can run with and without a job.
+func (j *job) setProgress(done int, total int) {
+
+	if j == nil || total == 0 {
+		return
+	}
+	atomic.StoreInt64(&j.progress, int64(done*100/total))
+}
+
+// cancelled tells if the job was asked to stop.
+func (j *job) cancelled() bool {
+
+	if j == nil {
+		return false
+	}
+	select {
+	case <-j.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *job) status() jobStatus {
+
+	status := jobStatus{ID: j.ID, Command: j.Command, State: "running", Progress: atomic.LoadInt64(&j.progress)}
+
+	select {
+	case <-j.done:
+		status.State = "done"
+		if j.cancelled() {
+			status.State = "cancelled"
+		}
+		response := j.response
+		status.Result = &response
+	default:
+		if j.cancelled() {
+			status.State = "cancelling"
+		}
+	}
+
+	return status
+}
+
+// uncancellableJobs report progress as jobFunctions, but would leave a part
+// of their work done if they were cancelled.
+var uncancellableJobs = map[string]bool{
+	"MOVEKEYS": true,
+}
+
+// startJob runs mes in background and returns a response with the job ID.
+// Commands from jobFunctions report progress and can be cancelled unless
+// they're uncancellableJobs, others are just invoked as usual.
+func (s *PotatoSlave) startJob(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	mes.Async = false
+	jf, reports := s.jobFunctions[mes.Name]
+
+	j := &job{
+		ID:          strconv.FormatUint(atomic.AddUint64(&s.jobSeq, 1), 10),
+		Command:     mes.Name,
+		user:        userID,
+		cancellable: reports && !uncancellableJobs[mes.Name],
+		cancel:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	s.jobsMutex.Lock()
+	s.pruneJobs(time.Now())
+	s.jobs[j.ID] = j
+	s.jobsMutex.Unlock()
+
+	s.stats.add("jobs_started", 1)
+
+	go func() {
+		var result ResponseMessage
+		if reports {
+			result = s.call(func(userID string, mes CommandMessage) ResponseMessage {
+				return jf(j, userID, mes)
+			}, userID, mes)
+		} else {
+			result = s.invoke(userID, mes)
+		}
+
+		atomic.StoreInt64(&j.progress, 100)
+		j.response = result
+		j.finished = time.Now()
+		close(j.done)
+	}()
+
+	response.Value = j.ID
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// pruneJobs forgets jobs finished more than JOBRETENTION ago, must be called
+// under jobsMutex.
+func (s *PotatoSlave) pruneJobs(now time.Time) {
+
+	for id, j := range s.jobs {
+		select {
+		case <-j.done:
+			if now.Sub(j.finished) > s.JOBRETENTION {
+				delete(s.jobs, id)
+			}
+		default:
+		}
+	}
+}
+
+//// Job functions
+
+// jobcommand is JOB STATUS id and JOB CANCEL id. Users only see their own jobs.
+func (s *PotatoSlave) jobcommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.jobsMutex.Lock()
+	j, ok := s.jobs[mes.Arguments[1]]
+	s.jobsMutex.Unlock()
+
+	if !ok || j.user != userID {
+		setStatus(&response, _NK)
+		return response
+	}
+
+	switch mes.Arguments[0] {
+	case "STATUS":
+		body, _ := json.Marshal(j.status())
+		response.Value = string(body)
+		setStatus(&response, _OK)
+	case "CANCEL":
+		if !j.cancellable {
+			setStatus(&response, _WA)
+			return response
+		}
+		j.cancelOnce.Do(func() { close(j.cancel) })
+		setStatus(&response, _OK)
+	default:
+		setStatus(&response, _WA)
+	}
+
+	return response
+}
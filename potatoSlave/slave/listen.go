@@ -0,0 +1,193 @@
+package slave
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+//////////
+// Listening
+//////////
+
+// bindAddrs are the addresses the slave listens on, BINDADDRS with PORT added
+// to those without a port, e. g. "10.0.0.1", "[::1]:6000" or "[::]" for both
+// IPv4 and IPv6 of all interfaces. Without BINDADDRS it's only PORT of all
+// IPv4 interfaces, as it always was.
+func (s *PotatoSlave) bindAddrs() []string {
+
+	if len(s.BINDADDRS) == 0 {
+		return []string{":" + s.port}
+	}
+	addrs := make([]string, 0, len(s.BINDADDRS))
+	for _, addr := range s.BINDADDRS {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), s.port)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// advertised is the address of the slave for others, IP:PORT with brackets
+// around an IPv6 address.
+func (s *PotatoSlave) advertised() string {
+	return net.JoinHostPort(s.IP, s.port)
+}
+
+// tlsAddrs are bindAddrs with TLSPORT, nil without it.
+func (s *PotatoSlave) tlsAddrs() []string {
+
+	if s.TLSPORT == "" {
+		return nil
+	}
+	addrs := s.bindAddrs()
+	for i, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		addrs[i] = net.JoinHostPort(host, s.TLSPORT)
+	}
+	return addrs
+}
+
+// tlsConfig loads TLSCERT, TLSKEY and TLSCLIENTCA.
+func (s *PotatoSlave) tlsConfig() (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(s.TLSCERT, s.TLSKEY)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.TLSCLIENTCA != "" {
+		pem, err := ioutil.ReadFile(s.TLSCLIENTCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + s.TLSCLIENTCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// listen opens a listener on every bind address, and a TLS one on every TLS
+// address, connections of all of them are accepted from the one that is
+// returned.
+func (s *PotatoSlave) listen() (net.Listener, error) {
+
+	network := "tcp"
+	if len(s.BINDADDRS) == 0 {
+		network = "tcp4"
+	}
+
+	var config *tls.Config
+	if s.TLSPORT != "" {
+		var err error
+		if config, err = s.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	var listeners []net.Listener
+	addrs := s.bindAddrs()
+	plain := len(addrs)
+	for i, addr := range append(addrs, s.tlsAddrs()...) {
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if i >= plain {
+			listener = tls.NewListener(listener, config)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// multiListener accepts connections of several listeners. An error of one
+// of them is returned by Accept like the connections are.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var errListenerClosed = errors.New("listener is closed")
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+
+	l := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		go l.acceptRoutine(listener)
+	}
+	return l
+}
+
+func (l *multiListener) acceptRoutine(listener net.Listener) {
+
+	for {
+		conn, err := listener.Accept()
+		select {
+		case l.accepted <- acceptResult{conn, err}:
+		case <-l.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil && !isTemporaryAcceptError(err) {
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *multiListener) Close() error {
+
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		for _, listener := range l.listeners {
+			if e := listener.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr is the address of the first listener.
+func (l *multiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
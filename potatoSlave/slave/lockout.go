@@ -0,0 +1,118 @@
+package slave
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//////////
+// Brute-force protection
+//////////
+
+// TODO: hosts behind the proxy all come from its address, it doesn't pass
+// AUTH anyway.
+
+// lockout counts failed logins of the hosts clients connect from.
+type lockout struct {
+	mutex sync.Mutex
+	hosts map[string]*failedLogins
+}
+
+// failedLogins are the failures of a host since the first one, a host with
+// AUTHMAXFAILURES of them isn't let to log in until bannedUntil.
+type failedLogins struct {
+	count       int
+	since       time.Time
+	bannedUntil time.Time
+}
+
+// maxLockoutHosts is how many hosts are remembered before the ones that are
+// neither banned nor failed recently are forgotten.
+const maxLockoutHosts = 10000
+
+// remoteHost is the host a connection comes from, without the port.
+func remoteHost(connection net.Conn) string {
+
+	addr := connection.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// authBanned tells if a host may not log in now.
+func (s *PotatoSlave) authBanned(host string) bool {
+
+	if host == "" || s.AUTHMAXFAILURES <= 0 {
+		return false
+	}
+	s.lockout.mutex.Lock()
+	defer s.lockout.mutex.Unlock()
+
+	failed, ok := s.lockout.hosts[host]
+	return ok && s.clock().Before(failed.bannedUntil)
+}
+
+// authFailed counts a failed login of a host. Failures older than AUTHBANTIME
+// are forgotten, the one that makes AUTHMAXFAILURES within it bans the host
+// for AUTHBANTIME.
+func (s *PotatoSlave) authFailed(host string) {
+
+	if host == "" || s.AUTHMAXFAILURES <= 0 {
+		return
+	}
+	now := s.clock()
+
+	s.lockout.mutex.Lock()
+	defer s.lockout.mutex.Unlock()
+
+	if s.lockout.hosts == nil {
+		s.lockout.hosts = make(map[string]*failedLogins)
+	}
+	failed, ok := s.lockout.hosts[host]
+	if !ok || now.Sub(failed.since) > s.AUTHBANTIME && now.After(failed.bannedUntil) {
+		if len(s.lockout.hosts) >= maxLockoutHosts {
+			s.forgetFailures(now)
+		}
+		failed = &failedLogins{since: now}
+		s.lockout.hosts[host] = failed
+	}
+	failed.count++
+	if failed.count >= s.AUTHMAXFAILURES {
+		failed.bannedUntil = now.Add(s.AUTHBANTIME)
+		failed.count, failed.since = 0, failed.bannedUntil
+		s.stats.add("auth_bans", 1)
+	}
+}
+
+// forgetFailures drops the hosts that can't be banned by their failures any
+// more, must be called under the mutex of lockout.
+func (s *PotatoSlave) forgetFailures(now time.Time) {
+
+	for host, failed := range s.lockout.hosts {
+		if now.Sub(failed.since) > s.AUTHBANTIME && now.After(failed.bannedUntil) {
+			delete(s.lockout.hosts, host)
+		}
+	}
+}
+
+// bannedHosts is the number of hosts that may not log in now.
+func (s *PotatoSlave) bannedHosts() int64 {
+
+	now := s.clock()
+	s.lockout.mutex.Lock()
+	defer s.lockout.mutex.Unlock()
+
+	var n int64
+	for _, failed := range s.lockout.hosts {
+		if now.Before(failed.bannedUntil) {
+			n++
+		}
+	}
+	return n
+}
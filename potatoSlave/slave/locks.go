@@ -0,0 +1,102 @@
+package slave
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+//////////
+// Locks of users
+//////////
+
+// TODO: only keyCommands, HGETALL, KEYS and the bookkeeping invoke does after
+// writes take locks of users so far, every other command still locks
+// storageMutex as a whole. AOFPATH serializes logged writes in
+// lockWrite anyway, so writes only run alongside each other without it.
+
+// userShards is how many locks keys of users are spread over.
+const userShards = 64
+
+// shardOf is the lock of userLocks that guards the keys of a user.
+func shardOf(user string) int {
+
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	return int(h.Sum32() % userShards)
+}
+
+// lockUser locks the keys of a user for a command that works with them only.
+// storageMutex is held for reading, so commands of users of other shards run
+// alongside, and the shard of the user for writing. Whoever holds
+// storageMutex as a whole may touch every user, whoever holds it for reading
+// only the users of its shard, and expiries and scheduled under expiryMutex.
+// A backend other than mapStorage isn't safe for that, and a user that isn't
+// known yet would change the map of users, so then storageMutex is locked as
+// a whole as it was before shards. It returns the unlock.
+func (s *PotatoSlave) lockUser(user string) func() {
+
+	s.storageMutex.RLock()
+	if _, ok := s.storage.(mapStorage); ok && s.storage.HasUser(user) {
+		shard := &s.userLocks[shardOf(user)]
+		shard.Lock()
+		return func() {
+			shard.Unlock()
+			s.storageMutex.RUnlock()
+		}
+	}
+	s.storageMutex.RUnlock()
+
+	s.storageMutex.Lock()
+	return s.storageMutex.Unlock
+}
+
+// rlockUser locks the keys of a user for reading, like lockUser but reads of
+// the same user run alongside each other too. What's read must not be
+// changed, so dead objects are left for dropDead. For a user that isn't known
+// there's nothing to guard but the map of users, so storageMutex for reading
+// is enough.
+func (s *PotatoSlave) rlockUser(user string) func() {
+
+	s.storageMutex.RLock()
+	if _, ok := s.storage.(mapStorage); !ok {
+		s.storageMutex.RUnlock()
+		s.storageMutex.Lock()
+		return s.storageMutex.Unlock
+	}
+	if !s.storage.HasUser(user) {
+		return s.storageMutex.RUnlock
+	}
+	shard := &s.userLocks[shardOf(user)]
+	shard.RLock()
+	return func() {
+		shard.RUnlock()
+		s.storageMutex.RUnlock()
+	}
+}
+
+// peek is live for reads under rlockUser: a dead object isn't deleted but
+// added to dead.
+func (s *PotatoSlave) peek(userID string, key string, dead *[]string) potat {
+
+	val := s.storage.Get(userID, key)
+	if val == nil {
+		return nil
+	}
+	if !val.getTimeOfDeath().After(time.Now()) {
+		*dead = append(*dead, key)
+		return nil
+	}
+	return val
+}
+
+// dropDead deletes the dead objects peek came across, as live would have.
+func (s *PotatoSlave) dropDead(userID string, dead []string) {
+
+	if len(dead) == 0 {
+		return
+	}
+	defer s.lockUser(userID)()
+	for _, key := range dead {
+		s.live(userID, key)
+	}
+}
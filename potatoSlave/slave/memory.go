@@ -0,0 +1,221 @@
+package slave
+
+import (
+	"encoding/json"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//////////
+// Memory reporting
+//////////
+
+// Rough overheads in bytes of a stored object and of an element inside of it
+// (map bucket share, slice header, string header).
+const (
+	objectOverhead  = 64
+	elementOverhead = 16
+)
+
+// sizeOf estimates how many bytes the object at key takes. It's what potato
+// thinks it stores, the runtime heap is compared against it.
+func sizeOf(key string, val potat) int64 {
+
+	size := int64(objectOverhead + len(key))
+
+	switch v := val.(type) {
+	case *pstring:
+		size += int64(len(v.content))
+	case *plist:
+		for _, item := range v.list {
+			size += int64(elementOverhead + len(item))
+		}
+	case *pmap:
+		for field, value := range v.ourmap {
+			size += int64(2*elementOverhead + len(field) + len(value))
+		}
+		for field := range v.fieldDeath {
+			size += int64(elementOverhead + len(field) + 24)
+		}
+	case *pset:
+		for member := range v.members {
+			size += int64(elementOverhead + len(member))
+		}
+	case *pzset:
+		// A member is in the ordered slice and in the map of scores
+		for _, m := range v.ordered {
+			size += int64(2*(elementOverhead+len(m.member)) + 16)
+		}
+	case *pcounter:
+		size += 8
+	case *pbitmap:
+		size += int64(len(v.bits))
+	case *papprox:
+		size += int64(len(v.registers))
+	case *pstream:
+		for _, e := range v.entries {
+			size += int64(elementOverhead + 8 + len(e.value))
+		}
+		for consumer := range v.offsets {
+			size += int64(elementOverhead + len(consumer) + 8)
+		}
+	case *pjson:
+		document, _ := json.Marshal(v.document)
+		size += int64(len(document))
+	}
+
+	return size
+}
+
+// liveBytes sums sizeOf over everything stored. The lock is taken for every
+// user separately, so the sum is not exact when the storage is being changed.
+func (s *PotatoSlave) liveBytes() (total int64, keys int) {
+
+	s.storageMutex.Lock()
+	users := s.storage.Users()
+	s.storageMutex.Unlock()
+
+	for _, user := range users {
+		s.storageMutex.Lock()
+		s.storage.Iterate(user, func(key string, val potat) bool {
+			total += sizeOf(key, val)
+			keys++
+			return true
+		})
+		s.storageMutex.Unlock()
+	}
+
+	return total, keys
+}
+
+// memoryReport is what MEMORYSTATS returns. Heap numbers come from the
+// runtime, LiveBytes is the estimate of stored data made at the end of the
+// last interval. Fragmentation is HeapInuse over LiveBytes: how many bytes of
+// heap the slave holds for every byte it thinks it stores.
+type memoryReport struct {
+	LiveBytes     int64
+	Keys          int
+	HeapAlloc     uint64
+	HeapInuse     uint64
+	HeapIdle      uint64
+	HeapReleased  uint64
+	Sys           uint64
+	Fragmentation float64
+	// PeakHeapInuse is the highest sample in the current interval that
+	// started at IntervalStarted, LastPeakHeapInuse is of the previous one
+	PeakHeapInuse     uint64
+	LastPeakHeapInuse uint64
+	IntervalStarted   time.Time
+	// Alerts are thresholds crossed in the previous interval
+	Alerts []string `json:",omitempty"`
+}
+
+// memoryTracker keeps the peaks between samples of memoryRoutine.
+type memoryTracker struct {
+	mu     sync.Mutex
+	report memoryReport
+}
+
+// sample reads memory stats of the runtime into the report and updates the
+// peak.
+func (m *memoryTracker) sample() {
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := &m.report
+	r.HeapAlloc = stats.HeapAlloc
+	r.HeapInuse = stats.HeapInuse
+	r.HeapIdle = stats.HeapIdle
+	r.HeapReleased = stats.HeapReleased
+	r.Sys = stats.Sys
+	if stats.HeapInuse > r.PeakHeapInuse {
+		r.PeakHeapInuse = stats.HeapInuse
+	}
+	if r.LiveBytes != 0 {
+		r.Fragmentation = float64(r.HeapInuse) / float64(r.LiveBytes)
+	}
+}
+
+// rollInterval puts a new estimate of live bytes into the report, checks the
+// finished interval against alert thresholds and starts a new one.
+func (s *PotatoSlave) rollInterval(now time.Time) {
+
+	live, keys := s.liveBytes()
+
+	m := &s.memory
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := &m.report
+	r.LiveBytes, r.Keys = live, keys
+	if live != 0 {
+		r.Fragmentation = float64(r.HeapInuse) / float64(live)
+	}
+
+	r.Alerts = nil
+	if s.MEMORYALERTBYTES != 0 && r.PeakHeapInuse > s.MEMORYALERTBYTES {
+		r.Alerts = append(r.Alerts, "peak heap is over MEMORYALERTBYTES")
+	}
+	if s.FRAGMENTATIONALERT != 0 && r.Fragmentation > s.FRAGMENTATIONALERT {
+		r.Alerts = append(r.Alerts, "fragmentation is over FRAGMENTATIONALERT")
+	}
+	for _, alert := range r.Alerts {
+		log.Printf("memory: %s: peak heap %d, live %d, fragmentation %.2f", alert, r.PeakHeapInuse, live, r.Fragmentation)
+		s.stats.add("memory_alerts", 1)
+	}
+
+	r.LastPeakHeapInuse = r.PeakHeapInuse
+	r.PeakHeapInuse = r.HeapInuse
+	r.IntervalStarted = now
+}
+
+// memoryRoutine samples memory every MEMORYSAMPLETIME and starts a new
+// interval every MEMORYINTERVAL until stopped by someone.
+func (s *PotatoSlave) memoryRoutine(shutdownChan chan bool) {
+
+	s.memory.sample()
+	s.rollInterval(time.Now())
+	next := time.Now().Add(s.MEMORYINTERVAL)
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.MEMORYSAMPLETIME):
+		}
+
+		s.memory.sample()
+		if now := time.Now(); !now.Before(next) {
+			s.rollInterval(now)
+			next = now.Add(s.MEMORYINTERVAL)
+		}
+	}
+}
+
+// memorystats returns the memory report as JSON.
+func (s *PotatoSlave) memorystats(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.memory.sample()
+
+	s.memory.mu.Lock()
+	body, _ := json.Marshal(s.memory.report)
+	s.memory.mu.Unlock()
+
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
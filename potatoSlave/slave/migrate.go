@@ -0,0 +1,81 @@
+package slave
+
+import "time"
+
+//////////
+// Migration between slaves
+//////////
+
+// TODO: the target authenticates the slave as its own user, which is the same
+// "user" now, keys should land at the user they belonged to.
+
+// migrate is MIGRATE key host:port: the key is restored with its TTL on the
+// slave at host:port and deleted here. The key is locked the whole time, so
+// no write to it is lost between the two. If the target refuses the key, e. g.
+// with _KE when it has one, the status is the target's; if it can't be reached
+// or doesn't answer in MIGRATETIMEOUT it's _UP and the key stays here, and
+// after a timeout it may be on both slaves. The local delete is logged as DEL.
+func (s *PotatoSlave) migrate(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+	if s.isReplica() {
+		setStatus(&response, _RO)
+		return response
+	}
+	key, addr := mes.Arguments[0], mes.Arguments[1]
+
+	defer s.lockWrite()()
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	val := s.live(userID, key)
+	if val == nil {
+		setStatus(&response, _NK)
+		return response
+	}
+
+	o, err := snapshotOf(userID, key, val)
+	var dump string
+	if err == nil {
+		dump, err = encodeDump(o)
+	}
+	if err != nil {
+		setStatus(&response, _IE)
+		return response
+	}
+	ttl := time.Until(o.TimeOfDeath)
+	if o.TimeOfDeath.Equal(neverDies) {
+		ttl = -1
+	} else if ttl <= 0 {
+		ttl = time.Millisecond
+	}
+
+	restored, err := askNode(addr, CommandMessage{Name: "RESTORE", Arguments: []string{key, dump}, TTL: ttl}, s.MIGRATETIMEOUT)
+	if err != nil {
+		s.stats.add("migrate_errors", 1)
+		response.Value = err.Error()
+		setStatus(&response, _UP)
+		return response
+	}
+	if restored.Code != _OK {
+		response.Value = restored.Value
+		setStatus(&response, restored.Code)
+		return response
+	}
+
+	s.storage.Delete(userID, key)
+	s.reconcile(userID, key)
+	if s.MAXKEYS != 0 {
+		s.tellEviction(userID, key, true)
+	}
+	s.logWrite(userID, CommandMessage{Name: "DEL", Arguments: []string{key}})
+	s.stats.add("keys_migrated", 1)
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,101 @@
+package slave
+
+import (
+	"path"
+	"strconv"
+)
+
+//////////
+// Moving keys between users
+//////////
+
+// movekeys is MOVEKEYS sourceUser destUser pattern, see moveKeysJob.
+func (s *PotatoSlave) movekeys(userID string, mes CommandMessage) ResponseMessage {
+	return s.moveKeysJob(nil, userID, mes)
+}
+
+// moveKeysJob moves every live key of sourceUser that matches pattern, a glob
+// like in path.Match, to destUser together with its TTL, e. g. when tenants
+// are merged. Keys are moved at once under the lock: either all of them are
+// moved or, if destUser already has one of them, none with _KE and the key in
+// Value. It returns the number of moved keys. As a job it reports progress,
+// but can't be cancelled, as a part of the move isn't left behind.
+// TODO: keys under encrypted prefixes are sealed for their user, so they're
+// refused with _DE, they should be sealed again for destUser.
+func (s *PotatoSlave) moveKeysJob(j *job, userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 3 || mes.Arguments[0] == mes.Arguments[1] {
+		setStatus(&response, _WA)
+		return response
+	}
+	from, to, pattern := mes.Arguments[0], mes.Arguments[1], mes.Arguments[2]
+	if _, err := path.Match(pattern, ""); err != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	// Without a job invoke already holds these and logs the command
+	if j != nil {
+		defer s.lockWrite()()
+	}
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	if !s.storage.HasUser(from) {
+		setStatus(&response, _NK)
+		return response
+	}
+
+	var keys []string
+	s.storage.Iterate(from, func(key string, _ potat) bool {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	moving := keys[:0]
+	for _, key := range keys {
+		if s.live(from, key) == nil {
+			continue
+		}
+		if s.isEncrypted(key) {
+			setStatus(&response, _DE)
+			response.Value = key
+			return response
+		}
+		if s.live(to, key) != nil {
+			setStatus(&response, _KE)
+			response.Value = key
+			return response
+		}
+		moving = append(moving, key)
+	}
+
+	s.storage.AddUser(to)
+	for i, key := range moving {
+		if j != nil && s.saving != nil {
+			s.saving.copyPending(s, from, key)
+			s.saving.copyPending(s, to, key)
+		}
+		s.storage.Set(to, key, s.storage.Get(from, key))
+		s.storage.Delete(from, key)
+		s.reconcile(from, key)
+		s.reconcile(to, key)
+		s.schedule(to, key)
+		j.setProgress(i+1, len(moving))
+	}
+
+	if j != nil {
+		s.logWrite(userID, mes)
+	}
+
+	s.stats.add("keys_moved", int64(len(moving)))
+	response.Value = strconv.Itoa(len(moving))
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,69 @@
+package slave
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+//////////
+// In-memory network
+//////////
+
+// pipeListener is a net.Listener whose connections are in-memory pipes, so a
+// slave can be served without sockets, e. g. in tests or when embedded.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// pipeAddr is the address of every pipeListener.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+var errPipeClosed = errors.New("pipe listener is closed")
+
+func newPipeListener() *pipeListener {
+
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial connects to the listener and returns the client side of the pipe. It
+// blocks until the connection is accepted.
+func (l *pipeListener) Dial() (net.Conn, error) {
+
+	client, server := net.Pipe()
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errPipeClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errPipeClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
@@ -0,0 +1,108 @@
+package slave
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////
+// Expiry notifications
+//////////
+
+// expirySubscriber is a connection waiting for expired keys of a user under
+// a prefix.
+type expirySubscriber struct {
+	user   string
+	prefix string
+	events chan string
+}
+
+// expirySubscribers are guarded by their own mutex, as notifications are sent
+// under storageMutex.
+type expirySubscribers struct {
+	mu   sync.Mutex
+	subs map[*expirySubscriber]bool
+}
+
+// notifyExpired tells subscribers that the key has expired. It never blocks,
+// events for subscribers that are too slow are dropped.
+func (s *PotatoSlave) notifyExpired(user string, key string) {
+
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+
+	for sub := range s.subscribers.subs {
+		if sub.user != user || !strings.HasPrefix(key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.events <- key:
+		default:
+			s.stats.add("expiry_events_dropped", 1)
+		}
+	}
+}
+
+// subscribeExpired serves SUBSCRIBE EXPIRED [prefix]. The connection is
+// answered with an OK frame and then gets a frame with every expired key
+// until the client disconnects. All frames have More set.
+func (s *PotatoSlave) subscribeExpired(connection net.Conn, decoder *json.Decoder, encoder *json.Encoder,
+	userID string, mes CommandMessage) {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) == 0 || len(mes.Arguments) > 2 || mes.Arguments[0] != "EXPIRED" {
+		setStatus(&response, _WA)
+		encoder.Encode(response)
+		return
+	}
+
+	sub := &expirySubscriber{user: userID, events: make(chan string, s.STREAMBATCH)}
+	if len(mes.Arguments) == 2 {
+		sub.prefix = mes.Arguments[1]
+	}
+
+	s.subscribers.mu.Lock()
+	if s.subscribers.subs == nil {
+		s.subscribers.subs = make(map[*expirySubscriber]bool)
+	}
+	s.subscribers.subs[sub] = true
+	s.subscribers.mu.Unlock()
+
+	defer func() {
+		s.subscribers.mu.Lock()
+		delete(s.subscribers.subs, sub)
+		s.subscribers.mu.Unlock()
+	}()
+
+	// Anything the client sends now is ignored, reading only tells when it's gone
+	closed := make(chan bool)
+	connection.SetReadDeadline(time.Time{})
+	go func() {
+		var ignored CommandMessage
+		for decoder.Decode(&ignored) == nil {
+		}
+		close(closed)
+	}()
+
+	setStatus(&response, _OK)
+	response.More = true
+	if encoder.Encode(response) != nil {
+		return
+	}
+
+	for {
+		select {
+		case key := <-sub.events:
+			response.Value = key
+			if encoder.Encode(response) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
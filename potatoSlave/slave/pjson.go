@@ -0,0 +1,239 @@
+package slave
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+///// JSON document
+
+// pjson keeps a parsed JSON document, objects are map[string]interface{} and
+// arrays are []interface{} as encoding/json makes them.
+type pjson struct {
+	document    interface{}
+	timeOfDeath time.Time
+}
+
+func (p *pjson) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *pjson) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+// getContent returns JSON of the part of the document at idx path.
+func (p *pjson) getContent(idx string) (string, error) {
+
+	path, err := parseJSONPath(idx)
+	if err != nil {
+		return "", err
+	}
+
+	node := p.document
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			object, ok := node.(map[string]interface{})
+			if !ok {
+				return "", errors.New("nk")
+			}
+			if node, ok = object[key]; !ok {
+				return "", errors.New("nk")
+			}
+		case int:
+			array, ok := node.([]interface{})
+			if !ok || key >= len(array) {
+				return "", errors.New("nk")
+			}
+			node = array[key]
+		}
+	}
+
+	body, err := json.Marshal(node)
+	return string(body), err
+}
+
+// setContent puts the JSON val at idx path. Missing objects on the way are
+// created and an array index equal to the array length appends to it.
+func (p *pjson) setContent(val string, idx string) error {
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(val), &value); err != nil {
+		return errors.New("wr")
+	}
+
+	path, err := parseJSONPath(idx)
+	if err != nil {
+		return err
+	}
+
+	document, err := setJSONPath(p.document, path, value)
+	if err != nil {
+		return err
+	}
+	p.document = document
+	return nil
+}
+
+// setJSONPath returns node with value put at path.
+func setJSONPath(node interface{}, path []interface{}, value interface{}) (interface{}, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch key := path[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			if node != nil {
+				return nil, errors.New("wt")
+			}
+			object = make(map[string]interface{})
+		}
+		child, err := setJSONPath(object[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		object[key] = child
+		return object, nil
+
+	case int:
+		array, ok := node.([]interface{})
+		if !ok {
+			if node != nil {
+				return nil, errors.New("wt")
+			}
+			array = []interface{}{}
+		}
+		if key > len(array) {
+			return nil, errors.New("ou")
+		}
+		if key == len(array) {
+			array = append(array, nil)
+		}
+		child, err := setJSONPath(array[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		array[key] = child
+		return array, nil
+	}
+
+	return nil, errors.New("wr")
+}
+
+// parseJSONPath splits a path like "$.users[2].name" into object keys
+// (strings) and array indexes (ints). The leading "$" is optional and "$"
+// alone is the whole document.
+func parseJSONPath(path string) ([]interface{}, error) {
+
+	var steps []interface{}
+
+	path = strings.TrimPrefix(path, "$")
+	for path != "" {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end == -1 {
+				end = len(path)
+			}
+			if end == 0 {
+				return nil, errors.New("wr")
+			}
+			steps = append(steps, path[:end])
+			path = path[end:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end == -1 {
+				return nil, errors.New("wr")
+			}
+			i, err := strconv.Atoi(path[1:end])
+			if err != nil || i < 0 {
+				return nil, errors.New("wr")
+			}
+			steps = append(steps, i)
+			path = path[end+1:]
+		default:
+			// A path may start without a dot: "users[2].name"
+			path = "." + path
+		}
+	}
+
+	return steps, nil
+}
+
+//// JSON functions
+
+func (s *PotatoSlave) jget(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pjson:
+			content, err := v.getContent(mes.Arguments[1])
+			if err != nil && err.Error() == "nk" {
+				setStatus(&response, _NK)
+			} else if err != nil {
+				setStatus(&response, _WA)
+			} else {
+				response.Value = content
+				setStatus(&response, _OK)
+			}
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
+
+	return response
+}
+
+// jset puts a JSON value at the path of a document, a missing document is
+// created. If the key holds an object of a different type it's replaced.
+func (s *PotatoSlave) jset(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 3 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	doc, ok := s.live(userID, mes.Arguments[0]).(*pjson)
+	if !ok {
+		doc = &pjson{timeOfDeath: deathAfter(ttl)}
+	}
+
+	switch err := doc.setContent(mes.Arguments[2], mes.Arguments[1]); {
+	case err == nil:
+		s.storage.Set(userID, mes.Arguments[0], doc)
+		setStatus(&response, _OK)
+	case err.Error() == "wt":
+		setStatus(&response, _WT)
+	default:
+		setStatus(&response, _WA)
+	}
+
+	return response
+}
@@ -0,0 +1,420 @@
+package slave
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//////////
+// Proxy
+//////////
+
+// TODO: slaves speak RESP on RESPPORT, the proxy should accept it as one more
+// frontend.
+
+// Proxy sits in front of a slave and serves any number of clients over a few
+// upstream connections, as every connection to a slave takes a worker for as
+// long as it's open. A command takes an upstream connection only until its
+// response is read. Clients speak the native protocol on Serve and JSON over
+// HTTP or a WebSocket on HTTPHandler.
+type Proxy struct {
+	// UPSTREAMCONNS is how many connections to the slave are kept, it
+	// should be less than MAXCONNECTIONS of the slave.
+	UPSTREAMCONNS int
+	// UPSTREAMWAIT is how long a command waits for a free upstream
+	// connection before it gets _UP.
+	UPSTREAMWAIT time.Duration
+	// UPSTREAMIDLE is how long an upstream connection can be idle before it's
+	// dialed again, it must be less than STALETIME of the slave.
+	UPSTREAMIDLE time.Duration
+	// RATELIMIT is how many commands per second a client can send with bursts
+	// of up to RATEBURST, 0 turns it off. Native clients are limited by
+	// connection, HTTP ones by address.
+	RATELIMIT float64
+	RATEBURST int
+	// URLKEY signs shared URLs, they are refused if it's empty.
+	URLKEY []byte
+	// ORIGINS are the origins of pages that may open a WebSocket, "*" is
+	// any. Empty allows pages of the host of the proxy only. WSMAXMESSAGE
+	// is the largest message a WebSocket client may send.
+	ORIGINS      []string
+	WSMAXMESSAGE int
+
+	dial     func() (net.Conn, error)
+	pool     chan *upstreamConn
+	initOnce sync.Once
+
+	buckets      map[string]*tokenBucket
+	bucketsMutex sync.Mutex
+}
+
+// NewProxy creates a proxy to the slave at upstream.
+func NewProxy(upstream string) *Proxy {
+
+	return &Proxy{
+		UPSTREAMCONNS: 4,
+		UPSTREAMWAIT:  time.Second,
+		UPSTREAMIDLE:  time.Second,
+		RATEBURST:     100,
+		WSMAXMESSAGE:  1 << 20,
+		dial: func() (net.Conn, error) {
+			return net.DialTimeout("tcp", upstream, time.Second*5)
+		},
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// upstreamConn is a connection to the slave, nil conn means it has to be
+// dialed first.
+type upstreamConn struct {
+	conn     net.Conn
+	encoder  *json.Encoder
+	decoder  *json.Decoder
+	lastUsed time.Time
+}
+
+func (p *Proxy) init() {
+
+	p.initOnce.Do(func() {
+		p.pool = make(chan *upstreamConn, p.UPSTREAMCONNS)
+		for i := 0; i < p.UPSTREAMCONNS; i++ {
+			p.pool <- &upstreamConn{}
+		}
+	})
+}
+
+// roundTrip sends a command upstream and reads all of its responses, a stream
+// has more than one.
+func (p *Proxy) roundTrip(mes CommandMessage) []ResponseMessage {
+
+	var responses []ResponseMessage
+	p.roundTripEach(mes, func(response ResponseMessage) error {
+		responses = append(responses, response)
+		return nil
+	})
+	return responses
+}
+
+// roundTripEach is roundTrip that passes responses to f as they come, so
+// frames of a stream aren't kept. If f fails the rest of the stream is
+// dropped with the upstream connection.
+func (p *Proxy) roundTripEach(mes CommandMessage, f func(ResponseMessage) error) {
+
+	response := ResponseMessage{RequestID: mes.RequestID}
+
+	// Upstream connections are shared, a login would be of every client
+	if mes.Name == "AUTH" {
+		response.Value = "AUTH isn't supported through a proxy"
+		setStatus(&response, _WA)
+		f(response)
+		return
+	}
+
+	var u *upstreamConn
+	select {
+	case u = <-p.pool:
+	case <-time.After(p.UPSTREAMWAIT):
+		setStatus(&response, _UP)
+		f(response)
+		return
+	}
+	defer func() { p.pool <- u }()
+
+	if u.conn != nil && time.Since(u.lastUsed) > p.UPSTREAMIDLE {
+		u.conn.Close()
+		u.conn = nil
+	}
+	if u.conn == nil {
+		conn, err := p.dial()
+		if err != nil {
+			log.Printf("proxy: can't dial upstream: %s", err)
+			setStatus(&response, _UP)
+			f(response)
+			return
+		}
+		u.conn, u.encoder, u.decoder = conn, json.NewEncoder(conn), json.NewDecoder(conn)
+	}
+
+	err := u.encoder.Encode(mes)
+	for err == nil {
+		var r ResponseMessage
+		if err = u.decoder.Decode(&r); err == nil {
+			if f(r) != nil {
+				u.conn.Close()
+				u.conn = nil
+				return
+			}
+			if !r.More {
+				u.lastUsed = time.Now()
+				return
+			}
+		}
+	}
+
+	// The command may have been applied, so it isn't sent again
+	log.Printf("proxy: upstream failed: %s", err)
+	u.conn.Close()
+	u.conn = nil
+	setStatus(&response, _UP)
+	f(response)
+}
+
+// RoundTrip sends a command to the slave and returns all of its responses,
+// only the last one has no More. It's _UP if the slave can't be reached.
+func (p *Proxy) RoundTrip(mes CommandMessage) []ResponseMessage {
+
+	p.init()
+	return p.roundTrip(mes)
+}
+
+// SequenceWrite checks Seq of a write the way a slave checks it on a
+// connection, for those in front of slaves that send writes of many clients
+// over one connection. Seq is removed from the command, last is the number of
+// the client's last sequenced write.
+func SequenceWrite(last *uint64, mes *CommandMessage) (ResponseMessage, bool) {
+
+	if mes.Seq != 0 && loggedCommands[mes.Name] {
+		if response, ok := checkSeq(last, *mes); !ok {
+			return response, false
+		}
+	}
+	mes.Seq = 0
+
+	return ResponseMessage{}, true
+}
+
+// Statuses that those in front of slaves answer with on their own.
+const (
+	StatusOK             = _OK
+	StatusWrongArguments = _WA
+	StatusUnknownCommand = _UC
+	StatusUpstream       = _UP
+	StatusRetry          = _RT
+)
+
+// NewStatus makes a response with a status code and its message.
+func NewStatus(code uint) ResponseMessage {
+
+	var response ResponseMessage
+	setStatus(&response, code)
+	return response
+}
+
+// Serve accepts native clients from listener until it fails.
+func (p *Proxy) Serve(listener net.Listener) error {
+
+	p.init()
+
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleClient(c)
+	}
+}
+
+// handleClient serves commands of a client one by one. Seq is checked here,
+// as the slave sees writes of many clients on one connection.
+func (p *Proxy) handleClient(connection net.Conn) {
+
+	defer connection.Close()
+
+	decoder := json.NewDecoder(connection)
+	encoder := &requestEncoder{messageEncoder: json.NewEncoder(connection)}
+	bucket := &tokenBucket{}
+	var seq uint64
+
+	for {
+		var mes CommandMessage
+		if err := decoder.Decode(&mes); err != nil {
+			return
+		}
+		encoder.id = mes.RequestID
+
+		// Notifications need a connection of their own
+		if mes.Name == "SUBSCRIBE" {
+			p.splice(connection, decoder, mes)
+			return
+		}
+
+		if !bucket.allow(time.Now(), p.RATELIMIT, p.RATEBURST) {
+			var response ResponseMessage
+			setStatus(&response, _RL)
+			encoder.Encode(response)
+			continue
+		}
+
+		if response, ok := SequenceWrite(&seq, &mes); !ok {
+			encoder.Encode(response)
+			continue
+		}
+
+		p.roundTripEach(mes, func(response ResponseMessage) error {
+			return encoder.Encode(response)
+		})
+	}
+}
+
+// splice connects the client to a new upstream connection of its own and
+// copies both ways until one of them is closed.
+func (p *Proxy) splice(connection net.Conn, decoder *json.Decoder, mes CommandMessage) {
+
+	upstream, err := p.dial()
+	if err != nil {
+		var response ResponseMessage
+		setStatus(&response, _UP)
+		json.NewEncoder(connection).Encode(response)
+		return
+	}
+	defer upstream.Close()
+
+	json.NewEncoder(upstream).Encode(mes)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// What the decoder has read ahead goes first
+		io.Copy(upstream, io.MultiReader(decoder.Buffered(), connection))
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(connection, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// HTTPHandler serves commands posted as JSON CommandMessage, the response is a
+// ResponseMessage or an array of them for a stream. Reads of shared URLs, see
+// SharedURL, are served at /shared, WebSocket clients at /ws.
+func (p *Proxy) HTTPHandler() http.Handler {
+
+	p.init()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !p.bucket(host).allow(time.Now(), p.RATELIMIT, p.RATEBURST) {
+			var response ResponseMessage
+			setStatus(&response, _RL)
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		if r.URL.Path == "/shared" {
+			p.serveShared(w, r)
+			return
+		}
+		if r.URL.Path == "/ws" {
+			p.serveWebSocket(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "commands are posted", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var mes CommandMessage
+		if err := json.NewDecoder(r.Body).Decode(&mes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// There is no connection to number writes on
+		mes.Seq = 0
+		if mes.Name == "SUBSCRIBE" {
+			http.Error(w, "SUBSCRIBE needs a connection", http.StatusBadRequest)
+			return
+		}
+
+		responses := p.roundTrip(mes)
+		w.Header().Set("Content-Type", "application/json")
+		if mes.Stream {
+			json.NewEncoder(w).Encode(responses)
+		} else {
+			json.NewEncoder(w).Encode(responses[len(responses)-1])
+		}
+	})
+}
+
+// bucket returns the rate limit of an HTTP client. Buckets that are full
+// again are forgotten once there are many of them.
+func (p *Proxy) bucket(host string) *tokenBucket {
+
+	p.bucketsMutex.Lock()
+	defer p.bucketsMutex.Unlock()
+
+	if len(p.buckets) > 10000 {
+		now := time.Now()
+		for h, b := range p.buckets {
+			if b.full(now, p.RATELIMIT, p.RATEBURST) {
+				delete(p.buckets, h)
+			}
+		}
+	}
+
+	b, ok := p.buckets[host]
+	if !ok {
+		b = &tokenBucket{}
+		p.buckets[host] = b
+	}
+	return b
+}
+
+// tokenBucket is a rate limit: rate tokens per second are added up to burst,
+// every command takes one.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+}
+
+// allow takes a token if there is one, a zero rate allows everything.
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+
+	if rate == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now, rate, burst)
+	return b.tokens >= float64(burst)
+}
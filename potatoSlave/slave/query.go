@@ -0,0 +1,319 @@
+package slave
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////////
+// Queries over hashes
+//////////
+
+// A query looks like
+//   SELECT field1, field2 FROM prefix WHERE field3 = 'value' AND field4 > 10
+//   ORDER BY field4 DESC LIMIT 10
+// Every hash of the user which key starts with prefix is a row and its fields
+// are columns. Everything but SELECT is optional, "*" selects all the fields.
+// TODO: there are no secondary indexes yet, so every query is a full scan of
+// the user's keys.
+
+// predicate is a single condition of a WHERE clause.
+type predicate struct {
+	field string
+	op    string
+	value string
+}
+
+type query struct {
+	fields  []string
+	prefix  string
+	where   []predicate
+	orderBy string
+	desc    bool
+	limit   int
+}
+
+// tokenize splits a query into words, quoted strings, operators and commas.
+func tokenize(q string) ([]string, error) {
+
+	var tokens []string
+
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == ',':
+			tokens = append(tokens, ",")
+			i++
+		case c == '\'':
+			end := strings.IndexByte(q[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("unterminated string")
+			}
+			// Quotes are kept so that strings are never taken for keywords
+			tokens = append(tokens, q[i:i+end+2])
+			i += end + 2
+		case strings.IndexByte("=!<>", c) != -1:
+			if i+1 < len(q) && q[i+1] == '=' {
+				tokens = append(tokens, q[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, q[i:i+1])
+				i++
+			}
+		default:
+			j := i
+			for j < len(q) && strings.IndexByte(" \t\n,'=!<>", q[j]) == -1 {
+				j++
+			}
+			tokens = append(tokens, q[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+// unquote removes quotes from a string token.
+func unquote(token string) string {
+
+	if len(token) >= 2 && token[0] == '\'' {
+		return token[1 : len(token)-1]
+	}
+	return token
+}
+
+// parseQuery turns a query string into a query.
+func parseQuery(q string) (query, error) {
+
+	var parsed query
+	parsed.limit = -1
+
+	tokens, err := tokenize(q)
+	if err != nil {
+		return parsed, err
+	}
+
+	pos := 0
+	next := func() string {
+		if pos >= len(tokens) {
+			return ""
+		}
+		pos++
+		return tokens[pos-1]
+	}
+	keyword := func(word string) bool {
+		if pos < len(tokens) && strings.ToUpper(tokens[pos]) == word {
+			pos++
+			return true
+		}
+		return false
+	}
+
+	if !keyword("SELECT") {
+		return parsed, errors.New("query should start with SELECT")
+	}
+	for {
+		field := next()
+		if field == "" || field == "," {
+			return parsed, errors.New("field expected")
+		}
+		if field != "*" {
+			parsed.fields = append(parsed.fields, unquote(field))
+		}
+		if pos >= len(tokens) || tokens[pos] != "," {
+			break
+		}
+		pos++
+	}
+
+	if keyword("FROM") {
+		parsed.prefix = unquote(next())
+	}
+
+	if keyword("WHERE") {
+		for {
+			p := predicate{field: unquote(next()), op: next(), value: unquote(next())}
+			switch p.op {
+			case "=", "!=", "<", "<=", ">", ">=":
+			default:
+				return parsed, errors.New("unknown operator " + p.op)
+			}
+			if p.field == "" {
+				return parsed, errors.New("field expected")
+			}
+			parsed.where = append(parsed.where, p)
+			if !keyword("AND") {
+				break
+			}
+		}
+	}
+
+	if keyword("ORDER") {
+		if !keyword("BY") {
+			return parsed, errors.New("BY expected")
+		}
+		parsed.orderBy = unquote(next())
+		if keyword("DESC") {
+			parsed.desc = true
+		} else {
+			keyword("ASC")
+		}
+	}
+
+	if keyword("LIMIT") {
+		if parsed.limit, err = strconv.Atoi(next()); err != nil || parsed.limit < 0 {
+			return parsed, errors.New("bad limit")
+		}
+	}
+
+	if pos != len(tokens) {
+		return parsed, errors.New("unexpected " + tokens[pos])
+	}
+
+	return parsed, nil
+}
+
+// compareValues compares two values as numbers if both of them are numbers and
+// as strings otherwise.
+func compareValues(a string, b string) int {
+
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	if errX == nil && errY == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(a, b)
+}
+
+// matches checks if a row satisfies all the predicates, missing fields never do.
+func (q query) matches(row map[string]string) bool {
+
+	for _, p := range q.where {
+		val, ok := row[p.field]
+		if !ok {
+			return false
+		}
+		c := compareValues(val, p.value)
+		switch p.op {
+		case "=":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// querycommand runs a query given as a single argument and returns matching
+// rows as a JSON array of objects, each having a "key" field with the key of
+// the hash besides the selected fields.
+func (s *PotatoSlave) querycommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	q, err := parseQuery(mes.Arguments[0])
+	if err != nil {
+		response.Value = err.Error()
+		setStatus(&response, _WA)
+		return response
+	}
+
+	type row struct {
+		key    string
+		fields map[string]string
+	}
+	var rows []row
+
+	s.storageMutex.Lock()
+	s.storage.Iterate(userID, func(key string, val potat) bool {
+
+		if s.live(userID, key) == nil {
+			return true
+		}
+
+		m, ok := val.(*pmap)
+		if !ok || !strings.HasPrefix(key, q.prefix) {
+			return true
+		}
+
+		fields := make(map[string]string, len(m.ourmap))
+		for field := range m.ourmap {
+			content, err := m.getContent(field)
+			if err != nil {
+				continue
+			}
+			if content, err = s.unseal(userID, key, content); err == nil {
+				fields[field] = content
+			}
+		}
+
+		if q.matches(fields) {
+			rows = append(rows, row{key: key, fields: fields})
+		}
+		return true
+	})
+	s.storageMutex.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		if q.orderBy != "" {
+			if c := compareValues(rows[i].fields[q.orderBy], rows[j].fields[q.orderBy]); c != 0 {
+				return (c < 0) != q.desc
+			}
+		}
+		return rows[i].key < rows[j].key
+	})
+
+	if q.limit >= 0 && len(rows) > q.limit {
+		rows = rows[:q.limit]
+	}
+
+	result := make([]map[string]string, 0, len(rows))
+	for _, r := range rows {
+		projected := map[string]string{"key": r.key}
+		if len(q.fields) == 0 {
+			for field, val := range r.fields {
+				projected[field] = val
+			}
+		}
+		for _, field := range q.fields {
+			if val, ok := r.fields[field]; ok {
+				projected[field] = val
+			}
+		}
+		result = append(result, projected)
+	}
+
+	body, _ := json.Marshal(result)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
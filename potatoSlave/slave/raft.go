@@ -0,0 +1,743 @@
+package slave
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////
+// Raft
+//////////
+
+// TODO: the log is never compacted, a member that is far behind gets all of
+// it at once, and all of it is applied again after a restart.
+// TODO: the group is fixed by RAFTPEERS, there are no membership changes.
+// TODO: values under encrypted prefixes are in RAFTPATH in plain text.
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// raftEntry is a write in the log of the group. An entry without a command
+// is the one a new leader starts its term with.
+type raftEntry struct {
+	Term    uint64
+	User    string `json:",omitempty"`
+	Command CommandMessage
+}
+
+// raftVote is the argument of RAFTVOTE, raftVoteReply is its Value.
+type raftVote struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type raftVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+// raftAppend is the argument of RAFTAPPEND, raftAppendReply is its Value.
+// Match is the last index the follower has in common with the leader, or
+// where the leader should try from when it didn't succeed.
+type raftAppend struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []raftEntry `json:",omitempty"`
+	Commit    uint64
+}
+
+type raftAppendReply struct {
+	Term    uint64
+	Success bool
+	Match   uint64
+}
+
+// raftRecord is a line of RAFTPATH: the term and the vote, and the entries
+// that replace the log from From on.
+type raftRecord struct {
+	Term     uint64
+	VotedFor string `json:",omitempty"`
+	From     uint64
+	Entries  []raftEntry `json:",omitempty"`
+}
+
+// raftNode is the state of the slave in its Raft group, guarded by mutex.
+// log[0] is a placeholder, entries are numbered from 1. heard is when the
+// slave last heard of a leader or voted, an election starts when it's too
+// long ago. waiters get the responses of entries the slave proposed as a
+// leader. file is RAFTPATH, size is how much of it is written.
+type raftNode struct {
+	mutex    sync.Mutex
+	term     uint64
+	votedFor string
+	role     int
+	leader   string
+	log      []raftEntry
+	commit   uint64
+	applied  uint64
+	next     map[string]uint64
+	match    map[string]uint64
+	heard    time.Time
+	waiters  map[uint64]chan ResponseMessage
+	file     *os.File
+	size     int64
+	// kick makes the leader replicate at once, committed wakes the applier
+	kick      chan struct{}
+	committed chan struct{}
+}
+
+func newRaftNode() raftNode {
+	return raftNode{
+		log:       make([]raftEntry, 1),
+		next:      make(map[string]uint64),
+		match:     make(map[string]uint64),
+		waiters:   make(map[uint64]chan ResponseMessage),
+		kick:      make(chan struct{}, 1),
+		committed: make(chan struct{}, 1),
+	}
+}
+
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// raftKey tells if a command is on a key of the Raft group.
+func (s *PotatoSlave) raftKey(mes CommandMessage) bool {
+
+	if len(s.RAFTPEERS) == 0 || len(mes.Arguments) == 0 {
+		return false
+	}
+	for _, prefix := range s.RAFTPREFIXES {
+		if strings.HasPrefix(mes.Arguments[0], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// openRaftLog loads the term, the vote and the log from RAFTPATH. Keys of the
+// group that the storage got from a snapshot or the append-only log are
+// dropped, committed entries are applied again from the start of the log.
+func (s *PotatoSlave) openRaftLog() error {
+
+	file, err := os.OpenFile(s.RAFTPATH, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	r := &s.raft
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var good int64
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) != 0 {
+				log.Printf("raft: dropping incomplete line %d", line)
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		var record raftRecord
+		if err := json.Unmarshal(b, &record); err != nil || record.From == 0 || record.From > uint64(len(r.log)) {
+			file.Close()
+			return errors.New("raft: malformed line " + strconv.Itoa(line))
+		}
+		r.term, r.votedFor = record.Term, record.VotedFor
+		r.log = append(r.log[:record.From], record.Entries...)
+		good += int64(len(b))
+	}
+
+	// Appending after a cut line would make the next one unreadable too
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, good
+
+	if len(r.log) > 1 {
+		s.storageMutex.Lock()
+		for _, user := range s.storage.Users() {
+			var keys []string
+			s.storage.Iterate(user, func(key string, _ potat) bool {
+				if s.raftKey(CommandMessage{Arguments: []string{key}}) {
+					keys = append(keys, key)
+				}
+				return true
+			})
+			for _, key := range keys {
+				s.storage.Delete(user, key)
+				s.deltas.mark(user, key)
+			}
+		}
+		s.storageMutex.Unlock()
+	}
+
+	return nil
+}
+
+// closeRaftLog closes RAFTPATH.
+func (s *PotatoSlave) closeRaftLog() {
+
+	r := &s.raft
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// raftPersist writes the term, the vote and the entries of the log from from
+// on to RAFTPATH and syncs it, the slave mustn't answer with them or count
+// them before. Without RAFTPATH they're in memory only. Should be called
+// under mutex.
+func (s *PotatoSlave) raftPersist(from uint64) error {
+
+	r := &s.raft
+	if r.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(raftRecord{Term: r.term, VotedFor: r.votedFor, From: from, Entries: r.log[from:]})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := r.file.Write(line); err != nil {
+		// A cut line would hide the ones after it
+		r.file.Truncate(r.size)
+		r.file.Seek(r.size, io.SeekStart)
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		return err
+	}
+	r.size += int64(len(line))
+	return nil
+}
+
+// raftFailed is the response of a slave that couldn't save its state.
+func (s *PotatoSlave) raftFailed(err error) ResponseMessage {
+
+	var response ResponseMessage
+
+	log.Printf("raft: %s", err)
+	s.stats.add("raft_errors", 1)
+	setStatus(&response, _IE)
+
+	return response
+}
+
+// raftPersistTerm writes a term learned from a reply, the slave doesn't
+// answer with it, so a failure is only logged. Should be called under mutex.
+func (s *PotatoSlave) raftPersistTerm() {
+
+	if err := s.raftPersist(uint64(len(s.raft.log))); err != nil {
+		log.Printf("raft: %s", err)
+		s.stats.add("raft_errors", 1)
+	}
+}
+
+func (s *PotatoSlave) raftMajority() int {
+	return (len(s.RAFTPEERS)+1)/2 + 1
+}
+
+// stepDown makes the slave a follower of a term. Proposals that are waiting
+// may still be committed by the next leader, they're answered with _RT.
+// Should be called under mutex.
+func (s *PotatoSlave) stepDown(term uint64) {
+
+	r := &s.raft
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.leader = ""
+	}
+	r.role = raftFollower
+	for index, waiter := range r.waiters {
+		var response ResponseMessage
+		setStatus(&response, _RT)
+		waiter <- response
+		delete(r.waiters, index)
+	}
+}
+
+// raftAsk sends a Raft message to a peer and decodes the reply, false if the
+// peer didn't answer in time.
+func (s *PotatoSlave) raftAsk(peer string, name string, args interface{}, reply interface{}) bool {
+
+	body, _ := json.Marshal(args)
+	response, err := askNode(peer, CommandMessage{Name: name, Arguments: []string{string(body)}}, s.RAFTELECTION/2)
+	return err == nil && response.Code == _OK && json.Unmarshal([]byte(response.Value), reply) == nil
+}
+
+// raftvote is RAFTVOTE vote, a candidate asks for the vote of the slave in
+// its term. The vote goes to the first candidate whose log is at least as
+// up to date as the slave's one.
+func (s *PotatoSlave) raftvote(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	var vote raftVote
+	if len(mes.Arguments) != 1 || json.Unmarshal([]byte(mes.Arguments[0]), &vote) != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	r := &s.raft
+	r.mutex.Lock()
+	term, votedFor := r.term, r.votedFor
+	if vote.Term > r.term {
+		s.stepDown(vote.Term)
+	}
+	reply := raftVoteReply{Term: r.term}
+	last := uint64(len(r.log) - 1)
+	upToDate := vote.LastTerm > r.log[last].Term || (vote.LastTerm == r.log[last].Term && vote.LastIndex >= last)
+	if vote.Term == r.term && (r.votedFor == "" || r.votedFor == vote.Candidate) && upToDate {
+		r.votedFor = vote.Candidate
+		r.heard = time.Now()
+		reply.Granted = true
+	}
+	// A vote that is forgotten after a restart could be given twice
+	if r.term != term || r.votedFor != votedFor {
+		if err := s.raftPersist(uint64(len(r.log))); err != nil {
+			r.mutex.Unlock()
+			return s.raftFailed(err)
+		}
+	}
+	r.mutex.Unlock()
+
+	body, _ := json.Marshal(reply)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// raftappend is RAFTAPPEND append, the leader sends entries that follow
+// PrevIndex, or none as a heartbeat. Entries that conflict with the leader's
+// ones are replaced.
+func (s *PotatoSlave) raftappend(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	var req raftAppend
+	if len(mes.Arguments) != 1 || json.Unmarshal([]byte(mes.Arguments[0]), &req) != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	r := &s.raft
+	r.mutex.Lock()
+	term := r.term
+	// from is where the log is changed, the length of it if it isn't
+	from := uint64(len(r.log))
+	reply := raftAppendReply{Term: r.term}
+	switch last := uint64(len(r.log) - 1); {
+	case req.Term < r.term:
+	case req.PrevIndex > last || r.log[req.PrevIndex].Term != req.PrevTerm:
+		s.stepDown(req.Term)
+		r.leader = req.Leader
+		r.heard = time.Now()
+		reply.Term = r.term
+		reply.Match = req.PrevIndex - 1
+		if last < reply.Match {
+			reply.Match = last
+		}
+		if r.term != term {
+			if err := s.raftPersist(from); err != nil {
+				r.mutex.Unlock()
+				return s.raftFailed(err)
+			}
+		}
+	default:
+		s.stepDown(req.Term)
+		r.leader = req.Leader
+		r.heard = time.Now()
+		reply.Term = r.term
+		for i, entry := range req.Entries {
+			index := req.PrevIndex + 1 + uint64(i)
+			if index < uint64(len(r.log)) {
+				if r.log[index].Term == entry.Term {
+					continue
+				}
+				r.log = r.log[:index]
+			}
+			if index < from {
+				from = index
+			}
+			r.log = append(r.log, entry)
+		}
+		// The leader counts on the entries once they're acknowledged, they
+		// are taken again on the next try if they aren't saved
+		if from < uint64(len(r.log)) || r.term != term {
+			if err := s.raftPersist(from); err != nil {
+				r.log = r.log[:from]
+				r.mutex.Unlock()
+				return s.raftFailed(err)
+			}
+		}
+		reply.Success = true
+		reply.Match = req.PrevIndex + uint64(len(req.Entries))
+		if commit := req.Commit; commit > r.commit {
+			if commit > reply.Match {
+				commit = reply.Match
+			}
+			r.commit = commit
+			wake(r.committed)
+		}
+	}
+	r.mutex.Unlock()
+
+	body, _ := json.Marshal(reply)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// raftElect makes the slave a candidate of the next term, it becomes the
+// leader with the votes of a majority.
+func (s *PotatoSlave) raftElect() {
+
+	r := &s.raft
+	me := s.advertised()
+
+	r.mutex.Lock()
+	r.term++
+	r.role = raftCandidate
+	r.votedFor = me
+	r.leader = ""
+	r.heard = time.Now()
+	last := uint64(len(r.log) - 1)
+	vote := raftVote{Term: r.term, Candidate: me, LastIndex: last, LastTerm: r.log[last].Term}
+	if err := s.raftPersist(last + 1); err != nil {
+		r.role = raftFollower
+		r.mutex.Unlock()
+		s.raftFailed(err)
+		return
+	}
+	r.mutex.Unlock()
+	s.stats.add("raft_elections", 1)
+
+	replies := make([]raftVoteReply, len(s.RAFTPEERS))
+	var wg sync.WaitGroup
+	for i, peer := range s.RAFTPEERS {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			s.raftAsk(peer, "RAFTVOTE", vote, &replies[i])
+		}(i, peer)
+	}
+	wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	votes := 1
+	for _, reply := range replies {
+		if reply.Term > r.term {
+			s.stepDown(reply.Term)
+			s.raftPersistTerm()
+			return
+		}
+		if reply.Granted && reply.Term == vote.Term {
+			votes++
+		}
+	}
+	if r.role != raftCandidate || r.term != vote.Term || votes < s.raftMajority() {
+		return
+	}
+
+	r.role = raftLeader
+	r.leader = me
+	for _, peer := range s.RAFTPEERS {
+		r.next[peer] = uint64(len(r.log))
+		r.match[peer] = 0
+	}
+	// Entries of older terms are committed only along with one of the
+	// leader's term
+	r.log = append(r.log, raftEntry{Term: r.term})
+	if err := s.raftPersist(uint64(len(r.log) - 1)); err != nil {
+		r.log = r.log[:len(r.log)-1]
+		s.stepDown(r.term)
+		s.raftFailed(err)
+		return
+	}
+	s.stats.add("raft_leaderships", 1)
+	wake(r.kick)
+}
+
+// raftReplicate sends every peer the entries it's missing and returns how
+// many members, the leader included, acknowledged the leader in its term.
+func (s *PotatoSlave) raftReplicate() int {
+
+	r := &s.raft
+	me := s.advertised()
+
+	r.mutex.Lock()
+	if r.role != raftLeader {
+		r.mutex.Unlock()
+		return 0
+	}
+	term := r.term
+	reqs := make([]raftAppend, len(s.RAFTPEERS))
+	for i, peer := range s.RAFTPEERS {
+		prev := r.next[peer] - 1
+		reqs[i] = raftAppend{
+			Term:      term,
+			Leader:    me,
+			PrevIndex: prev,
+			PrevTerm:  r.log[prev].Term,
+			Entries:   append([]raftEntry(nil), r.log[prev+1:]...),
+			Commit:    r.commit,
+		}
+	}
+	r.mutex.Unlock()
+
+	replies := make([]raftAppendReply, len(s.RAFTPEERS))
+	answered := make([]bool, len(s.RAFTPEERS))
+	var wg sync.WaitGroup
+	for i, peer := range s.RAFTPEERS {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			answered[i] = s.raftAsk(peer, "RAFTAPPEND", reqs[i], &replies[i])
+		}(i, peer)
+	}
+	wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	acks := 1
+	for i, peer := range s.RAFTPEERS {
+		reply := replies[i]
+		if !answered[i] {
+			continue
+		}
+		if reply.Term > r.term {
+			s.stepDown(reply.Term)
+			s.raftPersistTerm()
+			return 0
+		}
+		if r.role != raftLeader || r.term != term {
+			return 0
+		}
+		acks++
+		if reply.Success {
+			if reply.Match > r.match[peer] {
+				r.match[peer] = reply.Match
+			}
+			r.next[peer] = r.match[peer] + 1
+		} else {
+			r.next[peer] = reply.Match + 1
+		}
+	}
+
+	// The last entry of the term that a majority has is committed
+	for index := uint64(len(r.log) - 1); index > r.commit && r.log[index].Term == term; index-- {
+		count := 1
+		for _, peer := range s.RAFTPEERS {
+			if r.match[peer] >= index {
+				count++
+			}
+		}
+		if count >= s.raftMajority() {
+			r.commit = index
+			wake(r.committed)
+			break
+		}
+	}
+
+	return acks
+}
+
+// raftPropose appends a write to the log of the group and waits till it's
+// applied. Only the leader takes writes, others answer with _NL and the
+// address of the leader they know in Value.
+func (s *PotatoSlave) raftPropose(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	r := &s.raft
+	r.mutex.Lock()
+	if r.role != raftLeader {
+		response.Value = r.leader
+		r.mutex.Unlock()
+		setStatus(&response, _NL)
+		return response
+	}
+	r.log = append(r.log, raftEntry{Term: r.term, User: userID, Command: mes})
+	if err := s.raftPersist(uint64(len(r.log) - 1)); err != nil {
+		r.log = r.log[:len(r.log)-1]
+		r.mutex.Unlock()
+		return s.raftFailed(err)
+	}
+	waiter := make(chan ResponseMessage, 1)
+	r.waiters[uint64(len(r.log)-1)] = waiter
+	r.mutex.Unlock()
+	wake(r.kick)
+
+	select {
+	case response = <-waiter:
+	case <-time.After(s.RAFTTIMEOUT):
+		// The write may still be applied later
+		setStatus(&response, _RT)
+	}
+	return response
+}
+
+// raftRead lets a read of the group go once the slave knows it's still the
+// leader and has applied every write committed before the read came.
+func (s *PotatoSlave) raftRead() ResponseMessage {
+
+	var response ResponseMessage
+
+	r := &s.raft
+	r.mutex.Lock()
+	if r.role != raftLeader {
+		response.Value = r.leader
+		r.mutex.Unlock()
+		setStatus(&response, _NL)
+		return response
+	}
+	// A new leader doesn't know what's committed till an entry of its term is
+	readIndex, ready := r.commit, r.log[r.commit].Term == r.term
+	r.mutex.Unlock()
+
+	if !ready || s.raftReplicate() < s.raftMajority() {
+		setStatus(&response, _RT)
+		return response
+	}
+
+	deadline := time.Now().Add(s.RAFTTIMEOUT)
+	for {
+		r.mutex.Lock()
+		applied := r.applied
+		r.mutex.Unlock()
+		if applied >= readIndex {
+			break
+		}
+		if time.Now().After(deadline) {
+			setStatus(&response, _RT)
+			return response
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	setStatus(&response, _OK)
+	return response
+}
+
+// raftApplyRoutine applies committed entries in the order of the log and
+// answers the proposals waiting for them, until stop is closed.
+func (s *PotatoSlave) raftApplyRoutine(stop chan struct{}) {
+
+	r := &s.raft
+	for {
+		select {
+		case <-stop:
+			return
+		case <-r.committed:
+		}
+
+		for {
+			r.mutex.Lock()
+			if r.applied >= r.commit {
+				r.mutex.Unlock()
+				break
+			}
+			index := r.applied + 1
+			entry := r.log[index]
+			r.mutex.Unlock()
+
+			var response ResponseMessage
+			if entry.Command.Name != "" {
+				s.storageMutex.Lock()
+				s.storage.AddUser(entry.User)
+				s.storageMutex.Unlock()
+
+				mes := entry.Command
+				mes.raftApplied = true
+				mes.confirmed = true
+				response = s.invoke(entry.User, mes)
+				s.stats.add("raft_applied", 1)
+			}
+
+			r.mutex.Lock()
+			r.applied = index
+			if waiter, ok := r.waiters[index]; ok {
+				waiter <- response
+				delete(r.waiters, index)
+			}
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// raftRoutine runs elections while there is no leader and replicates every
+// RAFTHEARTBEAT while the slave is the leader, until stopped by someone.
+func (s *PotatoSlave) raftRoutine(shutdownChan chan bool) {
+
+	stop := make(chan struct{})
+	go s.raftApplyRoutine(stop)
+
+	r := &s.raft
+	r.mutex.Lock()
+	r.heard = time.Now()
+	r.mutex.Unlock()
+
+	timeout := s.RAFTELECTION + time.Duration(rand.Int63n(int64(s.RAFTELECTION)))
+	for {
+		select {
+		case <-shutdownChan:
+			close(stop)
+			return
+		case <-r.kick:
+		case <-time.After(s.RAFTHEARTBEAT):
+		}
+
+		r.mutex.Lock()
+		role, heard := r.role, r.heard
+		r.mutex.Unlock()
+
+		switch {
+		case role == raftLeader:
+			s.raftReplicate()
+		case time.Since(heard) > timeout:
+			s.raftElect()
+			timeout = s.RAFTELECTION + time.Duration(rand.Int63n(int64(s.RAFTELECTION)))
+		}
+	}
+}
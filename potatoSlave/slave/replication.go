@@ -0,0 +1,401 @@
+package slave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////
+// Replication
+//////////
+
+// TODO: a replica that reconnects gets a full snapshot every time, the
+// primary could keep a backlog of the stream to resume from.
+
+// replicaFeed is the stream of writes to one replica. A feed that falls more
+// than REPLICABUFFER lines behind is dropped and the replica syncs again.
+type replicaFeed struct {
+	lines    chan []byte
+	dropped  chan struct{}
+	dropOnce sync.Once
+	// acked is the last seq the replica has applied, guarded by ackMutex
+	acked uint64
+}
+
+// replicaAck is what a replica sends back for every line it has applied.
+type replicaAck struct {
+	Seq uint64
+}
+
+func (f *replicaFeed) drop() {
+	f.dropOnce.Do(func() { close(f.dropped) })
+}
+
+// replication is the set of replica feeds of a primary. Feeds are attached and
+// detached under saveMutex, so logged commands, which hold it for reading,
+// see the same set from start to end. mutex orders logged commands while
+// there are replicas, so they're streamed in the order they were applied.
+type replication struct {
+	mutex sync.Mutex
+	feeds map[*replicaFeed]bool
+	seq   uint64
+	// promoted is set to 1 when a replica is promoted, stop is closed then
+	promoted int32
+	stop     chan struct{}
+	// written is the seq of the last write of every user, guarded by mutex.
+	// ackMutex guards acks of the feeds, ackChanged is closed on every ack.
+	written    map[string]uint64
+	ackMutex   sync.Mutex
+	ackChanged chan struct{}
+}
+
+// isReplica tells if the slave follows a primary, a promoted replica is a
+// primary with the data it had.
+func (s *PotatoSlave) isReplica() bool {
+	return s.ROLE == "replica" && atomic.LoadInt32(&s.replication.promoted) == 0
+}
+
+// lockWrite is held by a logged command while it's applied and logged, it
+// returns the function that releases it.
+func (s *PotatoSlave) lockWrite() func() {
+
+	if s.aof != nil {
+		s.aof.mutex.Lock()
+	}
+	s.saveMutex.RLock()
+	replicated := len(s.replication.feeds) != 0
+	if replicated {
+		s.replication.mutex.Lock()
+	}
+
+	return func() {
+		if replicated {
+			s.replication.mutex.Unlock()
+		}
+		s.saveMutex.RUnlock()
+		if s.aof != nil {
+			s.aof.mutex.Unlock()
+		}
+	}
+}
+
+// logWrite writes a logged command that was applied to the append-only log and
+// streams it to replicas. Must be called under lockWrite.
+func (s *PotatoSlave) logWrite(userID string, mes CommandMessage) {
+
+	if s.aof != nil {
+		s.appendCommand(userID, mes)
+	}
+
+	if len(s.replication.feeds) == 0 {
+		return
+	}
+	s.replication.seq++
+	if s.replication.written == nil {
+		s.replication.written = make(map[string]uint64)
+	}
+	s.replication.written[userID] = s.replication.seq
+	line, err := s.logLine(s.replication.seq, userID, mes)
+	if err != nil {
+		log.Printf("replication: %s", err)
+		return
+	}
+	for feed := range s.replication.feeds {
+		select {
+		case feed.lines <- line:
+		default:
+			feed.drop()
+		}
+	}
+}
+
+// syncReplica is SYNC, it turns the connection into a stream of writes for a
+// replica: a line of the log with a snapshot in Base and then a line for
+// every logged command applied after the snapshot, until the replica
+// disconnects or falls behind. The replica answers every line but heartbeats
+// with a replicaAck.
+func (s *PotatoSlave) syncReplica(connection net.Conn, encoder *json.Encoder, mes CommandMessage) {
+
+	if len(mes.Arguments) != 0 {
+		var response ResponseMessage
+		setStatus(&response, _WA)
+		encoder.Encode(response)
+		return
+	}
+
+	feed := &replicaFeed{lines: make(chan []byte, s.REPLICABUFFER), dropped: make(chan struct{})}
+	var seq uint64
+	err := s.startSnapshotWith(func() {
+		if s.replication.feeds == nil {
+			s.replication.feeds = make(map[*replicaFeed]bool)
+		}
+		s.replication.feeds[feed] = true
+		seq = s.replication.seq
+	})
+	var snap snapshot
+	if err == nil {
+		snap, err = s.finishSnapshot(nil)
+	}
+	defer func() {
+		s.saveMutex.Lock()
+		delete(s.replication.feeds, feed)
+		s.saveMutex.Unlock()
+	}()
+
+	var base bytes.Buffer
+	if err == nil {
+		err = encodeSnapshot(&base, snap)
+	}
+	if err != nil {
+		var response ResponseMessage
+		response.Value = err.Error()
+		setStatus(&response, _SV)
+		encoder.Encode(response)
+		return
+	}
+
+	s.stats.add("replicas_attached", 1)
+	connection.SetReadDeadline(time.Time{})
+
+	// The replica sends only acks, a read fails when it's gone
+	go func() {
+		decoder := json.NewDecoder(connection)
+		for {
+			var ack replicaAck
+			if decoder.Decode(&ack) != nil {
+				break
+			}
+			s.acked(feed, ack.Seq)
+		}
+		feed.drop()
+	}()
+
+	line, _ := json.Marshal(logEntry{Seq: seq, Time: time.Now(), Base: base.Bytes()})
+	writer := bufio.NewWriter(connection)
+	_, err = writer.Write(append(line, '\n'))
+	for err == nil {
+		if len(feed.lines) == 0 {
+			err = writer.Flush()
+		}
+		select {
+		case line := <-feed.lines:
+			if err == nil {
+				_, err = writer.Write(line)
+			}
+		case <-feed.dropped:
+			err = errors.New("replica is gone or behind")
+		case <-time.After(s.REPLICAHEARTBEAT):
+			// An entry without a command tells that nothing was missed by now
+			heartbeat, _ := json.Marshal(logEntry{Time: time.Now()})
+			if err == nil {
+				_, err = writer.Write(append(heartbeat, '\n'))
+			}
+		}
+	}
+
+	s.stats.add("replicas_detached", 1)
+}
+
+// followPrimary applies the stream of writes of the primary on conn until the
+// connection is lost or nothing, not even a heartbeat, comes for three
+// REPLICAHEARTBEAT.
+func (s *PotatoSlave) followPrimary(conn net.Conn) error {
+
+	if err := json.NewEncoder(conn).Encode(CommandMessage{Name: "SYNC"}); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	acks := json.NewEncoder(conn)
+	synced := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.REPLICAHEARTBEAT * 3))
+		b, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return err
+		}
+
+		if entry.Base != nil {
+			s.resetStorage()
+			if err := s.readSnapshot(bytes.NewReader(entry.Base)); err != nil {
+				return err
+			}
+			synced = true
+			atomic.StoreInt64(&s.replicatedAt, entry.Time.UnixNano())
+			s.stats.add("replica_syncs", 1)
+			if err := acks.Encode(replicaAck{Seq: entry.Seq}); err != nil {
+				return err
+			}
+			continue
+		}
+		if !synced {
+			// A response of a primary that refused SYNC
+			var response ResponseMessage
+			json.Unmarshal(b, &response)
+			return errors.New("primary refused to sync: " + response.StatusMessage + " " + response.Value)
+		}
+		if entry.Command.Name == "" {
+			atomic.StoreInt64(&s.replicatedAt, entry.Time.UnixNano())
+			continue
+		}
+
+		mes, err := s.replayed(entry)
+		if err != nil {
+			return err
+		}
+		s.storageMutex.Lock()
+		s.storage.AddUser(entry.User)
+		s.storageMutex.Unlock()
+
+		mes.replicated = true
+		s.invoke(entry.User, mes)
+		atomic.StoreInt64(&s.replicatedAt, entry.Time.UnixNano())
+		s.stats.add("replicated_commands", 1)
+		if err := acks.Encode(replicaAck{Seq: entry.Seq}); err != nil {
+			return err
+		}
+	}
+}
+
+// acked records that a replica has applied everything up to seq.
+func (s *PotatoSlave) acked(feed *replicaFeed, seq uint64) {
+
+	r := &s.replication
+	r.ackMutex.Lock()
+	defer r.ackMutex.Unlock()
+
+	if seq > feed.acked {
+		feed.acked = seq
+	}
+	if r.ackChanged != nil {
+		close(r.ackChanged)
+		r.ackChanged = nil
+	}
+}
+
+// waitcommand is WAIT numreplicas timeout, it blocks until numreplicas
+// replicas have applied every write of the user so far or timeout
+// milliseconds pass, 0 waits for as long as it takes. The number of replicas
+// that have them is in Value either way.
+func (s *PotatoSlave) waitcommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+	want, err1 := strconv.Atoi(mes.Arguments[0])
+	ms, err2 := strconv.ParseInt(mes.Arguments[1], 10, 64)
+	if err1 != nil || err2 != nil || want < 0 || ms < 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+	var deadline <-chan time.Time
+	if ms > 0 {
+		deadline = time.After(time.Millisecond * time.Duration(ms))
+	}
+
+	r := &s.replication
+	r.mutex.Lock()
+	seq := r.written[userID]
+	r.mutex.Unlock()
+
+	for {
+		// Feeds come and go under saveMutex
+		s.saveMutex.RLock()
+		r.ackMutex.Lock()
+		count := 0
+		for feed := range r.feeds {
+			if feed.acked >= seq {
+				count++
+			}
+		}
+		if r.ackChanged == nil {
+			r.ackChanged = make(chan struct{})
+		}
+		changed := r.ackChanged
+		r.ackMutex.Unlock()
+		s.saveMutex.RUnlock()
+
+		response.Value = strconv.Itoa(count)
+		if count >= want {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-deadline:
+		}
+		break
+	}
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// replicationLag is how long ago the primary sent the last write or heartbeat
+// the replica has applied, measured by the clocks of both. It's -1 until the
+// first sync.
+func (s *PotatoSlave) replicationLag() time.Duration {
+
+	at := atomic.LoadInt64(&s.replicatedAt)
+	if at == 0 {
+		return -1
+	}
+	if lag := time.Since(time.Unix(0, at)); lag > 0 {
+		return lag
+	}
+	// Clocks of the nodes differ
+	return time.Nanosecond
+}
+
+// replicaRoutine follows REPLICAOF and connects again a second after the
+// connection is lost, until stopped by someone or PROMOTE.
+func (s *PotatoSlave) replicaRoutine(shutdownChan chan bool) {
+
+	lost := make(chan error, 1)
+	for {
+		conn, err := net.DialTimeout("tcp", s.REPLICAOF, time.Second*5)
+		if err == nil {
+			go func() { lost <- s.followPrimary(conn) }()
+			select {
+			case <-shutdownChan:
+				conn.Close()
+				<-lost
+				return
+			case <-s.replication.stop:
+				conn.Close()
+				<-lost
+				<-shutdownChan
+				return
+			case err = <-lost:
+				conn.Close()
+			}
+		}
+		log.Printf("replication: %s", err)
+		s.stats.add("replica_errors", 1)
+
+		select {
+		case <-shutdownChan:
+			return
+		case <-s.replication.stop:
+			<-shutdownChan
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package slave
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////
+// RESP
+//////////
+
+// TODO: MULTI, WATCH and pub/sub of Redis aren't there, the JSON protocol
+// has SUBSCRIBE for expirations only.
+
+// respMaxBulk and respMaxArgs are the largest bulk string and command a
+// client may send, like proto-max-bulk-len of Redis. respMaxLine is the
+// longest inline command or header of an array or a bulk string.
+const (
+	respMaxBulk = 512 << 20
+	respMaxArgs = 1 << 20
+	respMaxLine = 64 << 10
+)
+
+// respPrealloc is how much of a command is allocated before its bytes come,
+// the rest grows as they arrive, so a header alone can't take the memory.
+const respPrealloc = 64 << 10
+
+// respReply is what kind of a RESP reply a command gets from its Value.
+type respReply int
+
+const (
+	respBulk respReply = iota
+	respStatus
+	respInt
+	respArray
+)
+
+// respCommand is how a Redis command runs in potato: as the potato command
+// name, with its arguments turned by args when it's set.
+type respCommand struct {
+	name  string
+	reply respReply
+	args  func(args []string) ([]string, time.Duration, error)
+}
+
+var errRESPSyntax = errors.New("ERR syntax error")
+
+// respCommands are the commands whose arguments or replies differ from the
+// potato ones, others are sent as they are and get a bulk string.
+var respCommands = map[string]respCommand{
+	"GET":       {name: "GET"},
+	"SET":       {name: "SET", reply: respStatus, args: respSetArgs},
+	"EXPIRE":    {name: "EXPIRE", reply: respInt},
+	"PEXPIRE":   {name: "PEXPIRE", reply: respInt},
+	"EXPIREAT":  {name: "EXPIREAT", reply: respInt},
+	"PEXPIREAT": {name: "PEXPIREAT", reply: respInt},
+	"PERSIST":   {name: "PERSIST", reply: respInt},
+	"TTL":       {name: "TTL", reply: respInt},
+	"PTTL":      {name: "PTTL", reply: respInt},
+	"HGET":      {name: "HGET"},
+	"HGETALL":   {name: "HGETALL", reply: respArray},
+	"LINDEX":    {name: "LGET"},
+	"LLEN":      {name: "LLEN", reply: respInt},
+	"SADD":      {name: "SADD", reply: respInt, args: respNoExpiry},
+	"SREM":      {name: "SREM", reply: respInt},
+	"SISMEMBER": {name: "SISMEMBER", reply: respInt},
+	"SCARD":     {name: "SCARD", reply: respInt},
+	"SMEMBERS":  {name: "SMEMBERS", reply: respArray},
+	"KEYS":      {name: "KEYS", reply: respArray},
+	"PFADD":     {name: "PFADD", reply: respInt},
+	"PFCOUNT":   {name: "PFCOUNT", reply: respInt},
+	"GETBIT":    {name: "GETBIT", reply: respInt},
+	"SETBIT":    {name: "SETBIT", reply: respInt},
+	"BITCOUNT":  {name: "BITCOUNT", reply: respInt},
+	"WAIT":      {name: "WAIT", reply: respInt},
+}
+
+// respSetArgs turns SET key value [EX seconds | PX milliseconds] into SET
+// with a TTL, a key without one never expires like in Redis.
+func respSetArgs(args []string) ([]string, time.Duration, error) {
+
+	switch {
+	case len(args) == 2:
+		return args, -1, nil
+	case len(args) == 4:
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, 0, errors.New("ERR invalid expire time in 'set' command")
+		}
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			return args[:2], time.Duration(n) * time.Second, nil
+		case "PX":
+			return args[:2], time.Duration(n) * time.Millisecond, nil
+		}
+	}
+	return nil, 0, errRESPSyntax
+}
+
+// respNoExpiry keeps keys that a command creates forever like in Redis.
+func respNoExpiry(args []string) ([]string, time.Duration, error) {
+	return args, -1, nil
+}
+
+// readRESP reads a command, an array of bulk strings or an inline command.
+func readRESP(reader *bufio.Reader) ([]string, error) {
+
+	line, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, errors.New("ERR Protocol error: invalid multibulk length")
+	}
+	capacity := n
+	if capacity > respPrealloc/16 {
+		capacity = respPrealloc / 16
+	}
+	args := make([]string, 0, capacity)
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("ERR Protocol error: expected '$'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, errors.New("ERR Protocol error: invalid bulk length")
+		}
+		b, err := readAtMost(reader, size+2, respPrealloc)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line of at most respMaxLine bytes.
+func readRESPLine(reader *bufio.Reader) (string, error) {
+
+	var line []byte
+	for {
+		part, err := reader.ReadSlice('\n')
+		if len(line)+len(part) > respMaxLine {
+			return "", errors.New("ERR Protocol error: too big inline request")
+		}
+		line = append(line, part...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// readAtMost reads n bytes, allocating prealloc of them at first and the
+// rest as they come.
+func readAtMost(reader io.Reader, n int, prealloc int) ([]byte, error) {
+
+	if n <= prealloc {
+		b := make([]byte, n)
+		_, err := io.ReadFull(reader, b)
+		return b, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, prealloc))
+	if _, err := io.CopyN(buf, reader, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// respWriter writes RESP2 replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) status(s string) { w.WriteString("+" + s + "\r\n") }
+func (w respWriter) fail(s string)   { w.WriteString("-" + s + "\r\n") }
+func (w respWriter) integer(n int64) { w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n") }
+func (w respWriter) null()           { w.WriteString("$-1\r\n") }
+
+func (w respWriter) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w respWriter) array(items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		w.bulk(item)
+	}
+}
+
+// respError is the error reply for a response that isn't OK.
+func respError(name string, response ResponseMessage) string {
+
+	switch response.Code {
+	case _UC:
+		return "ERR unknown command '" + name + "'"
+	case _WT:
+		return "WRONGTYPE Operation against a key holding the wrong kind of value"
+	case _WA:
+		return "ERR wrong number of arguments for '" + strings.ToLower(name) + "' command"
+	}
+	message := "ERR " + response.StatusMessage
+	if response.Value != "" {
+		message += ": " + response.Value
+	}
+	return message
+}
+
+// respCall runs one command of a client and writes its reply.
+func (s *PotatoSlave) respCall(w respWriter, sess *session, args []string) {
+
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	// Commands of the connection rather than of potato
+	switch name {
+	case "PING":
+		if len(args) == 0 {
+			w.status("PONG")
+			return
+		}
+		name = "ECHO"
+	case "QUIT", "SELECT":
+		w.status("OK")
+		return
+	case "COMMAND":
+		w.array(nil)
+		return
+	case "CLIENT":
+		w.status("OK")
+		return
+	case "AUTH":
+		if !s.authRequired() {
+			w.fail("ERR AUTH <password> called without any password configured for the default user")
+			return
+		}
+		// AUTH password logs in as "default"
+		if len(args) == 1 && !strings.HasPrefix(args[0], tokenPrefix) {
+			args = []string{"default", args[0]}
+		}
+		switch s.auth(sess, CommandMessage{Name: "AUTH", Arguments: args}).Code {
+		case _OK:
+			w.status("OK")
+		case _WA:
+			w.fail("ERR wrong number of arguments for 'auth' command")
+		default:
+			w.fail("WRONGPASS invalid username-password pair or user is disabled.")
+		}
+		return
+	case "HELLO":
+		// HELLO of potato isn't the one of RESP3, clients fall back to RESP2
+		w.fail("NOPROTO unsupported protocol version")
+		return
+	case "DEL", "EXISTS", "UNLINK":
+		// One key at a time, the reply counts the keys that were there. DEL of
+		// potato succeeds for a missing key too.
+		var n int64
+		for _, key := range args {
+			if s.respInvoke(sess, CommandMessage{Name: "PTTL", Arguments: []string{key}}).Code != _OK {
+				continue
+			}
+			if name == "EXISTS" || s.respInvoke(sess, CommandMessage{Name: "DEL", Arguments: []string{key}}).Code == _OK {
+				n++
+			}
+		}
+		w.integer(n)
+		return
+	case "HSET", "HMSET", "LPUSH":
+		s.respEach(w, sess, name, args)
+		return
+	}
+
+	c, ok := respCommands[name]
+	if !ok {
+		c = respCommand{name: name}
+	}
+	mes := CommandMessage{Name: c.name, Arguments: args}
+	if c.args != nil {
+		var err error
+		if mes.Arguments, mes.TTL, err = c.args(args); err != nil {
+			w.fail(err.Error())
+			return
+		}
+	}
+	if name == "KEYS" {
+		mes.Arguments = nil
+	}
+	// Arrays are of the raw items of commands of streamFunctions, all at once
+	var items []string
+	if _, ok := s.streamFunctions[c.name]; ok && c.reply == respArray {
+		mes.stream = &itemStream{emit: func(batch []string) bool {
+			items = append(items, batch...)
+			return true
+		}}
+	}
+
+	response := s.respInvoke(sess, mes)
+	switch {
+	case response.Code == _AU:
+		w.fail("NOAUTH Authentication required.")
+	case response.Code == _NP:
+		w.fail("NOPERM this user has no permissions to run the '" + strings.ToLower(name) + "' command or its key")
+	case response.Code == _NK && c.reply == respInt:
+		switch name {
+		case "TTL", "PTTL":
+			w.integer(-2)
+		default:
+			w.integer(0)
+		}
+	case response.Code == _NK && c.reply == respArray:
+		w.array(nil)
+	case response.Code == _NK || response.Nil:
+		w.null()
+	case response.Code != _OK:
+		w.fail(respError(name, response))
+	case c.reply == respStatus:
+		w.status("OK")
+	case c.reply == respInt:
+		n, err := strconv.ParseInt(response.Value, 10, 64)
+		if err != nil {
+			// Commands like EXPIRE have no value but succeed for one key
+			n = 1
+		}
+		w.integer(n)
+	case c.reply == respArray:
+		if name == "KEYS" && len(args) == 1 {
+			var matched []string
+			for _, key := range items {
+				if ok, _ := path.Match(args[0], key); ok {
+					matched = append(matched, key)
+				}
+			}
+			items = matched
+		}
+		w.array(items)
+	default:
+		w.bulk(response.Value)
+	}
+}
+
+// respEach runs HSET key field value [field value ...] and LPUSH key value
+// [value ...] one field or value at a time, keys they create never expire.
+// HSET answers with the number of fields that weren't there, HGET tells
+// it before each one, and LPUSH with LLEN of the list after the last value.
+func (s *PotatoSlave) respEach(w respWriter, sess *session, name string, args []string) {
+
+	step := 1
+	potato := "LPUSH"
+	if name != "LPUSH" {
+		step, potato = 2, "HSET"
+	}
+	if len(args) < 1+step || (len(args)-1)%step != 0 {
+		w.fail("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return
+	}
+
+	var n int64
+	for i := 1; i < len(args); i += step {
+		mes := CommandMessage{Name: potato, Arguments: append([]string{args[0]}, args[i:i+step]...), TTL: -1}
+		if potato == "HSET" {
+			switch s.respInvoke(sess, CommandMessage{Name: "HGET", Arguments: mes.Arguments[:2]}).Code {
+			case _OK, _DE:
+			default:
+				n++
+			}
+		}
+		if response := s.respInvoke(sess, mes); response.Code != _OK {
+			w.fail(respError(name, response))
+			return
+		}
+	}
+	if name == "LPUSH" {
+		response := s.respInvoke(sess, CommandMessage{Name: "LLEN", Arguments: args[:1]})
+		n, _ = strconv.ParseInt(response.Value, 10, 64)
+	}
+	if name == "HMSET" {
+		w.status("OK")
+		return
+	}
+	w.integer(n)
+}
+
+// respInvoke runs a command like the JSON protocol does.
+func (s *PotatoSlave) respInvoke(sess *session, mes CommandMessage) ResponseMessage {
+
+	if response, ok := s.permit(sess, mes); !ok {
+		s.record(sess, mes, response)
+		return response
+	}
+	if s.standbyRefuses(mes) {
+		var response ResponseMessage
+		setStatus(&response, _SB)
+		s.record(sess, mes, response)
+		return response
+	}
+	response := s.invoke(sess.keyspace, mes)
+	s.record(sess, mes, response)
+	return response
+}
+
+// handleRESP serves a connection of a Redis client. Replies are flushed when
+// the client has sent nothing more, so pipelines get them in one write.
+func (s *PotatoSlave) handleRESP(connection net.Conn, username string) {
+
+	defer connection.Close()
+
+	held := worker{s: s}
+	defer held.release()
+	defer func() {
+		if r := recover(); r != nil && !s.recoverPanic(r, username, CommandMessage{}) {
+			panic(r)
+		}
+	}()
+
+	reader := bufio.NewReader(connection)
+	w := respWriter{bufio.NewWriter(connection)}
+	sess := &session{login: username, keyspace: username, host: remoteHost(connection)}
+	for {
+		held.release()
+		connection.SetReadDeadline(s.clock().Add(s.STALETIME))
+		args, err := readRESP(reader)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "ERR ") {
+				w.fail(err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if _, cheap := s.cheapFunctions[strings.ToUpper(args[0])]; cheap || held.take() {
+			s.respCall(w, sess, args)
+		} else {
+			w.fail("ERR " + statusMessages.message(_NW))
+		}
+		s.stats.add("resp_commands", 1)
+		if strings.EqualFold(args[0], "QUIT") {
+			w.Flush()
+			return
+		}
+		if reader.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// ServeRESP serves Redis clients on a listener with RESP2 for the commands
+// that potato has, it blocks until the listener fails. Connections and their
+// commands take workers like the ones of Serve.
+func (s *PotatoSlave) ServeRESP(listener net.Listener) error {
+
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if isTemporaryAcceptError(err) {
+				time.Sleep(time.Millisecond * 5)
+				continue
+			}
+			return err
+		}
+
+		s.admit(c, s.handleRESP, func(c net.Conn) {
+			c.Write([]byte("-ERR " + statusMessages.message(_NW) + "\r\n"))
+			c.Close()
+		})
+	}
+}
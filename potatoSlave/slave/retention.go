@@ -0,0 +1,198 @@
+package slave
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////
+// Retention policies
+//////////
+
+// retentionRule limits the lifetime of every key that starts with prefix.
+type retentionRule struct {
+	prefix string
+	maxTTL time.Duration
+}
+
+// AddRetentionRule makes keys under prefix live at most maxTTL. The rule is
+// applied to TTLs of new writes and, by retentionCheckRoutine, to the keys that
+// already exist.
+func (s *PotatoSlave) AddRetentionRule(prefix string, maxTTL time.Duration) {
+
+	s.storageMutex.Lock()
+	s.retentionRules = append(s.retentionRules, retentionRule{
+		prefix: prefix,
+		maxTTL: maxTTL,
+	})
+	s.storageMutex.Unlock()
+}
+
+// maxTTLFor returns the strictest retention limit for a key, 0 means there is
+// no limit. Should be called under storageMutex.
+func (s *PotatoSlave) maxTTLFor(key string) time.Duration {
+
+	var max time.Duration
+
+	for _, rule := range s.retentionRules {
+		if strings.HasPrefix(key, rule.prefix) && (max == 0 || rule.maxTTL < max) {
+			max = rule.maxTTL
+		}
+	}
+
+	return max
+}
+
+// ttlFor returns a TTL that should be used for writing a key: DEFAULTTTL if
+// none was requested, forever if it was negative, capped by retention rules.
+func (s *PotatoSlave) ttlFor(key string, ttl time.Duration) time.Duration {
+
+	if ttl == 0 {
+		ttl = s.DEFAULTTTL
+	} else if ttl < 0 {
+		ttl = forever
+	}
+
+	// Rules are only changed under the whole lock
+	s.storageMutex.RLock()
+	max := s.maxTTLFor(key)
+	s.storageMutex.RUnlock()
+
+	if max != 0 && ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+// retentionCheckRoutine periodically applies retention rules to stored keys
+// until stopped by someone.
+func (s *PotatoSlave) retentionCheckRoutine(shutdownChan chan bool) {
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.RETENTIONCHECKTIME):
+			s.applyRetention()
+		}
+	}
+}
+
+// applyRetention brings time of death of every key that breaks a retention
+// rule to the latest moment allowed by the rule.
+func (s *PotatoSlave) applyRetention() {
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	if len(s.retentionRules) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, user := range s.storage.Users() {
+		s.storage.Iterate(user, func(key string, val potat) bool {
+			if max := s.maxTTLFor(key); max != 0 && val.getTimeOfDeath().After(now.Add(max)) {
+				s.storage.Expire(user, key, now.Add(max))
+				s.schedule(user, key)
+			}
+			return true
+		})
+	}
+}
+
+//////////
+// Maximum TTL
+//////////
+
+// userMaxTTL returns the maximum TTL of a user, USERMAXTTL overrides MAXTTL.
+// 0 means there is no limit.
+func (s *PotatoSlave) userMaxTTL(userID string) time.Duration {
+
+	if max, ok := s.USERMAXTTL[userID]; ok {
+		return max
+	}
+	return s.MAXTTL
+}
+
+// limitTTL applies the maximum TTL of the user to a write: TTL of the message
+// or the one in arguments of an expiration command. A longer TTL, forever
+// included, is either clamped or rejected with _TL depending on TTLPOLICY. It
+// tells if the TTL was clamped, the command is rewritten then, e. g. PERSIST
+// becomes PEXPIRE, so it's logged and replayed the way it was applied. Keys
+// written without TTL get DEFAULTTTL, which isn't checked here.
+func (s *PotatoSlave) limitTTL(userID string, mes *CommandMessage) (bool, uint) {
+
+	max := s.userMaxTTL(userID)
+	if max <= 0 || !loggedCommands[mes.Name] {
+		return false, _OK
+	}
+
+	clamped := false
+	if mes.TTL < 0 || mes.TTL > max {
+		mes.TTL = max
+		clamped = true
+	}
+
+	args := mes.Arguments
+	switch mes.Name {
+	case "EXPIRE", "PEXPIRE", "EXPIREPREFIX":
+		unit := time.Second
+		if mes.Name == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		if n, err := strconv.ParseInt(argument(args, 1), 10, 64); err == nil && n > int64(max/unit) {
+			mes.Arguments = []string{args[0], strconv.FormatInt(unitsIn(max, unit), 10)}
+			clamped = true
+		}
+	case "EXPIREAT", "PEXPIREAT":
+		unit := time.Second
+		if mes.Name == "PEXPIREAT" {
+			unit = time.Millisecond
+		}
+		limit := time.Now().Add(max).UnixNano()
+		if n, err := strconv.ParseInt(argument(args, 1), 10, 64); err == nil && n > limit/int64(unit) {
+			mes.Name = "PEXPIREAT"
+			mes.Arguments = []string{args[0], strconv.FormatInt(limit/int64(time.Millisecond), 10)}
+			clamped = true
+		}
+	case "PERSIST":
+		if len(args) == 1 {
+			mes.Name = "PEXPIRE"
+			mes.Arguments = []string{args[0], strconv.FormatInt(unitsIn(max, time.Millisecond), 10)}
+			clamped = true
+		}
+	case "PERSISTPREFIX":
+		if len(args) == 1 {
+			mes.Name = "EXPIREPREFIX"
+			mes.Arguments = []string{args[0], strconv.FormatInt(unitsIn(max, time.Second), 10)}
+			clamped = true
+		}
+	}
+
+	if clamped && s.TTLPOLICY == "reject" {
+		return false, _TL
+	}
+	return clamped, _OK
+}
+
+// argument returns the i-th argument or an empty string if there are fewer.
+func argument(args []string, i int) string {
+
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// unitsIn is how many whole units fit into d, but at least one.
+func unitsIn(d time.Duration, unit time.Duration) int64 {
+
+	n := int64(d / unit)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
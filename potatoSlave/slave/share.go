@@ -0,0 +1,128 @@
+package slave
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////
+// Shared URLs
+//////////
+
+// TODO: a shared prefix can't be listed yet, KEYS returns every key of the
+// user in one string and the proxy would have to filter it.
+
+// sharedCommands are the reads that a shared URL allows, all of them read
+// only the key in their first argument. PFCOUNT reads all of its arguments,
+// so it isn't one of them.
+var sharedCommands = map[string]bool{
+	"GET":           true,
+	"LGET":          true,
+	"LLEN":          true,
+	"HGET":          true,
+	"HGETALL":       true,
+	"SMEMBERS":      true,
+	"SISMEMBER":     true,
+	"SCARD":         true,
+	"ZRANGE":        true,
+	"ZRANGEBYSCORE": true,
+	"ZRANK":         true,
+	"ZREVRANK":      true,
+	"CGET":          true,
+	"GETBIT":        true,
+	"BITCOUNT":      true,
+	"XRANGE":        true,
+	"JGET":          true,
+	"TTL":           true,
+	"PTTL":          true,
+	"DUMP":          true,
+}
+
+// shareSignature signs what a shared URL gives access to until expires.
+func shareSignature(key []byte, scope string, target string, expires string) string {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(scope + "\x00" + target + "\x00" + expires))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SharedURL returns the path and query of a URL of HTTPHandler that reads a
+// key, scope "key", or any key under a prefix, scope "prefix", for ttl without
+// credentials. It's signed with URLKEY, so every URL is revoked by changing
+// the key. Readers pass the key with key when the scope is a prefix, the
+// command with command, GET by default, and the rest of arguments with arg;
+// only sharedCommands are allowed.
+func (p *Proxy) SharedURL(scope string, target string, ttl time.Duration) string {
+
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	q := url.Values{}
+	q.Set("scope", scope)
+	q.Set("target", target)
+	q.Set("expires", expires)
+	q.Set("sig", shareSignature(p.URLKEY, scope, target, expires))
+
+	return "/shared?" + q.Encode()
+}
+
+// sharedCommand checks a request for a shared URL and turns it into a
+// command, the status code is for a request that isn't allowed.
+func (p *Proxy) sharedCommand(q url.Values) (CommandMessage, int) {
+
+	var mes CommandMessage
+
+	scope, target, expires := q.Get("scope"), q.Get("target"), q.Get("expires")
+	if len(p.URLKEY) == 0 || (scope != "key" && scope != "prefix") ||
+		!hmac.Equal([]byte(q.Get("sig")), []byte(shareSignature(p.URLKEY, scope, target, expires))) {
+		return mes, http.StatusForbidden
+	}
+	if e, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > e {
+		return mes, http.StatusForbidden
+	}
+
+	key := q.Get("key")
+	if scope == "key" && key == "" {
+		key = target
+	}
+	if (scope == "key" && key != target) || !strings.HasPrefix(key, target) {
+		return mes, http.StatusForbidden
+	}
+
+	mes.Name = q.Get("command")
+	if mes.Name == "" {
+		mes.Name = "GET"
+	}
+	if !sharedCommands[mes.Name] {
+		return mes, http.StatusBadRequest
+	}
+	mes.Arguments = append([]string{key}, q["arg"]...)
+
+	return mes, http.StatusOK
+}
+
+// serveShared answers a GET of a shared URL with a ResponseMessage.
+func (p *Proxy) serveShared(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "shared URLs are read with GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mes, code := p.sharedCommand(r.URL.Query())
+	if code != http.StatusOK {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	responses := p.roundTrip(mes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses[len(responses)-1])
+}
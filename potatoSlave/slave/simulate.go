@@ -0,0 +1,174 @@
+package slave
+
+import (
+	"encoding/json"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+//////////
+// Capacity planning
+//////////
+
+// WorkloadEntry is a recorded command of a client. A workload is read from
+// JSON lines, commands of every client are replayed in their order and
+// clients run concurrently.
+type WorkloadEntry struct {
+	Client  string
+	Command CommandMessage
+}
+
+// SimConfig is a configuration of a slave to try a workload against.
+// TODO: shards can be added here once they exist.
+type SimConfig struct {
+	Workers int
+	// MaxKeys and Eviction are MAXKEYS and EVICTION of the slave, the default
+	// policy is used if Eviction is nil.
+	MaxKeys  int
+	Eviction EvictionPolicy
+}
+
+// SimReport is what a simulation has measured.
+type SimReport struct {
+	Commands   int
+	Rejected   map[string]int
+	LatencyP50 time.Duration
+	LatencyP99 time.Duration
+	LatencyMax time.Duration
+	HeapGrowth int64
+	Duration   time.Duration
+}
+
+// ReadWorkload reads workload entries from JSON lines.
+func ReadWorkload(r io.Reader) ([]WorkloadEntry, error) {
+
+	var workload []WorkloadEntry
+
+	decoder := json.NewDecoder(r)
+	for {
+		var entry WorkloadEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return workload, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		workload = append(workload, entry)
+	}
+}
+
+// Simulate replays workload against a fresh slave with config served over
+// in-memory connections and reports latency, memory and rejections.
+func Simulate(workload []WorkloadEntry, config SimConfig) SimReport {
+
+	var clients []string
+	commands := make(map[string][]CommandMessage)
+	for _, entry := range workload {
+		if _, ok := commands[entry.Client]; !ok {
+			clients = append(clients, entry.Client)
+		}
+		commands[entry.Client] = append(commands[entry.Client], entry.Command)
+	}
+
+	report := SimReport{Commands: len(workload), Rejected: make(map[string]int)}
+	if len(clients) == 0 {
+		return report
+	}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	s := NewSlave("localhost", "simulation", time.Minute, time.Hour, time.Second, len(clients))
+	s.MAXKEYS = config.MaxKeys
+	if config.Eviction != nil {
+		s.EVICTION = config.Eviction
+	}
+	if config.Workers > 0 {
+		s.SetWorkers(config.Workers)
+	}
+	if len(clients) > s.MAXCONNECTIONS {
+		s.SetMaxConnections(len(clients))
+	}
+
+	listener := newPipeListener()
+	served := make(chan bool)
+	go func() {
+		s.Serve(listener)
+		served <- true
+	}()
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for _, client := range clients {
+		wg.Add(1)
+		go func(mess []CommandMessage) {
+			defer wg.Done()
+
+			conn, _ := listener.Dial()
+			defer conn.Close()
+			encoder := json.NewEncoder(conn)
+			decoder := json.NewDecoder(conn)
+
+			for i, mes := range mess {
+				t := time.Now()
+				var response ResponseMessage
+
+				// Pipes have no buffers: the slave can decode a command and
+				// start answering before the trailing newline is read, so
+				// writing and reading have to go at the same time
+				written := make(chan error, 1)
+				go func() { written <- encoder.Encode(mes) }()
+
+				var err error
+				for err == nil {
+					if err = decoder.Decode(&response); !response.More {
+						break
+					}
+				}
+				if werr := <-written; err == nil {
+					err = werr
+				}
+				latency := time.Since(t)
+
+				mu.Lock()
+				if err != nil {
+					// Connections without a worker are closed after one command
+					report.Rejected["Connection closed"] += len(mess) - i
+					mu.Unlock()
+					return
+				}
+				latencies = append(latencies, latency)
+				if response.Code != _OK {
+					report.Rejected[response.StatusMessage]++
+				}
+				mu.Unlock()
+			}
+		}(commands[client])
+	}
+	wg.Wait()
+	report.Duration = time.Since(start)
+	<-served
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	report.HeapGrowth = int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	runtime.KeepAlive(s)
+
+	if len(latencies) != 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		report.LatencyP50 = latencies[len(latencies)/2]
+		report.LatencyP99 = latencies[len(latencies)*99/100]
+		report.LatencyMax = latencies[len(latencies)-1]
+	}
+
+	return report
+}
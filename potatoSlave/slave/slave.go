@@ -1,10 +1,22 @@
 package slave
 
 import (
+	"bufio"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
 	"net"
-	"sync"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 //////////
@@ -14,88 +26,464 @@ import (
 // StartServing begins an infinite loop for serving connections.
 func (s *PotatoSlave) StartServing() {
 
-	listener, err := net.Listen("tcp4", ":"+s.port)
+	listener, err := s.listen()
 	if err != nil {
 		panic(err)
 	}
 	defer listener.Close()
 
+	// Commands of the primary would be logged with numbers of the standby
+	if s.STANDBYOF != "" && s.AOFPATH != "" {
+		panic("STANDBYOF can't be used with AOFPATH")
+	}
+	// A replica gets everything from its primary and replaces what it has
+	// on every sync
+	if s.REPLICAOF != "" {
+		if s.STANDBYOF != "" || s.AOFPATH != "" || s.DISKPATH != "" {
+			panic("REPLICAOF can't be used with STANDBYOF, AOFPATH or DISKPATH")
+		}
+		s.ROLE = "replica"
+	}
+	// Members of a Raft group take writes of its keys from its log only
+	if len(s.RAFTPEERS) != 0 && (s.REPLICAOF != "" || s.STANDBYOF != "") {
+		panic("RAFTPEERS can't be used with REPLICAOF or STANDBYOF")
+	}
+	// Other nodes don't log in
+	if s.USERSPATH != "" {
+		if s.REPLICAOF != "" || s.STANDBYOF != "" || len(s.SEEDS) != 0 || s.SEEDSNAME != "" || len(s.RAFTPEERS) != 0 || s.MASTER != "" {
+			panic("USERSPATH can't be used with REPLICAOF, STANDBYOF, SEEDS, SEEDSNAME, RAFTPEERS or MASTER")
+		}
+		if err := s.LoadUsers(s.USERSPATH); err != nil {
+			panic(err)
+		}
+		if s.TOKENSPATH != "" {
+			if err := s.LoadTokens(s.TOKENSPATH); err != nil {
+				panic(err)
+			}
+		}
+		if s.GRANTSPATH != "" {
+			if err := s.LoadGrants(s.GRANTSPATH); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if s.AUDITPATH != "" {
+		if err := s.openAudit(); err != nil {
+			panic(err)
+		}
+	}
+
+	// The data file is never older than a snapshot, so snapshots are only
+	// saved then. The log would replay commands already in the file.
+	if s.DISKPATH != "" {
+		if s.AOFPATH != "" {
+			panic("DISKPATH can't be used with AOFPATH")
+		}
+		if err := s.openDiskStorage(); err != nil {
+			panic(err)
+		}
+		defer s.closeDiskStorage()
+	}
+
+	// A corrupted snapshot is better found before anything is overwritten
+	if s.RESTOREFROM != nil {
+		if s.DISKPATH != "" {
+			panic("DISKPATH can't be used with RESTOREFROM")
+		}
+		if info, err := os.Stat(s.AOFPATH); s.AOFPATH != "" && err == nil && info.Size() != 0 {
+			panic("AOFPATH has to be empty to restore from RESTOREFROM")
+		}
+		if err := s.RestoreArchive(s.RESTOREFROM, s.RESTOREUNTIL); err != nil {
+			panic(err)
+		}
+	} else if s.SNAPSHOTPATH != "" && s.DISKPATH == "" {
+		if err := s.LoadSnapshot(s.SNAPSHOTPATH); err != nil {
+			panic(err)
+		}
+	}
+
+	// Commands logged after the snapshot are applied on top of it
+	if s.AOFPATH != "" {
+		if err := s.openAppendLog(); err != nil {
+			panic(err)
+		}
+		defer s.aof.close()
+	}
+	if s.ARCHIVE != nil {
+		if err := s.startArchive(); err != nil {
+			panic(err)
+		}
+	}
+	// Keys of the Raft group come from its log
+	if len(s.RAFTPEERS) != 0 {
+		if s.RAFTPATH == "" {
+			panic("RAFTPEERS needs RAFTPATH")
+		}
+		if err := s.openRaftLog(); err != nil {
+			panic(err)
+		}
+		defer s.closeRaftLog()
+	}
+
+	s.Serve(listener)
+}
+
+// Serve runs the serving loop on connections accepted from a listener.
+// Temporary accept errors are logged and retried with a backoff, the rest are
+// fatal.
+func (s *PotatoSlave) Serve(listener net.Listener) {
+
 	// ttl checker
 	shutdownChan := make(chan bool)
-	go ttlCheckRoutine(shutdownChan, s.storage, s.CLEANUPTIME, &s.storageMutex)
+	go s.ttlCheckRoutine(shutdownChan)
+	////
+
+	// retention checker
+	retentionShutdownChan := make(chan bool)
+	go s.retentionCheckRoutine(retentionShutdownChan)
+	////
+
+	// lock watchdog
+	watchdogShutdownChan := make(chan bool)
+	go s.watchdogRoutine(watchdogShutdownChan)
+	////
+
+	// memory sampler
+	memoryShutdownChan := make(chan bool)
+	go s.memoryRoutine(memoryShutdownChan)
+	////
+
+	// snapshots
+	snapshotShutdownChan := make(chan bool)
+	if s.SNAPSHOTPATH != "" {
+		go s.snapshotRoutine(snapshotShutdownChan)
+	}
+	////
+
+	// append-only log syncer and rewriter
+	aofShutdownChan := make(chan bool)
+	if s.aof != nil {
+		go s.aofRoutine(aofShutdownChan)
+	}
+	archiveShutdownChan := make(chan bool)
+	if s.archive != nil {
+		go s.archiveRoutine(archiveShutdownChan)
+	}
+	////
+
+	// standby mirroring
+	mirrorShutdownChan := make(chan bool)
+	if s.STANDBYOF != "" {
+		atomic.StoreInt32(&s.standby, 1)
+		go s.mirrorRoutine(mirrorShutdownChan)
+	}
+	////
+
+	// disk storage flusher
+	diskShutdownChan := make(chan bool)
+	disk, onDisk := s.storage.(*diskStorage)
+	if onDisk {
+		go s.diskRoutine(disk, diskShutdownChan)
+	}
+	////
+
+	// replication from the primary
+	replicaShutdownChan := make(chan bool)
+	if s.REPLICAOF != "" {
+		go s.replicaRoutine(replicaShutdownChan)
+	}
+	////
+
+	// registration with the master
+	registerShutdownChan := make(chan bool)
+	if s.MASTER != "" {
+		go s.registerRoutine(registerShutdownChan)
+	}
+	////
+
+	// gossip with other slaves
+	gossipShutdownChan := make(chan bool)
+	if len(s.SEEDS) != 0 || s.SEEDSNAME != "" {
+		go s.gossipRoutine(gossipShutdownChan)
+	}
+	////
+
+	// Raft group
+	raftShutdownChan := make(chan bool)
+	if len(s.RAFTPEERS) != 0 {
+		go s.raftRoutine(raftShutdownChan)
+	}
 	////
 
-	for i := s.numToServ; i != 0; i-- {
+	var backoff time.Duration
+
+	atomic.StoreInt32(&s.serving, 1)
+	defer atomic.StoreInt32(&s.serving, 0)
+
+	for i := s.numToServ; i != 0; {
 
 		c, err := listener.Accept()
 		if err != nil {
-			panic(err)
-		}
 
-		// Check if there are workers available
-		select {
-		case <-s.availableWorkers:
+			if !isTemporaryAcceptError(err) {
+				s.stats.add("accept_errors_fatal", 1)
+				panic(err)
+			}
 
-			name, _ := s.authConnection(c)
-			go s.handleConnection(c, name)
+			s.stats.add("accept_errors_temporary", 1)
 
-		case <-time.After(time.Second):
+			if backoff == 0 {
+				backoff = time.Millisecond * 5
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Printf("accept error: %s, retrying in %s", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
 
-			json.NewEncoder(c).Encode(ResponseMessage{
-				Code:          _NW,
-				StatusMessage: statusMessages[_NW],
-				Value:         "",
-			})
+		backoff = 0
+		s.stats.add("connections_accepted", 1)
+		if i > 0 {
+			i--
 		}
+
+		// Cheap commands are still served without a worker
+		s.admit(c, s.handleConnection, s.serveCheap)
 	}
 
 	// Kill ttl checker
 	shutdownChan <- true
+	retentionShutdownChan <- true
+	watchdogShutdownChan <- true
+	memoryShutdownChan <- true
 
 	// Wait for all serving routines to finish
-	for i := 0; i < s.NUMWORKERS; i++ {
-		<-s.availableWorkers
+	for i := 0; i < s.MAXCONNECTIONS; i++ {
+		<-s.availableConnections
+	}
+
+	if s.aof != nil {
+		aofShutdownChan <- true
+	}
+	if s.archive != nil {
+		archiveShutdownChan <- true
+		if err := s.archiveSegment(); err != nil {
+			log.Printf("archive: %s", err)
+		}
+	}
+	if onDisk {
+		diskShutdownChan <- true
+	}
+	if s.STANDBYOF != "" {
+		mirrorShutdownChan <- true
+	}
+	if s.MASTER != "" {
+		registerShutdownChan <- true
+	}
+	if len(s.SEEDS) != 0 || s.SEEDSNAME != "" {
+		gossipShutdownChan <- true
+	}
+	if len(s.RAFTPEERS) != 0 {
+		raftShutdownChan <- true
+	}
+	if s.REPLICAOF != "" {
+		replicaShutdownChan <- true
+	}
+	if s.SNAPSHOTPATH != "" {
+		snapshotShutdownChan <- true
+		if err := s.SaveSnapshot(s.SNAPSHOTPATH); err != nil {
+			log.Printf("snapshot failed: %s", err)
+		}
 	}
 }
 
-// ttlCheckRoutine deletes keys that are expired until stopped by someone.
-// TODO: currently all keys are checked at each checkup - it's clearly
-// O(keys) which is unscalable.
-func ttlCheckRoutine(shutdownChan chan bool, storage map[string]map[string]potat,
-	cleanup time.Duration, mut *sync.Mutex) {
+// checkSeq accepts a write if its Seq follows last and moves last to it.
+// A rejected write gets _SQ with the number that is expected instead.
+func checkSeq(last *uint64, mes CommandMessage) (ResponseMessage, bool) {
+
+	var response ResponseMessage
+
+	if mes.Seq != *last+1 {
+		response.Value = strconv.FormatUint(*last+1, 10)
+		setStatus(&response, _SQ)
+		return response, false
+	}
+	*last = mes.Seq
+
+	return response, true
+}
+
+// isTemporaryAcceptError checks if the listener could still accept connections
+// after err, e. g. when we ran out of file descriptors or a client has given up
+// before the connection was accepted.
+func isTemporaryAcceptError(err error) bool {
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EMFILE, syscall.ENFILE, syscall.ECONNABORTED, syscall.ECONNRESET,
+			syscall.EAGAIN, syscall.EINTR, syscall.ENOBUFS, syscall.ENOMEM:
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveCheap handles a single command of a connection that didn't get a worker.
+// Only commands from cheapFunctions are served, the rest are rejected with _NW.
+// Reading the command is limited by CHEAPTIMEOUT and CHEAPMAXSIZE, so that
+// the accept loop can't be stalled by a slow or a big message.
+func (s *PotatoSlave) serveCheap(connection net.Conn) {
+
+	defer connection.Close()
+
+	connection.SetDeadline(s.clock().Add(s.CHEAPTIMEOUT))
+
+	var mes CommandMessage
+	var response ResponseMessage
+
+	reader := bufio.NewReader(io.LimitReader(connection, s.CHEAPMAXSIZE))
+	var decoder messageDecoder = json.NewDecoder(reader)
+	var encoder messageEncoder = json.NewEncoder(connection)
+	isFramed := framed(connection, reader)
+	if isFramed {
+		codec := &frameCodec{reader: reader, conn: connection}
+		decoder, encoder = codec, codec
+	}
+	err := decoder.Decode(&mes)
+	mes.framed = isFramed
+
+	if f, ok := s.cheapFunctions[mes.Name]; ok && err == nil {
+		if s.authRequired() && !connectionCommands[mes.Name] {
+			setStatus(&response, _AU)
+		} else {
+			response = f("", mes)
+		}
+	} else {
+		setStatus(&response, _NW)
+	}
+	response.RequestID = mes.RequestID
+
+	encoder.Encode(response)
+}
+
+// ttlCheckRoutine deletes keys that are expired every CLEANUPTIME until
+// stopped by someone. Only the keys that are due are checked, see expireDue,
+// and then random samples of keys if EXPIRESAMPLE isn't 0.
+func (s *PotatoSlave) ttlCheckRoutine(shutdownChan chan bool) {
 
 	for {
 
-		time.Sleep(cleanup)
+		time.Sleep(s.CLEANUPTIME)
 
-		mut.Lock()
+		cycle := expiryCycle{Started: time.Now()}
 
-		for user := range storage {
-			for key := range storage[user] {
-				if storage[user][key].getTimeOfDeath().Before(time.Now()) {
-					delete(storage[user], key)
-				}
-			}
+		s.sweep(time.Now(), &cycle)
+
+		if s.EXPIRESAMPLE != 0 {
+			s.sampleRounds(&cycle)
 		}
 
-		mut.Unlock()
+		cycle.Duration = time.Since(cycle.Started)
+		s.recordCycle(cycle)
 
 		select {
 		case <-shutdownChan:
 			return
-		case <-time.After(time.Second):
-			continue
+		default:
 		}
 	}
 
 }
 
+// sweep expires due keys, at most SWEEPMAXKEYS of them. The lock is released
+// every SWEEPMAXHOLD so that commands aren't stalled by a big sweep.
+func (s *PotatoSlave) sweep(now time.Time, cycle *expiryCycle) {
+
+	left := s.SWEEPMAXKEYS
+	for {
+		s.storageMutex.Lock()
+		locked := time.Now()
+		handled, expired, more := s.expireDue(now, left, s.SWEEPMAXHOLD)
+		if !more || (s.SWEEPMAXKEYS != 0 && left-handled <= 0) {
+			cycle.Backlog = s.overdue(time.Now(), 0)
+		}
+		cycle.held(time.Since(locked))
+		s.storageMutex.Unlock()
+
+		cycle.Scanned += handled
+		cycle.Expired += expired
+
+		if !more {
+			return
+		}
+		if s.SWEEPMAXKEYS != 0 {
+			if left -= handled; left <= 0 {
+				s.stats.add("sweeps_cut", 1)
+				return
+			}
+		}
+	}
+}
+
 // CommandMessage is a structure that describes command messages sent by a client
 // to a slave node
 type CommandMessage struct {
 	Name      string
 	Arguments []string
-	TTL       time.Duration
+	// TTL of the key being written, DEFAULTTTL is used if it's 0 and the key
+	// never expires if it's negative.
+	TTL time.Duration
+	// Stream asks the server to send the result back as a sequence of frames
+	// instead of one message. Only commands from streamFunctions support it.
+	Stream bool
+	// Binary means every argument is base64 of raw bytes and the Value of
+	// the response comes back base64 encoded too. JSON strings can't carry
+	// bytes that aren't valid UTF-8, so blobs have to go this way.
+	Binary bool
+	// Async runs the command as a background job, the response holds the job
+	// ID to be checked with JOB STATUS.
+	Async bool
+	// TTLJitter is a percent from 0 to 100 by which TTL is randomly shortened,
+	// so keys written together don't expire together.
+	TTLJitter int
+	// IdempotencyKey makes a mutating command run only once, retries with the
+	// same key within IDEMPOTENCYWINDOW get the response of the first one.
+	IdempotencyKey string
+	// After is a causality token of a write, the command is served only once
+	// the write is applied.
+	After string `json:",omitempty"`
+
+	// Seq numbers writes of a connection starting from 1. Once a client sets
+	// it, writes with the wrong number are rejected, so retried or reordered
+	// writes can't be applied twice or out of order.
+	Seq uint64 `json:",omitempty"`
+
+	// Protocol is the version of the protocol the client speaks, 0 is the
+	// same as 1. Responses of protocol 2 have Nil.
+	Protocol uint `json:",omitempty"`
+
+	// RequestID is chosen by the client and echoed in every response to the
+	// command, so pipelined commands can be matched with their responses
+	// without counting them.
+	RequestID uint64 `json:",omitempty"`
+
+	// confirmed is set on commands from confirmed proposals, see propose.
+	confirmed bool
+	// replicated is set on writes that a replica got from its primary.
+	replicated bool
+	// raftApplied is set on committed writes of the Raft group.
+	raftApplied bool
+	// framed is set on commands that came in binary frames.
+	framed bool
+	// stream takes the items of a command with Stream, see itemStream.
+	stream *itemStream
 }
 
 // ResponseMessage is a message sent back to user
@@ -103,387 +491,1762 @@ type ResponseMessage struct {
 	Code          uint
 	StatusMessage string
 	Value         string
+	// More is set on every frame of a streamed response except the last one,
+	// which works as a terminator.
+	More bool
+	// Binary tells that Value is base64 encoded.
+	Binary bool
+	// Token is a causality token of a write, it can be passed to later
+	// commands in After to read what was written.
+	Token string `json:",omitempty"`
+	// Nil tells that there is no value at all, e. g. GET of a missing key, so
+	// it isn't mistaken for an empty string. It's only set for protocol 2.
+	Nil bool `json:",omitempty"`
+	// Clamped warns that the write was applied with a shorter TTL than it
+	// asked for, see MAXTTL.
+	Clamped bool `json:",omitempty"`
+	// Lag tells that a read was served by a replica and how far behind its
+	// primary it is, -1 if it hasn't synced yet. See REPORTLAG.
+	Lag time.Duration `json:",omitempty"`
+	// RequestID is the one of the command, see CommandMessage.RequestID.
+	RequestID uint64 `json:",omitempty"`
+}
+
+// requestEncoder sets RequestID of the command being served on every
+// response it sends, including frames of a stream and refusals.
+type requestEncoder struct {
+	messageEncoder
+	id uint64
+}
+
+func (e *requestEncoder) Encode(v interface{}) error {
+
+	if response, ok := v.(ResponseMessage); ok {
+		response.RequestID = e.id
+		v = response
+	}
+	return e.messageEncoder.Encode(v)
+}
+
+// markNil sets Nil on responses of protocol 2 that failed without a value.
+func markNil(mes CommandMessage, response ResponseMessage) ResponseMessage {
+
+	if mes.Protocol >= 2 && response.Code != _OK && response.Value == "" {
+		response.Nil = true
+	}
+	return response
 }
 
-// authConnection asks a user for his login and password and checks if his own map
-// exists in storage, if not then it will be created.
+// authConnection makes sure the storage knows the user of a connection that
+// doesn't log in. With USERSPATH nobody is served before AUTH, see auth.
 func (s *PotatoSlave) authConnection(connection net.Conn) (string, error) {
 
+	if s.authRequired() {
+		return "", nil
+	}
+
+	s.storageMutex.Lock()
+
+	s.storage.AddUser("user")
+
+	s.storageMutex.Unlock()
+
+	return "user", nil
+}
+
+func (s *PotatoSlave) handleConnection(connection net.Conn, username string) {
+
+	defer connection.Close()
+
+	w := worker{s: s}
+	defer w.release()
+	defer func() {
+		if r := recover(); r != nil && !s.recoverPanic(r, username, CommandMessage{}) {
+			panic(r)
+		}
+	}()
+
+	reader := bufio.NewReader(connection)
+	jsonDecoder, jsonEncoder := json.NewDecoder(reader), json.NewEncoder(connection)
+	var decoder messageDecoder = jsonDecoder
+	var encoder messageEncoder = jsonEncoder
+	connection.SetReadDeadline(s.clock().Add(s.STALETIME))
+	isFramed := framed(connection, reader)
+	if isFramed {
+		codec := &frameCodec{reader: reader, conn: connection}
+		decoder, encoder = codec, codec
+	}
+	replies := &requestEncoder{messageEncoder: encoder}
+	encoder = replies
+
+	// Without a user the connection has to log in
+	sess := &session{login: username, keyspace: username, host: remoteHost(connection)}
+
+	// seq is the number of the last sequenced write
+	var seq uint64
+	for {
+
+		// Fields missing in a message must not be left from the previous one
+		var mes CommandMessage
+		w.release()
+		connection.SetReadDeadline(s.clock().Add(s.STALETIME))
+		err := decoder.Decode(&mes)
+
+		if err != nil {
+			// TODO: check if it's a timeout and then just close the connection
+			return
+		}
+		mes.framed = isFramed
+		replies.id = mes.RequestID
+
+		if _, cheap := s.cheapFunctions[mes.Name]; !cheap && !w.take() {
+			var response ResponseMessage
+			setStatus(&response, _NW)
+			s.record(sess, mes, response)
+			encoder.Encode(response)
+			continue
+		}
+
+		if f, ok := s.sessionFunctions[mes.Name]; ok {
+			response := f(sess, mes)
+			s.record(sess, mes, response)
+			encoder.Encode(response)
+			username = sess.keyspace
+			continue
+		}
+		if response, ok := s.permit(sess, mes); !ok {
+			s.record(sess, mes, response)
+			encoder.Encode(response)
+			continue
+		}
+
+		// The connection is only used for notifications after it
+		if (mes.Name == "SUBSCRIBE" || mes.Name == "SYNC") && isFramed {
+			var response ResponseMessage
+			setStatus(&response, _WA)
+			response.Value = mes.Name + " needs a JSON connection"
+			encoder.Encode(response)
+			continue
+		}
+		if mes.Name == "SUBSCRIBE" {
+			w.release()
+			s.subscribeExpired(connection, jsonDecoder, jsonEncoder, username, mes)
+			return
+		}
+		if mes.Name == "SYNC" {
+			var response ResponseMessage
+			setStatus(&response, _OK)
+			s.record(sess, mes, response)
+			w.release()
+			s.syncReplica(connection, jsonEncoder, mes)
+			return
+		}
+
+		if s.standbyRefuses(mes) {
+			var response ResponseMessage
+			setStatus(&response, _SB)
+			s.record(sess, mes, response)
+			encoder.Encode(response)
+			continue
+		}
+
+		if _, ok := s.streamFunctions[mes.Name]; ok && mes.Stream {
+			// Frames go to this connection, not to a job
+			mes.Async = false
+			mes.stream = s.streamFrames(encoder, mes)
+			response := markNil(mes, s.invoke(username, mes))
+			s.record(sess, mes, response)
+			encoder.Encode(response)
+			continue
+		}
+
+		if mes.Seq != 0 && loggedCommands[mes.Name] {
+			if response, ok := checkSeq(&seq, mes); !ok {
+				s.record(sess, mes, response)
+				encoder.Encode(response)
+				continue
+			}
+		}
+
+		returnMes := markNil(mes, s.invoke(username, mes))
+		s.record(sess, mes, returnMes)
+		encoder.Encode(returnMes)
+
+	}
+}
+
+//////////
+// Invocable functions
+//////////
+
+// mutatingCommands are the commands that change the object stored at the key
+// given in their first argument.
+var mutatingCommands = map[string]bool{
+	"SET":         true,
+	"DEL":         true,
+	"LPUSH":       true,
+	"LSET":        true,
+	"HSET":        true,
+	"HGETDEL":     true,
+	"HGETEX":      true,
+	"HEXPIRE":     true,
+	"SADD":        true,
+	"SREM":        true,
+	"SINTERSTORE": true,
+	"SUNIONSTORE": true,
+	"SDIFFSTORE":  true,
+	"ZADD":        true,
+	"ZINCRBY":     true,
+	"CINCR":       true,
+	"CDECR":       true,
+	"SETBIT":      true,
+	"PFADD":       true,
+	"PFMERGE":     true,
+	"XADD":        true,
+	"XREAD":       true,
+	"JSET":        true,
+	"EXPIRE":      true,
+	"PEXPIRE":     true,
+	"EXPIREAT":    true,
+	"PEXPIREAT":   true,
+	"RESTORE":     true,
+}
+
+// call runs an invocable function, a panic inside of it is turned into an
+// internal error response if RECOVERPANICS is set.
+func (s *PotatoSlave) call(f func(string, CommandMessage) ResponseMessage, userID string,
+	mes CommandMessage) (response ResponseMessage) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			if !s.recoverPanic(r, userID, mes) {
+				panic(r)
+			}
+			response = ResponseMessage{}
+			setStatus(&response, _IE)
+		}
+	}()
+
+	return f(userID, mes)
+}
+
+// recoverPanic handles a value returned by recover. If RECOVERPANICS is set,
+// the panic is logged and counted, the storage lock is released if it was held
+// by the panicking goroutine and true is returned. Otherwise the panic should
+// go on. Locks of users can't be told apart by goroutine, so their holders
+// release them with defer.
+func (s *PotatoSlave) recoverPanic(r interface{}, userID string, mes CommandMessage) bool {
+
+	if !s.RECOVERPANICS {
+		return false
+	}
+
+	s.stats.add("handler_panics", 1)
+
+	buf := make([]byte, 1<<16)
+	buf = buf[:runtime.Stack(buf, false)]
+	log.Printf("panic while serving %s %s: %v\n%s", userID, mes.Name, r, buf)
+
+	if s.storageMutex.heldBy(goid()) {
+		log.Printf("releasing the storage lock left by the panic, data could be inconsistent")
+		s.storageMutex.Unlock()
+	}
+
+	return true
+}
+
+// invoke runs a command on behalf of a user and does the bookkeeping that has
+// to follow a mutation.
+func (s *PotatoSlave) invoke(userID string, mes CommandMessage) ResponseMessage {
+
+	f, ok := s.functions[mes.Name]
+	if !ok {
+		var response ResponseMessage
+		setStatus(&response, _UC)
+		return response
+	}
+
+	if !s.isReplica() && s.REPLICAONLY[mes.Name] {
+		var response ResponseMessage
+		setStatus(&response, _PR)
+		return response
+	}
+
+	// Writes come to a replica from its primary only
+	if s.isReplica() && loggedCommands[mes.Name] && !mes.replicated {
+		var response ResponseMessage
+		setStatus(&response, _RO)
+		return response
+	}
+
+	// The jitter is drawn once, so that the members of a Raft group, replicas
+	// and the log get the same TTL
+	if mes.TTLJitter != 0 {
+		if mes.TTLJitter < 0 || mes.TTLJitter > 100 {
+			var response ResponseMessage
+			setStatus(&response, _WA)
+			return response
+		}
+		mes.TTL, mes.TTLJitter = s.jitter(mes.TTL, mes.TTLJitter), 0
+	}
+
+	// Confirmed commands are the ones proposed to the Raft group, applied
+	// entries and replayed ones were confirmed before they were logged
+	if s.APPROVALDELAY != 0 && approvalCommands[mes.Name] && !mes.confirmed {
+		return s.propose(userID, mes)
+	}
+
+	// Keys of the Raft group are written through its log and read from its
+	// leader
+	if s.raftKey(mes) && !mes.raftApplied {
+		if loggedCommands[mes.Name] {
+			return s.raftPropose(userID, mes)
+		}
+		if response := s.raftRead(); response.Code != _OK {
+			return response
+		}
+	}
+
+	if mes.After != "" {
+		if code := s.waitToken(mes.After); code != _OK {
+			var response ResponseMessage
+			setStatus(&response, code)
+			return response
+		}
+	}
+
+	// Values aren't kept, they could be big or secret
+	recent := userID + " " + mes.Name
+	if len(mes.Arguments) != 0 {
+		recent += " " + mes.Arguments[0]
+	}
+	s.recentCommand.Store(recent)
+
+	if mes.IdempotencyKey != "" && mutatingCommands[mes.Name] {
+		return s.invokeOnce(userID, mes, func() ResponseMessage {
+			mes.IdempotencyKey = ""
+			return s.invoke(userID, mes)
+		})
+	}
+
+	if mes.Async {
+		return s.startJob(userID, mes)
+	}
+
+	if mes.Binary {
+		raw := make([]string, len(mes.Arguments))
+		for i, arg := range mes.Arguments {
+			b, err := base64.StdEncoding.DecodeString(arg)
+			if err != nil {
+				var response ResponseMessage
+				setStatus(&response, _WA)
+				return response
+			}
+			raw[i] = string(b)
+		}
+		mes.Arguments = raw
+	}
+
+	if unsealedCommands[mes.Name] && len(mes.Arguments) != 0 && s.isEncrypted(mes.Arguments[0]) {
+		var response ResponseMessage
+		setStatus(&response, _WT)
+		return response
+	}
+
+	clamped, code := s.limitTTL(userID, &mes)
+	if code != _OK {
+		var response ResponseMessage
+		setStatus(&response, code)
+		return response
+	}
+	f = s.functions[mes.Name]
+	if items, ok := s.streamFunctions[mes.Name]; ok && mes.stream != nil {
+		out := mes.stream
+		f = func(userID string, mes CommandMessage) ResponseMessage {
+			return items(userID, mes, out)
+		}
+	}
+
+	if loggedCommands[mes.Name] {
+		defer s.lockWrite()()
+		s.preserve(userID, mes)
+		s.markChanged(userID, mes)
+	}
+
+	response := s.callCached(f, userID, mes)
+	var seq uint64
+
+	if loggedCommands[mes.Name] && response.Code == _OK {
+		if !mutatingCommands[mes.Name] {
+			// Which keys they change isn't known here
+			s.invalidateUser(userID)
+		}
+		s.logWrite(userID, mes)
+		seq = s.applied.advance()
+		response.Token = s.causalityToken(seq)
+		response.Clamped = clamped
+	}
+
+	if mes.Binary {
+		response.Value = base64.StdEncoding.EncodeToString([]byte(response.Value))
+		response.Binary = true
+	}
+
+	if s.REPORTLAG && s.isReplica() && !loggedCommands[mes.Name] {
+		response.Lag = s.replicationLag()
+	}
+
+	if mutatingCommands[mes.Name] && len(mes.Arguments) != 0 && response.Code == _OK {
+		var m Mutation
+		var o snapshotObject
+		var err error
+		func() {
+			// Eviction picks keys of every user
+			unlock := s.storageMutex.Unlock
+			if s.MAXKEYS == 0 {
+				unlock = s.lockUser(userID)
+			} else {
+				s.storageMutex.Lock()
+			}
+			defer unlock()
+
+			s.reconcile(userID, mes.Arguments[0])
+			s.schedule(userID, mes.Arguments[0])
+			if len(s.mutationHooks) != 0 {
+				m, o, err = s.mutationOf(userID, mes.Arguments[0], mes.Name, seq)
+			}
+			if s.MAXKEYS != 0 {
+				s.tellEviction(userID, mes.Arguments[0], true)
+				s.evict()
+			}
+		}()
+
+		if len(s.mutationHooks) != 0 {
+			s.runMutationHooks(m, o, err)
+		}
+	} else if s.MAXKEYS != 0 && len(mes.Arguments) != 0 && !loggedCommands[mes.Name] {
+		s.storageMutex.Lock()
+		s.tellEviction(userID, mes.Arguments[0], false)
+		s.storageMutex.Unlock()
+	}
+
+	return response
+}
+
+///// Service messages
+
+const (
+	_OK = iota
+	_WT = iota
+	_NK = iota
+	_WA = iota
+	_NW = iota
+	_DE = iota
+	_OF = iota
+	_UC = iota
+	_IE = iota
+	_PR = iota
+	_SV = iota
+	_CT = iota
+	_AP = iota
+	_TE = iota
+	_KE = iota
+	_SQ = iota
+	_UP = iota
+	_RL = iota
+	_SB = iota
+	_TL = iota
+	_RO = iota
+	_RT = iota
+	_NL = iota
+	_PV = iota
+	_AU = iota
+	_NP = iota
+)
+
+var statusMessages = statusRegistry{messages: map[uint]string{
+	_OK: "OK",
+	_WT: "Object stored at the key is of different type",
+	_NK: "Key doesn't exist",
+	_WA: "Wrong call arguments",
+	_NW: "There are no available workers on the server",
+	_DE: "Value couldn't be decrypted",
+	_OF: "Counter overflow",
+	_UC: "Unknown command",
+	_IE: "Internal server error",
+	_PR: "Command is only served by replicas",
+	_SV: "Snapshot couldn't be saved",
+	_CT: "Write of the causality token isn't applied yet",
+	_AP: "Command has to be confirmed with PROPOSAL CONFIRM",
+	_TE: "Proposal can't be confirmed yet",
+	_KE: "Key already exists",
+	_SQ: "Write is out of sequence",
+	_UP: "Upstream slave is unavailable",
+	_RL: "Rate limit is exceeded",
+	_SB: "Node is a standby until PROMOTE",
+	_TL: "TTL is over the maximum",
+	_RO: "Replica is read-only, writes go to its primary",
+	_RT: "Node of the key is failing over, try again",
+	_NL: "Node isn't the leader of the Raft group, see Value",
+	_PV: "Protocol version isn't supported, see Value",
+	_AU: "Authentication is required or failed",
+	_NP: "Command isn't permitted for the user",
+}}
+
+func setStatus(mes *ResponseMessage, code uint) {
+	mes.Code = code
+	mes.StatusMessage = statusMessages.message(code)
+}
+
+//////////////////////////
+
+///// Service functions
+
+func (s *PotatoSlave) ping(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+	} else {
+		response.Value = "PONG"
+		setStatus(&response, _OK)
+	}
+
+	return response
+}
+
+func (s *PotatoSlave) echo(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+	} else {
+		response.Value = mes.Arguments[0]
+		setStatus(&response, _OK)
+	}
+
+	return response
+}
+
+// timecommand is TIME, the clock of the slave in unix nanoseconds.
+func (s *PotatoSlave) timecommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+	} else {
+		response.Value = strconv.FormatInt(time.Now().UnixNano(), 10)
+		setStatus(&response, _OK)
+	}
+
+	return response
+}
+
+///// Data independent Functions
+
+func (s *PotatoSlave) del(c *keyCommand, response *ResponseMessage) {
+
+	s.storage.Delete(c.userID, c.key)
+	setStatus(response, _OK)
+}
+
+func (s *PotatoSlave) keys(userID string, mes CommandMessage) ResponseMessage {
+	return joinItems(s.keysItems, userID, mes)
+}
+
+// keysItems gives every live key of a user. Only the names of a batch are
+// copied under the lock, so the lock isn't held while they're encoded.
+func (s *PotatoSlave) keysItems(userID string, mes CommandMessage, out *itemStream) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	after, first := "", true
+	for {
+		names, more := s.keyBatch(userID, after, first, out.batch)
+		if len(names) != 0 && !out.emit(names) || !more {
+			break
+		}
+		after, first = names[len(names)-1], false
+	}
+	setStatus(&response, _OK)
+
+	return response
+}
+
+//// String functions
+
+func (s *PotatoSlave) get(c *keyCommand, response *ResponseMessage) {
+
+	content, _ := c.val.getContent("")
+	value, err := s.unseal(c.userID, c.key, content)
+	if err != nil {
+		setStatus(response, _DE)
+		return
+	}
+	response.Value = value
+	setStatus(response, _OK)
+}
+
+// getItems is a streamed GET, the value is sent in pieces of STREAMCHUNK
+// bytes, so a big one isn't encoded in a single message. With Binary the
+// pieces are a multiple of 3 bytes, so every frame is base64 of its own and
+// can be decoded alone.
+func (s *PotatoSlave) getItems(userID string, mes CommandMessage, out *itemStream) ResponseMessage {
+
+	response := s.functions["GET"](userID, mes)
+	if response.Code != _OK {
+		return response
+	}
+	value := response.Value
+	response.Value = ""
+
+	size := s.STREAMCHUNK
+	if mes.Binary {
+		size = size / 4 * 3
+	}
+	if size < 3 {
+		size = 3
+	}
+	var items []string
+	for len(value) > 0 {
+		n := size
+		if n >= len(value) {
+			n = len(value)
+		} else if !mes.Binary {
+			// Runes aren't split, JSON would break them
+			for n > 1 && !utf8.RuneStart(value[n]) {
+				n--
+			}
+		}
+		items = append(items, value[:n])
+		value = value[n:]
+
+		if len(items) == out.batch || len(value) == 0 {
+			if !out.emit(items) {
+				break
+			}
+			items = nil
+		}
+	}
+
+	return response
+}
+
+func (s *PotatoSlave) set(c *keyCommand, response *ResponseMessage) {
+
+	s.storage.Delete(c.userID, c.key)
+	s.storage.Set(c.userID, c.key, &pstring{
+		content:     c.value,
+		timeOfDeath: deathAfter(c.ttl),
+	})
+	setStatus(response, _OK)
+}
+
+//// List functions
+
+func (s *PotatoSlave) lpush(c *keyCommand, response *ResponseMessage) {
+
+	// Key exist and it's of the right type
+	if list, ok := c.val.(*plist); ok {
+		list.setContent(c.value, "-1")
+	} else {
+		s.storage.Set(c.userID, c.key, &plist{
+			list:        []string{c.value},
+			timeOfDeath: deathAfter(c.ttl),
+		})
+	}
+	setStatus(response, _OK)
+}
+
+func (s *PotatoSlave) lset(c *keyCommand, response *ResponseMessage) {
+
+	if err := c.val.setContent(c.value, c.mes.Arguments[1]); err != nil {
+		setStatus(response, _WA)
+	} else {
+		setStatus(response, _OK)
+	}
+}
+
+func (s *PotatoSlave) lget(c *keyCommand, response *ResponseMessage) {
+
+	content, err := c.val.getContent(c.mes.Arguments[1])
+
+	if err != nil {
+		setStatus(response, _WA)
+	} else if content, err = s.unseal(c.userID, c.key, content); err != nil {
+		setStatus(response, _DE)
+	} else {
+		response.Value = content
+		setStatus(response, _OK)
+	}
+}
+
+// llen is the number of values in a list.
+func (s *PotatoSlave) llen(c *keyCommand, response *ResponseMessage) {
+
+	response.Value = strconv.Itoa(len(c.val.(*plist).list))
+	setStatus(response, _OK)
+}
+
+//// Map functions
+
+func (s *PotatoSlave) hget(c *keyCommand, response *ResponseMessage) {
+
+	content, err := c.val.getContent(c.mes.Arguments[1])
+
+	if err != nil {
+		setStatus(response, _WA)
+	} else if content, err = s.unseal(c.userID, c.key, content); err != nil {
+		setStatus(response, _DE)
+	} else {
+		response.Value = content
+		setStatus(response, _OK)
+	}
+}
+
+func (s *PotatoSlave) hgetall(userID string, mes CommandMessage) ResponseMessage {
+	return joinItems(s.hgetallItems, userID, mes)
+}
+
+// hgetallItems gives every field of a hash followed by its value.
+func (s *PotatoSlave) hgetallItems(userID string, mes CommandMessage, out *itemStream) ResponseMessage {
+
+	return s.streamElements(userID, mes, out, "hash", func(val potat, after string, first bool) ([]string, string, bool) {
+
+		v := val.(*pmap)
+		fields, more := nextNames(func(add func(string)) {
+			for field := range v.ourmap {
+				if _, err := v.getContent(field); err == nil {
+					add(field)
+				}
+			}
+		}, after, first, out.batch)
+
+		items := make([]string, 0, 2*len(fields))
+		for _, field := range fields {
+			value, _ := v.getContent(field)
+			value, err := s.unseal(userID, mes.Arguments[0], value)
+			if err != nil {
+				value = ""
+			}
+			items = append(items, field, value)
+		}
+		if len(fields) == 0 {
+			return items, "", more
+		}
+		return items, fields[len(fields)-1], more
+	})
+}
+
+// hgetdel returns a field of a hash and removes it, a hash without fields is
+// removed as well.
+func (s *PotatoSlave) hgetdel(c *keyCommand, response *ResponseMessage) {
+
+	v := c.val.(*pmap)
+	content, err := v.getContent(c.mes.Arguments[1])
+
+	if err != nil {
+		setStatus(response, _WA)
+	} else if content, err = s.unseal(c.userID, c.key, content); err != nil {
+		setStatus(response, _DE)
+	} else {
+		v.deleteContent(c.mes.Arguments[1])
+		if len(v.ourmap) == 0 {
+			s.storage.Delete(c.userID, c.key)
+		}
+		response.Value = content
+		setStatus(response, _OK)
+	}
+}
+
+// hgetex returns a field of a hash and updates the TTL of the whole hash.
+func (s *PotatoSlave) hgetex(c *keyCommand, response *ResponseMessage) {
+
+	v := c.val.(*pmap)
+	content, err := v.getContent(c.mes.Arguments[1])
+
+	if err != nil {
+		setStatus(response, _WA)
+	} else if content, err = s.unseal(c.userID, c.key, content); err != nil {
+		setStatus(response, _DE)
+	} else {
+		v.timeOfDeath = deathAfter(c.ttl)
+		response.Value = content
+		setStatus(response, _OK)
+	}
+}
+
+// hexpireTTL parses the TTL of HEXPIRE in seconds, like the one of EXPIRE.
+func hexpireTTL(arg string) (time.Duration, bool) {
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n <= 0 || n > int64(neverDies.Sub(time.Now())/time.Second) {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// hexpire is HEXPIRE key field seconds, it sets a TTL of a single field of a
+// hash. Retention rules of the key cap it.
+func (s *PotatoSlave) hexpire(c *keyCommand, response *ResponseMessage) {
+
+	ttl, _ := hexpireTTL(c.mes.Arguments[2])
+	if max := s.maxTTLFor(c.key); max != 0 && ttl > max {
+		ttl = max
+	}
+
+	if err := c.val.(*pmap).expireField(c.mes.Arguments[1], deathAfter(ttl)); err != nil {
+		setStatus(response, _NK)
+	} else {
+		setStatus(response, _OK)
+	}
+}
+
+func (s *PotatoSlave) hset(c *keyCommand, response *ResponseMessage) {
+
+	if m, ok := c.val.(*pmap); ok {
+		if err := m.setContent(c.value, c.mes.Arguments[1]); err != nil {
+			setStatus(response, _WA)
+		} else {
+			setStatus(response, _OK)
+		}
+	} else {
+		s.storage.Set(c.userID, c.key, &pmap{
+			timeOfDeath: deathAfter(c.ttl),
+			ourmap:      map[string]string{c.mes.Arguments[1]: c.value},
+		})
+	}
+}
+
+//// Set functions
+
+// sadd adds one or more members to a set. If the key holds an object of a
+// different type it's replaced with a new set.
+func (s *PotatoSlave) sadd(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) < 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
+
+	s.storageMutex.Lock()
+
+	set, ok := s.live(userID, mes.Arguments[0]).(*pset)
+	if !ok {
+		set = &pset{
+			members:     make(map[string]struct{}),
+			timeOfDeath: deathAfter(ttl),
+		}
+		s.storage.Set(userID, mes.Arguments[0], set)
+	}
+
+	added := 0
+	for _, member := range mes.Arguments[1:] {
+		if _, err := set.getContent(member); err != nil {
+			set.setContent(member, "")
+			added++
+		}
+	}
+
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.Itoa(added)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// srem removes one or more members from a set, a set without members is
+// removed as well.
+func (s *PotatoSlave) srem(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) < 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pset:
+			removed := 0
+			for _, member := range mes.Arguments[1:] {
+				if _, ok := v.members[member]; ok {
+					delete(v.members, member)
+					removed++
+				}
+			}
+			if len(v.members) == 0 {
+				s.storage.Delete(userID, mes.Arguments[0])
+			}
+
+			response.Value = strconv.Itoa(removed)
+			setStatus(&response, _OK)
+
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
+
+	return response
+}
+
+func (s *PotatoSlave) smembers(userID string, mes CommandMessage) ResponseMessage {
+	return joinItems(s.smembersItems, userID, mes)
+}
+
+// smembersItems gives every member of a set.
+func (s *PotatoSlave) smembersItems(userID string, mes CommandMessage, out *itemStream) ResponseMessage {
+
+	return s.streamElements(userID, mes, out, "set", func(val potat, after string, first bool) ([]string, string, bool) {
+
+		members, more := nextNames(func(add func(string)) {
+			for member := range val.(*pset).members {
+				add(member)
+			}
+		}, after, first, out.batch)
+
+		if len(members) == 0 {
+			return members, "", more
+		}
+		return members, members[len(members)-1], more
+	})
+}
+
+// sismember returns "1" if the member is in the set and "0" otherwise.
+func (s *PotatoSlave) sismember(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pset:
+			if _, err := v.getContent(mes.Arguments[1]); err != nil {
+				response.Value = "0"
+			} else {
+				response.Value = "1"
+			}
+			setStatus(&response, _OK)
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
+
+	return response
+}
+
+// scard returns the number of members of a set.
+func (s *PotatoSlave) scard(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pset:
+			response.Value = strconv.Itoa(len(v.members))
+			setStatus(&response, _OK)
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
+
+	return response
+}
+
+///// Set algebra
+
+// setCombiner merges the next set into the accumulated result.
+type setCombiner func(result map[string]struct{}, next map[string]struct{}) map[string]struct{}
+
+func intersectSets(result map[string]struct{}, next map[string]struct{}) map[string]struct{} {
+
+	for member := range result {
+		if _, ok := next[member]; !ok {
+			delete(result, member)
+		}
+	}
+	return result
+}
+
+func uniteSets(result map[string]struct{}, next map[string]struct{}) map[string]struct{} {
+
+	for member := range next {
+		result[member] = struct{}{}
+	}
+	return result
+}
+
+func subtractSets(result map[string]struct{}, next map[string]struct{}) map[string]struct{} {
+
+	for member := range next {
+		delete(result, member)
+	}
+	return result
+}
+
+// setOperation makes an invocable function that combines the sets stored at the
+// keys from arguments. Missing keys are treated as empty sets. If store is set,
+// the first argument is a destination key, the result is written there and its
+// cardinality is returned, otherwise the members are returned.
+func (s *PotatoSlave) setOperation(combine setCombiner, store bool) func(string, CommandMessage) ResponseMessage {
+
+	return func(userID string, mes CommandMessage) ResponseMessage {
+
+		var response ResponseMessage
+
+		keys := mes.Arguments
+		if store {
+			if len(keys) < 2 {
+				setStatus(&response, _WA)
+				return response
+			}
+			keys = keys[1:]
+		} else if len(keys) < 1 {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		var destTTL time.Duration
+		if store {
+			destTTL = s.ttlFor(mes.Arguments[0], mes.TTL)
+		}
+
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
+
+		result := make(map[string]struct{})
+		for i, key := range keys {
+
+			var members map[string]struct{}
+			if val := s.live(userID, key); val != nil {
+				set, ok := val.(*pset)
+				if !ok {
+					setStatus(&response, _WT)
+					return response
+				}
+				members = set.members
+			}
+
+			if i == 0 {
+				result = uniteSets(result, members)
+			} else {
+				result = combine(result, members)
+			}
+		}
+
+		if store {
+			if len(result) == 0 {
+				s.storage.Delete(userID, mes.Arguments[0])
+			} else {
+				s.storage.Set(userID, mes.Arguments[0], &pset{
+					members:     result,
+					timeOfDeath: deathAfter(destTTL),
+				})
+			}
+			response.Value = strconv.Itoa(len(result))
+		} else {
+			for member := range result {
+				response.Value += "'" + member + "',"
+			}
+		}
+
+		setStatus(&response, _OK)
+		return response
+	}
+}
+
+//// Sorted set functions
+
+// zadd sets scores of members given as score-member pairs. If the key holds an
+// object of a different type it's replaced with a new sorted set.
+func (s *PotatoSlave) zadd(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) < 3 || len(mes.Arguments)%2 != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	scores := make([]float64, 0, len(mes.Arguments)/2)
+	for i := 1; i < len(mes.Arguments); i += 2 {
+		// A NaN score can't be ordered
+		score, err := strconv.ParseFloat(mes.Arguments[i], 64)
+		if err != nil || math.IsNaN(score) {
+			setStatus(&response, _WA)
+			return response
+		}
+		scores = append(scores, score)
+	}
+
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
+
+	s.storageMutex.Lock()
+
+	zset, ok := s.live(userID, mes.Arguments[0]).(*pzset)
+	if !ok {
+		zset = &pzset{
+			scores:      make(map[string]float64),
+			timeOfDeath: deathAfter(ttl),
+		}
+		s.storage.Set(userID, mes.Arguments[0], zset)
+	}
+
+	added := 0
+	for i, score := range scores {
+		if zset.add(mes.Arguments[2*i+2], score) {
+			added++
+		}
+	}
+
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.Itoa(added)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// zincrby adds an increment to the score of a member and returns the new score,
+// a missing member (or a whole sorted set) is created with a zero score.
+func (s *PotatoSlave) zincrby(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 3 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	increment, err := strconv.ParseFloat(mes.Arguments[1], 64)
+	if err != nil || math.IsNaN(increment) {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
+
+	s.storageMutex.Lock()
+
+	zset, ok := s.live(userID, mes.Arguments[0]).(*pzset)
+	if !ok {
+		if s.storage.Get(userID, mes.Arguments[0]) != nil {
+			s.storageMutex.Unlock()
+			setStatus(&response, _WT)
+			return response
+		}
+		zset = &pzset{
+			scores:      make(map[string]float64),
+			timeOfDeath: deathAfter(ttl),
+		}
+		s.storage.Set(userID, mes.Arguments[0], zset)
+	}
+
+	// Infinities of both signs add up to NaN
+	score := zset.scores[mes.Arguments[2]] + increment
+	if math.IsNaN(score) {
+		s.storageMutex.Unlock()
+		setStatus(&response, _WA)
+		return response
+	}
+	zset.add(mes.Arguments[2], score)
+
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.FormatFloat(score, 'g', -1, 64)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// zrank makes a function that returns the rank of a member counting from the
+// lowest score, or from the highest one if reverse is set.
+func (s *PotatoSlave) zrank(reverse bool) func(string, CommandMessage) ResponseMessage {
+
+	return func(userID string, mes CommandMessage) ResponseMessage {
+
+		var response ResponseMessage
+
+		if len(mes.Arguments) != 2 {
+			setStatus(&response, _WA)
+			return response
+		}
+
+		s.storageMutex.Lock()
+		if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+			switch v := val.(type) {
+			case *pzset:
+				if rank, ok := v.rank(mes.Arguments[1]); ok {
+					if reverse {
+						rank = len(v.ordered) - 1 - rank
+					}
+					response.Value = strconv.Itoa(rank)
+					setStatus(&response, _OK)
+				} else {
+					setStatus(&response, _NK)
+				}
+			default:
+				setStatus(&response, _WT)
+			}
+		} else {
+			setStatus(&response, _NK)
+		}
+		s.storageMutex.Unlock()
+
+		return response
+	}
+}
+
+// formatZmembers formats members as "'member'," or as "'member':'score'," if
+// withScores is set.
+func formatZmembers(members []zmember, withScores bool) string {
+
+	ans := ""
+	for _, m := range members {
+		if withScores {
+			ans += "'" + m.member + "':'" + strconv.FormatFloat(m.score, 'g', -1, 64) + "',"
+		} else {
+			ans += "'" + m.member + "',"
+		}
+	}
+	return ans
+}
+
+// zrangeQuery parses arguments of range commands: key, two bounds and an
+// optional WITHSCORES, and runs query on the sorted set under the lock.
+func (s *PotatoSlave) zrangeQuery(userID string, mes CommandMessage,
+	query func(*pzset, string, string) ([]zmember, error)) ResponseMessage {
+
+	var response ResponseMessage
+
+	withScores := len(mes.Arguments) == 4 && strings.ToUpper(mes.Arguments[3]) == "WITHSCORES"
+	if len(mes.Arguments) != 3 && !withScores {
+		setStatus(&response, _WA)
+		return response
+	}
+
 	s.storageMutex.Lock()
-
-	if _, ok := s.storage["user"]; ok {
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pzset:
+			members, err := query(v, mes.Arguments[1], mes.Arguments[2])
+			if err != nil {
+				setStatus(&response, _WA)
+			} else {
+				response.Value = formatZmembers(members, withScores)
+				setStatus(&response, _OK)
+			}
+		default:
+			setStatus(&response, _WT)
+		}
 	} else {
-		s.storage["user"] = make(map[string]potat)
+		setStatus(&response, _NK)
 	}
-
 	s.storageMutex.Unlock()
 
-	return "user", nil
+	return response
 }
 
-func (s *PotatoSlave) handleConnection(connection net.Conn, username string) {
-
-	defer connection.Close()
-
-	decoder := json.NewDecoder(connection)
-	encoder := json.NewEncoder(connection)
-	var mes CommandMessage
-	for {
+// zrange returns members between two ranks inclusive.
+func (s *PotatoSlave) zrange(userID string, mes CommandMessage) ResponseMessage {
 
-		connection.SetReadDeadline(time.Now().Add(s.STALETIME))
-		err := decoder.Decode(&mes)
+	return s.zrangeQuery(userID, mes, func(z *pzset, from string, to string) ([]zmember, error) {
 
+		start, err := strconv.Atoi(from)
 		if err != nil {
-			// TODO: check if it's a timeout and then just close the connection
-			// Say that you are available
-			s.availableWorkers <- true
-			return
+			return nil, err
+		}
+		stop, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, err
 		}
+		return z.rangeByRank(start, stop), nil
+	})
+}
 
-		returnMes := s.functions[mes.Name](username, mes)
-		encoder.Encode(returnMes)
+// zrangebyscore returns members which scores are between two values inclusive,
+// "-inf" and "+inf" can be used as bounds.
+func (s *PotatoSlave) zrangebyscore(userID string, mes CommandMessage) ResponseMessage {
 
-	}
+	return s.zrangeQuery(userID, mes, func(z *pzset, from string, to string) ([]zmember, error) {
+
+		min, err := strconv.ParseFloat(from, 64)
+		if err != nil {
+			return nil, err
+		}
+		max, err := strconv.ParseFloat(to, 64)
+		if err != nil {
+			return nil, err
+		}
+		return z.rangeByScore(min, max), nil
+	})
 }
 
-//////////
-// Invocable functions
-//////////
+//// Counter functions
 
-///// Service messages
+// counterAdd makes a function that adds an optional amount from arguments (1 by
+// default) multiplied by sign to a counter and returns the new value. Missing
+// counters are created with zero value.
+func (s *PotatoSlave) counterAdd(sign int64) func(string, CommandMessage) ResponseMessage {
 
-const (
-	_OK = iota
-	_WT = iota
-	_NK = iota
-	_WA = iota
-	_NW = iota
-)
+	return func(userID string, mes CommandMessage) ResponseMessage {
 
-var statusMessages = map[uint]string{
-	_OK: "OK",
-	_WT: "Object stored at the key is of different type",
-	_NK: "Key doesn't exist",
-	_WA: "Wrong call arguments",
-	_NW: "There are no available workers on the server",
-}
+		var response ResponseMessage
 
-func setStatus(mes *ResponseMessage, code uint) {
-	mes.Code = code
-	mes.StatusMessage = statusMessages[code]
-}
+		if len(mes.Arguments) != 1 && len(mes.Arguments) != 2 {
+			setStatus(&response, _WA)
+			return response
+		}
 
-//////////////////////////
+		amount := int64(1)
+		if len(mes.Arguments) == 2 {
+			var err error
+			if amount, err = strconv.ParseInt(mes.Arguments[1], 10, 64); err != nil {
+				setStatus(&response, _WA)
+				return response
+			}
+		}
 
-///// Data independent Functions
+		ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
 
-func (s *PotatoSlave) del(userID string, mes CommandMessage) ResponseMessage {
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
 
-	var response ResponseMessage
+		counter, ok := s.live(userID, mes.Arguments[0]).(*pcounter)
+		if !ok {
+			if s.storage.Get(userID, mes.Arguments[0]) != nil {
+				setStatus(&response, _WT)
+				return response
+			}
+			counter = &pcounter{timeOfDeath: deathAfter(ttl)}
+			s.storage.Set(userID, mes.Arguments[0], counter)
+		}
 
-	if len(mes.Arguments) != 1 {
-		setStatus(&response, _WA)
-	} else {
+		var err error
+		if sign < 0 && amount == math.MinInt64 {
+			// -MinInt64 doesn't fit into int64, subtract in two steps
+			if err = counter.add(math.MaxInt64, s.COUNTERWRAP); err == nil {
+				err = counter.add(1, s.COUNTERWRAP)
+			}
+		} else {
+			err = counter.add(sign*amount, s.COUNTERWRAP)
+		}
 
-		s.storageMutex.Lock()
-		delete(s.storage[userID], mes.Arguments[0])
-		s.storageMutex.Unlock()
+		if err != nil {
+			setStatus(&response, _OF)
+			return response
+		}
 
+		response.Value, _ = counter.getContent("")
 		setStatus(&response, _OK)
+		return response
 	}
-
-	return response
 }
 
-func (s *PotatoSlave) keys(userID string, mes CommandMessage) ResponseMessage {
+func (s *PotatoSlave) cget(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
 
-	if len(mes.Arguments) != 0 {
+	if len(mes.Arguments) != 1 {
 		setStatus(&response, _WA)
-	} else {
-		ans := ""
-		s.storageMutex.Lock()
-		for k := range s.storage["user"] {
-			ans += "'" + k + "',"
-		}
-		s.storageMutex.Unlock()
+		return response
+	}
 
-		response.Value = ans
-		setStatus(&response, _OK)
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pcounter:
+			response.Value, _ = v.getContent("")
+			setStatus(&response, _OK)
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
 	}
+	s.storageMutex.Unlock()
 
 	return response
 }
 
-// TODO: get rid of the boilerplate in here...
+//// Bitmap functions
 
-//// String functions
-
-func (s *PotatoSlave) get(userID string, mes CommandMessage) ResponseMessage {
+// setbit sets a bit of a bitmap and returns its previous value. If the key holds
+// an object of a different type it's replaced with a new bitmap.
+func (s *PotatoSlave) setbit(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
-	if len(mes.Arguments) != 1 {
-		setStatus(&response, _WA)
-	} else {
 
-		s.storageMutex.Lock()
+	if len(mes.Arguments) != 3 {
+		setStatus(&response, _WA)
+		return response
+	}
 
-		if val, ok := s.storage[userID][mes.Arguments[0]]; ok {
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
 
-			switch val.(type) {
-			case *pstring:
-				response.Value, _ = val.getContent("")
-				setStatus(&response, _OK)
-			default:
-				setStatus(&response, _WT)
-			}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
 
-		} else {
-			setStatus(&response, _NK)
-		}
+	bitmap, ok := s.live(userID, mes.Arguments[0]).(*pbitmap)
+	if !ok {
+		bitmap = &pbitmap{timeOfDeath: deathAfter(ttl)}
+	}
 
-		s.storageMutex.Unlock()
+	old, err := bitmap.getContent(mes.Arguments[1])
+	if err == nil {
+		err = bitmap.setContent(mes.Arguments[2], mes.Arguments[1])
+	}
+	if err != nil {
+		setStatus(&response, _WA)
+		return response
 	}
 
+	s.storage.Set(userID, mes.Arguments[0], bitmap)
+	response.Value = old
+	setStatus(&response, _OK)
+
 	return response
 }
 
-func (s *PotatoSlave) set(userID string, mes CommandMessage) ResponseMessage {
+func (s *PotatoSlave) getbit(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
-	var ttl time.Duration
 
 	if len(mes.Arguments) != 2 {
 		setStatus(&response, _WA)
-	} else {
-
-		s.storageMutex.Lock()
-
-		delete(s.storage[userID], mes.Arguments[0])
-
-		s.storageMutex.Unlock()
-
-		if mes.TTL != 0 {
-			ttl = mes.TTL
-		} else {
-			ttl = s.DEFAULTTTL
-		}
-
-		s.storageMutex.Lock()
+		return response
+	}
 
-		s.storage[userID][mes.Arguments[0]] = &pstring{
-			content:     mes.Arguments[1],
-			timeOfDeath: time.Now().Add(ttl),
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pbitmap:
+			content, err := v.getContent(mes.Arguments[1])
+			if err != nil {
+				setStatus(&response, _WA)
+			} else {
+				response.Value = content
+				setStatus(&response, _OK)
+			}
+		default:
+			setStatus(&response, _WT)
 		}
-
-		s.storageMutex.Unlock()
-		setStatus(&response, _OK)
+	} else {
+		setStatus(&response, _NK)
 	}
+	s.storageMutex.Unlock()
 
 	return response
 }
 
-//// List functions
-
-func (s *PotatoSlave) lpush(userID string, mes CommandMessage) ResponseMessage {
+// bitcount returns the number of set bits in a bitmap.
+func (s *PotatoSlave) bitcount(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
 
-	if len(mes.Arguments) != 2 {
-		// currently we don't support addition of multiple elements...
+	if len(mes.Arguments) != 1 {
 		setStatus(&response, _WA)
-	} else {
+		return response
+	}
 
-		// Key exist and it's of the right type
-		if val, ok := s.storage[userID][mes.Arguments[0]]; ok {
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pbitmap:
+			response.Value = strconv.Itoa(v.count())
+			setStatus(&response, _OK)
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
 
-			switch val.(type) {
-			case *plist:
+	return response
+}
 
-				s.storageMutex.Lock()
-				s.storage[userID][mes.Arguments[0]].setContent(mes.Arguments[1], "-1")
-				s.storageMutex.Unlock()
+//// Approximate counter functions
 
-				setStatus(&response, _OK)
-				return response
+// pfadd adds elements to an approximate counter and returns "1" if its estimate
+// could change and "0" otherwise. If the key holds an object of a different
+// type it's replaced with a new counter.
+func (s *PotatoSlave) pfadd(userID string, mes CommandMessage) ResponseMessage {
 
-			default:
-			}
+	var response ResponseMessage
 
-		}
+	if len(mes.Arguments) < 1 {
+		setStatus(&response, _WA)
+		return response
+	}
 
-		var ttl time.Duration
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
 
-		if mes.TTL != 0 {
-			ttl = mes.TTL
-		} else {
-			ttl = s.DEFAULTTTL
-		}
+	s.storageMutex.Lock()
 
-		s.storageMutex.Lock()
+	counter, ok := s.live(userID, mes.Arguments[0]).(*papprox)
+	changed := !ok
+	if !ok {
+		counter = newPapprox(deathAfter(ttl))
+		s.storage.Set(userID, mes.Arguments[0], counter)
+	}
 
-		s.storage[userID][mes.Arguments[0]] = &plist{
-			list:        []string{mes.Arguments[1]},
-			timeOfDeath: time.Now().Add(ttl),
+	for _, el := range mes.Arguments[1:] {
+		if counter.add(el) {
+			changed = true
 		}
+	}
 
-		s.storageMutex.Unlock()
+	s.storageMutex.Unlock()
 
-		setStatus(&response, _OK)
+	if changed {
+		response.Value = "1"
+	} else {
+		response.Value = "0"
 	}
+	setStatus(&response, _OK)
 
 	return response
 }
 
-func (s *PotatoSlave) lset(userID string, mes CommandMessage) ResponseMessage {
+// pfcount returns the approximate number of distinct elements added to any of
+// the given counters, missing keys are treated as empty counters.
+func (s *PotatoSlave) pfcount(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
 
-	if len(mes.Arguments) != 3 {
+	if len(mes.Arguments) < 1 {
 		setStatus(&response, _WA)
-	} else {
-
-		s.storageMutex.Lock()
-
-		if val, ok := s.storage[userID][mes.Arguments[0]]; ok {
-
-			switch val.(type) {
-			case *plist:
-
-				err := s.storage[userID][mes.Arguments[0]].setContent(mes.Arguments[2], mes.Arguments[1])
+		return response
+	}
 
-				if err != nil {
-					setStatus(&response, _WA)
-				} else {
-					setStatus(&response, _OK)
-				}
+	union := newPapprox(time.Time{})
 
-			default:
+	s.storageMutex.Lock()
+	for _, key := range mes.Arguments {
+		if val := s.live(userID, key); val != nil {
+			counter, ok := val.(*papprox)
+			if !ok {
+				s.storageMutex.Unlock()
 				setStatus(&response, _WT)
+				return response
 			}
-
-		} else {
-			setStatus(&response, _NK)
+			union.merge(counter)
 		}
-		s.storageMutex.Unlock()
 	}
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.FormatUint(union.count(), 10)
+	setStatus(&response, _OK)
 
 	return response
 }
 
-func (s *PotatoSlave) lget(userID string, mes CommandMessage) ResponseMessage {
+// pfmerge merges the counters given after the destination key into it.
+func (s *PotatoSlave) pfmerge(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
 
-	if len(mes.Arguments) != 2 {
+	if len(mes.Arguments) < 1 {
 		setStatus(&response, _WA)
-	} else {
-
-		s.storageMutex.Lock()
-		if val, ok := s.storage[userID][mes.Arguments[0]]; ok {
+		return response
+	}
 
-			switch val.(type) {
-			case *plist:
-				content, err := s.storage[userID][mes.Arguments[0]].getContent(mes.Arguments[1])
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
 
-				if err != nil {
-					setStatus(&response, _WA)
-				} else {
-					response.Value = content
-					setStatus(&response, _OK)
-				}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
 
-			default:
+	merged := newPapprox(deathAfter(ttl))
+	for _, key := range mes.Arguments {
+		if val := s.live(userID, key); val != nil {
+			counter, ok := val.(*papprox)
+			if !ok {
 				setStatus(&response, _WT)
+				return response
 			}
-		} else {
-			setStatus(&response, _NK)
+			merged.merge(counter)
 		}
-		s.storageMutex.Unlock()
 	}
 
+	if dest := s.live(userID, mes.Arguments[0]); dest != nil {
+		merged.timeOfDeath = dest.getTimeOfDeath()
+	}
+	s.storage.Set(userID, mes.Arguments[0], merged)
+
+	setStatus(&response, _OK)
 	return response
 }
 
-//// Map functions
+//// Stream functions
+
+func formatStreamEntries(entries []streamEntry) string {
+
+	ans := ""
+	for _, e := range entries {
+		ans += "'" + strconv.FormatUint(e.id, 10) + "':'" + e.value + "',"
+	}
+	return ans
+}
 
-func (s *PotatoSlave) hget(userID string, mes CommandMessage) ResponseMessage {
+// xadd appends a value to a stream and returns the id of the new entry. If the
+// key holds an object of a different type it's replaced with a new stream.
+func (s *PotatoSlave) xadd(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
 
 	if len(mes.Arguments) != 2 {
 		setStatus(&response, _WA)
-	} else {
-		s.storageMutex.Lock()
-		if val, ok := s.storage[userID][mes.Arguments[0]]; ok {
+		return response
+	}
 
-			switch val.(type) {
-			case *pmap:
-				content, err := s.storage[userID][mes.Arguments[0]].getContent(mes.Arguments[1])
+	ttl := s.ttlFor(mes.Arguments[0], mes.TTL)
 
-				if err != nil {
-					setStatus(&response, _WA)
-				} else {
-					response.Value = content
-					setStatus(&response, _OK)
-				}
+	s.storageMutex.Lock()
 
-			default:
-				setStatus(&response, _WT)
-			}
-		} else {
-			setStatus(&response, _NK)
+	stream, ok := s.live(userID, mes.Arguments[0]).(*pstream)
+	if !ok {
+		stream = &pstream{
+			offsets:     make(map[string]uint64),
+			timeOfDeath: deathAfter(ttl),
 		}
-		s.storageMutex.Unlock()
+		s.storage.Set(userID, mes.Arguments[0], stream)
 	}
+	id := stream.add(mes.Arguments[1])
+
+	s.storageMutex.Unlock()
+
+	response.Value = strconv.FormatUint(id, 10)
+	setStatus(&response, _OK)
+
 	return response
 }
 
-func (s *PotatoSlave) hset(userID string, mes CommandMessage) ResponseMessage {
+// parseStreamID parses a bound of a range, "-" and "+" stand for the first and
+// the last possible ids.
+func parseStreamID(id string) (uint64, error) {
+
+	switch id {
+	case "-":
+		return 0, nil
+	case "+":
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(id, 10, 64)
+}
+
+// xrange returns entries with ids between two bounds inclusive.
+func (s *PotatoSlave) xrange(userID string, mes CommandMessage) ResponseMessage {
 
 	var response ResponseMessage
 
 	if len(mes.Arguments) != 3 {
 		setStatus(&response, _WA)
-	} else {
-
-		if val, ok := s.storage[userID][mes.Arguments[0]]; ok {
-			switch val.(type) {
-			case *pmap:
+		return response
+	}
 
-				s.storageMutex.Lock()
-				err := s.storage[userID][mes.Arguments[0]].setContent(mes.Arguments[2], mes.Arguments[1])
-				s.storageMutex.Unlock()
+	start, err1 := parseStreamID(mes.Arguments[1])
+	end, err2 := parseStreamID(mes.Arguments[2])
+	if err1 != nil || err2 != nil {
+		setStatus(&response, _WA)
+		return response
+	}
 
-				if err != nil {
-					setStatus(&response, _WA)
-				} else {
-					setStatus(&response, _OK)
-				}
-				return response
-			default:
-			}
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pstream:
+			response.Value = formatStreamEntries(v.between(start, end))
+			setStatus(&response, _OK)
+		default:
+			setStatus(&response, _WT)
 		}
+	} else {
+		setStatus(&response, _NK)
+	}
+	s.storageMutex.Unlock()
 
-		var ttl time.Duration
+	return response
+}
 
-		if mes.TTL != 0 {
-			ttl = mes.TTL
-		} else {
-			ttl = s.DEFAULTTTL
-		}
+// xread returns entries that a consumer hasn't read yet, at most count of them
+// if it's given, and remembers them as read.
+func (s *PotatoSlave) xread(userID string, mes CommandMessage) ResponseMessage {
 
-		s.storageMutex.Lock()
+	var response ResponseMessage
 
-		s.storage[userID][mes.Arguments[0]] = &pmap{
-			timeOfDeath: time.Now().Add(ttl),
-			ourmap:      map[string]string{mes.Arguments[2]: mes.Arguments[1]},
-		}
+	if len(mes.Arguments) != 2 && len(mes.Arguments) != 3 {
+		setStatus(&response, _WA)
+		return response
+	}
 
-		s.storageMutex.Unlock()
+	count := 0
+	if len(mes.Arguments) == 3 {
+		var err error
+		if count, err = strconv.Atoi(mes.Arguments[2]); err != nil || count <= 0 {
+			setStatus(&response, _WA)
+			return response
+		}
+	}
 
+	s.storageMutex.Lock()
+	if val := s.live(userID, mes.Arguments[0]); val != nil {
+
+		switch v := val.(type) {
+		case *pstream:
+			response.Value = formatStreamEntries(v.read(mes.Arguments[1], count))
+			setStatus(&response, _OK)
+		default:
+			setStatus(&response, _WT)
+		}
+	} else {
+		setStatus(&response, _NK)
 	}
+	s.storageMutex.Unlock()
 
 	return response
 }
@@ -2,8 +2,13 @@ package slave
 
 import (
 	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,29 +23,333 @@ type PotatoSlave struct {
 	// Constants
 	IP   string
 	port string
+	// BINDADDRS are the addresses the slave listens on, see bindAddrs.
+	BINDADDRS []string
+	// With TLSPORT clients are also served with TLS on it, on the hosts of
+	// BINDADDRS, with the certificate and the key in TLSCERT and TLSKEY. With
+	// TLSCLIENTCA clients must have a certificate signed by one of the CAs in
+	// it. PORT stays plain for other nodes.
+	TLSPORT     string
+	TLSCERT     string
+	TLSKEY      string
+	TLSCLIENTCA string
+	// USERSPATH has the users that may log in with AUTH and what they may
+	// do, see userACL. Without it everyone is served as "user".
+	USERSPATH string
+	users     users
+	// TOKENSPATH keeps API tokens made with TOKEN, without it they are lost
+	// when the slave stops.
+	TOKENSPATH string
+	// GRANTSPATH keeps grants made with GRANT, without it they are lost when
+	// the slave stops.
+	GRANTSPATH string
+	// A host that fails to log in AUTHMAXFAILURES times within AUTHBANTIME
+	// can't log in for AUTHBANTIME, 0 turns it off.
+	AUTHMAXFAILURES int
+	AUTHBANTIME     time.Duration
+	lockout         lockout
+	// Writes, adminCommands and changes of tokens are audited, the last
+	// AUDITSIZE of them are kept for AUDIT and with AUDITPATH all of them are
+	// appended to it.
+	AUDITSIZE int
+	AUDITPATH string
+	audit     auditLog
+	// ROLE is "primary" or "replica". Commands from REPLICAONLY, e. g. heavy
+	// analytics like QUERY, are rejected on primaries to protect writes.
+	// TODO: the master should route such commands to replicas.
+	ROLE        string
+	REPLICAONLY map[string]bool
 
 	STALETIME   time.Duration
 	DEFAULTTTL  time.Duration
 	CLEANUPTIME time.Duration
-	NUMWORKERS  int
+	// NUMWORKERS is how many commands are served at once, a command waits for
+	// a worker WORKERWAIT at most and gets _NW then, cheapFunctions don't need
+	// one. MAXCONNECTIONS is how many connections are open at once, one more
+	// waits WORKERWAIT too and then it's served by serveCheap. They are
+	// changed with SetWorkers and SetMaxConnections.
+	NUMWORKERS     int
+	MAXCONNECTIONS int
+	WORKERWAIT     time.Duration
+	// STREAMBATCH is the maximum number of items sent in one frame of a
+	// streamed response.
+	STREAMBATCH int
+	// STREAMCHUNK is the number of bytes after which a frame of a streamed
+	// response is sent, a streamed GET sends values in pieces of this size.
+	STREAMCHUNK int
+	// CHEAPTIMEOUT and CHEAPMAXSIZE limit reading of a command from a connection
+	// that is served without a worker.
+	CHEAPTIMEOUT time.Duration
+	CHEAPMAXSIZE int64
+	// RETENTIONCHECKTIME is how often keys are checked against retention rules.
+	RETENTIONCHECKTIME time.Duration
+	// MAXTTL is the longest TTL a write can have, USERMAXTTL overrides it
+	// for some users, 0 means no limit. TTLPOLICY says what's done with a
+	// longer one: "clamp" applies the maximum instead and sets Clamped in the
+	// response, "reject" answers with _TL. Keep DEFAULTTTL within the limit,
+	// it isn't checked.
+	MAXTTL     time.Duration
+	USERMAXTTL map[string]time.Duration
+	TTLPOLICY  string
+	// MAXKEYS is how many keys all the users can have together, keys picked
+	// by EVICTION are evicted after writes over it. 0 turns eviction off.
+	MAXKEYS  int
+	EVICTION EvictionPolicy
+	// CACHECOMMANDS are the expensive reads which responses are cached until
+	// a key they read changes, see cacheScopes for those that can be cached.
+	// CACHESIZE is how many responses are kept.
+	CACHECOMMANDS map[string]bool
+	CACHESIZE     int
+	// REPORTKEY is used to sign erasure reports, they are unsigned if it's empty.
+	REPORTKEY []byte
+	// COUNTERWRAP makes counters wrap around on overflow instead of returning an
+	// error.
+	COUNTERWRAP bool
+	// WATCHDOGINTERVAL is how often the watchdog checks the storage lock and
+	// WATCHDOGTHRESHOLD is how long it could be held before it's reported.
+	WATCHDOGINTERVAL  time.Duration
+	WATCHDOGTHRESHOLD time.Duration
+	// RECOVERPANICS makes panics in command handlers be answered with an
+	// internal error instead of crashing the slave.
+	RECOVERPANICS bool
+	// JOBRETENTION is how long results of finished async jobs are kept.
+	JOBRETENTION time.Duration
+	// EXPIRESAMPLE is how many random keys are checked for expiration in a
+	// round after the expiry queue, 0 turns sampling off. Rounds are repeated
+	// for at most EXPIRESAMPLETIME.
+	EXPIRESAMPLE     int
+	EXPIRESAMPLETIME time.Duration
+	// SWEEPMAXKEYS limits how many due keys are expired in one cleanup, the
+	// rest wait for the next one. SWEEPMAXHOLD is how long the storage lock is
+	// held at most during a cleanup before it's released for a while. 0 means
+	// no limit for both.
+	SWEEPMAXKEYS int
+	SWEEPMAXHOLD time.Duration
+	// IDEMPOTENCYWINDOW is how long results of commands with idempotency keys
+	// are remembered.
+	IDEMPOTENCYWINDOW time.Duration
+	// SNAPSHOTPATH is a file where the storage is saved every SNAPSHOTINTERVAL
+	// and loaded from on StartServing, empty turns snapshots off. With
+	// DELTASNAPSHOTS that many delta snapshots of only the changed keys are
+	// saved next to it between full ones, see SaveDeltaSnapshot.
+	SNAPSHOTPATH     string
+	SNAPSHOTINTERVAL time.Duration
+	DELTASNAPSHOTS   int
+	// AOFPATH is a file where every command that changes the storage is
+	// appended and replayed from on StartServing, empty turns it off.
+	// AOFFSYNC says when the file is synced: "always", "everysec" or "no",
+	// which leaves it to the OS.
+	AOFPATH  string
+	AOFFSYNC string
+	// AOFREWRITESIZE is the size in bytes after which the log is rewritten
+	// once it's also twice as big as after the last rewrite, 0 turns it off.
+	AOFREWRITESIZE int64
+	// ARCHIVE is object storage where the log is shipped for point-in-time
+	// recovery: a segment of the lines written since the last one every
+	// ARCHIVEINTERVAL and a base snapshot on start and every BASEINTERVAL.
+	// It needs AOFPATH, nil turns it off.
+	ARCHIVE         Archive
+	ARCHIVEINTERVAL time.Duration
+	BASEINTERVAL    time.Duration
+	// RESTOREFROM is an archive the storage is restored from on StartServing
+	// as it was at RESTOREUNTIL, instead of SNAPSHOTPATH and AOFPATH, see
+	// RestoreArchive. AOFPATH has to be empty then.
+	RESTOREFROM  Archive
+	RESTOREUNTIL time.Time
+	// DISKPATH is a data file the storage is kept in instead of memory, see
+	// diskStorage. It's flushed every DISKFLUSHINTERVAL, empty keeps the
+	// storage in memory.
+	DISKPATH          string
+	DISKFLUSHINTERVAL time.Duration
+	// NODEID is a stable identity of the slave, see LoadNodeID.
+	NODEID string
+	// SHARD names the shard in causality tokens, the node itself is the
+	// shard if it's empty. Commands wait for the write of a token for at most
+	// CAUSALITYTIMEOUT.
+	SHARD            string
+	CAUSALITYTIMEOUT time.Duration
+	// APPROVALDELAY turns destructive commands into proposals that can be
+	// confirmed no sooner than after the delay and within APPROVALWINDOW
+	// after that, 0 runs them at once.
+	APPROVALDELAY  time.Duration
+	APPROVALWINDOW time.Duration
+	// STANDBYOF is the address of a primary the slave mirrors every
+	// MIRRORINTERVAL as a standby, it serves nothing but standbyCommands until
+	// PROMOTE. Empty makes it a primary.
+	STANDBYOF      string
+	MIRRORINTERVAL time.Duration
+	// MIGRATETIMEOUT is how long MIGRATE waits for the target slave.
+	MIGRATETIMEOUT time.Duration
+	// MASTER is the address of a master the slave registers with as IP:port
+	// every REGISTERINTERVAL, so registrations survive restarts of the
+	// master. Empty doesn't register.
+	MASTER           string
+	REGISTERINTERVAL time.Duration
+	// SEEDS are slaves the gossip starts from, it tells every GOSSIPINTERVAL
+	// a random member what the slave knows. A member whose heartbeat hasn't
+	// grown for PEERTIMEOUT is down, see MEMBERS. SEEDSNAME is a DNS name
+	// of the seeds, its SRV records or its A records with the port of the
+	// slave, it's looked up whenever the gossip needs seeds; SEEDS are used
+	// while it has never resolved.
+	SEEDS          []string
+	SEEDSNAME      string
+	GOSSIPINTERVAL time.Duration
+	PEERTIMEOUT    time.Duration
+	// REPLICAOF is the address of a primary the slave is a replica of: it
+	// gets a snapshot with SYNC and then every write of the primary as it's
+	// applied. A primary drops a replica that is REPLICABUFFER writes
+	// behind, it syncs again then.
+	REPLICAOF     string
+	REPLICABUFFER int
+	// REPLICAHEARTBEAT is how often a primary tells replicas it's there when
+	// there are no writes, a replica reconnects after three of them are
+	// missed. Keep it the same on both.
+	REPLICAHEARTBEAT time.Duration
+	// REPORTLAG makes a replica put its replication lag into responses to
+	// reads. A replica rejects writes from clients with _RO.
+	REPORTLAG bool
+	// RAFTPEERS are the other members of a Raft group as IP:port, keys under
+	// RAFTPREFIXES are written through its log and read from its leader, so
+	// they're linearizable. The leader sends a heartbeat every RAFTHEARTBEAT,
+	// a member that hears of no leader for RAFTELECTION to twice of it starts
+	// an election. A write that isn't applied in RAFTTIMEOUT gets _RT. The
+	// term, the vote and the log are kept in RAFTPATH and synced before the
+	// slave answers with them.
+	RAFTPEERS     []string
+	RAFTPREFIXES  []string
+	RAFTHEARTBEAT time.Duration
+	RAFTELECTION  time.Duration
+	RAFTTIMEOUT   time.Duration
+	RAFTPATH      string
+	// LIVENESSTHRESHOLD is how long the storage lock can be held before the
+	// liveness probe fails.
+	LIVENESSTHRESHOLD time.Duration
+	// Memory is sampled every MEMORYSAMPLETIME and peaks are kept for every
+	// MEMORYINTERVAL. An alert is logged when the peak heap of an interval is
+	// over MEMORYALERTBYTES or fragmentation is over FRAGMENTATIONALERT, 0
+	// turns an alert off.
+	MEMORYSAMPLETIME   time.Duration
+	MEMORYINTERVAL     time.Duration
+	MEMORYALERTBYTES   uint64
+	FRAGMENTATIONALERT float64
 
 	// Functions - a map that holds invocable functions
 	functions map[string]func(string, CommandMessage) ResponseMessage
+	// sessionFunctions are served with the session of the connection, they
+	// log in and manage credentials.
+	sessionFunctions map[string]func(*session, CommandMessage) ResponseMessage
+	// streamFunctions holds functions which result can be streamed, they
+	// give the items to send in batches, see itemStream.
+	streamFunctions map[string]itemsFunc
+	// cheapFunctions are served even when there are no available workers, they
+	// must not touch the storage.
+	cheapFunctions map[string]func(string, CommandMessage) ResponseMessage
+	// jobFunctions are versions of commands that report progress and can be
+	// cancelled when they run as async jobs.
+	jobFunctions map[string]func(*job, string, CommandMessage) ResponseMessage
 
-	// Data - the structure is a nested map, where first level is a separation by users
-	// (each user's keys are stored in a separate table) and then a data map itself.
+	// jobs are async jobs by their IDs, guarded by jobsMutex.
+	jobs      map[string]*job
+	jobsMutex sync.Mutex
+	jobSeq    uint64
+
+	// Data - kept by a Storage backend, mapStorage unless another one is set.
 	// TODO: this mutex should be added to all operations with storage, thats
 	// currently not the case.
-	storage      map[string]map[string]potat
-	storageMutex sync.Mutex
+	storage      Storage
+	storageMutex watchedMutex
+	// userLocks let commands of different users run at once, see lockUser.
+	userLocks [userShards]watchedMutex
+	// expiries is a queue of keys by the time they're due, scheduled holds the
+	// earliest death queued for "user\x00key". Both are guarded by storageMutex,
+	// and by expiryMutex too when it's held for reading.
+	expiries    expiryHeap
+	scheduled   map[string]time.Time
+	expiryMutex sync.Mutex
+	// clock gives the time connection deadlines are counted from, tests replace
+	// it to make reads time out without waiting.
+	clock func() time.Time
+
+	// idempotency holds results of commands sent with idempotency keys.
+	idempotency idempotencyCache
+
+	// subscribers get notified about expired keys.
+	subscribers expirySubscribers
+
+	// stats are counters exposed by the STATS command.
+	stats counters
+
+	// recentCommand is the last command that was invoked, for the watchdog.
+	recentCommand atomic.Value
+	// lastCycle is the last expiryCycle of the ttl checker.
+	lastCycle atomic.Value
+	// aof is the open append-only log, nil if there is none. snapshotSeq is
+	// the last entry of it that the loaded snapshot had.
+	aof         *appendLog
+	snapshotSeq uint64
+	// archive is what of the log isn't in ARCHIVE yet, nil if it isn't
+	// shipped. It's guarded by the mutex of the log.
+	archive *archiveLog
+	// saving is the snapshot being taken, nil if there is none. It's set and
+	// cleared under saveMutex, logged commands hold it for reading while they
+	// run, see preserve.
+	saving    *snapshotProgress
+	saveMutex sync.RWMutex
+	// deltas are the keys changed since the last full snapshot.
+	deltas deltaTracker
+	// memory has the peaks for MEMORYSTATS.
+	memory memoryTracker
+	// proposals wait for PROPOSAL CONFIRM.
+	proposals proposals
+	// applied counts writes for causality tokens.
+	applied appliedLog
+	// serving is 1 while Serve accepts connections.
+	serving int32
+	// standby is 1 until a standby is promoted, mirrorMutex is held by a
+	// sync with the primary.
+	standby     int32
+	mirrorMutex sync.Mutex
+
+	// encryptionKey is a master key from which keys of users are derived, values
+	// of keys under encryptedPrefixes are stored encrypted.
+	encryptionKey     []byte
+	encryptedPrefixes []string
+
+	// aggregations are maintained on every mutation, the first level is users
+	// and the second one is names of aggregations, guarded by storageMutex.
+	aggregations map[string]map[string]*aggregation
+
+	// retentionRules cap TTL of keys under given prefixes, guarded by storageMutex.
+	retentionRules []retentionRule
+	// replication streams writes to replicas of the slave.
+	replication replication
+	// cache keeps responses of CACHECOMMANDS.
+	cache resultCache
+	// gossip is what the slave knows about other members.
+	gossip membership
+	// resolver looks SEEDSNAME up, net.DefaultResolver if nil.
+	resolver seedResolver
+	// raft is the state of the slave in its Raft group.
+	raft raftNode
+	// replicatedAt is the time by the primary's clock of the last entry a
+	// replica has applied, in unix nanoseconds, updated atomically.
+	replicatedAt int64
+	// mutationHooks are added before serving and only read after that.
+	mutationHooks []MutationHook
 
-	// TODO: This is maximum number of connections that server is allowed to open -
-	// it's just a hack so that we can easily stop the server for the tests
+	// numToServ is the number of connections after which Serve stops, so
+	// tests can stop the server, a negative one serves until the listener
+	// fails.
 	numToServ int
 	// availableWorkers is a channel that holds NUMWORKERS 1's when new worker is
 	// started it takes one element with him and puts it back when it finishes.
-	// It's a semaphore, basicly.
-	availableWorkers chan bool
+	// It's a semaphore, basicly. availableConnections is the same for
+	// MAXCONNECTIONS. busyWorkers and openConnections are the numbers of taken
+	// ones, updated atomically.
+	availableWorkers     chan bool
+	availableConnections chan bool
+	busyWorkers          int64
+	openConnections      int64
 }
 
 // NewSlave creates an instance of a PotatoSlave.
@@ -48,31 +357,176 @@ func NewSlave(IP string, port string, STALETIME time.Duration, DEFAULTTTL time.D
 
 	nw := 5
 	s := PotatoSlave{
-		IP:               IP,
-		port:             port,
-		STALETIME:        STALETIME,
-		DEFAULTTTL:       DEFAULTTTL,
-		CLEANUPTIME:      CLEANUPTIME,
-		NUMWORKERS:       nw,
-		storage:          make(map[string]map[string]potat),
-		functions:        make(map[string]func(string, CommandMessage) ResponseMessage),
-		numToServ:        numToServ,
-		availableWorkers: make(chan bool, nw),
-	}
-
-	s.functions["GET"] = s.get
-	s.functions["SET"] = s.set
-	s.functions["LGET"] = s.lget
-	s.functions["LSET"] = s.lset
-	s.functions["LPUSH"] = s.lpush
-	s.functions["DEL"] = s.del
-	s.functions["KEYS"] = s.keys
-	s.functions["HGET"] = s.hget
-	s.functions["HSET"] = s.hset
+		IP:                 IP,
+		port:               port,
+		ROLE:               "primary",
+		replication:        replication{stop: make(chan struct{})},
+		REPLICAONLY:        make(map[string]bool),
+		STALETIME:          STALETIME,
+		DEFAULTTTL:         DEFAULTTTL,
+		CLEANUPTIME:        CLEANUPTIME,
+		WORKERWAIT:         time.Second,
+		STREAMBATCH:        1000,
+		STREAMCHUNK:        64 << 10,
+		AUTHMAXFAILURES:    10,
+		AUTHBANTIME:        time.Minute,
+		AUDITSIZE:          1000,
+		CHEAPTIMEOUT:       time.Millisecond * 100,
+		CHEAPMAXSIZE:       4096,
+		RETENTIONCHECKTIME: time.Minute,
+		USERMAXTTL:         make(map[string]time.Duration),
+		TTLPOLICY:          "clamp",
+		EVICTION:           NewSampledLRU(5),
+		CACHECOMMANDS:      make(map[string]bool),
+		CACHESIZE:          1000,
+		WATCHDOGINTERVAL:   time.Millisecond * 100,
+		WATCHDOGTHRESHOLD:  time.Second,
+		RECOVERPANICS:      true,
+		JOBRETENTION:       time.Minute * 10,
+		EXPIRESAMPLE:       20,
+		EXPIRESAMPLETIME:   time.Millisecond * 25,
+		SWEEPMAXHOLD:       time.Millisecond * 10,
+		IDEMPOTENCYWINDOW:  time.Minute * 5,
+		SNAPSHOTINTERVAL:   time.Minute * 5,
+		AOFFSYNC:           "everysec",
+		AOFREWRITESIZE:     64 << 20,
+		ARCHIVEINTERVAL:    time.Minute,
+		BASEINTERVAL:       time.Hour,
+		DISKFLUSHINTERVAL:  time.Second,
+		LIVENESSTHRESHOLD:  time.Second * 30,
+		CAUSALITYTIMEOUT:   time.Second,
+		APPROVALWINDOW:     time.Minute * 10,
+		MIRRORINTERVAL:     time.Second,
+		MIGRATETIMEOUT:     time.Second * 5,
+		REGISTERINTERVAL:   time.Second * 10,
+		GOSSIPINTERVAL:     time.Second,
+		PEERTIMEOUT:        time.Second * 5,
+		REPLICABUFFER:      10000,
+		REPLICAHEARTBEAT:   time.Second,
+		RAFTHEARTBEAT:      time.Millisecond * 50,
+		RAFTELECTION:       time.Millisecond * 500,
+		RAFTTIMEOUT:        time.Second * 5,
+		raft:               newRaftNode(),
+		proposals:          proposals{items: make(map[string]*proposal)},
+		MEMORYSAMPLETIME:   time.Second,
+		MEMORYINTERVAL:     time.Minute,
+		clock:              time.Now,
+		storage:            newMapStorage(),
+		scheduled:          make(map[string]time.Time),
+		aggregations:       make(map[string]map[string]*aggregation),
+		functions:          make(map[string]func(string, CommandMessage) ResponseMessage),
+		streamFunctions:    make(map[string]itemsFunc),
+		sessionFunctions:   make(map[string]func(*session, CommandMessage) ResponseMessage),
+		cheapFunctions:     make(map[string]func(string, CommandMessage) ResponseMessage),
+		jobFunctions:       make(map[string]func(*job, string, CommandMessage) ResponseMessage),
+		jobs:               make(map[string]*job),
+		numToServ:          numToServ,
+	}
 
-	for i := 0; i < s.NUMWORKERS; i++ {
-		s.availableWorkers <- true
+	for name, spec := range keyCommands {
+		s.functions[name] = s.handle(spec)
 	}
+	s.functions["KEYS"] = s.keys
+	s.functions["SCAN"] = s.scan
+	s.functions["HGETALL"] = s.hgetall
+	s.functions["SADD"] = s.sadd
+	s.functions["SREM"] = s.srem
+	s.functions["SMEMBERS"] = s.smembers
+	s.functions["SISMEMBER"] = s.sismember
+	s.functions["SCARD"] = s.scard
+	s.functions["SINTER"] = s.setOperation(intersectSets, false)
+	s.functions["SUNION"] = s.setOperation(uniteSets, false)
+	s.functions["SDIFF"] = s.setOperation(subtractSets, false)
+	s.functions["SINTERSTORE"] = s.setOperation(intersectSets, true)
+	s.functions["SUNIONSTORE"] = s.setOperation(uniteSets, true)
+	s.functions["SDIFFSTORE"] = s.setOperation(subtractSets, true)
+	s.functions["ZADD"] = s.zadd
+	s.functions["ZRANGE"] = s.zrange
+	s.functions["ZRANGEBYSCORE"] = s.zrangebyscore
+	s.functions["ZINCRBY"] = s.zincrby
+	s.functions["ZRANK"] = s.zrank(false)
+	s.functions["ZREVRANK"] = s.zrank(true)
+	s.functions["CINCR"] = s.counterAdd(1)
+	s.functions["CDECR"] = s.counterAdd(-1)
+	s.functions["CGET"] = s.cget
+	s.functions["SETBIT"] = s.setbit
+	s.functions["GETBIT"] = s.getbit
+	s.functions["BITCOUNT"] = s.bitcount
+	s.functions["PFADD"] = s.pfadd
+	s.functions["PFCOUNT"] = s.pfcount
+	s.functions["PFMERGE"] = s.pfmerge
+	s.functions["XADD"] = s.xadd
+	s.functions["XRANGE"] = s.xrange
+	s.functions["XREAD"] = s.xread
+	s.functions["EXPIRE"] = s.expireCommand(time.Second)
+	s.functions["PEXPIRE"] = s.expireCommand(time.Millisecond)
+	s.functions["EXPIREAT"] = s.expireatCommand(time.Second)
+	s.functions["PEXPIREAT"] = s.expireatCommand(time.Millisecond)
+	s.functions["PERSIST"] = s.persist
+	s.functions["EXPIREPREFIX"] = s.expireprefix
+	s.functions["PERSISTPREFIX"] = s.persistprefix
+	s.functions["TTL"] = s.ttlCommand(time.Second)
+	s.functions["PTTL"] = s.ttlCommand(time.Millisecond)
+	s.functions["JGET"] = s.jget
+	s.functions["JSET"] = s.jset
+	s.functions["QUERY"] = s.querycommand
+	s.functions["AGGCREATE"] = s.aggcreate
+	s.functions["AGGGET"] = s.aggget
+	s.functions["AGGDROP"] = s.aggdrop
+	s.functions["ERASEUSER"] = s.eraseuser
+	s.functions["JOB"] = s.jobcommand
+	s.functions["PROPOSAL"] = s.proposalcommand
+	s.jobFunctions["ERASEUSER"] = s.eraseUserJob
+	s.functions["MOVEKEYS"] = s.movekeys
+	s.jobFunctions["MOVEKEYS"] = s.moveKeysJob
+
+	s.functions["PING"] = s.ping
+	s.functions["ECHO"] = s.echo
+	s.functions["TIME"] = s.timecommand
+	s.functions["STATS"] = s.statscommand
+	s.functions["EXPIRESTATS"] = s.expirestats
+	s.functions["MEMORYSTATS"] = s.memorystats
+	s.functions["VERSION"] = s.version
+	s.functions["HELLO"] = s.hello
+	s.functions["SAVE"] = s.save
+	s.functions["BGSAVE"] = s.bgsave
+	s.functions["DUMP"] = s.dump
+	s.functions["RESTORE"] = s.restore
+	s.functions["MIGRATE"] = s.migrate
+	s.functions["BACKUP"] = s.backup
+	s.jobFunctions["BGSAVE"] = s.bgsaveJob
+	s.functions["BGREWRITEAOF"] = s.bgrewriteaof
+	s.jobFunctions["BGREWRITEAOF"] = s.bgrewriteaofJob
+	s.functions["COMMANDS"] = s.commandscommand
+	s.functions["MIRROR"] = s.mirror
+	s.functions["PROMOTE"] = s.promote
+	s.functions["WAIT"] = s.waitcommand
+	s.functions["GOSSIP"] = s.gossipcommand
+	s.functions["MEMBERS"] = s.members
+	s.functions["RAFTVOTE"] = s.raftvote
+	s.functions["RAFTAPPEND"] = s.raftappend
+	s.functions["AUDIT"] = s.auditcommand
+	s.functions["GRANT"] = s.grantcommand
+
+	s.cheapFunctions["PING"] = s.ping
+	s.cheapFunctions["ECHO"] = s.echo
+	s.cheapFunctions["TIME"] = s.timecommand
+	s.cheapFunctions["STATS"] = s.statscommand
+	s.cheapFunctions["VERSION"] = s.version
+	s.cheapFunctions["HELLO"] = s.hello
+
+	s.sessionFunctions["AUTH"] = s.auth
+	s.sessionFunctions["TOKEN"] = s.tokencommand
+	s.sessionFunctions["USE"] = s.use
+
+	s.streamFunctions["GET"] = s.getItems
+	s.streamFunctions["KEYS"] = s.keysItems
+	s.streamFunctions["HGETALL"] = s.hgetallItems
+	s.streamFunctions["SMEMBERS"] = s.smembersItems
+	s.streamFunctions["BACKUP"] = s.backupItems
+
+	s.SetWorkers(nw)
+	s.SetMaxConnections(1000)
 
 	return &s
 }
@@ -84,6 +538,7 @@ func NewSlave(IP string, port string, STALETIME time.Duration, DEFAULTTTL time.D
 // potat is an interface for objects that could be stored in a PotatoSlave's data storage
 type potat interface {
 	getTimeOfDeath() time.Time
+	setTimeOfDeath(time.Time)
 	getContent(string) (string, error)
 	setContent(string, string) error
 }
@@ -99,6 +554,10 @@ func (p *pstring) getTimeOfDeath() time.Time {
 	return p.timeOfDeath
 }
 
+func (p *pstring) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
 func (p *pstring) getContent(idx string) (string, error) {
 	return p.content, nil
 }
@@ -116,6 +575,10 @@ func (p *plist) getTimeOfDeath() time.Time {
 	return p.timeOfDeath
 }
 
+func (p *plist) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
 // getContent retrieves a string on idx position of list.
 func (p *plist) getContent(idx string) (string, error) {
 
@@ -158,21 +621,510 @@ func (p *plist) setContent(val string, idx string) error {
 type pmap struct {
 	ourmap      map[string]string
 	timeOfDeath time.Time
+	// fieldDeath holds expiration times of the fields that have their own TTL.
+	fieldDeath map[string]time.Time
 }
 
 func (p *pmap) getTimeOfDeath() time.Time {
 	return p.timeOfDeath
 }
 
+func (p *pmap) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
 func (p *pmap) getContent(idx string) (string, error) {
 
+	if death, ok := p.fieldDeath[idx]; ok && death.Before(time.Now()) {
+		return "", errors.New("nk")
+	}
 	if el, ok := p.ourmap[idx]; ok {
 		return el, nil
 	}
 	return "", errors.New("nk")
 }
 
+// setContent sets a field of the map, a field that is set anew loses its own TTL.
 func (p *pmap) setContent(val string, idx string) error {
 	p.ourmap[idx] = val
+	delete(p.fieldDeath, idx)
+	return nil
+}
+
+// deleteContent removes a field from the map.
+func (p *pmap) deleteContent(idx string) {
+	delete(p.ourmap, idx)
+	delete(p.fieldDeath, idx)
+}
+
+// expireField sets time of death for a single field of the map, a field that
+// has expired is missing even if it isn't pruned yet.
+func (p *pmap) expireField(idx string, timeOfDeath time.Time) error {
+
+	if _, err := p.getContent(idx); err != nil {
+		return err
+	}
+	if p.fieldDeath == nil {
+		p.fieldDeath = make(map[string]time.Time)
+	}
+	p.fieldDeath[idx] = timeOfDeath
+	return nil
+}
+
+// pruneFields deletes fields that have expired before now.
+func (p *pmap) pruneFields(now time.Time) {
+
+	for idx, death := range p.fieldDeath {
+		if death.Before(now) {
+			delete(p.ourmap, idx)
+			delete(p.fieldDeath, idx)
+		}
+	}
+}
+
+///// Set
+
+type pset struct {
+	members     map[string]struct{}
+	timeOfDeath time.Time
+}
+
+func (p *pset) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *pset) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+// getContent checks if idx is a member of the set.
+func (p *pset) getContent(idx string) (string, error) {
+
+	if _, ok := p.members[idx]; ok {
+		return idx, nil
+	}
+	return "", errors.New("nk")
+}
+
+// setContent adds val to the set, idx is ignored.
+func (p *pset) setContent(val string, idx string) error {
+	p.members[val] = struct{}{}
+	return nil
+}
+
+///// Sorted set
+
+// zmember is an element of a sorted set.
+type zmember struct {
+	member string
+	score  float64
+}
+
+// pzset keeps members ordered by score (and by member for equal scores) in a
+// slice, scores map allows finding a member quickly.
+type pzset struct {
+	ordered     []zmember
+	scores      map[string]float64
+	timeOfDeath time.Time
+}
+
+func (p *pzset) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *pzset) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+// getContent returns the score of the idx member.
+func (p *pzset) getContent(idx string) (string, error) {
+
+	if score, ok := p.scores[idx]; ok {
+		return strconv.FormatFloat(score, 'g', -1, 64), nil
+	}
+	return "", errors.New("nk")
+}
+
+// setContent sets the score of the idx member to val.
+func (p *pzset) setContent(val string, idx string) error {
+
+	score, err := strconv.ParseFloat(val, 64)
+	if err != nil || math.IsNaN(score) {
+		return errors.New("wr")
+	}
+
+	p.add(idx, score)
 	return nil
 }
+
+// position returns where an element with given score and member is or should be
+// in the ordered slice.
+func (p *pzset) position(member string, score float64) int {
+
+	return sort.Search(len(p.ordered), func(i int) bool {
+		if p.ordered[i].score != score {
+			return p.ordered[i].score > score
+		}
+		return p.ordered[i].member >= member
+	})
+}
+
+// add sets the score of a member, it returns true if the member is new.
+func (p *pzset) add(member string, score float64) bool {
+
+	old, exists := p.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		i := p.position(member, old)
+		p.ordered = append(p.ordered[:i], p.ordered[i+1:]...)
+	}
+
+	i := p.position(member, score)
+	p.ordered = append(p.ordered, zmember{})
+	copy(p.ordered[i+1:], p.ordered[i:])
+	p.ordered[i] = zmember{member: member, score: score}
+	p.scores[member] = score
+
+	return !exists
+}
+
+// rank returns the position of a member in the ordered slice.
+func (p *pzset) rank(member string) (int, bool) {
+
+	score, ok := p.scores[member]
+	if !ok {
+		return 0, false
+	}
+	return p.position(member, score), true
+}
+
+// rangeByRank returns members from start to stop positions inclusive, negative
+// positions are counted from the end.
+func (p *pzset) rangeByRank(start int, stop int) []zmember {
+
+	n := len(p.ordered)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil
+	}
+
+	return p.ordered[start : stop+1]
+}
+
+// rangeByScore returns members with scores between min and max inclusive.
+func (p *pzset) rangeByScore(min float64, max float64) []zmember {
+
+	start := sort.Search(len(p.ordered), func(i int) bool { return p.ordered[i].score >= min })
+	stop := sort.Search(len(p.ordered), func(i int) bool { return p.ordered[i].score > max })
+	if start >= stop {
+		return nil
+	}
+
+	return p.ordered[start:stop]
+}
+
+///// Counter
+
+type pcounter struct {
+	value       int64
+	timeOfDeath time.Time
+}
+
+func (p *pcounter) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *pcounter) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+func (p *pcounter) getContent(idx string) (string, error) {
+	return strconv.FormatInt(p.value, 10), nil
+}
+
+func (p *pcounter) setContent(val string, idx string) error {
+
+	v, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return errors.New("wr")
+	}
+	p.value = v
+	return nil
+}
+
+// add adds delta to the counter. On overflow the value wraps around if wrap is
+// set, otherwise it stays the same and an error is returned.
+func (p *pcounter) add(delta int64, wrap bool) error {
+
+	result := p.value + delta
+	overflow := (delta > 0 && result < p.value) || (delta < 0 && result > p.value)
+	if overflow && !wrap {
+		return errors.New("of")
+	}
+	p.value = result
+	return nil
+}
+
+///// Bitmap
+
+// maxBitOffset limits the size of a bitmap to 512MB.
+const maxBitOffset = 1<<32 - 1
+
+type pbitmap struct {
+	bits        []byte
+	timeOfDeath time.Time
+}
+
+func (p *pbitmap) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *pbitmap) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+// getContent returns the bit at idx offset as "0" or "1".
+func (p *pbitmap) getContent(idx string) (string, error) {
+
+	offset, err := strconv.ParseUint(idx, 10, 64)
+	if err != nil || offset > maxBitOffset {
+		return "", errors.New("wr")
+	}
+	return strconv.Itoa(int(p.getBit(offset))), nil
+}
+
+// setContent sets the bit at idx offset to val, which is "0" or "1".
+func (p *pbitmap) setContent(val string, idx string) error {
+
+	offset, err := strconv.ParseUint(idx, 10, 64)
+	if err != nil || offset > maxBitOffset || (val != "0" && val != "1") {
+		return errors.New("wr")
+	}
+	p.setBit(offset, val == "1")
+	return nil
+}
+
+func (p *pbitmap) getBit(offset uint64) byte {
+
+	if offset/8 >= uint64(len(p.bits)) {
+		return 0
+	}
+	return (p.bits[offset/8] >> (7 - offset%8)) & 1
+}
+
+// setBit sets a bit growing the bitmap if needed.
+func (p *pbitmap) setBit(offset uint64, on bool) {
+
+	if offset/8 >= uint64(len(p.bits)) {
+		grown := make([]byte, offset/8+1)
+		copy(grown, p.bits)
+		p.bits = grown
+	}
+	if on {
+		p.bits[offset/8] |= 1 << (7 - offset%8)
+	} else {
+		p.bits[offset/8] &^= 1 << (7 - offset%8)
+	}
+}
+
+// count returns the number of set bits.
+func (p *pbitmap) count() int {
+
+	n := 0
+	for _, b := range p.bits {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+///// Approximate distinct counter (HyperLogLog)
+
+// hllPrecision gives 2^14 registers, which makes the standard error about 0.8%.
+const hllPrecision = 14
+const hllRegisters = 1 << hllPrecision
+
+type papprox struct {
+	registers   []uint8
+	timeOfDeath time.Time
+}
+
+func newPapprox(timeOfDeath time.Time) *papprox {
+	return &papprox{
+		registers:   make([]uint8, hllRegisters),
+		timeOfDeath: timeOfDeath,
+	}
+}
+
+func (p *papprox) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *papprox) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+// getContent returns the estimated number of distinct elements.
+func (p *papprox) getContent(idx string) (string, error) {
+	return strconv.FormatUint(p.count(), 10), nil
+}
+
+// setContent adds val to the counter, idx is ignored.
+func (p *papprox) setContent(val string, idx string) error {
+	p.add(val)
+	return nil
+}
+
+// hllHash is 64-bit FNV-1a followed by a splitmix64 finalizer, as FNV alone
+// doesn't mix the high bits well enough for short strings.
+func hllHash(val string) uint64 {
+
+	h := fnv.New64a()
+	h.Write([]byte(val))
+	x := h.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// add registers an element, it returns true if the estimate could change.
+func (p *papprox) add(val string) bool {
+
+	x := hllHash(val)
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+
+	if rank > p.registers[idx] {
+		p.registers[idx] = rank
+		return true
+	}
+	return false
+}
+
+// merge makes the counter count elements of other as well.
+func (p *papprox) merge(other *papprox) {
+
+	for i, r := range other.registers {
+		if r > p.registers[i] {
+			p.registers[i] = r
+		}
+	}
+}
+
+// count estimates the number of distinct elements, using linear counting when
+// there are many empty registers.
+func (p *papprox) count() uint64 {
+
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range p.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	if estimate <= 2.5*m && zeros != 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+///// Stream
+
+type streamEntry struct {
+	id    uint64
+	value string
+}
+
+// pstream is an append only log, entries get increasing ids starting from 1.
+// offsets hold the last id read by every consumer.
+type pstream struct {
+	entries     []streamEntry
+	lastID      uint64
+	offsets     map[string]uint64
+	timeOfDeath time.Time
+}
+
+func (p *pstream) getTimeOfDeath() time.Time {
+	return p.timeOfDeath
+}
+
+func (p *pstream) setTimeOfDeath(t time.Time) {
+	p.timeOfDeath = t
+}
+
+// getContent returns the value of the entry with idx id.
+func (p *pstream) getContent(idx string) (string, error) {
+
+	id, err := strconv.ParseUint(idx, 10, 64)
+	if err != nil {
+		return "", errors.New("wr")
+	}
+
+	entries := p.between(id, id)
+	if len(entries) == 0 {
+		return "", errors.New("nk")
+	}
+	return entries[0].value, nil
+}
+
+// setContent appends val to the stream, idx is ignored.
+func (p *pstream) setContent(val string, idx string) error {
+	p.add(val)
+	return nil
+}
+
+// add appends a value and returns its id.
+func (p *pstream) add(val string) uint64 {
+	p.lastID++
+	p.entries = append(p.entries, streamEntry{id: p.lastID, value: val})
+	return p.lastID
+}
+
+// between returns entries with ids from start to end inclusive.
+func (p *pstream) between(start uint64, end uint64) []streamEntry {
+
+	from := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].id >= start })
+	to := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].id > end })
+	if from >= to {
+		return nil
+	}
+	return p.entries[from:to]
+}
+
+// read returns at most count entries the consumer hasn't read yet and moves
+// his offset past them, count <= 0 means no limit.
+func (p *pstream) read(consumer string, count int) []streamEntry {
+
+	entries := p.between(p.offsets[consumer]+1, p.lastID)
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	if len(entries) != 0 {
+		p.offsets[consumer] = entries[len(entries)-1].id
+	}
+	return entries
+}
@@ -1,9 +1,41 @@
 package slave
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/gob"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -139,7 +171,7 @@ func TestPlist(t *testing.T) {
 		if response.Code != _OK {
 			t.Errorf("Got %s on deletion", response.StatusMessage)
 		}
-		if _, ok := s.storage["user"]["mylist"]; ok {
+		if s.storage.Get("user", "mylist") != nil {
 			t.Errorf("Deletion didn't work")
 		}
 
@@ -255,8 +287,8 @@ func _TestTTL(t *testing.T) {
 			Arguments: []string{"long", "value"},
 			TTL:       time.Hour,
 		})
-		//fmt.Println(s.storage["user"]["short"].getTimeOfDeath())
-		//fmt.Println(s.storage["user"]["long"].getTimeOfDeath())
+		//fmt.Println(s.storage.Get("user", "short").getTimeOfDeath())
+		//fmt.Println(s.storage.Get("user", "long").getTimeOfDeath())
 		decoder.Decode(&response)
 		time.Sleep(time.Second)
 
@@ -286,3 +318,5400 @@ func _TestTTL(t *testing.T) {
 	<-done
 }
 */
+
+func TestKeysStream(t *testing.T) {
+
+	// Create a slave
+	testPort := "62553"
+	s := NewSlave("localhost", testPort, time.Second, time.Minute, time.Millisecond*100, 1)
+	s.STREAMBATCH = 2
+	s.REPLICAONLY["SMEMBERS"] = true
+
+	// Client simulator
+	go func(testPort string, s *PotatoSlave, t *testing.T) {
+
+		encoder, decoder, response := newClient(testPort)
+
+		for i := 0; i < 5; i++ {
+			encoder.Encode(CommandMessage{
+				Name:      "HSET",
+				Arguments: []string{"myhash", strconv.Itoa(i), strconv.Itoa(i)},
+			})
+			decoder.Decode(&response)
+		}
+
+		encoder.Encode(CommandMessage{
+			Name:      "HGETALL",
+			Arguments: []string{"myhash"},
+			Stream:    true,
+		})
+
+		frames := 0
+		all := ""
+		for {
+			decoder.Decode(&response)
+			if response.Code != _OK {
+				t.Errorf("Got %s while streaming", response.StatusMessage)
+				return
+			}
+			all += response.Value
+			if !response.More {
+				break
+			}
+			frames++
+		}
+
+		if frames != 3 {
+			t.Errorf("Expected 3 frames, got %d", frames)
+		}
+		// Batches go in order of the fields
+		if all != "'0':'0','1':'1','2':'2','3':'3','4':'4'," {
+			t.Errorf("Got wrong fields: %s", all)
+		}
+
+		// A stream runs through invoke like any other command
+		encoder.Encode(CommandMessage{Name: "SMEMBERS", Arguments: []string{"set"}, Stream: true})
+		decoder.Decode(&response)
+		if response.Code != _PR || response.More {
+			t.Errorf("Expected _PR in one message for a command of replicas, got %+v", response)
+		}
+
+		encoder.Encode(CommandMessage{
+			Name:   "KEYS",
+			Stream: true,
+		})
+		decoder.Decode(&response)
+		if response.Value != "'myhash'," || !response.More {
+			t.Errorf("Got wrong keys frame: %s", response.Value)
+		}
+		decoder.Decode(&response)
+		if response.More {
+			t.Errorf("Keys stream wasn't terminated")
+		}
+
+	}(testPort, s, t)
+
+	// Start serving
+	s.StartServing()
+}
+
+func TestScan(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for i := 0; i < 25; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k" + strconv.Itoa(100 + i)[1:], "v"}})
+	}
+
+	// A key written during the scan behind the cursor isn't returned, every
+	// other one is, once
+	var keys []string
+	cursor, scans := "0", 0
+	for {
+		response := s.invoke("user", CommandMessage{Name: "SCAN", Arguments: []string{cursor, "10"}})
+		items := strings.Split(strings.TrimSuffix(response.Value, ","), ",")
+		if response.Code != _OK || len(items) > 11 {
+			t.Fatalf("SCAN failed: %+v", response)
+		}
+		for _, item := range items[1:] {
+			keys = append(keys, strings.Trim(item, "'"))
+		}
+		if scans++; scans == 1 {
+			s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"a", "v"}})
+		}
+		if cursor = strings.Trim(items[0], "'"); cursor == "0" {
+			break
+		}
+	}
+	if scans != 3 || len(keys) != 25 || keys[0] != "k00" || keys[24] != "k24" {
+		t.Errorf("Got wrong keys in %d scans: %v", scans, keys)
+	}
+
+	for _, args := range [][]string{{}, {"0", "0"}, {"not base64"}} {
+		if code := s.invoke("user", CommandMessage{Name: "SCAN", Arguments: args}).Code; code != _WA {
+			t.Errorf("SCAN %v: %d", args, code)
+		}
+	}
+}
+
+func TestHexpire(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"myhash", "a", "short"}})
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"myhash", "b", "long"}})
+
+	response := s.functions["HEXPIRE"]("user", CommandMessage{Name: "HEXPIRE", Arguments: []string{"myhash", "a", "1"}})
+	if response.Code != _OK {
+		t.Errorf("Got %s on hexpire", response.StatusMessage)
+	}
+	if ttl := time.Until(s.storage.Get("user", "myhash").(*pmap).fieldDeath["a"]); ttl > time.Second || ttl < time.Second/2 {
+		t.Errorf("Field got a wrong TTL: %s", ttl)
+	}
+	response = s.functions["HEXPIRE"]("user", CommandMessage{Name: "HEXPIRE", Arguments: []string{"myhash", "nosuchfield", "1"}})
+	if response.Code != _NK {
+		t.Errorf("Expected _NK for a missing field, got %s", response.StatusMessage)
+	}
+	for _, ttl := range []string{"0", "-1", "x"} {
+		response = s.functions["HEXPIRE"]("user", CommandMessage{Name: "HEXPIRE", Arguments: []string{"myhash", "a", ttl}})
+		if response.Code != _WA {
+			t.Errorf("Expected _WA for TTL %s, got %s", ttl, response.StatusMessage)
+		}
+	}
+
+	s.storage.Get("user", "myhash").(*pmap).fieldDeath["a"] = time.Now().Add(-time.Millisecond)
+
+	// A field that has expired is missing before it's pruned
+	response = s.functions["HEXPIRE"]("user", CommandMessage{Name: "HEXPIRE", Arguments: []string{"myhash", "a", "100"}})
+	if response.Code != _NK {
+		t.Errorf("Expected _NK for an expired field, got %s", response.StatusMessage)
+	}
+
+	response = s.functions["HGET"]("user", CommandMessage{Name: "HGET", Arguments: []string{"myhash", "a"}})
+	if response.Code == _OK {
+		t.Errorf("Expired field was returned")
+	}
+
+	s.storage.Get("user", "myhash").(*pmap).pruneFields(time.Now())
+	if _, ok := s.storage.Get("user", "myhash").(*pmap).ourmap["a"]; ok {
+		t.Errorf("Expired field wasn't pruned")
+	}
+	response = s.functions["HGET"]("user", CommandMessage{Name: "HGET", Arguments: []string{"myhash", "b"}})
+	if response.Value != "long" {
+		t.Errorf("Non expired field was deleted")
+	}
+}
+
+func TestCheapWithoutWorkers(t *testing.T) {
+
+	// Create a slave
+	testPort := "62553"
+	s := NewSlave("localhost", testPort, time.Second, time.Minute, time.Millisecond*100, 1)
+
+	// Take all the workers
+	for i := 0; i < s.NUMWORKERS; i++ {
+		<-s.availableWorkers
+	}
+
+	// Client simulator
+	go func(testPort string, s *PotatoSlave, t *testing.T) {
+
+		encoder, decoder, response := newClient(testPort)
+
+		encoder.Encode(CommandMessage{
+			Name: "PING",
+		})
+		decoder.Decode(&response)
+
+		if response.Code != _OK || response.Value != "PONG" {
+			t.Errorf("Ping wasn't served without workers: %s", response.StatusMessage)
+		}
+
+		// Give the workers back
+		for i := 0; i < s.NUMWORKERS; i++ {
+			s.availableWorkers <- true
+		}
+
+	}(testPort, s, t)
+
+	// Start serving
+	s.StartServing()
+}
+
+func TestHgetdelHgetex(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"myhash", "a", "1"}})
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"myhash", "b", "2"}})
+
+	response := s.functions["HGETEX"]("user", CommandMessage{Name: "HGETEX", Arguments: []string{"myhash", "a"}, TTL: time.Hour})
+	if response.Code != _OK || response.Value != "1" {
+		t.Errorf("Got wrong response on hgetex: %s, %s", response.StatusMessage, response.Value)
+	}
+	if s.storage.Get("user", "myhash").getTimeOfDeath().Before(time.Now().Add(time.Minute * 59)) {
+		t.Errorf("Hgetex didn't update TTL")
+	}
+
+	response = s.functions["HGETDEL"]("user", CommandMessage{Name: "HGETDEL", Arguments: []string{"myhash", "a"}})
+	if response.Code != _OK || response.Value != "1" {
+		t.Errorf("Got wrong response on hgetdel: %s, %s", response.StatusMessage, response.Value)
+	}
+	response = s.functions["HGET"]("user", CommandMessage{Name: "HGET", Arguments: []string{"myhash", "a"}})
+	if response.Code == _OK {
+		t.Errorf("Hgetdel didn't delete the field")
+	}
+
+	s.functions["HGETDEL"]("user", CommandMessage{Name: "HGETDEL", Arguments: []string{"myhash", "b"}})
+	if s.storage.Get("user", "myhash") != nil {
+		t.Errorf("Empty hash wasn't deleted")
+	}
+}
+
+func TestRetention(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Hour, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"logs:old", "value"}, TTL: time.Hour * 24})
+	s.AddRetentionRule("logs:", time.Minute)
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"logs:new", "value"}, TTL: time.Hour * 24})
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"other", "value"}, TTL: time.Hour * 24})
+
+	limit := time.Now().Add(time.Minute)
+	if s.storage.Get("user", "logs:new").getTimeOfDeath().After(limit) {
+		t.Errorf("TTL wasn't capped on write")
+	}
+
+	s.applyRetention()
+	if s.storage.Get("user", "logs:old").getTimeOfDeath().After(time.Now().Add(time.Minute)) {
+		t.Errorf("TTL of an existing key wasn't capped")
+	}
+	if s.storage.Get("user", "other").getTimeOfDeath().Before(time.Now().Add(time.Hour)) {
+		t.Errorf("TTL of a key without a rule was changed")
+	}
+}
+
+func TestPset(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	response := s.sadd("user", CommandMessage{Name: "SADD", Arguments: []string{"myset", "a", "b", "a"}})
+	if response.Code != _OK || response.Value != "2" {
+		t.Errorf("Got wrong response on sadd: %s, %s", response.StatusMessage, response.Value)
+	}
+
+	response = s.sismember("user", CommandMessage{Name: "SISMEMBER", Arguments: []string{"myset", "a"}})
+	if response.Value != "1" {
+		t.Errorf("Added member isn't in the set")
+	}
+	response = s.sismember("user", CommandMessage{Name: "SISMEMBER", Arguments: []string{"myset", "c"}})
+	if response.Value != "0" {
+		t.Errorf("Member that wasn't added is in the set")
+	}
+
+	response = s.scard("user", CommandMessage{Name: "SCARD", Arguments: []string{"myset"}})
+	if response.Value != "2" {
+		t.Errorf("Got wrong cardinality: %s", response.Value)
+	}
+
+	response = s.smembers("user", CommandMessage{Name: "SMEMBERS", Arguments: []string{"myset"}})
+	if !strings.Contains(response.Value, "'a',") || !strings.Contains(response.Value, "'b',") {
+		t.Errorf("Got wrong members: %s", response.Value)
+	}
+
+	response = s.srem("user", CommandMessage{Name: "SREM", Arguments: []string{"myset", "a", "b"}})
+	if response.Value != "2" {
+		t.Errorf("Got wrong response on srem: %s", response.Value)
+	}
+	if s.storage.Get("user", "myset") != nil {
+		t.Errorf("Empty set wasn't deleted")
+	}
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"str", "value"}})
+	response = s.sismember("user", CommandMessage{Name: "SISMEMBER", Arguments: []string{"str", "a"}})
+	if response.Code != _WT {
+		t.Errorf("Expected _WT for a string, got %s", response.StatusMessage)
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.REPORTKEY = []byte("secret")
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"a", "value"}})
+	s.functions["LPUSH"]("user", CommandMessage{Name: "LPUSH", Arguments: []string{"b", "value"}})
+
+	response := s.eraseuser("admin", CommandMessage{Name: "ERASEUSER", Arguments: []string{"user"}})
+	if response.Code != _OK {
+		t.Fatalf("Got %s on eraseuser", response.StatusMessage)
+	}
+	if s.storage.Len("user") != 0 {
+		t.Errorf("User's keys weren't erased")
+	}
+
+	var report ErasureReport
+	json.Unmarshal([]byte(response.Value), &report)
+	if len(report.Keys) != 2 || report.User != "user" {
+		t.Errorf("Got wrong report: %s", response.Value)
+	}
+	if !VerifyErasureReport(report, s.REPORTKEY) {
+		t.Errorf("Report signature doesn't verify")
+	}
+	report.Keys = report.Keys[:1]
+	if VerifyErasureReport(report, s.REPORTKEY) {
+		t.Errorf("Changed report verifies")
+	}
+
+	response = s.eraseuser("admin", CommandMessage{Name: "ERASEUSER", Arguments: []string{"nobody"}})
+	if response.Code != _NK {
+		t.Errorf("Expected _NK for an unknown user, got %s", response.StatusMessage)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.sadd("user", CommandMessage{Name: "SADD", Arguments: []string{"x", "a", "b", "c"}})
+	s.sadd("user", CommandMessage{Name: "SADD", Arguments: []string{"y", "b", "c", "d"}})
+
+	response := s.functions["SINTER"]("user", CommandMessage{Name: "SINTER", Arguments: []string{"x", "y"}})
+	if len(response.Value) != len("'b','c',") || !strings.Contains(response.Value, "'b',") || !strings.Contains(response.Value, "'c',") {
+		t.Errorf("Got wrong intersection: %s", response.Value)
+	}
+
+	response = s.functions["SDIFF"]("user", CommandMessage{Name: "SDIFF", Arguments: []string{"x", "y", "nosuchkey"}})
+	if response.Value != "'a'," {
+		t.Errorf("Got wrong difference: %s", response.Value)
+	}
+
+	response = s.functions["SUNIONSTORE"]("user", CommandMessage{Name: "SUNIONSTORE", Arguments: []string{"z", "x", "y"}})
+	if response.Code != _OK || response.Value != "4" {
+		t.Errorf("Got wrong union cardinality: %s", response.Value)
+	}
+	response = s.scard("user", CommandMessage{Name: "SCARD", Arguments: []string{"z"}})
+	if response.Value != "4" {
+		t.Errorf("Union wasn't stored: %s", response.Value)
+	}
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"str", "value"}})
+	response = s.functions["SINTER"]("user", CommandMessage{Name: "SINTER", Arguments: []string{"x", "str"}})
+	if response.Code != _WT {
+		t.Errorf("Expected _WT for a string, got %s", response.StatusMessage)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.EnableEncryption([]byte("master key"), []string{"secret:"})
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"secret:str", "value"}})
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"secret:hash", "field", "value"}})
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"plain", "value"}})
+
+	if content, _ := s.storage.Get("user", "secret:str").getContent(""); content == "value" {
+		t.Errorf("Value under encrypted prefix is stored as is")
+	}
+	if content, _ := s.storage.Get("user", "plain").getContent(""); content != "value" {
+		t.Errorf("Value without encrypted prefix was changed")
+	}
+
+	response := s.functions["GET"]("user", CommandMessage{Name: "GET", Arguments: []string{"secret:str"}})
+	if response.Code != _OK || response.Value != "value" {
+		t.Errorf("Got wrong value after decryption: %s, %s", response.StatusMessage, response.Value)
+	}
+	response = s.functions["HGET"]("user", CommandMessage{Name: "HGET", Arguments: []string{"secret:hash", "field"}})
+	if response.Code != _OK || response.Value != "value" {
+		t.Errorf("Got wrong hash value after decryption: %s, %s", response.StatusMessage, response.Value)
+	}
+
+	// Another user can't decrypt the value
+	s.storage.Set("other", "secret:str", s.storage.Get("user", "secret:str"))
+	response = s.functions["GET"]("other", CommandMessage{Name: "GET", Arguments: []string{"secret:str"}})
+	if response.Code != _DE {
+		t.Errorf("Value was decrypted for another user")
+	}
+
+	// Types that aren't sealed aren't kept under encrypted prefixes
+	for _, mes := range []CommandMessage{
+		{Name: "SADD", Arguments: []string{"secret:set", "member"}},
+		{Name: "ZADD", Arguments: []string{"secret:zset", "1", "member"}},
+		{Name: "XADD", Arguments: []string{"secret:stream", "entry"}},
+		{Name: "SADD", Arguments: []string{base64.StdEncoding.EncodeToString([]byte("secret:bin")), "bWVtYmVy"}, Binary: true},
+	} {
+		if code := s.invoke("user", mes).Code; code != _WT {
+			t.Errorf("%s under an encrypted prefix: %d", mes.Name, code)
+		}
+	}
+	s.invoke("user", CommandMessage{Name: "SADD", Arguments: []string{"set", "member"}})
+	dump := s.invoke("user", CommandMessage{Name: "DUMP", Arguments: []string{"set"}}).Value
+	if code := s.invoke("user", CommandMessage{Name: "RESTORE", Arguments: []string{"secret:set", dump}}).Code; code != _WT {
+		t.Errorf("Set was restored under an encrypted prefix: %d", code)
+	}
+	dump = s.invoke("user", CommandMessage{Name: "DUMP", Arguments: []string{"secret:str"}}).Value
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"secret:str"}})
+	s.invoke("user", CommandMessage{Name: "RESTORE", Arguments: []string{"secret:str", dump}})
+	if value := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"secret:str"}}).Value; value != "value" {
+		t.Errorf("Got wrong value of a restored string: %s", value)
+	}
+	if s.storage.Len("user") != 4 {
+		t.Errorf("Got wrong keys: %d", s.storage.Len("user"))
+	}
+}
+
+func TestPzset(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	response := s.zadd("user", CommandMessage{Name: "ZADD", Arguments: []string{"board", "30", "c", "10", "a", "20", "b"}})
+	if response.Code != _OK || response.Value != "3" {
+		t.Errorf("Got wrong response on zadd: %s, %s", response.StatusMessage, response.Value)
+	}
+
+	response = s.zrange("user", CommandMessage{Name: "ZRANGE", Arguments: []string{"board", "0", "-1"}})
+	if response.Value != "'a','b','c'," {
+		t.Errorf("Got wrong order: %s", response.Value)
+	}
+
+	// Update a score
+	s.zadd("user", CommandMessage{Name: "ZADD", Arguments: []string{"board", "5", "c"}})
+	response = s.zrange("user", CommandMessage{Name: "ZRANGE", Arguments: []string{"board", "0", "0", "WITHSCORES"}})
+	if response.Value != "'c':'5'," {
+		t.Errorf("Got wrong first member after update: %s", response.Value)
+	}
+
+	response = s.zrangebyscore("user", CommandMessage{Name: "ZRANGEBYSCORE", Arguments: []string{"board", "10", "+inf"}})
+	if response.Value != "'a','b'," {
+		t.Errorf("Got wrong range by score: %s", response.Value)
+	}
+
+	response = s.zrange("user", CommandMessage{Name: "ZRANGE", Arguments: []string{"board", "x", "1"}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for a bad rank, got %s", response.StatusMessage)
+	}
+
+	// NaN can't be ordered, a member with it would break the next update
+	response = s.zadd("user", CommandMessage{Name: "ZADD", Arguments: []string{"board", "NaN", "d"}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for a NaN score, got %s", response.StatusMessage)
+	}
+	if response = s.zadd("user", CommandMessage{Name: "ZADD", Arguments: []string{"board", "1", "d"}}); response.Value != "1" {
+		t.Errorf("Got wrong response on zadd after NaN: %s, %s", response.StatusMessage, response.Value)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"str", "value"}})
+	s.functions["LPUSH"]("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", "el"}})
+
+	dir, err := ioutil.TempDir("", "potato-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := s.ExportCSV(dir); err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+
+	f, _ := os.Open(filepath.Join(dir, "lists.csv"))
+	defer f.Close()
+	rows, _ := csv.NewReader(f).ReadAll()
+	if len(rows) != 2 || rows[1][1] != "list" || rows[1][3] != "el" {
+		t.Errorf("Got wrong list rows: %v", rows)
+	}
+}
+
+func TestZincrbyZrank(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.zadd("user", CommandMessage{Name: "ZADD", Arguments: []string{"board", "10", "a", "20", "b"}})
+
+	response := s.zincrby("user", CommandMessage{Name: "ZINCRBY", Arguments: []string{"board", "15", "a"}})
+	if response.Code != _OK || response.Value != "25" {
+		t.Errorf("Got wrong response on zincrby: %s, %s", response.StatusMessage, response.Value)
+	}
+	response = s.zincrby("user", CommandMessage{Name: "ZINCRBY", Arguments: []string{"board", "1", "c"}})
+	if response.Value != "1" {
+		t.Errorf("New member got wrong score: %s", response.Value)
+	}
+
+	response = s.functions["ZRANK"]("user", CommandMessage{Name: "ZRANK", Arguments: []string{"board", "a"}})
+	if response.Value != "2" {
+		t.Errorf("Got wrong rank: %s", response.Value)
+	}
+	response = s.functions["ZREVRANK"]("user", CommandMessage{Name: "ZREVRANK", Arguments: []string{"board", "a"}})
+	if response.Value != "0" {
+		t.Errorf("Got wrong reverse rank: %s", response.Value)
+	}
+	response = s.functions["ZRANK"]("user", CommandMessage{Name: "ZRANK", Arguments: []string{"board", "nobody"}})
+	if response.Code != _NK {
+		t.Errorf("Expected _NK for a missing member, got %s", response.StatusMessage)
+	}
+
+	// Scores never become NaN
+	s.zincrby("user", CommandMessage{Name: "ZINCRBY", Arguments: []string{"board", "+inf", "inf"}})
+	for _, increment := range []string{"-inf", "nan"} {
+		response = s.zincrby("user", CommandMessage{Name: "ZINCRBY", Arguments: []string{"board", increment, "inf"}})
+		if response.Code != _WA {
+			t.Errorf("Expected _WA for a NaN score, got %s, %s", response.StatusMessage, response.Value)
+		}
+	}
+	if response = s.zincrby("user", CommandMessage{Name: "ZINCRBY", Arguments: []string{"board", "1", "inf"}}); response.Value != "+Inf" {
+		t.Errorf("Got wrong score after NaN: %s, %s", response.StatusMessage, response.Value)
+	}
+}
+
+func TestPcounter(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	response := s.functions["CINCR"]("user", CommandMessage{Name: "CINCR", Arguments: []string{"c"}})
+	if response.Code != _OK || response.Value != "1" {
+		t.Errorf("Got wrong response on cincr: %s, %s", response.StatusMessage, response.Value)
+	}
+	response = s.functions["CDECR"]("user", CommandMessage{Name: "CDECR", Arguments: []string{"c", "5"}})
+	if response.Value != "-4" {
+		t.Errorf("Got wrong value after cdecr: %s", response.Value)
+	}
+	response = s.cget("user", CommandMessage{Name: "CGET", Arguments: []string{"c"}})
+	if response.Value != "-4" {
+		t.Errorf("Got wrong value from cget: %s", response.Value)
+	}
+
+	// Overflow
+	s.functions["CINCR"]("user", CommandMessage{Name: "CINCR", Arguments: []string{"big", "9223372036854775807"}})
+	response = s.functions["CINCR"]("user", CommandMessage{Name: "CINCR", Arguments: []string{"big"}})
+	if response.Code != _OF {
+		t.Errorf("Expected _OF on overflow, got %s", response.StatusMessage)
+	}
+
+	s.COUNTERWRAP = true
+	response = s.functions["CINCR"]("user", CommandMessage{Name: "CINCR", Arguments: []string{"big"}})
+	if response.Code != _OK || response.Value != "-9223372036854775808" {
+		t.Errorf("Counter didn't wrap around: %s, %s", response.StatusMessage, response.Value)
+	}
+}
+
+func TestQuery(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	people := [][]string{{"anna", "30", "msk"}, {"boris", "25", "spb"}, {"vera", "35", "msk"}}
+	for _, p := range people {
+		s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"person:" + p[0], "age", p[1]}})
+		s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"person:" + p[0], "city", p[2]}})
+	}
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"other", "city", "msk"}})
+
+	response := s.querycommand("user", CommandMessage{Name: "QUERY", Arguments: []string{
+		"SELECT age FROM person: WHERE city = 'msk' AND age >= 30 ORDER BY age DESC LIMIT 5",
+	}})
+	if response.Code != _OK {
+		t.Fatalf("Got %s on query: %s", response.StatusMessage, response.Value)
+	}
+
+	var rows []map[string]string
+	json.Unmarshal([]byte(response.Value), &rows)
+	if len(rows) != 2 || rows[0]["key"] != "person:vera" || rows[1]["age"] != "30" {
+		t.Errorf("Got wrong rows: %s", response.Value)
+	}
+	if _, ok := rows[0]["city"]; ok {
+		t.Errorf("Field that wasn't selected was returned")
+	}
+
+	response = s.querycommand("user", CommandMessage{Name: "QUERY", Arguments: []string{"SELECT * WHERE age ~ 1"}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for a bad query, got %s", response.StatusMessage)
+	}
+}
+
+func TestPbitmap(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for _, offset := range []string{"0", "7", "100000"} {
+		response := s.setbit("user", CommandMessage{Name: "SETBIT", Arguments: []string{"dau", offset, "1"}})
+		if response.Code != _OK || response.Value != "0" {
+			t.Errorf("Got wrong response on setbit: %s, %s", response.StatusMessage, response.Value)
+		}
+	}
+
+	response := s.setbit("user", CommandMessage{Name: "SETBIT", Arguments: []string{"dau", "7", "0"}})
+	if response.Value != "1" {
+		t.Errorf("Setbit returned wrong old value: %s", response.Value)
+	}
+
+	response = s.getbit("user", CommandMessage{Name: "GETBIT", Arguments: []string{"dau", "100000"}})
+	if response.Value != "1" {
+		t.Errorf("Got wrong bit: %s", response.Value)
+	}
+	response = s.getbit("user", CommandMessage{Name: "GETBIT", Arguments: []string{"dau", "5000000"}})
+	if response.Code != _OK || response.Value != "0" {
+		t.Errorf("Bit out of the bitmap isn't zero")
+	}
+
+	response = s.bitcount("user", CommandMessage{Name: "BITCOUNT", Arguments: []string{"dau"}})
+	if response.Value != "2" {
+		t.Errorf("Got wrong bit count: %s", response.Value)
+	}
+
+	response = s.setbit("user", CommandMessage{Name: "SETBIT", Arguments: []string{"dau", "1", "2"}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for a bad bit, got %s", response.StatusMessage)
+	}
+}
+
+func TestAggregations(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"order:1", "price", "10"}})
+
+	s.invoke("user", CommandMessage{Name: "AGGCREATE", Arguments: []string{"orders", "COUNT", "order:"}})
+	s.invoke("user", CommandMessage{Name: "AGGCREATE", Arguments: []string{"revenue", "SUM", "order:", "price"}})
+
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"order:2", "price", "5.5"}})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"order:1", "price", "20"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"order:3", "broken"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"other", "value"}})
+
+	response := s.invoke("user", CommandMessage{Name: "AGGGET", Arguments: []string{"orders"}})
+	if response.Value != "3" {
+		t.Errorf("Got wrong count: %s", response.Value)
+	}
+	response = s.invoke("user", CommandMessage{Name: "AGGGET", Arguments: []string{"revenue"}})
+	if response.Value != "25.5" {
+		t.Errorf("Got wrong sum: %s", response.Value)
+	}
+
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"order:1"}})
+
+	// Expiration is accounted too
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"order:4", "value"}, TTL: time.Millisecond})
+	time.Sleep(time.Millisecond * 10)
+	shutdownChan := make(chan bool)
+	s.CLEANUPTIME = time.Millisecond
+	go s.ttlCheckRoutine(shutdownChan)
+	shutdownChan <- true
+
+	response = s.invoke("user", CommandMessage{Name: "AGGGET", Arguments: []string{"orders"}})
+	if response.Value != "2" {
+		t.Errorf("Got wrong count after deletion: %s", response.Value)
+	}
+	response = s.invoke("user", CommandMessage{Name: "AGGGET", Arguments: []string{"revenue"}})
+	if response.Value != "5.5" {
+		t.Errorf("Got wrong sum after deletion: %s", response.Value)
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "NOSUCHCOMMAND"})
+	if response.Code != _UC {
+		t.Errorf("Expected _UC for an unknown command, got %s", response.StatusMessage)
+	}
+}
+
+func TestPapprox(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for i := 0; i < 10000; i++ {
+		s.pfadd("user", CommandMessage{Name: "PFADD", Arguments: []string{"a", strconv.Itoa(i), strconv.Itoa(i)}})
+	}
+	for i := 5000; i < 20000; i++ {
+		s.pfadd("user", CommandMessage{Name: "PFADD", Arguments: []string{"b", strconv.Itoa(i)}})
+	}
+
+	check := func(response ResponseMessage, expected int) {
+		n, _ := strconv.Atoi(response.Value)
+		if response.Code != _OK || math.Abs(float64(n-expected)) > float64(expected)*0.03 {
+			t.Errorf("Estimate %s is too far from %d", response.Value, expected)
+		}
+	}
+
+	check(s.pfcount("user", CommandMessage{Name: "PFCOUNT", Arguments: []string{"a"}}), 10000)
+	check(s.pfcount("user", CommandMessage{Name: "PFCOUNT", Arguments: []string{"a", "b"}}), 20000)
+
+	s.pfmerge("user", CommandMessage{Name: "PFMERGE", Arguments: []string{"c", "a", "b"}})
+	check(s.pfcount("user", CommandMessage{Name: "PFCOUNT", Arguments: []string{"c"}}), 20000)
+
+	response := s.pfadd("user", CommandMessage{Name: "PFADD", Arguments: []string{"a", "1"}})
+	if response.Value != "0" {
+		t.Errorf("Adding an existing element changed the counter")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.WATCHDOGINTERVAL = time.Millisecond
+	s.WATCHDOGTHRESHOLD = time.Millisecond * 10
+	s.authConnection(nil)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	shutdownChan := make(chan bool)
+	go s.watchdogRoutine(shutdownChan)
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"slowkey", "value"}})
+	s.storageMutex.Lock()
+	time.Sleep(time.Millisecond * 50)
+	s.storageMutex.Unlock()
+
+	shutdownChan <- true
+
+	if !strings.Contains(buf.String(), "storage lock is held") || !strings.Contains(buf.String(), "user SET slowkey") {
+		t.Errorf("Stall wasn't reported properly: %s", buf.String())
+	}
+	if strings.Count(buf.String(), "storage lock is held") != 1 {
+		t.Errorf("Stall was reported more than once")
+	}
+
+	// Locks of users are watched too, a reader that holds one on shows as a
+	// writer that waits
+	shard := "lock of shard " + strconv.Itoa(shardOf("user"))
+	buf.Reset()
+	go s.watchdogRoutine(shutdownChan)
+	unlock := s.lockUser("user")
+	time.Sleep(time.Millisecond * 50)
+	unlock()
+	unlock = s.rlockUser("user")
+	written := make(chan bool)
+	go func() {
+		s.lockUser("user")()
+		written <- true
+	}()
+	time.Sleep(time.Millisecond * 50)
+	unlock()
+	<-written
+	shutdownChan <- true
+
+	if !strings.Contains(buf.String(), shard+" is held by goroutine") {
+		t.Errorf("A held lock of a user wasn't reported: %s", buf.String())
+	}
+	if strings.Count(buf.String(), shard+" is waited for") != 1 {
+		t.Errorf("A waiting lock of a user wasn't reported once: %s", buf.String())
+	}
+}
+
+// flakyListener fails the first accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptTemporaryErrors(t *testing.T) {
+
+	testPort := "62553"
+	s := NewSlave("localhost", testPort, time.Second, time.Minute, time.Millisecond*100, 1)
+
+	listener, err := net.Listen("tcp4", ":"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	go func(testPort string, s *PotatoSlave, t *testing.T) {
+
+		encoder, decoder, response := newClient(testPort)
+
+		encoder.Encode(CommandMessage{Name: "PING"})
+		decoder.Decode(&response)
+
+		if response.Value != "PONG" {
+			t.Errorf("Server didn't survive temporary accept errors")
+		}
+	}(testPort, s, t)
+
+	s.Serve(&flakyListener{Listener: listener, failures: 3})
+
+	if s.stats.get("accept_errors_temporary") != 3 || s.stats.get("connections_accepted") != 1 {
+		t.Errorf("Got wrong accept counters: %v", s.stats.snapshot())
+	}
+}
+
+func TestPstream(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for i := 1; i <= 5; i++ {
+		response := s.xadd("user", CommandMessage{Name: "XADD", Arguments: []string{"events", "e" + strconv.Itoa(i)}})
+		if response.Code != _OK || response.Value != strconv.Itoa(i) {
+			t.Errorf("Got wrong id from xadd: %s, %s", response.StatusMessage, response.Value)
+		}
+	}
+
+	response := s.xrange("user", CommandMessage{Name: "XRANGE", Arguments: []string{"events", "2", "3"}})
+	if response.Value != "'2':'e2','3':'e3'," {
+		t.Errorf("Got wrong range: %s", response.Value)
+	}
+	response = s.xrange("user", CommandMessage{Name: "XRANGE", Arguments: []string{"events", "4", "+"}})
+	if response.Value != "'4':'e4','5':'e5'," {
+		t.Errorf("Got wrong open range: %s", response.Value)
+	}
+
+	// Consumers have their own offsets
+	response = s.xread("user", CommandMessage{Name: "XREAD", Arguments: []string{"events", "a", "2"}})
+	if response.Value != "'1':'e1','2':'e2'," {
+		t.Errorf("Got wrong first read: %s", response.Value)
+	}
+	response = s.xread("user", CommandMessage{Name: "XREAD", Arguments: []string{"events", "a"}})
+	if response.Value != "'3':'e3','4':'e4','5':'e5'," {
+		t.Errorf("Got wrong second read: %s", response.Value)
+	}
+	response = s.xread("user", CommandMessage{Name: "XREAD", Arguments: []string{"events", "a"}})
+	if response.Code != _OK || response.Value != "" {
+		t.Errorf("Read past the end returned something: %s", response.Value)
+	}
+	response = s.xread("user", CommandMessage{Name: "XREAD", Arguments: []string{"events", "b", "1"}})
+	if response.Value != "'1':'e1'," {
+		t.Errorf("Another consumer got wrong entries: %s", response.Value)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s.functions["BOOM"] = func(userID string, mes CommandMessage) ResponseMessage {
+		s.storageMutex.Lock()
+		panic("boom")
+	}
+
+	response := s.invoke("user", CommandMessage{Name: "BOOM"})
+	if response.Code != _IE {
+		t.Errorf("Expected _IE after a panic, got %s", response.StatusMessage)
+	}
+	if s.stats.get("handler_panics") != 1 {
+		t.Errorf("Panic wasn't counted")
+	}
+
+	// The lock was released, so other commands still work
+	done := make(chan bool)
+	go func() {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"key", "value"}})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Storage lock is still held after a panic")
+	}
+
+	// Locks of users are released too
+	s.functions["BOOM"] = func(userID string, mes CommandMessage) ResponseMessage {
+		defer s.lockUser(userID)()
+		panic("boom")
+	}
+	s.functions["RBOOM"] = func(userID string, mes CommandMessage) ResponseMessage {
+		defer s.rlockUser(userID)()
+		panic("boom")
+	}
+	s.invoke("user", CommandMessage{Name: "BOOM"})
+	s.invoke("user", CommandMessage{Name: "RBOOM"})
+	go func() {
+		s.storageMutex.Lock()
+		s.storageMutex.Unlock()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Locks of users are still held after a panic")
+	}
+}
+
+func TestPjson(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	response := s.jset("user", CommandMessage{Name: "JSET", Arguments: []string{"doc", "$", `{"name":"potato","tags":["a"]}`}})
+	if response.Code != _OK {
+		t.Fatalf("Got %s on jset", response.StatusMessage)
+	}
+
+	s.jset("user", CommandMessage{Name: "JSET", Arguments: []string{"doc", "$.tags[1]", `"b"`}})
+	s.jset("user", CommandMessage{Name: "JSET", Arguments: []string{"doc", "owner.address.city", `"msk"`}})
+
+	response = s.jget("user", CommandMessage{Name: "JGET", Arguments: []string{"doc", "$.tags"}})
+	if response.Value != `["a","b"]` {
+		t.Errorf("Got wrong array: %s", response.Value)
+	}
+	response = s.jget("user", CommandMessage{Name: "JGET", Arguments: []string{"doc", "$.owner.address.city"}})
+	if response.Value != `"msk"` {
+		t.Errorf("Got wrong nested value: %s", response.Value)
+	}
+	response = s.jget("user", CommandMessage{Name: "JGET", Arguments: []string{"doc", "$.nosuchfield"}})
+	if response.Code != _NK {
+		t.Errorf("Expected _NK for a missing path, got %s", response.StatusMessage)
+	}
+
+	response = s.jset("user", CommandMessage{Name: "JSET", Arguments: []string{"doc", "$.name.first", `"x"`}})
+	if response.Code != _WT {
+		t.Errorf("Expected _WT when going through a string, got %s", response.StatusMessage)
+	}
+	response = s.jset("user", CommandMessage{Name: "JSET", Arguments: []string{"doc", "$.name", `{broken`}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for broken JSON, got %s", response.StatusMessage)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	blob := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}
+	key := base64.StdEncoding.EncodeToString([]byte("image"))
+
+	response := s.invoke("user", CommandMessage{Name: "SET", Binary: true,
+		Arguments: []string{key, base64.StdEncoding.EncodeToString(blob)}})
+	if response.Code != _OK {
+		t.Fatalf("Got %s on binary set", response.StatusMessage)
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "GET", Binary: true, Arguments: []string{key}})
+	value, err := base64.StdEncoding.DecodeString(response.Value)
+	if err != nil || !response.Binary || string(value) != string(blob) {
+		t.Errorf("Blob didn't survive: %q", response.Value)
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "GET", Binary: true, Arguments: []string{"not base64!"}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for broken base64, got %s", response.StatusMessage)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files of the conformance suite")
+
+// conformanceCase is a request and every frame the server answers it with.
+type conformanceCase struct {
+	Request   CommandMessage    `json:"request"`
+	Responses []ResponseMessage `json:"responses"`
+}
+
+// runConformance plays cases over conn and returns them with the responses
+// that were actually received. It only knows the wire format, so any
+// listener speaking it can be checked.
+func runConformance(conn io.ReadWriter, cases []conformanceCase) ([]conformanceCase, error) {
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	got := make([]conformanceCase, len(cases))
+	for i, c := range cases {
+		got[i].Request = c.Request
+		if err := encoder.Encode(c.Request); err != nil {
+			return nil, err
+		}
+		for {
+			var response ResponseMessage
+			if err := decoder.Decode(&response); err != nil {
+				return nil, err
+			}
+			got[i].Responses = append(got[i].Responses, response)
+			if !response.More {
+				break
+			}
+		}
+	}
+
+	return got, nil
+}
+
+// TestConformance runs every fixture from testdata/conformance against a
+// fresh slave. Run with -update after an intended protocol change.
+func TestConformance(t *testing.T) {
+
+	files, _ := filepath.Glob(filepath.Join("testdata", "conformance", "*.golden"))
+	if len(files) == 0 {
+		t.Fatalf("No conformance fixtures found")
+	}
+
+	for _, file := range files {
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cases []conformanceCase
+		if err := json.Unmarshal(data, &cases); err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+
+		s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(listener)
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runConformance(conn, cases)
+		conn.Close()
+		listener.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+
+		if *updateGolden {
+			data, _ = json.MarshalIndent(got, "", "  ")
+			ioutil.WriteFile(file, append(data, '\n'), 0644)
+			continue
+		}
+
+		for i := range cases {
+			want, _ := json.Marshal(cases[i].Responses)
+			have, _ := json.Marshal(got[i].Responses)
+			if !bytes.Equal(want, have) {
+				t.Errorf("%s: %s %v\nwant %s\ngot  %s", file, cases[i].Request.Name,
+					cases[i].Request.Arguments, want, have)
+			}
+		}
+	}
+}
+
+func TestExpireAndPersist(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"key", "value"}})
+
+	response := s.invoke("user", CommandMessage{Name: "PEXPIRE", Arguments: []string{"key", "1500"}})
+	if response.Code != _OK {
+		t.Fatalf("Got %s on pexpire", response.StatusMessage)
+	}
+	left := s.storage.Get("user", "key").getTimeOfDeath().Sub(time.Now())
+	if left > time.Millisecond*1500 || left < time.Second {
+		t.Errorf("Wrong ttl after pexpire: %s", left)
+	}
+
+	s.invoke("user", CommandMessage{Name: "PERSIST", Arguments: []string{"key"}})
+	if !s.storage.Get("user", "key").getTimeOfDeath().Equal(neverDies) {
+		t.Errorf("Key still expires after persist")
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "EXPIRE", Arguments: []string{"nokey", "10"}})
+	if response.Code != _NK {
+		t.Errorf("Expected _NK for a missing key, got %s", response.StatusMessage)
+	}
+	response = s.invoke("user", CommandMessage{Name: "EXPIRE", Arguments: []string{"key", "-1"}})
+	if response.Code != _WA {
+		t.Errorf("Expected _WA for a negative ttl, got %s", response.StatusMessage)
+	}
+}
+
+func TestVersion(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+
+	response := s.invoke("user", CommandMessage{Name: "VERSION"})
+
+	var info versionInfo
+	if err := json.Unmarshal([]byte(response.Value), &info); err != nil {
+		t.Fatalf("VERSION isn't JSON: %s", response.Value)
+	}
+	if info.Version != Version || len(info.Protocols) == 0 {
+		t.Errorf("Wrong version info: %s", response.Value)
+	}
+	if info.Features["encryption"] {
+		t.Errorf("Encryption is reported without a key")
+	}
+}
+
+func TestHello(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+
+	var info helloInfo
+	response := s.invoke("user", CommandMessage{Name: "HELLO", Arguments: []string{"7"}})
+	if err := json.Unmarshal([]byte(response.Value), &info); err != nil || response.Code != _OK {
+		t.Fatalf("HELLO failed: %s %s", response.StatusMessage, response.Value)
+	}
+	if info.Protocol != maxProtocol || info.Format != "json" || !info.Features["hello"] {
+		t.Errorf("A newer client didn't get the newest protocol: %s", response.Value)
+	}
+
+	info = helloInfo{}
+	response = s.invoke("user", CommandMessage{Name: "HELLO", Arguments: []string{"1", "frames", "teleport"}, framed: true})
+	json.Unmarshal([]byte(response.Value), &info)
+	if info.Protocol != 1 || info.Format != "frames" {
+		t.Errorf("Wrong agreement for an old framed client: %s", response.Value)
+	}
+	if len(info.Features) != 2 || !info.Features["frames"] || info.Features["teleport"] {
+		t.Errorf("Wrong features for the ones asked: %s", response.Value)
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "HELLO", Arguments: []string{"0"}})
+	if response.Code != _PV || !strings.Contains(response.Value, "json/1") {
+		t.Errorf("Expected _PV with the versions for protocol 0, got %s %s", response.StatusMessage, response.Value)
+	}
+	for _, args := range [][]string{nil, {"two"}} {
+		if response := s.invoke("user", CommandMessage{Name: "HELLO", Arguments: args}); response.Code != _WA {
+			t.Errorf("Expected _WA for %v, got %s", args, response.StatusMessage)
+		}
+	}
+}
+
+// waitJob polls JOB STATUS until the job isn't running.
+func waitJob(t *testing.T, s *PotatoSlave, id string) jobStatus {
+
+	var status jobStatus
+	for i := 0; i < 100; i++ {
+		response := s.invoke("user", CommandMessage{Name: "JOB", Arguments: []string{"STATUS", id}})
+		json.Unmarshal([]byte(response.Value), &status)
+		if status.State != "running" && status.State != "cancelling" {
+			return status
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("Job %s didn't finish", id)
+	return status
+}
+
+func TestAsyncJobs(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.STREAMBATCH = 10
+
+	for i := 0; i < 95; i++ {
+		s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"key" + strconv.Itoa(i), "value"}})
+	}
+
+	// A plain command as a job
+	response := s.invoke("user", CommandMessage{Name: "PING", Async: true})
+	status := waitJob(t, s, response.Value)
+	if status.State != "done" || status.Progress != 100 || status.Result.Value != "PONG" {
+		t.Errorf("Wrong status of a PING job: %+v", status)
+	}
+	if s.invoke("user", CommandMessage{Name: "JOB", Arguments: []string{"CANCEL", response.Value}}).Code != _WA {
+		t.Errorf("PING job can't be cancelled")
+	}
+
+	// Erasure reports progress and erases everything
+	response = s.invoke("user", CommandMessage{Name: "ERASEUSER", Arguments: []string{"user"}, Async: true})
+	if response.Code != _OK {
+		t.Fatalf("Got %s on async eraseuser", response.StatusMessage)
+	}
+	status = waitJob(t, s, response.Value)
+
+	var report ErasureReport
+	json.Unmarshal([]byte(status.Result.Value), &report)
+	if status.State != "done" || len(report.Keys) != 95 || s.storage.Len("user") != 0 {
+		t.Errorf("Erasure job didn't erase everything: %+v", status)
+	}
+
+	// Cancelled erasure stops between batches
+	for i := 0; i < 95; i++ {
+		s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"key" + strconv.Itoa(i), "value"}})
+	}
+	j := &job{cancel: make(chan struct{})}
+	close(j.cancel)
+	response = s.eraseUserJob(j, "user", CommandMessage{Arguments: []string{"user"}})
+	json.Unmarshal([]byte(response.Value), &report)
+	if !report.Cancelled || len(report.Keys) != 0 || s.storage.Len("user") != 95 {
+		t.Errorf("Cancelled erasure went on: %s", response.Value)
+	}
+
+	if s.invoke("other", CommandMessage{Name: "JOB", Arguments: []string{"STATUS", "1"}}).Code != _NK {
+		t.Errorf("Jobs of other users are visible")
+	}
+}
+
+func TestTTL(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"key", "value"}, TTL: time.Second * 30})
+
+	if v := s.invoke("user", CommandMessage{Name: "TTL", Arguments: []string{"key"}}).Value; v != "30" {
+		t.Errorf("Wrong ttl: %s", v)
+	}
+	pttl, _ := strconv.Atoi(s.invoke("user", CommandMessage{Name: "PTTL", Arguments: []string{"key"}}).Value)
+	if pttl > 30000 || pttl < 29000 {
+		t.Errorf("Wrong pttl: %d", pttl)
+	}
+
+	s.invoke("user", CommandMessage{Name: "PERSIST", Arguments: []string{"key"}})
+	if v := s.invoke("user", CommandMessage{Name: "TTL", Arguments: []string{"key"}}).Value; v != "-1" {
+		t.Errorf("Expected -1 for a persistent key, got %s", v)
+	}
+
+	s.storage.Get("user", "key").setTimeOfDeath(time.Now().Add(-time.Second))
+	if s.invoke("user", CommandMessage{Name: "TTL", Arguments: []string{"key"}}).Code != _NK {
+		t.Errorf("Expired key still has a ttl")
+	}
+}
+
+// pipeSlave serves s on an in-memory listener and returns a connection to it.
+func pipeSlave(t *testing.T, s *PotatoSlave) net.Conn {
+
+	listener := newPipeListener()
+	go s.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestPipelining(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+
+	// Several commands in one write, the last one split in two
+	requests := `{"Name":"SET","Arguments":["a","1"]}{"Name":"SET","Arguments":["b","2"]}` +
+		"\n" + `{"Name":"GET","Arguments":["a"]}{"Name":"GE`
+	go func() {
+		conn.Write([]byte(requests))
+		time.Sleep(time.Millisecond * 20)
+		conn.Write([]byte(`T","Arguments":["b"]}`))
+	}()
+
+	decoder := json.NewDecoder(conn)
+	var values []string
+	for i := 0; i < 4; i++ {
+		var response ResponseMessage
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, response.Value)
+	}
+	if strings.Join(values, ",") != ",,1,2" {
+		t.Errorf("Wrong responses to pipelined commands: %v", values)
+	}
+}
+
+func TestStaleConnection(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	// Every deadline is already in the past
+	s.clock = func() time.Time { return time.Now().Add(-time.Hour) }
+
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Stale connection wasn't closed: %v", err)
+	}
+}
+
+func TestLazyExpiration(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"string", "value"}})
+	s.functions["LPUSH"]("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", "value"}})
+	s.functions["HSET"]("user", CommandMessage{Name: "HSET", Arguments: []string{"hash", "field", "value"}})
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"alive", "value"}})
+
+	// Die without waiting for the cleanup
+	for _, key := range []string{"string", "list", "hash"} {
+		s.storage.Get("user", key).setTimeOfDeath(time.Now().Add(-time.Millisecond))
+	}
+
+	if s.functions["GET"]("user", CommandMessage{Name: "GET", Arguments: []string{"string"}}).Code != _NK {
+		t.Errorf("Dead string was read")
+	}
+	if s.functions["LGET"]("user", CommandMessage{Name: "LGET", Arguments: []string{"list", "0"}}).Code != _NK {
+		t.Errorf("Dead list was read")
+	}
+	if s.functions["HGET"]("user", CommandMessage{Name: "HGET", Arguments: []string{"hash", "field"}}).Code != _NK {
+		t.Errorf("Dead hash was read")
+	}
+	if v := s.keys("user", CommandMessage{Name: "KEYS"}).Value; v != "'alive'," {
+		t.Errorf("Dead keys are listed: %s", v)
+	}
+	if s.storage.Len("user") != 1 || s.stats.get("expired_on_read") != 3 {
+		t.Errorf("Dead keys weren't deleted on read")
+	}
+
+	// A dead list isn't resurrected by a push
+	s.functions["LPUSH"]("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", "a"}})
+	s.storage.Get("user", "list").setTimeOfDeath(time.Now().Add(-time.Millisecond))
+	s.functions["LPUSH"]("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", "b"}})
+	if v := s.functions["LGET"]("user", CommandMessage{Name: "LGET", Arguments: []string{"list", "0"}}).Value; v != "b" {
+		t.Errorf("Push went into a dead list, got %s", v)
+	}
+}
+
+func TestExpirePrefix(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.AddRetentionRule("session:short:", time.Second*10)
+
+	for _, key := range []string{"session:1", "session:2", "session:short:3", "other"} {
+		s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{key, "value"}})
+	}
+
+	response := s.invoke("user", CommandMessage{Name: "EXPIREPREFIX", Arguments: []string{"session:", "3600"}})
+	if response.Value != "3" {
+		t.Errorf("Expected 3 changed keys, got %s", response.Value)
+	}
+	if s.storage.Get("user", "session:1").getTimeOfDeath().Before(time.Now().Add(time.Minute * 59)) {
+		t.Errorf("TTL wasn't extended")
+	}
+	if s.storage.Get("user", "session:short:3").getTimeOfDeath().After(time.Now().Add(time.Second * 10)) {
+		t.Errorf("Retention rule wasn't applied")
+	}
+	if s.storage.Get("user", "other").getTimeOfDeath().After(time.Now().Add(time.Minute)) {
+		t.Errorf("Key outside of the prefix was changed")
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "PERSISTPREFIX", Arguments: []string{"session:"}})
+	if response.Value != "3" || !s.storage.Get("user", "session:2").getTimeOfDeath().Equal(neverDies) {
+		t.Errorf("Keys weren't persisted: %s", response.Value)
+	}
+}
+
+func TestExpiryQueue(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"short", "value"}, TTL: time.Second})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"long", "value"}, TTL: time.Hour})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"extended", "value"}, TTL: time.Second})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"extended", "value"}, TTL: time.Hour})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"shortened", "value"}, TTL: time.Hour})
+	s.invoke("user", CommandMessage{Name: "EXPIRE", Arguments: []string{"shortened", "1"}})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"hash", "a", "1"}, TTL: time.Hour})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"hash", "b", "2"}})
+	s.invoke("user", CommandMessage{Name: "HEXPIRE", Arguments: []string{"hash", "a", "1"}})
+
+	s.storageMutex.Lock()
+	s.expireDue(time.Now().Add(time.Second*2), 0, 0)
+	s.storageMutex.Unlock()
+
+	for _, key := range []string{"short", "shortened"} {
+		if s.storage.Get("user", key) != nil {
+			t.Errorf("Due key %s wasn't deleted", key)
+		}
+	}
+	for _, key := range []string{"long", "extended", "hash"} {
+		if s.storage.Get("user", key) == nil {
+			t.Errorf("Key %s was deleted too early", key)
+		}
+	}
+	if _, ok := s.storage.Get("user", "hash").(*pmap).ourmap["a"]; ok {
+		t.Errorf("Due field wasn't pruned")
+	}
+
+	// Keys that aren't due stay queued
+	s.storageMutex.Lock()
+	s.expireDue(time.Now().Add(time.Hour*2), 0, 0)
+	s.storageMutex.Unlock()
+	if s.storage.Len("user") != 0 || len(s.scheduled) != 0 {
+		t.Errorf("Keys left after all of them are due: %d", s.storage.Len("user"))
+	}
+}
+
+func TestSampledExpiration(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.EXPIRESAMPLE = 10
+
+	// Keys set bypassing invoke aren't in the expiry queue
+	for i := 0; i < 100; i++ {
+		s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"dead" + strconv.Itoa(i), "value"}, TTL: time.Millisecond})
+	}
+	for i := 0; i < 5; i++ {
+		s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"alive" + strconv.Itoa(i), "value"}})
+	}
+	time.Sleep(time.Millisecond * 5)
+
+	s.storageMutex.Lock()
+	checked, expired := s.sampleExpired(time.Now(), s.EXPIRESAMPLE)
+	s.storageMutex.Unlock()
+	if checked != 10 || expired > 10 {
+		t.Errorf("Wrong sample: %d checked, %d expired", checked, expired)
+	}
+
+	// Rounds go on while most of the sample is expired
+	s.EXPIRESAMPLETIME = time.Second
+	s.sampleRounds(&expiryCycle{})
+	if s.storage.Len("user") > 5+s.EXPIRESAMPLE*3/4 {
+		t.Errorf("Too many keys left after sampling: %d", s.storage.Len("user"))
+	}
+	for i := 0; i < 5; i++ {
+		if s.storage.Get("user", "alive"+strconv.Itoa(i)) == nil {
+			t.Errorf("Live key was deleted")
+		}
+	}
+}
+
+func TestReplicaOnly(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.REPLICAONLY["QUERY"] = true
+
+	query := CommandMessage{Name: "QUERY", Arguments: []string{"SELECT age FROM person:"}}
+	if response := s.invoke("user", query); response.Code != _PR {
+		t.Errorf("Expected _PR on a primary, got %s", response.StatusMessage)
+	}
+
+	s.ROLE = "replica"
+	if response := s.invoke("user", query); response.Code != _OK {
+		t.Errorf("Replica-only command failed on a replica: %s", response.StatusMessage)
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.AddRetentionRule("logs:", time.Hour)
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"config", "value"}, TTL: -1})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"settings", "a", "1"}, TTL: -1})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"logs:1", "value"}, TTL: -1})
+
+	for _, key := range []string{"config", "settings"} {
+		if v := s.invoke("user", CommandMessage{Name: "TTL", Arguments: []string{key}}).Value; v != "-1" {
+			t.Errorf("Key %s expires in %s", key, v)
+		}
+	}
+	if len(s.expiries) != 1 {
+		t.Errorf("Keys without expiration were queued")
+	}
+
+	// Retention still wins
+	if v := s.invoke("user", CommandMessage{Name: "TTL", Arguments: []string{"logs:1"}}).Value; v != "3600" {
+		t.Errorf("Retention wasn't applied to a persistent key: %s", v)
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"key", "value"}})
+	s.functions["SET"]("user", CommandMessage{Name: "SET", Arguments: []string{"old", "value"}})
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	response := s.invoke("user", CommandMessage{Name: "EXPIREAT", Arguments: []string{"key", strconv.FormatInt(at.Unix(), 10)}})
+	if response.Code != _OK || !s.storage.Get("user", "key").getTimeOfDeath().Equal(at) {
+		t.Errorf("Wrong time of death after expireat: %s", response.StatusMessage)
+	}
+
+	s.invoke("user", CommandMessage{Name: "PEXPIREAT", Arguments: []string{"old", "1000"}})
+	if s.storage.Get("user", "old") != nil {
+		t.Errorf("Key with a past timestamp wasn't deleted")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+
+	workload, err := ReadWorkload(strings.NewReader(`
+		{"Client":"a","Command":{"Name":"SET","Arguments":["k","v"]}}
+		{"Client":"b","Command":{"Name":"GET","Arguments":["k"]}}
+		{"Client":"a","Command":{"Name":"GET","Arguments":["k"]}}
+		{"Client":"b","Command":{"Name":"NOSUCHCOMMAND"}}`))
+	if err != nil || len(workload) != 4 {
+		t.Fatalf("Workload wasn't read: %v", err)
+	}
+
+	report := Simulate(workload, SimConfig{Workers: 2})
+	if report.Commands != 4 || report.Rejected["Unknown command"] != 1 || report.LatencyMax == 0 {
+		t.Errorf("Wrong report: %+v", report)
+	}
+}
+
+func TestStatusRegistry(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+
+	if RegisterStatus(_NK, "Mine") == nil {
+		t.Errorf("Core status code was taken by a plugin")
+	}
+	if err := RegisterStatus(FirstPluginStatus+7, "Plugin is sad"); err != nil {
+		t.Fatal(err)
+	}
+	if RegisterStatus(FirstPluginStatus+7, "Plugin is sad again") == nil {
+		t.Errorf("Status code was registered twice")
+	}
+	defer func() {
+		statusMessages.mu.Lock()
+		delete(statusMessages.messages, FirstPluginStatus+7)
+		statusMessages.mu.Unlock()
+	}()
+
+	err := s.RegisterCommand("SAD", func(userID string, mes CommandMessage) ResponseMessage {
+		var response ResponseMessage
+		SetStatus(&response, FirstPluginStatus+7)
+		return response
+	})
+	if err != nil || s.RegisterCommand("GET", nil) == nil {
+		t.Errorf("Commands weren't registered properly")
+	}
+	if response := s.invoke("user", CommandMessage{Name: "SAD"}); response.StatusMessage != "Plugin is sad" {
+		t.Errorf("Wrong plugin status: %+v", response)
+	}
+
+	var docs commandsDocs
+	response := s.invoke("user", CommandMessage{Name: "COMMANDS", Arguments: []string{"DOCS"}})
+	if err := json.Unmarshal([]byte(response.Value), &docs); err != nil {
+		t.Fatal(err)
+	}
+	if docs.Statuses[FirstPluginStatus+7] != "Plugin is sad" || docs.Statuses[_UC] != "Unknown command" {
+		t.Errorf("Wrong status catalog: %v", docs.Statuses)
+	}
+	if sort.SearchStrings(docs.Commands, "SAD") == len(docs.Commands) {
+		t.Errorf("Plugin command isn't listed")
+	}
+}
+
+func TestExpiryNotifications(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	var response ResponseMessage
+
+	encoder.Encode(CommandMessage{Name: "SUBSCRIBE", Arguments: []string{"EXPIRED", "cache:"}})
+	if decoder.Decode(&response); response.Code != _OK || !response.More {
+		t.Fatalf("Subscription failed: %+v", response)
+	}
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"cache:1", "value"}, TTL: time.Second})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"other", "value"}, TTL: time.Second})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"cache:2", "value"}, TTL: time.Minute})
+	s.storageMutex.Lock()
+	s.expireDue(time.Now().Add(time.Second*2), 0, 0)
+	s.storageMutex.Unlock()
+
+	// Lazy expiration is reported too
+	s.storageMutex.Lock()
+	s.storage.Get("user", "cache:2").setTimeOfDeath(time.Now().Add(-time.Millisecond))
+	s.storageMutex.Unlock()
+	s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"cache:2"}})
+
+	var keys []string
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, response.Value)
+	}
+	if strings.Join(keys, ",") != "cache:1,cache:2" {
+		t.Errorf("Wrong notifications: %v", keys)
+	}
+}
+
+func TestSweepLimits(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for i := 0; i < 50; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{strconv.Itoa(i), "value"}, TTL: time.Second})
+	}
+
+	s.SWEEPMAXKEYS = 20
+	s.SWEEPMAXHOLD = 0
+	later := time.Now().Add(time.Second * 2)
+
+	s.sweep(later, &expiryCycle{})
+	if s.storage.Len("user") != 30 || s.stats.get("sweeps_cut") != 1 {
+		t.Errorf("Sweep wasn't cut after SWEEPMAXKEYS: %d keys left", s.storage.Len("user"))
+	}
+
+	// Releasing the lock often still expires everything
+	s.SWEEPMAXKEYS = 0
+	s.SWEEPMAXHOLD = time.Nanosecond
+	s.sweep(later, &expiryCycle{})
+	if s.storage.Len("user") != 0 {
+		t.Errorf("%d keys left after sweep", s.storage.Len("user"))
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	incr := CommandMessage{Name: "CINCR", Arguments: []string{"counter"}, IdempotencyKey: "req-1"}
+	for i := 0; i < 3; i++ {
+		if v := s.invoke("user", incr).Value; v != "1" {
+			t.Errorf("Retry was applied again: %s", v)
+		}
+	}
+
+	incr.IdempotencyKey = "req-2"
+	if v := s.invoke("user", incr).Value; v != "2" {
+		t.Errorf("New key wasn't applied: %s", v)
+	}
+
+	// Other users have their own keys
+	s.invoke("other", CommandMessage{Name: "SET", Arguments: []string{"x", "y"}, IdempotencyKey: "req-1"})
+	if s.stats.get("idempotent_replays") != 2 {
+		t.Errorf("Wrong number of replays: %d", s.stats.get("idempotent_replays"))
+	}
+
+	// Results are forgotten after the window
+	s.IDEMPOTENCYWINDOW = time.Millisecond
+	time.Sleep(time.Millisecond * 5)
+	incr.IdempotencyKey = "req-1"
+	if v := s.invoke("user", incr).Value; v != "3" {
+		t.Errorf("Key wasn't forgotten after the window: %s", v)
+	}
+}
+
+func TestExpireStats(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for i := 0; i < 30; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{strconv.Itoa(i), "value"}, TTL: time.Millisecond})
+	}
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"alive", "value"}})
+	time.Sleep(time.Millisecond * 5)
+
+	s.SWEEPMAXKEYS = 10
+	shutdownChan := make(chan bool)
+	s.CLEANUPTIME = time.Millisecond
+	go s.ttlCheckRoutine(shutdownChan)
+	shutdownChan <- true
+
+	var stats expiryStats
+	response := s.invoke("user", CommandMessage{Name: "EXPIRESTATS"})
+	if err := json.Unmarshal([]byte(response.Value), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	first := stats.LastCycle
+	if stats.Cycles == 0 || first.Scanned != 10 || first.Expired != 10 || first.Backlog == 0 {
+		t.Errorf("Wrong cycle stats: %s", response.Value)
+	}
+	if first.LockHeld == 0 || first.MaxLockHeld > first.LockHeld || first.Duration < first.LockHeld {
+		t.Errorf("Wrong lock stats: %s", response.Value)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	deaths := make(map[int64]bool)
+	for i := 0; i < 50; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{strconv.Itoa(i), "value"}, TTL: time.Hour, TTLJitter: 10})
+		death := s.storage.Get("user", strconv.Itoa(i)).getTimeOfDeath()
+		if death.After(time.Now().Add(time.Hour)) || death.Before(time.Now().Add(time.Minute*53)) {
+			t.Errorf("TTL is out of the jitter range: %s", time.Until(death))
+		}
+		deaths[death.Unix()] = true
+	}
+	if len(deaths) < 10 {
+		t.Errorf("Keys still expire together")
+	}
+
+	if s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "v"}, TTLJitter: 101}).Code != _WA {
+		t.Errorf("Jitter over 100 percent was accepted")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "potato.snapshot")
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	for _, mes := range []CommandMessage{
+		{Name: "AGGCREATE", Arguments: []string{"agg", "COUNT", "c"}},
+		{Name: "SET", Arguments: []string{"s", "value"}, TTL: time.Hour},
+		{Name: "SET", Arguments: []string{"dead", "value"}, TTL: time.Millisecond},
+		{Name: "LPUSH", Arguments: []string{"l", "a"}},
+		{Name: "LPUSH", Arguments: []string{"l", "b"}},
+		{Name: "HSET", Arguments: []string{"h", "field", "value"}},
+		{Name: "SADD", Arguments: []string{"set", "a", "b"}},
+		{Name: "ZADD", Arguments: []string{"z", "1", "a", "2", "b"}},
+		{Name: "CINCR", Arguments: []string{"c"}},
+		{Name: "SETBIT", Arguments: []string{"b", "7", "1"}},
+		{Name: "PFADD", Arguments: []string{"p", "a", "b", "c"}},
+		{Name: "XADD", Arguments: []string{"x", "entry"}},
+		{Name: "JSET", Arguments: []string{"j", "$", `{"a":[1,"b"]}`}},
+	} {
+		if response := s.invoke("user", mes); response.Code != _OK {
+			t.Fatalf("%s failed: %s", mes.Name, response.StatusMessage)
+		}
+	}
+	time.Sleep(time.Millisecond * 5)
+
+	if err := s.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	if err := loaded.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mes := range []CommandMessage{
+		{Name: "GET", Arguments: []string{"s"}},
+		{Name: "TTL", Arguments: []string{"s"}},
+		{Name: "GET", Arguments: []string{"dead"}},
+		{Name: "LGET", Arguments: []string{"l", "1"}},
+		{Name: "HGET", Arguments: []string{"h", "field"}},
+		{Name: "SCARD", Arguments: []string{"set"}},
+		{Name: "ZRANGE", Arguments: []string{"z", "0", "-1", "WITHSCORES"}},
+		{Name: "CGET", Arguments: []string{"c"}},
+		{Name: "BITCOUNT", Arguments: []string{"b"}},
+		{Name: "PFCOUNT", Arguments: []string{"p"}},
+		{Name: "XRANGE", Arguments: []string{"x", "0", "10"}},
+		{Name: "JGET", Arguments: []string{"j", "$.a[1]"}},
+		{Name: "AGGGET", Arguments: []string{"agg"}},
+	} {
+		want, got := s.invoke("user", mes), loaded.invoke("user", mes)
+		if want.Code != got.Code || want.Value != got.Value {
+			t.Errorf("%s %v differs after loading: %+v, want %+v", mes.Name, mes.Arguments, got, want)
+		}
+	}
+
+	// Keys keep expiring after they are loaded
+	if _, ok := loaded.scheduled["user\x00s"]; !ok {
+		t.Errorf("Loaded keys weren't scheduled")
+	}
+	if loaded.storage.Get("user", "dead") != nil {
+		t.Errorf("Dead key was loaded")
+	}
+
+	// There is nothing to load on the first start
+	if err := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1).LoadSnapshot(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Missing snapshot is an error: %s", err)
+	}
+}
+
+func TestSnapshotFormat(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"s", "value"}})
+	snap, err := s.takeSnapshot(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file bytes.Buffer
+	if err := encodeSnapshot(&file, snap); err != nil {
+		t.Fatal(err)
+	}
+	good := file.Bytes()
+
+	if decoded, err := decodeSnapshot(bytes.NewReader(good)); err != nil || len(decoded.Objects) != 1 {
+		t.Errorf("Snapshot wasn't decoded: %v", err)
+	}
+
+	corrupted := append([]byte{}, good...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	newer := append([]byte{}, good...)
+	newer[len(snapshotMagic)+1] = snapshotVersion + 1
+	for name, data := range map[string][]byte{
+		"truncated": good[:len(good)-1],
+		"header":    good[:len(snapshotMagic)+3],
+		"corrupted": corrupted,
+		"newer":     newer,
+	} {
+		if _, err := decodeSnapshot(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s snapshot was loaded", name)
+		}
+	}
+
+	// Bare gob of version 0 is still loaded
+	var old bytes.Buffer
+	gob.NewEncoder(&old).Encode(snap)
+	if decoded, err := decodeSnapshot(&old); err != nil || len(decoded.Objects) != 1 {
+		t.Errorf("Snapshot of version 0 wasn't decoded: %v", err)
+	}
+}
+
+func TestAppendOnlyLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *PotatoSlave {
+		s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+		s.EnableEncryption([]byte("master key"), []string{"secret:"})
+		s.AOFPATH = filepath.Join(dir, "potato.aof")
+		s.AOFFSYNC = "always"
+		if err := s.LoadSnapshot(filepath.Join(dir, "potato.snapshot")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.openAppendLog(); err != nil {
+			t.Fatal(err)
+		}
+		s.authConnection(nil)
+		return s
+	}
+
+	s := open()
+	for _, mes := range []CommandMessage{
+		{Name: "SET", Arguments: []string{"s", "value"}},
+		{Name: "CINCR", Arguments: []string{"c"}},
+		{Name: "EXPIRE", Arguments: []string{"s", "100"}},
+		{Name: "SET", Arguments: []string{"secret:s", "plain"}},
+		{Name: "SET", Arguments: []string{base64.StdEncoding.EncodeToString([]byte("bin")), base64.StdEncoding.EncodeToString([]byte{0xff, 0})}, Binary: true},
+		{Name: "SET", Arguments: []string{"gone", "value"}},
+		{Name: "DEL", Arguments: []string{"gone"}},
+	} {
+		if response := s.invoke("user", mes); response.Code != _OK {
+			t.Fatalf("%s failed: %s", mes.Name, response.StatusMessage)
+		}
+	}
+
+	// The snapshot has the first increment, the log has both
+	if err := s.SaveSnapshot(filepath.Join(dir, "potato.snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	s.invoke("user", CommandMessage{Name: "CINCR", Arguments: []string{"c"}})
+	s.aof.close()
+
+	body, _ := ioutil.ReadFile(s.AOFPATH)
+	if bytes.Contains(body, []byte("plain")) {
+		t.Errorf("Encrypted value is in the log in plain text")
+	}
+
+	// A crash in the middle of a write leaves a cut line
+	f, _ := os.OpenFile(s.AOFPATH, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"Seq":100,"User":"us`)
+	f.Close()
+
+	loaded := open()
+	for _, mes := range []CommandMessage{
+		{Name: "GET", Arguments: []string{"s"}},
+		{Name: "GET", Arguments: []string{"secret:s"}},
+		{Name: "GET", Arguments: []string{"bin"}},
+		{Name: "GET", Arguments: []string{"gone"}},
+		{Name: "CGET", Arguments: []string{"c"}},
+	} {
+		want, got := s.invoke("user", mes), loaded.invoke("user", mes)
+		if want.Code != got.Code || want.Value != got.Value {
+			t.Errorf("%s %v differs after replay: %+v, want %+v", mes.Name, mes.Arguments, got, want)
+		}
+	}
+	if ttl := time.Until(loaded.storage.Get("user", "s").getTimeOfDeath()); ttl > time.Second*100 || ttl < time.Second*99 {
+		t.Errorf("Wrong TTL after replay: %s", ttl)
+	}
+
+	// New entries go after the readable part and continue the sequence
+	loaded.invoke("user", CommandMessage{Name: "CINCR", Arguments: []string{"c"}})
+	loaded.aof.close()
+	if v := open().invoke("user", CommandMessage{Name: "CGET", Arguments: []string{"c"}}).Value; v != "3" {
+		t.Errorf("Wrong counter after the second replay: %s", v)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := LoadNodeID(filepath.Join(dir, "node-id"))
+	if err != nil || len(id) != 32 {
+		t.Fatalf("Wrong node id %q: %v", id, err)
+	}
+	if again, _ := LoadNodeID(filepath.Join(dir, "node-id")); again != id {
+		t.Errorf("Node id changed after a restart: %s, was %s", again, id)
+	}
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	probe := func(path string) int {
+		recorder := httptest.NewRecorder()
+		s.healthHandler().ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Code
+	}
+
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Ready before serving: %d", code)
+	}
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("Not ready while serving: %d", code)
+	}
+
+	if code := probe("/livez"); code != http.StatusOK {
+		t.Errorf("Not alive: %d", code)
+	}
+	s.LIVENESSTHRESHOLD = time.Millisecond
+	s.storageMutex.Lock()
+	time.Sleep(time.Millisecond * 5)
+	code := probe("/livez")
+	s.storageMutex.Unlock()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Alive with a stuck lock: %d", code)
+	}
+}
+
+func TestBackgroundSnapshot(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bgsave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.SNAPSHOTPATH = filepath.Join(dir, "potato.snapshot")
+	s.STREAMBATCH = 10
+
+	for i := 0; i < 100; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{strconv.Itoa(i), "old"}})
+	}
+
+	// Commands run between batches, changed keys keep their old values in
+	// the snapshot and new keys don't get there
+	if err := s.startSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.startSnapshot(); err == nil {
+		t.Errorf("Second snapshot was started at the same time")
+	}
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"0", "new"}})
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"1"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"added", "new"}})
+	if s.saving.left != 98 {
+		t.Errorf("Changed keys weren't copied first: %d left", s.saving.left)
+	}
+
+	snap, err := s.finishSnapshot(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for _, o := range snap.Objects {
+		values[o.Key] = o.Strings[0]
+	}
+	if values["0"] != "old" || values["1"] != "old" || values["added"] != "" || len(values) != 100 {
+		t.Errorf("Snapshot isn't what was stored when it started: %d keys, %v", len(values), values["0"])
+	}
+
+	// BGSAVE runs as a job
+	response := s.invoke("user", CommandMessage{Name: "BGSAVE"})
+	if status := waitJob(t, s, response.Value); status.Result == nil || status.Result.Code != _OK {
+		t.Fatalf("BGSAVE failed: %+v", status)
+	}
+
+	loaded := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	if err := loaded.LoadSnapshot(s.SNAPSHOTPATH); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.storage.Len("user") != 100 || loaded.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"0"}}).Value != "new" {
+		t.Errorf("Wrong snapshot after BGSAVE: %d keys", loaded.storage.Len("user"))
+	}
+}
+
+func TestDeltaSnapshot(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "potato.snapshot")
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.storage.AddUser("other")
+	for _, key := range []string{"a", "b", "c"} {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{key, "old"}})
+	}
+	s.invoke("other", CommandMessage{Name: "SET", Arguments: []string{"o", "old"}})
+
+	// Without a full snapshot a full one is saved
+	if err := s.SaveDeltaSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(deltaPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("A delta was saved without a full snapshot: %v", err)
+	}
+	full, err := readSnapshotFile(path)
+	if err != nil || len(full.Objects) != 4 {
+		t.Fatalf("No full snapshot instead of a delta: %v", err)
+	}
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"a", "new"}})
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"b"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"d", "new"}})
+	s.invoke("other", CommandMessage{Name: "ERASEUSER", Arguments: []string{"other"}})
+
+	// Only the changed keys are in the delta
+	if err := s.SaveDeltaSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	delta, err := readSnapshotFile(deltaPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := make(map[string]string)
+	for _, o := range delta.Objects {
+		objects[o.User+"/"+o.Key] = o.Strings[0]
+	}
+	deleted := make(map[UserKey]bool)
+	for _, k := range delta.Deleted {
+		deleted[k] = true
+	}
+	if !delta.Base.Equal(full.Taken) || len(objects) != 2 || objects["user/a"] != "new" || objects["user/d"] != "new" ||
+		len(deleted) != 2 || !deleted[UserKey{"user", "b"}] || !deleted[UserKey{"other", "o"}] {
+		t.Fatalf("Wrong delta of %v: %v, deleted %v", delta.Base, objects, delta.Deleted)
+	}
+
+	// A delta has every change since the full snapshot, not since the last
+	// delta, and is loaded on top of the full one
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"c", "new"}})
+	if err := s.SaveDeltaSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if delta, err = readSnapshotFile(deltaPath(path)); err != nil || len(delta.Objects) != 3 || len(delta.Deleted) != 2 {
+		t.Fatalf("Changes before the last delta were lost: %+v, %v", delta, err)
+	}
+
+	check := func(what string, loaded *PotatoSlave, want map[string]string) {
+		for key, value := range want {
+			user := "user"
+			if key == "o" {
+				user = "other"
+			}
+			response := loaded.invoke(user, CommandMessage{Name: "GET", Arguments: []string{key}})
+			if value == "" && response.Code != _NK || value != "" && response.Value != value {
+				t.Errorf("%s: %s is %+v, want %q", what, key, response, value)
+			}
+		}
+	}
+	loaded := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	if err := loaded.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	check("base and delta", loaded, map[string]string{"a": "new", "b": "", "c": "new", "d": "new", "o": ""})
+
+	// The loaded slave keeps the changes of the delta it loaded
+	loaded.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"e", "new"}})
+	if err := loaded.SaveDeltaSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if delta, err = readSnapshotFile(deltaPath(path)); err != nil || len(delta.Objects) != 4 || len(delta.Deleted) != 2 {
+		t.Fatalf("Changes of the loaded delta were lost: %+v, %v", delta, err)
+	}
+
+	// A full snapshot makes the old delta useless, one left over is ignored
+	stale, err := ioutil.ReadFile(deltaPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"a", "newer"}})
+	if err := loaded.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(deltaPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("The old delta wasn't removed: %v", err)
+	}
+	if err := ioutil.WriteFile(deltaPath(path), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	if err := reloaded.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	check("stale delta", reloaded, map[string]string{"a": "newer", "b": "", "e": "new"})
+
+	// Like a full one, a delta is of the moment it was started
+	reloaded.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"x", "old"}})
+	if err := reloaded.startSnapshotOf(true, nil); err != nil {
+		t.Fatal(err)
+	}
+	reloaded.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"x"}})
+	reloaded.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"y", "new"}})
+	delta, err = reloaded.finishSnapshot(nil)
+	if err != nil || len(delta.Objects) != 1 || delta.Objects[0].Key != "x" || delta.Objects[0].Strings[0] != "old" ||
+		len(delta.Deleted) != 0 {
+		t.Errorf("Delta isn't what was stored when it started: %+v, %v", delta, err)
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 100; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{strconv.Itoa(i), value}})
+	}
+
+	s.MEMORYALERTBYTES = 1
+	s.memory.sample()
+	s.rollInterval(time.Now())
+
+	var report memoryReport
+	response := s.invoke("user", CommandMessage{Name: "MEMORYSTATS"})
+	if err := json.Unmarshal([]byte(response.Value), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Keys != 100 || report.LiveBytes < 100*1000 || report.LiveBytes > 100*1200 {
+		t.Errorf("Wrong estimate of stored data: %d bytes in %d keys", report.LiveBytes, report.Keys)
+	}
+	if report.HeapInuse == 0 || report.LastPeakHeapInuse == 0 || report.Fragmentation == 0 {
+		t.Errorf("Heap wasn't sampled: %s", response.Value)
+	}
+	if len(report.Alerts) != 1 || s.stats.get("memory_alerts") != 1 {
+		t.Errorf("Peak heap alert wasn't raised: %v", report.Alerts)
+	}
+}
+
+func TestAppendOnlyLogRewrite(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "aofrewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *PotatoSlave {
+		s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+		s.AOFPATH = filepath.Join(dir, "potato.aof")
+		if err := s.openAppendLog(); err != nil {
+			t.Fatal(err)
+		}
+		s.authConnection(nil)
+		return s
+	}
+
+	s := open()
+	for i := 0; i < 200; i++ {
+		s.invoke("user", CommandMessage{Name: "CINCR", Arguments: []string{"hot"}})
+	}
+	s.invoke("user", CommandMessage{Name: "PFADD", Arguments: []string{"p", "a", "b"}})
+	before, _ := os.Stat(s.AOFPATH)
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"late", "value"}})
+
+	response := s.invoke("user", CommandMessage{Name: "BGREWRITEAOF"})
+	if status := waitJob(t, s, response.Value); status.Result == nil || status.Result.Code != _OK {
+		t.Fatalf("BGREWRITEAOF failed: %+v", status)
+	}
+	after, _ := os.Stat(s.AOFPATH)
+	if after.Size() >= before.Size() {
+		t.Errorf("Log wasn't compacted: %d bytes, was %d", after.Size(), before.Size())
+	}
+
+	s.invoke("user", CommandMessage{Name: "CINCR", Arguments: []string{"hot"}})
+	s.aof.close()
+
+	loaded := open()
+	for _, mes := range []CommandMessage{
+		{Name: "CGET", Arguments: []string{"hot"}},
+		{Name: "PFCOUNT", Arguments: []string{"p"}},
+		{Name: "GET", Arguments: []string{"late"}},
+	} {
+		want, got := s.invoke("user", mes), loaded.invoke("user", mes)
+		if want.Code != got.Code || want.Value != got.Value {
+			t.Errorf("%s %v differs after rewrite: %+v, want %+v", mes.Name, mes.Arguments, got, want)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := DirArchive(filepath.Join(dir, "archive"))
+	if err := os.Mkdir(string(archive), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() *PotatoSlave {
+		s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+		s.AOFPATH = filepath.Join(dir, "potato.aof")
+		s.ARCHIVE = archive
+		if err := s.openAppendLog(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.startArchive(); err != nil {
+			t.Fatal(err)
+		}
+		s.authConnection(nil)
+		return s
+	}
+	write := func(s *PotatoSlave, mes ...CommandMessage) time.Time {
+		for _, m := range mes {
+			if response := s.invoke("user", m); response.Code != _OK {
+				t.Fatalf("%s failed: %s", m.Name, response.StatusMessage)
+			}
+		}
+		if err := s.archiveSegment(); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now()
+		time.Sleep(time.Millisecond * 2)
+		return at
+	}
+	restored := func(until time.Time, want map[string]string) {
+		r := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+		if err := r.RestoreArchive(archive, until); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range want {
+			response := r.invoke("user", CommandMessage{Name: "GET", Arguments: []string{key}})
+			if value == "" && response.Code != _NK || value != "" && response.Value != value {
+				t.Errorf("Restored to %s, %s is %+v, want %q", until.Format(time.StampMicro), key, response, value)
+			}
+		}
+	}
+
+	started := time.Now()
+	time.Sleep(time.Millisecond * 2)
+	s := open()
+	first := write(s,
+		CommandMessage{Name: "SET", Arguments: []string{"a", "1"}},
+		CommandMessage{Name: "SET", Arguments: []string{"b", "1"}},
+	)
+	write(s,
+		CommandMessage{Name: "SET", Arguments: []string{"a", "2"}},
+		CommandMessage{Name: "DEL", Arguments: []string{"b"}},
+	)
+	if err := s.archiveBase(); err != nil {
+		t.Fatal(err)
+	}
+	second := write(s, CommandMessage{Name: "SET", Arguments: []string{"c", "1"}})
+	write(s, CommandMessage{Name: "SET", Arguments: []string{"a", "3"}})
+
+	// The base before the time and the commands after it up to the time
+	restored(first, map[string]string{"a": "1", "b": "1", "c": ""})
+	restored(second, map[string]string{"a": "2", "b": "", "c": "1"})
+	restored(time.Now(), map[string]string{"a": "3", "c": "1"})
+	if err := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1).RestoreArchive(archive, started); err == nil {
+		t.Error("Restored to a time before any base snapshot")
+	}
+
+	// Lines that weren't shipped before a crash are shipped after it
+	if response := s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"d", "1"}}); response.Code != _OK {
+		t.Fatal(response.StatusMessage)
+	}
+	s.aof.close()
+	s = open()
+	last := write(s)
+	defer s.aof.close()
+	restored(last, map[string]string{"a": "3", "d": "1"})
+	if s.stats.get("archive_segments") != 1 || s.stats.get("archive_bases") != 1 {
+		t.Errorf("Wrong archive counters: %v", s.stats.snapshot())
+	}
+
+	// A missing segment isn't skipped
+	segments, err := archive.List(segmentPrefix)
+	if err != nil || len(segments) != 5 {
+		t.Fatalf("%d segments in the archive, %v", len(segments), err)
+	}
+	if err := os.Remove(filepath.Join(string(archive), segments[1])); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1).RestoreArchive(archive, first.Add(time.Millisecond)); err == nil {
+		t.Error("Restored over a missing segment")
+	}
+}
+
+func TestCausalityTokens(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.CAUSALITYTIMEOUT = time.Millisecond * 50
+
+	token := s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "v"}}).Token
+	if token != "localhost:62553:1" {
+		t.Fatalf("Wrong token: %q", token)
+	}
+	if s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}}).Token != "" {
+		t.Errorf("Read got a token")
+	}
+
+	if response := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}, After: token}); response.Value != "v" {
+		t.Errorf("Read after an applied token failed: %s", response.StatusMessage)
+	}
+	if code := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}, After: "other:100"}).Code; code != _OK {
+		t.Errorf("Token of another shard wasn't passed: %d", code)
+	}
+	if code := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}, After: "garbage"}).Code; code != _WA {
+		t.Errorf("Malformed token was accepted: %d", code)
+	}
+
+	// A read waits for a write that isn't applied yet
+	done := make(chan ResponseMessage)
+	go func() {
+		done <- s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}, After: "localhost:62553:2"})
+	}()
+	time.Sleep(time.Millisecond * 10)
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "new"}})
+	if response := <-done; response.Value != "new" {
+		t.Errorf("Read didn't wait for the write: %+v", response)
+	}
+
+	if code := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}, After: "localhost:62553:10"}).Code; code != _CT {
+		t.Errorf("Read of a write that never came didn't time out: %d", code)
+	}
+}
+
+func TestApprovalWorkflow(t *testing.T) {
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	s.APPROVALDELAY = time.Millisecond * 20
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "v"}})
+
+	response := s.invoke("user", CommandMessage{Name: "ERASEUSER", Arguments: []string{"user"}})
+	if response.Code != _AP || s.storage.Len("user") != 1 {
+		t.Fatalf("Erasure wasn't held for approval: %+v", response)
+	}
+	id := response.Value
+
+	var list []proposal
+	json.Unmarshal([]byte(s.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"LIST"}}).Value), &list)
+	if len(list) != 1 || list[0].ID != id || list[0].Command != "ERASEUSER" {
+		t.Errorf("Wrong list of proposals: %+v", list)
+	}
+
+	if code := s.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"CONFIRM", id}}).Code; code != _TE {
+		t.Errorf("Proposal was confirmed before the delay: %d", code)
+	}
+	if code := s.invoke("other", CommandMessage{Name: "PROPOSAL", Arguments: []string{"CONFIRM", id}}).Code; code != _NK {
+		t.Errorf("Proposal of another user was found: %d", code)
+	}
+
+	time.Sleep(time.Millisecond * 25)
+	if response := s.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"CONFIRM", id}}); response.Code != _OK || s.storage.Len("user") != 0 {
+		t.Errorf("Confirmed erasure didn't run: %+v", response)
+	}
+	if code := s.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"CONFIRM", id}}).Code; code != _NK {
+		t.Errorf("Proposal was confirmed twice: %d", code)
+	}
+
+	// A confirmed erasure stays done when the log is replayed
+	dir, err := ioutil.TempDir("", "approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func() *PotatoSlave {
+		s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+		s.APPROVALDELAY = time.Millisecond * 20
+		s.AOFPATH = filepath.Join(dir, "potato.aof")
+		if err := s.openAppendLog(); err != nil {
+			t.Fatal(err)
+		}
+		s.authConnection(nil)
+		return s
+	}
+	logged := open()
+	logged.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "v"}})
+	erase := logged.invoke("user", CommandMessage{Name: "ERASEUSER", Arguments: []string{"user"}}).Value
+	time.Sleep(time.Millisecond * 25)
+	logged.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"CONFIRM", erase}})
+	logged.aof.close()
+	logged = open()
+	defer logged.aof.close()
+	if code := logged.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}}).Code; code != _NK {
+		t.Errorf("Erased key came back after a restart: %d", code)
+	}
+	if len(logged.proposals.items) != 0 {
+		t.Errorf("Replayed erasure was held for approval again")
+	}
+
+	// Discarded proposals are gone, expired ones too
+	id = s.invoke("user", CommandMessage{Name: "ERASEUSER", Arguments: []string{"user"}}).Value
+	s.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"DISCARD", id}})
+	s.APPROVALWINDOW = time.Millisecond
+	expired := s.invoke("user", CommandMessage{Name: "ERASEUSER", Arguments: []string{"user"}}).Value
+	time.Sleep(time.Millisecond * 25)
+	for _, id := range []string{id, expired} {
+		if code := s.invoke("user", CommandMessage{Name: "PROPOSAL", Arguments: []string{"CONFIRM", id}}).Code; code != _NK {
+			t.Errorf("Proposal wasn't forgotten: %d", code)
+		}
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.authConnection(nil)
+	other := NewSlave("localhost", "62554", time.Second, time.Minute, time.Millisecond*100, 1)
+	other.authConnection(nil)
+
+	s.invoke("user", CommandMessage{Name: "ZADD", Arguments: []string{"z", "1", "a", "2", "b"}})
+	dump := s.invoke("user", CommandMessage{Name: "DUMP", Arguments: []string{"z"}})
+	if dump.Code != _OK {
+		t.Fatalf("DUMP failed: %s", dump.StatusMessage)
+	}
+
+	restore := CommandMessage{Name: "RESTORE", Arguments: []string{"moved", dump.Value}, TTL: time.Hour}
+	if code := other.invoke("user", restore).Code; code != _OK {
+		t.Fatalf("RESTORE failed: %d", code)
+	}
+	zrange := CommandMessage{Name: "ZRANGE", Arguments: []string{"moved", "0", "-1", "WITHSCORES"}}
+	if got, want := other.invoke("user", zrange).Value, s.invoke("user", CommandMessage{Name: "ZRANGE", Arguments: []string{"z", "0", "-1", "WITHSCORES"}}).Value; got != want {
+		t.Errorf("Restored key differs: %s, want %s", got, want)
+	}
+	if ttl := time.Until(other.storage.Get("user", "moved").getTimeOfDeath()); ttl > time.Hour || ttl < time.Minute*59 {
+		t.Errorf("Restored key got a wrong TTL: %s", ttl)
+	}
+
+	if code := other.invoke("user", restore).Code; code != _KE {
+		t.Errorf("Existing key was replaced without REPLACE: %d", code)
+	}
+	restore.Arguments = append(restore.Arguments, "REPLACE")
+	if code := other.invoke("user", restore).Code; code != _OK {
+		t.Errorf("REPLACE failed: %d", code)
+	}
+	if code := other.invoke("user", CommandMessage{Name: "RESTORE", Arguments: []string{"bad", "bm90IGEgZHVtcA=="}}).Code; code != _WA {
+		t.Errorf("Garbage was restored: %d", code)
+	}
+	var nan bytes.Buffer
+	gob.NewEncoder(&nan).Encode(snapshotObject{Type: "zset", Strings: []string{"a"}, Scores: []float64{math.NaN()}})
+	if code := other.invoke("user", CommandMessage{Name: "RESTORE", Arguments: []string{"nan", base64.StdEncoding.EncodeToString(nan.Bytes())}}).Code; code != _WA {
+		t.Errorf("NaN score was restored: %d", code)
+	}
+	if code := s.invoke("user", CommandMessage{Name: "DUMP", Arguments: []string{"missing"}}).Code; code != _NK {
+		t.Errorf("Missing key was dumped: %d", code)
+	}
+
+	// SAVE is done when it returns
+	if code := s.invoke("user", CommandMessage{Name: "SAVE"}).Code; code != _WA {
+		t.Errorf("SAVE without SNAPSHOTPATH: %d", code)
+	}
+	s.SNAPSHOTPATH = filepath.Join(dir, "potato.snapshot")
+	if code := s.invoke("user", CommandMessage{Name: "SAVE"}).Code; code != _OK {
+		t.Fatalf("SAVE failed: %d", code)
+	}
+	if _, err := os.Stat(s.SNAPSHOTPATH); err != nil {
+		t.Errorf("Snapshot wasn't written: %s", err)
+	}
+}
+
+func TestSequencedWrites(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	send := func(mes string) ResponseMessage {
+		var response ResponseMessage
+		go conn.Write([]byte(mes + "\n"))
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	for _, c := range []struct {
+		mes  string
+		code uint
+	}{
+		{`{"Name":"LPUSH","Arguments":["l","a"],"Seq":1}`, _OK},
+		{`{"Name":"LPUSH","Arguments":["l","c"],"Seq":3}`, _SQ},
+		{`{"Name":"LPUSH","Arguments":["l","a"],"Seq":1}`, _SQ},
+		{`{"Name":"LPUSH","Arguments":["l","b"],"Seq":2}`, _OK},
+		{`{"Name":"LPUSH","Arguments":["l","c"],"Seq":3}`, _OK},
+		// Reads and writes without a number aren't checked
+		{`{"Name":"LGET","Arguments":["l","0"],"Seq":10}`, _OK},
+		{`{"Name":"SET","Arguments":["k","v"],"TTL":1000000}`, _OK},
+	} {
+		if response := send(c.mes); response.Code != c.code {
+			t.Errorf("%s: got %s", c.mes, response.StatusMessage)
+		}
+	}
+
+	if response := send(`{"Name":"LPUSH","Arguments":["l","d"],"Seq":7}`); response.Value != "4" {
+		t.Errorf("Rejection doesn't tell the expected number: %+v", response)
+	}
+
+	// Fields of the previous message aren't kept
+	send(`{"Name":"SET","Arguments":["k","v"]}`)
+	if ttl := send(`{"Name":"PTTL","Arguments":["k"]}`).Value; ttl == "0" || ttl == "1" {
+		t.Errorf("TTL of the previous message was used: %s", ttl)
+	}
+
+	var list []string
+	for i := 0; i < 3; i++ {
+		list = append(list, send(`{"Name":"LGET","Arguments":["l","`+strconv.Itoa(i)+`"]}`).Value)
+	}
+	if strings.Join(list, "") != "abc" {
+		t.Errorf("Writes were applied out of order: %v", list)
+	}
+}
+
+func TestMapStorage(t *testing.T) {
+
+	st := newMapStorage()
+
+	if st.HasUser("user") || st.Get("user", "key") != nil {
+		t.Errorf("Empty storage has something")
+	}
+	st.AddUser("empty")
+	if !st.HasUser("empty") || st.Len("empty") != 0 {
+		t.Errorf("User wasn't added")
+	}
+
+	st.Set("user", "a", &pstring{content: "1", timeOfDeath: neverDies})
+	st.Set("user", "b", &pstring{content: "2", timeOfDeath: neverDies})
+	st.Set("user", "c", &pstring{content: "3", timeOfDeath: neverDies})
+	if st.Len("user") != 3 || len(st.Users()) != 2 {
+		t.Errorf("Got %d keys of %d users", st.Len("user"), len(st.Users()))
+	}
+
+	death := time.Now().Add(time.Hour)
+	if !st.Expire("user", "a", death) || !st.Get("user", "a").getTimeOfDeath().Equal(death) {
+		t.Errorf("Time of death wasn't set")
+	}
+	if st.Expire("user", "missing", death) {
+		t.Errorf("Missing key was expired")
+	}
+
+	// Keys can be deleted while iterating
+	st.Iterate("user", func(key string, val potat) bool {
+		if key != "a" {
+			st.Delete("user", key)
+		}
+		return true
+	})
+	if st.Len("user") != 1 || st.Get("user", "a") == nil {
+		t.Errorf("Wrong keys left after deleting while iterating: %d", st.Len("user"))
+	}
+
+	st.Set("user", "b", &pstring{content: "2", timeOfDeath: neverDies})
+	visited := 0
+	st.Iterate("user", func(key string, val potat) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("Iteration wasn't stopped: %d visited", visited)
+	}
+
+	st.Reset()
+	if st.HasUser("user") || len(st.Users()) != 0 {
+		t.Errorf("Storage wasn't reset")
+	}
+}
+
+func TestDiskStorage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.DISKPATH = filepath.Join(dir, "potato.data")
+	if err := s.openDiskStorage(); err != nil {
+		t.Fatal(err)
+	}
+	s.authConnection(nil)
+
+	for _, mes := range []CommandMessage{
+		{Name: "SET", Arguments: []string{"s", "value"}, TTL: time.Hour},
+		{Name: "LPUSH", Arguments: []string{"l", "a"}},
+		{Name: "HSET", Arguments: []string{"h", "field", "value"}},
+		{Name: "SET", Arguments: []string{"gone", "value"}},
+		{Name: "SET", Arguments: []string{"short", "value"}, TTL: time.Millisecond * 50},
+	} {
+		if response := s.invoke("user", mes); response.Code != _OK {
+			t.Fatalf("%s failed: %s", mes.Name, response.StatusMessage)
+		}
+	}
+
+	d := s.storage.(*diskStorage)
+	s.storageMutex.Lock()
+	err = d.flush()
+	s.storageMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed in place after the flush, so it's written by the next one
+	s.invoke("user", CommandMessage{Name: "LPUSH", Arguments: []string{"l", "b"}})
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"gone"}})
+	s.closeDiskStorage()
+
+	loaded := NewSlave("localhost", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+	loaded.DISKPATH = s.DISKPATH
+	if err := loaded.openDiskStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := loaded.functions["GET"]("user", CommandMessage{Name: "GET", Arguments: []string{"s"}}); response.Value != "value" {
+		t.Errorf("String wasn't kept on disk: %s", response.StatusMessage)
+	}
+	if response := loaded.functions["LGET"]("user", CommandMessage{Name: "LGET", Arguments: []string{"l", "1"}}); response.Value != "b" {
+		t.Errorf("Change after flush wasn't kept: %s, %s", response.StatusMessage, response.Value)
+	}
+	if response := loaded.functions["HGET"]("user", CommandMessage{Name: "HGET", Arguments: []string{"h", "field"}}); response.Value != "value" {
+		t.Errorf("Hash wasn't kept on disk: %s", response.StatusMessage)
+	}
+	if loaded.storage.Get("user", "gone") != nil {
+		t.Errorf("Deleted key came back")
+	}
+	if loaded.scheduled["user\x00short"].IsZero() {
+		t.Errorf("Key from the data file wasn't scheduled")
+	}
+
+	// Compaction keeps only the latest records
+	ld := loaded.storage.(*diskStorage)
+	loaded.storageMutex.Lock()
+	err = ld.flush()
+	before := ld.size
+	if err == nil {
+		err = ld.compact()
+	}
+	loaded.storageMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld.size >= before || ld.size != ld.live {
+		t.Errorf("Data file wasn't compacted: %d before, %d after, %d live", before, ld.size, ld.live)
+	}
+	loaded.closeDiskStorage()
+
+	again, err := openDiskStorage(s.DISKPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.close()
+	if again.Len("user") != 4 {
+		t.Errorf("Got %d keys after compaction", again.Len("user"))
+	}
+}
+
+func TestProxy(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	upstream := newPipeListener()
+	go s.Serve(upstream)
+
+	p := NewProxy("")
+	p.UPSTREAMCONNS = 1
+	p.dial = upstream.Dial
+	frontend := newPipeListener()
+	go p.Serve(frontend)
+	defer frontend.Close()
+
+	// Clients share the only upstream connection
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := frontend.Dial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+
+			key := "key" + strconv.Itoa(i)
+			for _, mes := range []CommandMessage{
+				{Name: "SET", Arguments: []string{key, "value"}},
+				{Name: "GET", Arguments: []string{key}},
+			} {
+				encoder.Encode(mes)
+				var response ResponseMessage
+				if err := decoder.Decode(&response); err != nil || response.Code != _OK {
+					t.Errorf("%s through the proxy failed: %v, %s", mes.Name, err, response.StatusMessage)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Writes are numbered by client connection
+	conn, err := frontend.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	var response ResponseMessage
+	encoder.Encode(CommandMessage{Name: "SET", Arguments: []string{"a", "1"}, Seq: 2})
+	if decoder.Decode(&response); response.Code != _SQ || response.Value != "1" {
+		t.Errorf("Out of sequence write went through the proxy: %s", response.StatusMessage)
+	}
+
+	// Streams get every part
+	encoder.Encode(CommandMessage{Name: "KEYS", Stream: true})
+	keys := 0
+	for {
+		var part ResponseMessage
+		if err := decoder.Decode(&part); err != nil {
+			t.Fatal(err)
+		}
+		keys += strings.Count(part.Value, "',")
+		if !part.More {
+			break
+		}
+	}
+	if keys != 5 {
+		t.Errorf("Got %d keys streamed through the proxy", keys)
+	}
+
+	// HTTP clients are limited by address
+	p.RATELIMIT, p.RATEBURST = 1, 1
+	server := httptest.NewServer(p.HTTPHandler())
+	defer server.Close()
+	post := func() (*http.Response, ResponseMessage) {
+		var r ResponseMessage
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"Name":"GET","Arguments":["key0"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp, r
+	}
+	if resp, r := post(); resp.StatusCode != http.StatusOK || r.Value != "value" {
+		t.Errorf("Got %d, %s over HTTP", resp.StatusCode, r.StatusMessage)
+	}
+	if resp, r := post(); resp.StatusCode != http.StatusTooManyRequests || r.Code != _RL {
+		t.Errorf("Rate limit wasn't applied: %d, %s", resp.StatusCode, r.StatusMessage)
+	}
+}
+
+func TestWarmStandby(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	primary.AOFPATH = filepath.Join(dir, "potato.aof")
+	if err := primary.openAppendLog(); err != nil {
+		t.Fatal(err)
+	}
+	defer primary.aof.close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		primary.Serve(listener)
+	}()
+	primary.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"a", "1"}})
+
+	standby := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	standby.STANDBYOF = listener.Addr().String()
+	standby.MIRRORINTERVAL = time.Millisecond * 10
+	conn := pipeSlave(t, standby)
+	defer conn.Close()
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	send := func(mes CommandMessage) ResponseMessage {
+		var response ResponseMessage
+		encoder.Encode(mes)
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	mirrored := func(key string) bool {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			standby.storageMutex.Lock()
+			ok := standby.storage.Get("user", key) != nil
+			standby.storageMutex.Unlock()
+			if ok {
+				return true
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		return false
+	}
+
+	if !mirrored("a") {
+		t.Fatalf("Snapshot of the primary wasn't mirrored")
+	}
+	if response := send(CommandMessage{Name: "GET", Arguments: []string{"a"}}); response.Code != _SB {
+		t.Errorf("Standby served a read: %s", response.StatusMessage)
+	}
+
+	// Writes after the snapshot come from the log
+	primary.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"b", "2"}})
+	if !mirrored("b") {
+		t.Fatalf("Log of the primary wasn't mirrored")
+	}
+
+	if response := send(CommandMessage{Name: "PROMOTE"}); response.Code != _OK {
+		t.Fatalf("PROMOTE failed: %s", response.StatusMessage)
+	}
+	if response := send(CommandMessage{Name: "GET", Arguments: []string{"b"}}); response.Value != "2" {
+		t.Errorf("Promoted standby doesn't have the data: %s", response.StatusMessage)
+	}
+	if response := send(CommandMessage{Name: "PROMOTE"}); response.Code != _WA {
+		t.Errorf("Primary was promoted again")
+	}
+
+	primary.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"c", "3"}})
+	time.Sleep(time.Millisecond * 50)
+	if response := send(CommandMessage{Name: "GET", Arguments: []string{"c"}}); response.Code != _NK {
+		t.Errorf("Mirroring went on after PROMOTE")
+	}
+}
+
+func TestBackup(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.STREAMBATCH = 2
+	s.authConnection(nil)
+	for _, mes := range []CommandMessage{
+		{Name: "SET", Arguments: []string{"s", "value"}, TTL: time.Hour},
+		{Name: "SET", Arguments: []string{"forever", "value"}, TTL: -1},
+		{Name: "HSET", Arguments: []string{"h", "field", "value"}},
+		{Name: "SADD", Arguments: []string{"set", "a", "b"}},
+		{Name: "SET", Arguments: []string{"dead", "value"}, TTL: time.Millisecond},
+	} {
+		s.invoke("user", mes)
+	}
+	s.invoke("other", CommandMessage{Name: "SET", Arguments: []string{"theirs", "value"}})
+	time.Sleep(time.Millisecond * 5)
+
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+	json.NewEncoder(conn).Encode(CommandMessage{Name: "BACKUP", Stream: true})
+	decoder := json.NewDecoder(conn)
+	var lines []string
+	frames := 0
+	for {
+		var response ResponseMessage
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != _OK {
+			t.Fatalf("BACKUP failed: %s", response.StatusMessage)
+		}
+		frames++
+		lines = append(lines, strings.SplitAfter(response.Value, "\n")...)
+		if !response.More {
+			break
+		}
+	}
+	if frames != 3 {
+		t.Errorf("Backup came in %d frames", frames)
+	}
+
+	// Everything is put back into an empty slave with RESTORE
+	restored := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	restored.authConnection(nil)
+	keys := 0
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		var entry backupEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Malformed backup line %q: %s", line, err)
+		}
+		keys++
+		response := restored.invoke("user", CommandMessage{Name: "RESTORE", Arguments: []string{entry.Key, entry.Dump}, TTL: entry.TTL})
+		if response.Code != _OK {
+			t.Errorf("Backup of %s wasn't restored: %s", entry.Key, response.StatusMessage)
+		}
+	}
+	if keys != 4 {
+		t.Errorf("Got %d keys in backup", keys)
+	}
+
+	if response := restored.invoke("user", CommandMessage{Name: "HGET", Arguments: []string{"h", "field"}}); response.Value != "value" {
+		t.Errorf("Hash wasn't restored: %s", response.StatusMessage)
+	}
+	if response := restored.invoke("user", CommandMessage{Name: "TTL", Arguments: []string{"s"}}); response.Value == "-1" {
+		t.Errorf("TTL wasn't kept")
+	}
+	if !restored.storage.Get("user", "forever").getTimeOfDeath().Equal(neverDies) {
+		t.Errorf("Key without expiration got one")
+	}
+}
+
+func TestNilValues(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	conn := pipeSlave(t, s)
+	defer conn.Close()
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+
+	for _, c := range []struct {
+		mes CommandMessage
+		nil bool
+	}{
+		{CommandMessage{Name: "SET", Arguments: []string{"empty", ""}, Protocol: 2}, false},
+		{CommandMessage{Name: "GET", Arguments: []string{"empty"}, Protocol: 2}, false},
+		{CommandMessage{Name: "GET", Arguments: []string{"missing"}, Protocol: 2}, true},
+		{CommandMessage{Name: "HGET", Arguments: []string{"missing", "field"}, Protocol: 2}, true},
+		// The first protocol has no Nil
+		{CommandMessage{Name: "GET", Arguments: []string{"missing"}}, false},
+	} {
+		encoder.Encode(c.mes)
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			t.Fatal(err)
+		}
+		var response ResponseMessage
+		json.Unmarshal(raw, &response)
+		if response.Nil != c.nil {
+			t.Errorf("%s %v of protocol %d: got Nil %v", c.mes.Name, c.mes.Arguments, c.mes.Protocol, response.Nil)
+		}
+		if c.mes.Protocol < 2 && bytes.Contains(raw, []byte("Nil")) {
+			t.Errorf("Nil was sent to a client of the first protocol: %s", raw)
+		}
+	}
+}
+
+func TestMaxTTL(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.MAXTTL = time.Hour
+	s.USERMAXTTL["trusted"] = time.Hour * 24
+
+	dies := func(user string, key string) time.Duration {
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
+		return time.Until(s.storage.Get(user, key).getTimeOfDeath())
+	}
+
+	response := s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"year", "v"}, TTL: time.Hour * 24 * 365})
+	if response.Code != _OK || !response.Clamped {
+		t.Fatalf("a long TTL wasn't clamped: %+v", response)
+	}
+	if d := dies("user", "year"); d > time.Hour {
+		t.Errorf("clamped key dies in %s", d)
+	}
+
+	response = s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"short", "v"}, TTL: time.Minute * 30})
+	if response.Clamped || dies("user", "short") < time.Minute*29 {
+		t.Errorf("a TTL within the limit was changed: %+v", response)
+	}
+
+	s.invoke("trusted", CommandMessage{Name: "SET", Arguments: []string{"day", "v"}, TTL: time.Hour * 12})
+	if dies("trusted", "day") < time.Hour*11 {
+		t.Error("the limit of the user wasn't used")
+	}
+
+	for _, mes := range []CommandMessage{
+		{Name: "PERSIST", Arguments: []string{"short"}},
+		{Name: "EXPIRE", Arguments: []string{"short", "86400"}},
+		{Name: "PEXPIREAT", Arguments: []string{"short", strconv.FormatInt(time.Now().Add(time.Hour*48).UnixNano()/1e6, 10)}},
+	} {
+		response = s.invoke("user", mes)
+		if response.Code != _OK || !response.Clamped {
+			t.Errorf("%s wasn't clamped: %+v", mes.Name, response)
+		}
+		if d := dies("user", "short"); d > time.Hour || d < time.Minute*59 {
+			t.Errorf("%s made the key die in %s", mes.Name, d)
+		}
+	}
+
+	s.TTLPOLICY = "reject"
+	response = s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"forever", "v"}, TTL: -1})
+	if response.Code != _TL {
+		t.Errorf("a write that lives forever wasn't rejected: %+v", response)
+	}
+	if s.storage.Get("user", "forever") != nil {
+		t.Error("a rejected write was applied")
+	}
+}
+
+type recordingHook struct {
+	mu        sync.Mutex
+	mutations []Mutation
+}
+
+func (h *recordingHook) OnMutation(m Mutation) {
+	h.mu.Lock()
+	h.mutations = append(h.mutations, m)
+	h.mu.Unlock()
+}
+
+func TestMutationHooks(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	hook := &recordingHook{}
+	s.AddMutationHook(hook)
+
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"name", "potato"}, TTL: time.Hour})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"h", "f", "v"}, TTL: -1})
+	s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"name"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"name"}})
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"name"}})
+
+	if len(hook.mutations) != 3 {
+		t.Fatalf("expected 3 mutations, got %+v", hook.mutations)
+	}
+
+	set, hset, del := hook.mutations[0], hook.mutations[1], hook.mutations[2]
+	if set.User != "user" || set.Key != "name" || set.Command != "SET" || set.Type != "string" ||
+		set.TTL <= time.Minute*59 || set.TTL > time.Hour {
+		t.Errorf("wrong mutation of SET: %+v", set)
+	}
+	if hset.Type != "hash" || hset.TTL >= 0 || hset.Seq <= set.Seq {
+		t.Errorf("wrong mutation of HSET: %+v", hset)
+	}
+	if !del.Deleted || del.Dump != "" {
+		t.Errorf("wrong mutation of DEL: %+v", del)
+	}
+
+	// The dump is good for RESTORE
+	response := s.invoke("user", CommandMessage{Name: "RESTORE", Arguments: []string{"copy", set.Dump}, TTL: time.Minute})
+	if response.Code != _OK {
+		t.Fatalf("dump of a mutation wasn't restored: %+v", response)
+	}
+	if response := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"copy"}}); response.Value != "potato" {
+		t.Errorf("restored %q", response.Value)
+	}
+}
+
+func TestSampledLRU(t *testing.T) {
+
+	// With as many samples as keys it's a true LRU
+	p := NewSampledLRU(100)
+	for i := 0; i < 10; i++ {
+		p.OnWrite(UserKey{User: "user", Key: strconv.Itoa(i)}, 10)
+	}
+	p.OnAccess(UserKey{User: "user", Key: "0"})
+	p.OnDelete(UserKey{User: "user", Key: "1"})
+
+	victims := p.PickVictims(3)
+	if len(victims) != 3 || victims[0].Key != "2" || victims[1].Key != "3" || victims[2].Key != "4" {
+		t.Errorf("wrong victims %v", victims)
+	}
+	if victims := p.PickVictims(100); len(victims) != 9 {
+		t.Errorf("expected all 9 keys, got %v", victims)
+	}
+
+	// Concurrent use, run with -race
+	p = NewSampledLRU(5)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := UserKey{User: strconv.Itoa(g), Key: strconv.Itoa(i % 50)}
+				p.OnWrite(k, 1)
+				p.OnAccess(k)
+				for _, v := range p.PickVictims(2) {
+					if v.User == "" {
+						t.Error("an empty victim was picked")
+					}
+				}
+				if i%3 == 0 {
+					p.OnDelete(k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestEviction(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	s.MAXKEYS = 5
+	s.EVICTION = NewSampledLRU(100)
+
+	for i := 0; i < 5; i++ {
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{strconv.Itoa(i), "v"}})
+	}
+	s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"0"}})
+	s.invoke("other", CommandMessage{Name: "SET", Arguments: []string{"new", "v"}})
+
+	if n := s.keyCount(); n != 5 {
+		t.Errorf("%d keys are left over MAXKEYS", n)
+	}
+	if s.storage.Get("user", "1") != nil {
+		t.Error("the least recently used key wasn't evicted")
+	}
+	if s.storage.Get("user", "0") == nil || s.storage.Get("other", "new") == nil {
+		t.Error("a recently used key was evicted")
+	}
+
+	// Keys that are gone by themselves are skipped
+	s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"2"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"a", "v"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"b", "v"}})
+	if n := s.keyCount(); n != 5 || s.storage.Get("user", "3") != nil {
+		t.Errorf("wrong eviction after a delete, %d keys", n)
+	}
+}
+
+func TestMoveKeys(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+
+	s.invoke("old", CommandMessage{Name: "SET", Arguments: []string{"order:1", "a"}, TTL: time.Hour})
+	s.invoke("old", CommandMessage{Name: "HSET", Arguments: []string{"order:2", "f", "v"}})
+	s.invoke("old", CommandMessage{Name: "SET", Arguments: []string{"profile", "p"}})
+	s.invoke("new", CommandMessage{Name: "SET", Arguments: []string{"order:2", "taken"}})
+
+	// A conflict moves nothing
+	response := s.invoke("admin", CommandMessage{Name: "MOVEKEYS", Arguments: []string{"old", "new", "order:*"}})
+	if response.Code != _KE || response.Value != "order:2" {
+		t.Fatalf("a conflicting move got %+v", response)
+	}
+	if s.storage.Get("old", "order:1") == nil {
+		t.Fatal("a key was moved by a refused move")
+	}
+
+	s.invoke("new", CommandMessage{Name: "DEL", Arguments: []string{"order:2"}})
+	response = s.invoke("admin", CommandMessage{Name: "MOVEKEYS", Arguments: []string{"old", "new", "order:*"}})
+	if response.Code != _OK || response.Value != "2" {
+		t.Fatalf("MOVEKEYS got %+v", response)
+	}
+	if s.storage.Get("old", "order:1") != nil || s.storage.Get("old", "profile") == nil {
+		t.Error("wrong keys are left to the source user")
+	}
+	if response := s.invoke("new", CommandMessage{Name: "GET", Arguments: []string{"order:1"}}); response.Value != "a" {
+		t.Errorf("moved key has %+v", response)
+	}
+	if response := s.invoke("new", CommandMessage{Name: "TTL", Arguments: []string{"order:1"}}); response.Value == "-1" {
+		t.Error("TTL wasn't moved")
+	}
+
+	// As a job it reports progress and can't be cancelled
+	response = s.invoke("user", CommandMessage{Name: "MOVEKEYS", Arguments: []string{"old", "other", "*"}, Async: true})
+	if response.Code != _OK {
+		t.Fatalf("MOVEKEYS job wasn't started: %+v", response)
+	}
+	status := waitJob(t, s, response.Value)
+	if status.Progress != 100 || status.Result.Value != "1" || s.storage.Get("other", "profile") == nil {
+		t.Errorf("MOVEKEYS job got %+v", status)
+	}
+	if s.invoke("user", CommandMessage{Name: "JOB", Arguments: []string{"CANCEL", response.Value}}).Code != _WA {
+		t.Error("MOVEKEYS job was cancelled")
+	}
+}
+
+func TestReplication(t *testing.T) {
+
+	primary := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		primary.Serve(listener)
+	}()
+	primary.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"before", "1"}})
+
+	replica := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	replica.REPLICAOF = listener.Addr().String()
+	replica.ROLE = "replica"
+	shutdownChan := make(chan bool)
+	go replica.replicaRoutine(shutdownChan)
+	defer func() { shutdownChan <- true }()
+
+	replicated := func(key string) potat {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			replica.storageMutex.Lock()
+			val := replica.storage.Get("user", key)
+			replica.storageMutex.Unlock()
+			if val != nil {
+				return val
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		return nil
+	}
+
+	if replicated("before") == nil {
+		t.Fatal("the replica didn't get a snapshot")
+	}
+
+	// Writes that aren't idempotent come once and in order
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				primary.invoke("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", strconv.Itoa(i*100 + j)}})
+			}
+		}(i)
+	}
+	wg.Wait()
+	primary.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"after", "1"}})
+
+	if replicated("after") == nil {
+		t.Fatal("writes weren't streamed")
+	}
+	primary.storageMutex.Lock()
+	want := append([]string(nil), primary.storage.Get("user", "list").(*plist).list...)
+	primary.storageMutex.Unlock()
+	replica.storageMutex.Lock()
+	got := replica.storage.Get("user", "list").(*plist).list
+	replica.storageMutex.Unlock()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("the replica has %d items, the primary %d", len(got), len(want))
+	}
+
+	// Clients can only read from a replica, which tells how stale it is
+	if r := replica.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"after", "2"}}); r.Code != _RO {
+		t.Errorf("a replica accepted a write: %s", r.StatusMessage)
+	}
+	if r := replica.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"after"}}); r.Value != "1" || r.Lag != 0 {
+		t.Errorf("unexpected read from a replica: %+v", r)
+	}
+	replica.REPORTLAG = true
+	if r := replica.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"after"}}); r.Lag <= 0 || r.Lag > time.Second*5 {
+		t.Errorf("unexpected lag %s", r.Lag)
+	}
+}
+
+func TestSharedURLs(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	upstream := newPipeListener()
+	go s.Serve(upstream)
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"debug:1", "dump"}})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"debug:2", "f", "v"}})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"secret", "s"}})
+
+	p := NewProxy("")
+	p.dial = upstream.Dial
+	p.URLKEY = []byte("key")
+	server := httptest.NewServer(p.HTTPHandler())
+	defer server.Close()
+
+	get := func(url string) (int, ResponseMessage) {
+		var r ResponseMessage
+		resp, err := http.Get(server.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r
+	}
+
+	key := p.SharedURL("key", "debug:1", time.Hour)
+	if code, r := get(key); code != http.StatusOK || r.Value != "dump" {
+		t.Errorf("a shared key got %d, %+v", code, r)
+	}
+	if code, _ := get(key + "&key=secret"); code != http.StatusForbidden {
+		t.Errorf("another key was read with a shared URL: %d", code)
+	}
+	if code, _ := get(strings.Replace(key, "debug%3A1", "secret", 1)); code != http.StatusForbidden {
+		t.Errorf("a changed shared URL got %d", code)
+	}
+	if code, _ := get(key + "&command=SET&arg=v"); code != http.StatusBadRequest {
+		t.Errorf("a write through a shared URL got %d", code)
+	}
+	if code, _ := get(key + "&command=PFCOUNT&arg=secret"); code != http.StatusBadRequest {
+		t.Errorf("keys that aren't shared were counted through a shared URL: %d", code)
+	}
+
+	prefix := p.SharedURL("prefix", "debug:", time.Hour)
+	if code, r := get(prefix + "&key=debug:2&command=HGET&arg=f"); code != http.StatusOK || r.Value != "v" {
+		t.Errorf("a key under a shared prefix got %d, %+v", code, r)
+	}
+	if code, _ := get(prefix + "&key=secret"); code != http.StatusForbidden {
+		t.Errorf("a key out of a shared prefix got %d", code)
+	}
+
+	if code, _ := get(p.SharedURL("key", "debug:1", -time.Minute)); code != http.StatusForbidden {
+		t.Errorf("an expired URL got %d", code)
+	}
+	p.URLKEY = []byte("rotated")
+	if code, _ := get(key); code != http.StatusForbidden {
+		t.Errorf("a URL of an old key got %d", code)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.authConnection(nil)
+	s.CACHECOMMANDS["SINTER"] = true
+	s.CACHECOMMANDS["QUERY"] = true
+
+	s.invoke("user", CommandMessage{Name: "SADD", Arguments: []string{"a", "1", "2", "3"}})
+	s.invoke("user", CommandMessage{Name: "SADD", Arguments: []string{"b", "2", "3"}})
+	sinter := CommandMessage{Name: "SINTER", Arguments: []string{"a", "b"}}
+
+	first := s.invoke("user", sinter)
+	if second := s.invoke("user", sinter); second.Value != first.Value || s.stats.get("cache_hits") != 1 {
+		t.Fatalf("SINTER wasn't cached: %v", s.stats.snapshot())
+	}
+
+	// A write to an unrelated key keeps the response, one to a read key drops it
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"c", "1"}})
+	s.invoke("user", sinter)
+	s.invoke("user", CommandMessage{Name: "SREM", Arguments: []string{"b", "3"}})
+	if r := s.invoke("user", sinter); strings.Contains(r.Value, "3") {
+		t.Errorf("a stale response after a write: %q", r.Value)
+	}
+	if s.stats.get("cache_hits") != 2 || s.stats.get("cache_invalidations") != 1 {
+		t.Errorf("unexpected cache counters: %v", s.stats.snapshot())
+	}
+
+	// A query reads every key under its prefix
+	query := CommandMessage{Name: "QUERY", Arguments: []string{"SELECT age FROM person:"}}
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"person:anna", "age", "30"}})
+	s.invoke("user", query)
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"person:boris", "age", "25"}})
+	if r := s.invoke("user", query); !strings.Contains(r.Value, "25") {
+		t.Errorf("a stale query: %s", r.Value)
+	}
+
+	// Responses of other users are their own
+	if r := s.invoke("other", sinter); r.Value != "" {
+		t.Errorf("a response of another user: %+v", r)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+
+	target := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		target.Serve(listener)
+	}()
+	addr := listener.Addr().String()
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.authConnection(nil)
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"hash", "f", "v"}, TTL: time.Hour})
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"other", "1"}})
+	target.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"other", "2"}})
+
+	if r := s.invoke("user", CommandMessage{Name: "MIGRATE", Arguments: []string{"hash", addr}}); r.Code != _OK {
+		t.Fatalf("MIGRATE failed: %s %s", r.StatusMessage, r.Value)
+	}
+	if r := s.invoke("user", CommandMessage{Name: "HGET", Arguments: []string{"hash", "f"}}); r.Code == _OK {
+		t.Error("a migrated key is still here")
+	}
+	if r := target.invoke("user", CommandMessage{Name: "HGET", Arguments: []string{"hash", "f"}}); r.Value != "v" {
+		t.Errorf("the target has %+v", r)
+	}
+	if r := target.invoke("user", CommandMessage{Name: "PTTL", Arguments: []string{"hash"}}); r.Value == "-1" {
+		t.Error("the TTL wasn't migrated")
+	}
+
+	// A key the target has stays here
+	if r := s.invoke("user", CommandMessage{Name: "MIGRATE", Arguments: []string{"other", addr}}); r.Code != _KE {
+		t.Errorf("MIGRATE over an existing key: %s", r.StatusMessage)
+	}
+	if r := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"other"}}); r.Value != "1" {
+		t.Errorf("a key that wasn't migrated is gone: %+v", r)
+	}
+
+	listener.Close()
+	time.Sleep(time.Millisecond * 10)
+	if r := s.invoke("user", CommandMessage{Name: "MIGRATE", Arguments: []string{"other", addr}}); r.Code != _UP {
+		t.Errorf("MIGRATE to a slave that is gone: %s", r.StatusMessage)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+
+	peer := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		peer.Serve(listener)
+	}()
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.SNAPSHOTPATH = filepath.Join(t.TempDir(), "snapshot")
+	s.REPLICAOF = listener.Addr().String()
+
+	checks := make(map[string]Finding)
+	for _, f := range s.Doctor() {
+		checks[strings.Fields(f.Check)[0]] = f
+		if f.Level == "error" {
+			t.Errorf("unexpected error: %+v", f)
+		}
+	}
+	for _, check := range []string{"port", "open", "disk", "clock"} {
+		if _, ok := checks[check]; !ok {
+			t.Errorf("%s wasn't checked: %v", check, checks)
+		}
+	}
+	if checks["clock"].Level != "ok" {
+		t.Errorf("the clock of a local peer: %+v", checks["clock"])
+	}
+
+	// A port that is taken is an error
+	taken, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, s.port, _ = net.SplitHostPort(taken.Addr().String())
+	if f := s.checkPort(); f.Level != "error" {
+		t.Errorf("a taken port: %+v", f)
+	}
+}
+
+func TestGossip(t *testing.T) {
+
+	var slaves []*PotatoSlave
+	var listeners []net.Listener
+	var stops []chan bool
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		s := NewSlave("127.0.0.1", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+		_, s.port, _ = net.SplitHostPort(listener.Addr().String())
+		s.GOSSIPINTERVAL = time.Millisecond * 20
+		s.PEERTIMEOUT = time.Millisecond * 300
+		go func() {
+			defer func() { recover() }()
+			s.Serve(listener)
+		}()
+		slaves = append(slaves, s)
+		listeners = append(listeners, listener)
+	}
+	// The second and the third only know the first one
+	for _, s := range slaves {
+		for atomic.LoadInt32(&s.serving) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		s.SEEDS = []string{listeners[0].Addr().String()}
+		stop := make(chan bool)
+		go s.gossipRoutine(stop)
+		stops = append(stops, stop)
+	}
+	defer func() {
+		for _, stop := range stops[:2] {
+			stop <- true
+		}
+	}()
+
+	alive := func(s *PotatoSlave) map[string]bool {
+		var members []Member
+		json.Unmarshal([]byte(s.invoke("user", CommandMessage{Name: "MEMBERS"}).Value), &members)
+		alive := make(map[string]bool)
+		for _, m := range members {
+			alive[m.Addr] = m.Alive
+		}
+		return alive
+	}
+	wait := func(what string, ok func() bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	third := listeners[2].Addr().String()
+	wait("members didn't learn about each other", func() bool {
+		for _, s := range slaves {
+			a := alive(s)
+			if len(a) != 3 || !a[third] {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The third one goes away
+	stops[2] <- true
+	listeners[2].Close()
+	wait("the third one is still alive", func() bool {
+		a := alive(slaves[1])
+		return !a[third] && a[listeners[0].Addr().String()]
+	})
+}
+
+// stubResolver answers lookups of seeds from maps, a name that isn't there
+// fails.
+type stubResolver struct {
+	mutex sync.Mutex
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if records, ok := r.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, errors.New("no SRV records of " + name)
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, errors.New("no such host " + host)
+}
+
+func TestSeedLookup(t *testing.T) {
+
+	resolver := &stubResolver{}
+	s := NewSlave("127.0.0.1", "7000", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.resolver = resolver
+	s.SEEDS = []string{"10.0.0.9:7000"}
+	s.SEEDSNAME = "seeds.potato"
+
+	check := func(what string, want ...string) {
+		got := s.seedAddrs()
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: seeds are %v, not %v", what, got, want)
+		}
+	}
+
+	// Nothing resolves yet, so the static seeds are used
+	check("never resolved", "10.0.0.9:7000")
+
+	// A records get the port of the slave
+	resolver.hosts = map[string][]string{"seeds.potato": {"10.0.0.1", "10.0.0.2"}}
+	check("A records", "10.0.0.1:7000", "10.0.0.2:7000")
+
+	// SRV records win over A records and have ports of their own
+	resolver.srv = map[string][]*net.SRV{"seeds.potato": {{Target: "a.potato", Port: 7001}, {Target: "b.potato", Port: 7002}}}
+	check("SRV records", "a.potato:7001", "b.potato:7002")
+
+	// DNS going away keeps what it resolved to last
+	resolver.mutex.Lock()
+	resolver.srv, resolver.hosts = nil, nil
+	resolver.mutex.Unlock()
+	check("DNS unavailable", "a.potato:7001", "b.potato:7002")
+	if n := s.stats.get("seed_lookup_errors"); n < 2 {
+		t.Fatalf("%d lookup errors counted", n)
+	}
+
+	// A slave finds a member through its seeds name
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	seed := NewSlave("127.0.0.1", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	_, seed.port, _ = net.SplitHostPort(listener.Addr().String())
+	go func() {
+		defer func() { recover() }()
+		seed.Serve(listener)
+	}()
+	for atomic.LoadInt32(&seed.serving) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.gossip.mutex.Lock()
+	s.gossip.seeds = nil
+	s.gossip.mutex.Unlock()
+	s.SEEDS = nil
+	s.port = seed.port
+	s.IP = "127.0.0.2"
+	s.GOSSIPINTERVAL = time.Millisecond * 20
+	resolver.mutex.Lock()
+	resolver.hosts = map[string][]string{"seeds.potato": {"127.0.0.1"}}
+	resolver.mutex.Unlock()
+	stop := make(chan bool)
+	go s.gossipRoutine(stop)
+	defer func() { stop <- true }()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		seed.gossip.mutex.Lock()
+		found := seed.gossip.members[s.advertised()] != nil
+		seed.gossip.mutex.Unlock()
+		if found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the seed didn't learn about the slave")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRaft(t *testing.T) {
+
+	var slaves []*PotatoSlave
+	var addrs []string
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		s := NewSlave("127.0.0.1", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+		_, s.port, _ = net.SplitHostPort(listener.Addr().String())
+		s.RAFTPREFIXES = []string{"lock:"}
+		s.RAFTHEARTBEAT = time.Millisecond * 20
+		s.RAFTELECTION = time.Millisecond * 150
+		go func() {
+			defer func() { recover() }()
+			s.Serve(listener)
+		}()
+		slaves = append(slaves, s)
+		addrs = append(addrs, listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	stops := make(map[*PotatoSlave]chan bool)
+	for i, s := range slaves {
+		for atomic.LoadInt32(&s.serving) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for j, addr := range addrs {
+			if j != i {
+				s.RAFTPEERS = append(s.RAFTPEERS, addr)
+			}
+		}
+		stops[s] = make(chan bool)
+		go s.raftRoutine(stops[s])
+	}
+	defer func() {
+		for _, stop := range stops {
+			stop <- true
+		}
+	}()
+
+	// The leader is the one that takes writes of the group
+	leader := func(slaves []*PotatoSlave, value string) *PotatoSlave {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			for _, s := range slaves {
+				if s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"lock:a", value}}).Code == _OK {
+					return s
+				}
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("no leader was elected")
+		return nil
+	}
+	local := func(s *PotatoSlave, key string) string {
+		mes := CommandMessage{Name: "GET", Arguments: []string{key}}
+		mes.raftApplied = true
+		return s.invoke("user", mes).Value
+	}
+
+	first := leader(slaves, "1")
+	var followers []*PotatoSlave
+	for _, s := range slaves {
+		if s != first {
+			followers = append(followers, s)
+		}
+	}
+
+	if r := first.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"lock:a"}}); r.Code != _OK || r.Value != "1" {
+		t.Fatalf("leader read %d %q", r.Code, r.Value)
+	}
+	leaderAddr := first.IP + ":" + first.port
+	for _, s := range followers {
+		if r := s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"lock:a", "2"}}); r.Code != _NL || r.Value != leaderAddr {
+			t.Fatalf("follower took a write: %d %q", r.Code, r.Value)
+		}
+		if r := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"lock:a"}}); r.Code != _NL {
+			t.Fatalf("follower served a read: %d", r.Code)
+		}
+		if r := s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"other", "1"}}); r.Code != _OK {
+			t.Fatalf("key outside of the group: %d", r.Code)
+		}
+	}
+
+	// Followers apply what's committed
+	deadline := time.Now().Add(time.Second * 5)
+	for _, s := range followers {
+		for local(s, "lock:a") != "1" {
+			if time.Now().After(deadline) {
+				t.Fatal("follower didn't apply the write")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// The others elect a new leader that has the write
+	stops[first] <- true
+	delete(stops, first)
+	for i, s := range slaves {
+		if s == first {
+			listeners[i].Close()
+		}
+	}
+
+	second := leader(followers, "3")
+	if r := second.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"lock:a"}}); r.Code != _OK || r.Value != "3" {
+		t.Fatalf("new leader read %d %q", r.Code, r.Value)
+	}
+	if second.stats.get("raft_applied") < 2 {
+		t.Fatal("writes weren't applied on the new leader")
+	}
+}
+
+func TestRaftLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *PotatoSlave {
+		s := NewSlave("127.0.0.1", "62553", time.Second, time.Minute, time.Millisecond*100, 1)
+		s.RAFTPEERS = []string{"127.0.0.1:1", "127.0.0.1:2"}
+		s.RAFTPREFIXES = []string{"lock:"}
+		s.RAFTTIMEOUT = time.Millisecond
+		s.RAFTPATH = filepath.Join(dir, "potato.raft")
+		s.authConnection(nil)
+		s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"lock:stale", "1"}, raftApplied: true})
+		if err := s.openRaftLog(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	ask := func(s *PotatoSlave, name string, args interface{}, reply interface{}) {
+		body, _ := json.Marshal(args)
+		response := s.invoke("user", CommandMessage{Name: name, Arguments: []string{string(body)}})
+		if response.Code != _OK || json.Unmarshal([]byte(response.Value), reply) != nil {
+			t.Fatalf("%s failed: %+v", name, response)
+		}
+	}
+
+	s := open()
+	var vote raftVoteReply
+	ask(s, "RAFTVOTE", raftVote{Term: 3, Candidate: "a"}, &vote)
+	if !vote.Granted {
+		t.Fatalf("Vote wasn't granted: %+v", vote)
+	}
+	entries := []raftEntry{{Term: 3}, {Term: 3, User: "user", Command: CommandMessage{Name: "SET", Arguments: []string{"lock:a", "1"}}}}
+	var appended raftAppendReply
+	ask(s, "RAFTAPPEND", raftAppend{Term: 3, Leader: "a", Entries: entries}, &appended)
+	// The second entry is replaced by one of a later leader
+	ask(s, "RAFTAPPEND", raftAppend{Term: 4, Leader: "b", PrevIndex: 1, PrevTerm: 3, Entries: []raftEntry{{Term: 4}}}, &appended)
+	if !appended.Success || appended.Match != 2 {
+		t.Fatalf("Entries weren't appended: %+v", appended)
+	}
+
+	// Writes of a leader are saved before it waits for the others
+	s.raft.mutex.Lock()
+	s.raft.role = raftLeader
+	s.raft.mutex.Unlock()
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"lock:b", "1"}, TTL: time.Hour, TTLJitter: 50})
+	s.closeRaftLog()
+	f, _ := os.OpenFile(s.RAFTPATH, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"Term":9`)
+	f.Close()
+
+	s = open()
+	defer s.closeRaftLog()
+	r := &s.raft
+	if r.term != 4 || r.votedFor != "" || len(r.log) != 4 || r.log[2].Term != 4 {
+		t.Fatalf("Wrong state after a restart: term %d, vote %q, log %+v", r.term, r.votedFor, r.log)
+	}
+	if mes := r.log[3].Command; mes.Name != "SET" || mes.TTLJitter != 0 || mes.TTL < time.Hour/2 || mes.TTL > time.Hour*3/2 {
+		t.Errorf("Wrong proposed write: %+v", mes)
+	}
+	if s.storage.Get("user", "lock:stale") != nil {
+		t.Errorf("Key of the group wasn't dropped, it's applied again from the log")
+	}
+
+	// A member that voted in a term doesn't vote again after a restart
+	ask(s, "RAFTVOTE", raftVote{Term: 5, Candidate: "c", LastIndex: 3, LastTerm: 4}, &vote)
+	s.closeRaftLog()
+	s = open()
+	defer s.closeRaftLog()
+	ask(s, "RAFTVOTE", raftVote{Term: 5, Candidate: "d", LastIndex: 3, LastTerm: 4}, &vote)
+	if vote.Granted || s.raft.votedFor != "c" {
+		t.Errorf("Vote was given twice in a term: %+v", vote)
+	}
+}
+
+func TestWait(t *testing.T) {
+
+	primary := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		primary.Serve(listener)
+	}()
+
+	// Without replicas nobody has the writes
+	primary.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"a", "1"}})
+	if r := primary.invoke("user", CommandMessage{Name: "WAIT", Arguments: []string{"1", "20"}}); r.Code != _OK || r.Value != "0" {
+		t.Fatalf("WAIT without replicas: %d %q", r.Code, r.Value)
+	}
+
+	replica := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, 1)
+	replica.REPLICAOF = listener.Addr().String()
+	replica.ROLE = "replica"
+	shutdownChan := make(chan bool)
+	go replica.replicaRoutine(shutdownChan)
+	defer func() { shutdownChan <- true }()
+
+	// The snapshot has the write
+	if r := primary.invoke("user", CommandMessage{Name: "WAIT", Arguments: []string{"1", "5000"}}); r.Value != "1" {
+		t.Fatalf("the write in the snapshot isn't acknowledged: %q", r.Value)
+	}
+
+	for i := 0; i < 50; i++ {
+		primary.invoke("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", strconv.Itoa(i)}})
+	}
+	if r := primary.invoke("user", CommandMessage{Name: "WAIT", Arguments: []string{"1", "0"}}); r.Value != "1" {
+		t.Fatalf("writes aren't acknowledged: %q", r.Value)
+	}
+	// Once WAIT returns the replica has every write
+	replica.storageMutex.Lock()
+	n := len(replica.storage.Get("user", "list").(*plist).list)
+	replica.storageMutex.Unlock()
+	if n != 50 {
+		t.Errorf("the replica has %d items", n)
+	}
+
+	start := time.Now()
+	if r := primary.invoke("user", CommandMessage{Name: "WAIT", Arguments: []string{"2", "50"}}); r.Value != "1" || time.Since(start) < time.Millisecond*50 {
+		t.Errorf("WAIT for more replicas than there are: %q after %s", r.Value, time.Since(start))
+	}
+	if r := primary.invoke("user", CommandMessage{Name: "WAIT", Arguments: []string{"1"}}); r.Code != _WA {
+		t.Errorf("WAIT without a timeout: %d", r.Code)
+	}
+}
+
+func TestRESP(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go s.ServeRESP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(args ...string) string {
+		var b strings.Builder
+		b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+		}
+		conn.Write([]byte(b.String()))
+
+		// A reply is read whole, arrays of bulk strings inline
+		var reply strings.Builder
+		var read func()
+		read = func() {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.WriteString(line)
+			switch line[0] {
+			case '$':
+				if n, _ := strconv.Atoi(strings.TrimSpace(line[1:])); n >= 0 {
+					data := make([]byte, n+2)
+					io.ReadFull(reader, data)
+					reply.Write(data)
+				}
+			case '*':
+				n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				for i := 0; i < n; i++ {
+					read()
+				}
+			}
+		}
+		read()
+		return reply.String()
+	}
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"ping", "hi"}, "$2\r\nhi\r\n"},
+		{[]string{"SET", "a", "1"}, "+OK\r\n"},
+		{[]string{"GET", "a"}, "$1\r\n1\r\n"},
+		{[]string{"GET", "missing"}, "$-1\r\n"},
+		{[]string{"TTL", "a"}, ":-1\r\n"},
+		{[]string{"TTL", "missing"}, ":-2\r\n"},
+		{[]string{"SET", "b", "2", "EX", "100"}, "+OK\r\n"},
+		{[]string{"TTL", "b"}, ":100\r\n"},
+		{[]string{"SET", "b", "2", "NX"}, "-ERR syntax error\r\n"},
+		{[]string{"EXISTS", "a", "b", "missing"}, ":2\r\n"},
+		{[]string{"SADD", "s", "x", "y"}, ":2\r\n"},
+		{[]string{"SISMEMBER", "s", "x"}, ":1\r\n"},
+		{[]string{"SCARD", "s"}, ":2\r\n"},
+		{[]string{"SMEMBERS", "missing"}, "*0\r\n"},
+		{[]string{"HSET", "h", "f", "v"}, ":1\r\n"},
+		{[]string{"HGET", "h", "f"}, "$1\r\nv\r\n"},
+		{[]string{"HGETALL", "h"}, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"HSET", "h", "f", "w", "g", "x"}, ":1\r\n"},
+		{[]string{"HSET", "q", "a':'b", "c','d"}, ":1\r\n"},
+		{[]string{"HGETALL", "q"}, "*2\r\n$5\r\na':'b\r\n$5\r\nc','d\r\n"},
+		{[]string{"SADD", "t", "x',"}, ":1\r\n"},
+		{[]string{"SMEMBERS", "t"}, "*1\r\n$3\r\nx',\r\n"},
+		{[]string{"LPUSH", "l", "x", "y"}, ":2\r\n"},
+		{[]string{"LPUSH", "l", "z"}, ":3\r\n"},
+		{[]string{"LLEN", "l"}, ":3\r\n"},
+		{[]string{"LLEN", "missing"}, ":0\r\n"},
+		{[]string{"GET", "s"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"KEYS", "[ab]"}, ""},
+		{[]string{"DEL", "a", "missing"}, ":1\r\n"},
+		{[]string{"NOSUCH"}, "-ERR unknown command 'NOSUCH'\r\n"},
+	}
+	for _, c := range cases {
+		got := send(c.args...)
+		if c.args[0] == "KEYS" {
+			if got != "*2\r\n$1\r\na\r\n$1\r\nb\r\n" && got != "*2\r\n$1\r\nb\r\n$1\r\na\r\n" {
+				t.Errorf("KEYS: %q", got)
+			}
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%v: %q, want %q", c.args, got, c.want)
+		}
+	}
+
+	// Pipelined and inline commands
+	conn.Write([]byte("*1\r\n$4\r\nPING\r\nPING\r\nECHO x\r\n"))
+	for _, want := range []string{"+PONG\r\n", "+PONG\r\n", "$1\r\n"} {
+		if line, _ := reader.ReadString('\n'); line != want {
+			t.Errorf("pipeline: %q, want %q", line, want)
+		}
+	}
+
+	// Broken lengths are errors, not panics or allocations of what they say
+	for _, request := range []string{
+		"*-1\r\n",
+		"*1\r\n$-5\r\n",
+		"*1048576\r\n",
+		"*1\r\n$536870912\r\nabc",
+		strings.Repeat("x", respMaxLine+1) + "\r\n",
+	} {
+		if _, err := readRESP(bufio.NewReader(strings.NewReader(request))); err == nil {
+			t.Errorf("%.20q was read", request)
+		}
+	}
+	if args, err := readRESP(bufio.NewReader(strings.NewReader("*1\r\n$70000\r\n" + strings.Repeat("v", 70000) + "\r\n"))); err != nil || len(args[0]) != 70000 {
+		t.Errorf("A big bulk string wasn't read: %v", err)
+	}
+	bad, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("*-1\r\n"))
+	if line, _ := bufio.NewReader(bad).ReadString('\n'); !strings.HasPrefix(line, "-ERR Protocol error") {
+		t.Errorf("A negative length got %q", line)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	p := NewProxy(listener.Addr().String())
+	p.WSMAXMESSAGE = 1024
+	server := httptest.NewServer(p.HTTPHandler())
+	defer server.Close()
+
+	dial := func(origin string) (net.Conn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := "GET /ws HTTP/1.1\r\nHost: " + server.Listener.Addr().String() + "\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+		if origin != "" {
+			request += "Origin: " + origin + "\r\n"
+		}
+		conn.Write([]byte(request + "\r\n"))
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			conn.Close()
+			return nil, nil, resp.Status
+		}
+		return conn, reader, resp.Header.Get("Sec-WebSocket-Accept")
+	}
+	// Frames of a client are masked
+	write := func(conn net.Conn, opcode byte, fin bool, payload []byte) {
+		head := opcode
+		if fin {
+			head |= 0x80
+		}
+		frame := []byte{head}
+		if len(payload) < 126 {
+			frame = append(frame, 0x80|byte(len(payload)))
+		} else {
+			frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+		}
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+		conn.Write(frame)
+	}
+	read := func(reader *bufio.Reader) (byte, []byte) {
+		var head [2]byte
+		if _, err := io.ReadFull(reader, head[:]); err != nil {
+			t.Fatal(err)
+		}
+		n := int(head[1] & 0x7F)
+		if n == 126 {
+			var ext [2]byte
+			io.ReadFull(reader, ext[:])
+			n = int(ext[0])<<8 | int(ext[1])
+		}
+		payload := make([]byte, n)
+		io.ReadFull(reader, payload)
+		return head[0] & 0x0F, payload
+	}
+	command := func(conn net.Conn, reader *bufio.Reader, mes CommandMessage) ResponseMessage {
+		body, _ := json.Marshal(mes)
+		write(conn, wsText, true, body)
+		var response ResponseMessage
+		if opcode, payload := read(reader); opcode != wsText || json.Unmarshal(payload, &response) != nil {
+			t.Fatalf("unexpected frame %d %q", opcode, payload)
+		}
+		return response
+	}
+
+	conn, reader, accept := dial("")
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s", accept)
+	}
+	defer conn.Close()
+
+	if r := command(conn, reader, CommandMessage{Name: "SET", Arguments: []string{"a", "1"}}); r.Code != _OK {
+		t.Errorf("SET over a WebSocket: %s", r.StatusMessage)
+	}
+	if r := command(conn, reader, CommandMessage{Name: "GET", Arguments: []string{"a"}}); r.Value != "1" {
+		t.Errorf("GET over a WebSocket: %q", r.Value)
+	}
+
+	// Fragments make a message, pings are answered between them
+	body, _ := json.Marshal(CommandMessage{Name: "ECHO", Arguments: []string{"fragmented"}})
+	write(conn, wsText, false, body[:5])
+	write(conn, wsPing, true, []byte("ping"))
+	write(conn, wsContinuation, true, body[5:])
+	if opcode, payload := read(reader); opcode != wsPong || string(payload) != "ping" {
+		t.Errorf("ping: %d %q", opcode, payload)
+	}
+	var response ResponseMessage
+	if _, payload := read(reader); json.Unmarshal(payload, &response) != nil || response.Value != "fragmented" {
+		t.Errorf("fragmented message: %q", payload)
+	}
+
+	// Messages over WSMAXMESSAGE close the connection
+	write(conn, wsText, true, make([]byte, 2000))
+	if opcode, payload := read(reader); opcode != wsClose || string(payload) != "\x03\xf1" {
+		t.Errorf("too big message: %d %q", opcode, payload)
+	}
+
+	// Pages of other sites can't connect unless allowed
+	if _, _, status := dial("http://evil.example"); !strings.HasPrefix(status, "403") {
+		t.Errorf("other origin: %s", status)
+	}
+	p.ORIGINS = []string{"http://app.example"}
+	if conn, _, _ := dial("http://app.example"); conn == nil {
+		t.Error("allowed origin was refused")
+	} else {
+		conn.Close()
+	}
+}
+
+func TestFraming(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	conn.Write([]byte(framePreamble))
+	reader := bufio.NewReader(conn)
+	answer := make([]byte, len(framePreamble))
+	if _, err := io.ReadFull(reader, answer); err != nil || string(answer) != framePreamble {
+		t.Fatal("slave doesn't answer the preamble", answer, err)
+	}
+
+	codec := &frameCodec{reader: reader, conn: conn}
+	send := func(mes CommandMessage) {
+		body := encodeCommand(mes)
+		frame := make([]byte, 4, 4+len(body))
+		binary.BigEndian.PutUint32(frame, uint32(len(body)))
+		conn.Write(append(frame, body...))
+	}
+	receive := func() ResponseMessage {
+		var size [4]byte
+		if _, err := io.ReadFull(codec.reader, size[:]); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(codec.reader, b); err != nil {
+			t.Fatal(err)
+		}
+		response, err := decodeResponse(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	value := "\xff\x00potato\xfe"
+	send(CommandMessage{Name: "SET", Arguments: []string{"key", value}, TTL: -1})
+	if response := receive(); response.Code != _OK {
+		t.Fatal("framed SET failed", response)
+	}
+	send(CommandMessage{Name: "GET", Arguments: []string{"key"}})
+	if response := receive(); response.Code != _OK || response.Value != value {
+		t.Fatal("framed GET returned", response)
+	}
+	send(CommandMessage{Name: "GET", Arguments: []string{"missing"}})
+	if response := receive(); response.Code != _NK {
+		t.Fatal("framed GET of a missing key returned", response)
+	}
+
+	send(CommandMessage{Name: "KEYS", Stream: true})
+	keys := ""
+	for {
+		response := receive()
+		keys += response.Value
+		if !response.More {
+			break
+		}
+	}
+	if !strings.Contains(keys, "key") {
+		t.Fatal("framed stream of KEYS returned", keys)
+	}
+
+	send(CommandMessage{Name: "SUBSCRIBE", Arguments: []string{"key"}})
+	if response := receive(); response.Code != _WA {
+		t.Fatal("framed SUBSCRIBE returned", response)
+	}
+
+	// JSON stays the default, values that aren't UTF-8 only survive frames
+	send(CommandMessage{Name: "SET", Arguments: []string{"plain", "potato"}, TTL: -1})
+	receive()
+	plain, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(time.Second * 10))
+	json.NewEncoder(plain).Encode(CommandMessage{Name: "GET", Arguments: []string{"plain"}})
+	var response ResponseMessage
+	if err := json.NewDecoder(plain).Decode(&response); err != nil || response.Value != "potato" {
+		t.Fatal("JSON GET returned", response, err)
+	}
+
+	// A length without the bytes doesn't allocate what it says
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, maxFrame)
+	broken := &frameCodec{reader: bufio.NewReader(bytes.NewReader(append(header, "abc"...)))}
+	var mes CommandMessage
+	if err := broken.Decode(&mes); err == nil {
+		t.Error("A short frame was decoded")
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("A short frame allocated %d bytes", grown)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	// Everything is written before anything is read
+	encoder := json.NewEncoder(conn)
+	encoder.Encode(CommandMessage{Name: "SET", Arguments: []string{"key", "value"}, TTL: -1, RequestID: 1})
+	encoder.Encode(CommandMessage{Name: "NOSUCHCOMMAND", RequestID: 2})
+	encoder.Encode(CommandMessage{Name: "SET", Arguments: []string{"key", "value"}, TTL: -1, Seq: 5, RequestID: 3})
+	encoder.Encode(CommandMessage{Name: "KEYS", Stream: true, RequestID: 4})
+	encoder.Encode(CommandMessage{Name: "GET", Arguments: []string{"key"}})
+
+	decoder := json.NewDecoder(conn)
+	for _, want := range []struct {
+		id   uint64
+		code uint
+	}{{1, _OK}, {2, _UC}, {3, _SQ}, {4, _OK}, {4, _OK}, {0, _OK}} {
+		var response ResponseMessage
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.RequestID != want.id || response.Code != want.code {
+			t.Errorf("Expected request %d with %d, got %+v", want.id, want.code, response)
+		}
+	}
+
+	body := encodeResponse(ResponseMessage{RequestID: 1 << 40})
+	if response, err := decodeResponse(body); err != nil || response.RequestID != 1<<40 {
+		t.Error("RequestID doesn't survive a frame", response, err)
+	}
+	if mes, err := decodeCommand(encodeCommand(CommandMessage{RequestID: 7})); err != nil || mes.RequestID != 7 {
+		t.Error("RequestID of a command doesn't survive a frame", mes, err)
+	}
+}
+
+func TestBindAddrs(t *testing.T) {
+
+	s := NewSlave("::1", "6000", time.Second, time.Minute, time.Millisecond*100, -1)
+	if addrs := s.bindAddrs(); len(addrs) != 1 || addrs[0] != ":6000" {
+		t.Errorf("Wrong default bind address: %v", addrs)
+	}
+	s.BINDADDRS = []string{"10.0.0.1", "::1", "[::]", "127.0.0.1:7000"}
+	want := []string{"10.0.0.1:6000", "[::1]:6000", "[::]:6000", "127.0.0.1:7000"}
+	if addrs := s.bindAddrs(); strings.Join(addrs, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, addrs)
+	}
+	if s.advertised() != "[::1]:6000" {
+		t.Errorf("Wrong advertised address %s", s.advertised())
+	}
+
+	s = NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.BINDADDRS = []string{"127.0.0.1", "127.0.0.2"}
+	if probe, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		probe.Close()
+		s.BINDADDRS = append(s.BINDADDRS, "[::1]")
+	}
+	listener, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, ok := listener.(*multiListener)
+	if !ok {
+		t.Fatalf("Expected a listener for every address, got %T", listener)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	for _, l := range multi.listeners {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		json.NewEncoder(conn).Encode(CommandMessage{Name: "PING"})
+		var response ResponseMessage
+		if err := json.NewDecoder(conn).Decode(&response); err != nil || response.Code != _OK {
+			t.Errorf("PING on %s failed: %+v %v", l.Addr(), response, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestGetStream(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.STREAMCHUNK = 1000
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+
+	raw := make([]byte, 10000)
+	for i := range raw {
+		raw[i] = byte(i * 7)
+	}
+	value := base64.StdEncoding.EncodeToString(raw)
+	key := base64.StdEncoding.EncodeToString([]byte("big"))
+	var response ResponseMessage
+	encoder.Encode(CommandMessage{Name: "SET", Arguments: []string{key, value}, TTL: -1, Binary: true})
+	decoder.Decode(&response)
+
+	// Every frame of a binary value is base64 of its own
+	stream := func(mes CommandMessage) (string, int) {
+		encoder.Encode(mes)
+		all, frames := "", 0
+		for {
+			response = ResponseMessage{}
+			if err := decoder.Decode(&response); err != nil || response.Code != _OK {
+				t.Fatal("Streamed GET failed", response, err)
+			}
+			if mes.Binary {
+				b, err := base64.StdEncoding.DecodeString(response.Value)
+				if err != nil || len(response.Value) > s.STREAMCHUNK || !response.Binary {
+					t.Fatalf("Frame %d can't be decoded alone: %v", frames, err)
+				}
+				all += string(b)
+			} else {
+				if len(response.Value) > s.STREAMCHUNK {
+					t.Fatalf("Frame %d has %d bytes", frames, len(response.Value))
+				}
+				all += response.Value
+			}
+			if !response.More {
+				return all, frames
+			}
+			frames++
+		}
+	}
+	if all, frames := stream(CommandMessage{Name: "GET", Arguments: []string{key}, Stream: true, Binary: true}); all != string(raw) || frames != 14 {
+		t.Errorf("Binary value came wrong in %d frames", frames)
+	}
+	text := strings.Repeat("картошка ", 1000)
+	encoder.Encode(CommandMessage{Name: "SET", Arguments: []string{"text", text}, TTL: -1})
+	decoder.Decode(&response)
+	if all, frames := stream(CommandMessage{Name: "GET", Arguments: []string{"text"}, Stream: true}); all != text || frames < 17 {
+		t.Errorf("Value came wrong in %d frames", frames)
+	}
+
+	encoder.Encode(CommandMessage{Name: "GET", Arguments: []string{"missing"}, Stream: true, Protocol: 2})
+	response = ResponseMessage{}
+	if decoder.Decode(&response); response.Code != _NK || response.More || !response.Nil {
+		t.Errorf("Expected _NK in one message for a missing key, got %+v", response)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 that is its
+// own CA and good for both servers and clients.
+func writeTestCert(t *testing.T, dir string) (string, string, tls.Certificate) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "potato"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, certPEM, 0600)
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert
+}
+
+func TestTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath, cert := writeTestCert(t, dir)
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.BINDADDRS = []string{"127.0.0.1"}
+	s.TLSPORT, s.TLSCERT, s.TLSKEY, s.TLSCLIENTCA = "0", certPath, keyPath, certPath
+	listener, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+	plainAddr := listener.(*multiListener).listeners[0].Addr().String()
+	tlsAddr := listener.(*multiListener).listeners[1].Addr().String()
+
+	pool := x509.NewCertPool()
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool.AddCert(leaf)
+
+	ping := func(conn net.Conn) error {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		if err := json.NewEncoder(conn).Encode(CommandMessage{Name: "PING"}); err != nil {
+			return err
+		}
+		var response ResponseMessage
+		if err := json.NewDecoder(conn).Decode(&response); err != nil {
+			return err
+		}
+		if response.Code != _OK {
+			return errors.New(response.StatusMessage)
+		}
+		return nil
+	}
+
+	conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(conn); err != nil {
+		t.Errorf("PING over TLS failed: %s", err)
+	}
+
+	// Without a certificate of the client the connection fails
+	if conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: pool}); err == nil {
+		if ping(conn) == nil {
+			t.Errorf("A client without a certificate was served")
+		}
+	}
+
+	// Other nodes still speak plain
+	plain, err := net.Dial("tcp", plainAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(plain); err != nil {
+		t.Errorf("Plain PING failed: %s", err)
+	}
+	if !s.features()["tls"] {
+		t.Errorf("TLS isn't reported in features")
+	}
+
+	s.TLSKEY = certPath
+	if _, err := s.listen(); err == nil {
+		t.Errorf("A broken key was accepted")
+	}
+}
+
+func TestACL(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	body, _ := json.Marshal(map[string]userACL{
+		"admin":     {Password: HashPassword("secret"), Admin: true},
+		"dashboard": {Password: HashPassword("look"), Keyspace: "admin", ReadOnly: true, Prefixes: []string{"metrics:"}},
+		"getter":    {Password: HashPassword("get"), Commands: []string{"GET"}},
+	})
+	ioutil.WriteFile(path, body, 0600)
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	if err := s.LoadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	connect := func() func(name string, args ...string) ResponseMessage {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+		return func(name string, args ...string) ResponseMessage {
+			encoder.Encode(CommandMessage{Name: name, Arguments: args, TTL: -1})
+			var response ResponseMessage
+			if err := decoder.Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			return response
+		}
+	}
+
+	admin := connect()
+	if response := admin("GET", "metrics:cpu"); response.Code != _AU {
+		t.Errorf("Expected _AU before AUTH, got %s", response.StatusMessage)
+	}
+	if response := admin("PING"); response.Code != _OK {
+		t.Errorf("PING needs no AUTH, got %s", response.StatusMessage)
+	}
+	if response := admin("AUTH", "admin", "wrong"); response.Code != _AU {
+		t.Errorf("Wrong password was accepted")
+	}
+	if response := admin("AUTH", "admin", "secret"); response.Code != _OK {
+		t.Fatalf("AUTH failed: %s", response.StatusMessage)
+	}
+	admin("SET", "metrics:cpu", "42")
+	admin("SET", "secret", "value")
+
+	dashboard := connect()
+	dashboard("AUTH", "dashboard", "look")
+	if response := dashboard("GET", "metrics:cpu"); response.Code != _OK || response.Value != "42" {
+		t.Errorf("Dashboard can't read the keyspace of admin: %+v", response)
+	}
+	for _, args := range [][]string{{"SET", "metrics:cpu", "0"}, {"GET", "secret"}, {"KEYS"}, {"SYNC"}} {
+		if response := dashboard(args[0], args[1:]...); response.Code != _NP {
+			t.Errorf("Expected _NP for %v, got %s", args, response.StatusMessage)
+		}
+	}
+
+	getter := connect()
+	getter("AUTH", "getter", "get")
+	if response := getter("GET", "anything"); response.Code != _NK {
+		t.Errorf("GET is allowed for getter, got %s", response.StatusMessage)
+	}
+	if response := getter("SET", "anything", "1"); response.Code != _NP {
+		t.Errorf("Expected _NP for SET of getter, got %s", response.StatusMessage)
+	}
+
+	// Keys under a prefix of arguments in base64 are checked decoded
+	acl := userACL{Prefixes: []string{"metrics:"}}
+	key := base64.StdEncoding.EncodeToString([]byte("metrics:mem"))
+	if !acl.allows(CommandMessage{Name: "GET", Arguments: []string{key}, Binary: true}) {
+		t.Errorf("Binary key under the prefix isn't allowed")
+	}
+	if acl.allows(CommandMessage{Name: "SUNIONSTORE", Arguments: []string{"metrics:all", "other"}}) {
+		t.Errorf("Every key of SUNIONSTORE has to be under the prefix")
+	}
+	if acl.allows(CommandMessage{Name: "PFCOUNT", Arguments: []string{"metrics:h", "secret:h"}}) {
+		t.Errorf("Every key of PFCOUNT has to be under the prefix")
+	}
+	if !acl.allows(CommandMessage{Name: "PFCOUNT", Arguments: []string{"metrics:h", "metrics:g"}}) {
+		t.Errorf("PFCOUNT of keys under the prefix isn't allowed")
+	}
+
+	// Redis clients log in with AUTH too
+	resp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+	go s.ServeRESP(resp)
+	conn, err := net.Dial("tcp", resp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	reader := bufio.NewReader(conn)
+	for _, step := range []struct{ command, reply string }{
+		{"GET metrics:cpu\r\n", "-NOAUTH"},
+		{"AUTH dashboard nope\r\n", "-WRONGPASS"},
+		{"AUTH dashboard look\r\n", "+OK"},
+		{"GET secret\r\n", "-NOPERM"},
+		{"GET metrics:cpu\r\n", "$2"},
+	} {
+		conn.Write([]byte(step.command))
+		line, _ := reader.ReadString('\n')
+		if !strings.HasPrefix(line, step.reply) {
+			t.Errorf("%q got %q instead of %s", step.command, line, step.reply)
+		}
+		if strings.HasPrefix(line, "$") {
+			reader.ReadString('\n')
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	body, _ := json.Marshal(map[string]userACL{
+		"admin":   {Password: HashPassword("secret"), Admin: true},
+		"service": {Password: HashPassword("pass"), Prefixes: []string{"jobs:"}},
+		"other":   {Password: HashPassword("pass")},
+	})
+	ioutil.WriteFile(path, body, 0600)
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.TOKENSPATH = filepath.Join(dir, "tokens.json")
+	s.LoadUsers(path)
+
+	service := &session{}
+	if response := s.tokencommand(service, CommandMessage{Arguments: []string{"CREATE"}}); response.Code != _AU {
+		t.Errorf("Expected _AU for TOKEN before AUTH, got %s", response.StatusMessage)
+	}
+	s.auth(service, CommandMessage{Arguments: []string{"service", "pass"}})
+	response := s.tokencommand(service, CommandMessage{Arguments: []string{"CREATE"}})
+	if response.Code != _OK || !strings.HasPrefix(response.Value, tokenPrefix) {
+		t.Fatalf("TOKEN CREATE failed: %s", response.StatusMessage)
+	}
+	token := response.Value
+	if response := s.tokencommand(service, CommandMessage{Arguments: []string{"CREATE", "other"}}); response.Code != _NP {
+		t.Errorf("A restricted user made a token of another one: %s", response.StatusMessage)
+	}
+
+	// The token logs in as the user, ACL included, and survives a restart
+	restarted := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	restarted.LoadUsers(path)
+	if err := restarted.LoadTokens(s.TOKENSPATH); err != nil {
+		t.Fatal(err)
+	}
+	sess := &session{}
+	if response := restarted.auth(sess, CommandMessage{Arguments: []string{token}}); response.Code != _OK || sess.login != "service" {
+		t.Fatalf("AUTH with a token failed: %s", response.StatusMessage)
+	}
+	if _, ok := restarted.permit(sess, CommandMessage{Name: "GET", Arguments: []string{"other"}}); ok {
+		t.Errorf("The token isn't restricted like its user")
+	}
+	if response := restarted.auth(&session{}, CommandMessage{Arguments: []string{token + "x"}}); response.Code != _AU {
+		t.Errorf("A wrong secret was accepted")
+	}
+
+	admin := &session{}
+	restarted.auth(admin, CommandMessage{Arguments: []string{"admin", "secret"}})
+	response = restarted.tokencommand(admin, CommandMessage{Arguments: []string{"CREATE", "other", "60"}})
+	if response.Code != _OK {
+		t.Fatalf("Admin can't make a token of another user: %s", response.StatusMessage)
+	}
+	expiring := response.Value
+	var list []tokenInfo
+	json.Unmarshal([]byte(restarted.tokencommand(admin, CommandMessage{Arguments: []string{"LIST"}}).Value), &list)
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 tokens, got %v", list)
+	}
+	restarted.clock = func() time.Time { return time.Now().Add(time.Minute * 2) }
+	if response := restarted.auth(&session{}, CommandMessage{Arguments: []string{expiring}}); response.Code != _AU {
+		t.Errorf("An expired token was accepted")
+	}
+	restarted.clock = time.Now
+
+	id := strings.SplitN(strings.TrimPrefix(token, tokenPrefix), ".", 2)[0]
+	if response := restarted.tokencommand(admin, CommandMessage{Arguments: []string{"REVOKE", id}}); response.Code != _OK {
+		t.Errorf("TOKEN REVOKE failed: %s", response.StatusMessage)
+	}
+	if response := restarted.auth(&session{}, CommandMessage{Arguments: []string{token}}); response.Code != _AU {
+		t.Errorf("A revoked token was accepted")
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	body, _ := json.Marshal(map[string]userACL{"admin": {Password: HashPassword("secret")}})
+	ioutil.WriteFile(path, body, 0600)
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.LoadUsers(path)
+	s.AUTHMAXFAILURES = 3
+	now := time.Now()
+	s.clock = func() time.Time { return now }
+
+	login := func(host string, password string) uint {
+		sess := &session{host: host}
+		return s.auth(sess, CommandMessage{Arguments: []string{"admin", password}}).Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := login("10.0.0.1", "guess"); code != _AU {
+			t.Fatalf("A wrong password was accepted")
+		}
+	}
+	if code := login("10.0.0.1", "secret"); code != _AU {
+		t.Errorf("A banned host logged in")
+	}
+	if code := login("10.0.0.2", "secret"); code != _OK {
+		t.Errorf("Another host is banned too")
+	}
+	if s.stats.get("auth_bans") != 1 || s.stats.get("auth_banned") != 1 {
+		t.Errorf("Unexpected stats %v", s.stats.snapshot())
+	}
+	if s.bannedHosts() != 1 {
+		t.Errorf("Expected one banned host, got %d", s.bannedHosts())
+	}
+
+	now = now.Add(s.AUTHBANTIME + time.Second)
+	if code := login("10.0.0.1", "secret"); code != _OK {
+		t.Errorf("The ban didn't end")
+	}
+
+	// Failures spread wider than AUTHBANTIME don't ban
+	for i := 0; i < 5; i++ {
+		login("10.0.0.3", "guess")
+		now = now.Add(s.AUTHBANTIME * 2 / 3)
+	}
+	if code := login("10.0.0.3", "secret"); code != _OK {
+		t.Errorf("Slow failures banned the host")
+	}
+}
+
+func TestAdminRole(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	admin := &session{login: "root", keyspace: "root", acl: &userACL{Admin: true}}
+	regular := &session{login: "app", keyspace: "app", acl: &userACL{}}
+
+	for _, mes := range []CommandMessage{
+		{Name: "BACKUP"},
+		{Name: "BGSAVE"},
+		{Name: "MOVEKEYS", Arguments: []string{"app", "other", "*"}},
+		{Name: "ERASEUSER", Arguments: []string{"other"}},
+		{Name: "SYNC"},
+	} {
+		if _, ok := s.permit(regular, mes); ok {
+			t.Errorf("A regular user may run %s", mes.Name)
+		}
+		if _, ok := s.permit(admin, mes); !ok {
+			t.Errorf("An admin may not run %s", mes.Name)
+		}
+	}
+	if _, ok := s.permit(regular, CommandMessage{Name: "SET", Arguments: []string{"key", "value"}}); !ok {
+		t.Errorf("A regular user may not write its keys")
+	}
+	if !admin.managesTokens("app") || regular.managesTokens("root") {
+		t.Errorf("Only admins manage tokens of others")
+	}
+}
+
+func TestAudit(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.AUDITSIZE = 3
+	s.AUDITPATH = filepath.Join(dir, "audit.log")
+	if err := s.openAudit(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	send := func(name string, args ...string) ResponseMessage {
+		encoder.Encode(CommandMessage{Name: name, Arguments: args, TTL: -1})
+		var response ResponseMessage
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	send("SET", "a", "secret value")
+	send("GET", "a")
+	send("SET", "b", "1")
+	send("DEL", "a")
+	send("MOVEKEYS", "user", "other", "b")
+
+	var entries []auditEntry
+	json.Unmarshal([]byte(send("AUDIT").Value), &entries)
+	if len(entries) != 3 {
+		t.Fatalf("Expected the last 3 entries, got %+v", entries)
+	}
+	if entries[0].Command != "SET" || entries[0].Keys[0] != "b" || entries[0].User != "user" || entries[0].Host != "127.0.0.1" {
+		t.Errorf("Unexpected entry %+v", entries[0])
+	}
+	if entries[2].Command != "MOVEKEYS" || len(entries[2].Arguments) != 3 || entries[2].Code != _OK {
+		t.Errorf("Unexpected entry %+v", entries[2])
+	}
+	json.Unmarshal([]byte(send("AUDIT", "1").Value), &entries)
+	if len(entries) != 1 || entries[0].Command != "AUDIT" {
+		t.Errorf("Expected AUDIT itself, got %+v", entries)
+	}
+
+	// The file has every entry and never a value
+	body, err := ioutil.ReadFile(s.AUDITPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(body), "\n"); lines != 6 {
+		t.Errorf("Expected 6 lines in the file, got %d", lines)
+	}
+	if strings.Contains(string(body), "secret value") {
+		t.Errorf("A value got to the audit log")
+	}
+
+	// Writes refused by a standby or out of sequence are audited too
+	encoder.Encode(CommandMessage{Name: "SET", Arguments: []string{"c", "1"}, Seq: 5})
+	var response ResponseMessage
+	decoder.Decode(&response)
+	atomic.StoreInt32(&s.standby, 1)
+	if response := send("SET", "c", "2"); response.Code != _SB {
+		t.Fatalf("Expected _SB from a standby, got %s", response.StatusMessage)
+	}
+	atomic.StoreInt32(&s.standby, 0)
+	entries = nil
+	json.Unmarshal([]byte(send("AUDIT", "2").Value), &entries)
+	if len(entries) != 2 || entries[0].Code != _SQ || entries[1].Code != _SB || entries[0].Command != "SET" {
+		t.Errorf("Refused writes weren't audited: %+v", entries)
+	}
+}
+
+func TestGrants(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "grants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	body, _ := json.Marshal(map[string]userACL{
+		"root":  {Password: HashPassword("root"), Admin: true},
+		"alice": {Password: HashPassword("alice")},
+		"bob":   {Password: HashPassword("bob")},
+	})
+	ioutil.WriteFile(path, body, 0600)
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.LoadUsers(path)
+	s.GRANTSPATH = filepath.Join(dir, "grants.json")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+	connect := func(name string) func(name string, args ...string) ResponseMessage {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+		send := func(name string, args ...string) ResponseMessage {
+			encoder.Encode(CommandMessage{Name: name, Arguments: args, TTL: -1})
+			var response ResponseMessage
+			if err := decoder.Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			return response
+		}
+		send("AUTH", name, name)
+		return send
+	}
+
+	alice, bob, root := connect("alice"), connect("bob"), connect("root")
+	alice("SET", "public:report", "42")
+	alice("SET", "private:diary", "secret")
+
+	if response := bob("USE", "alice"); response.Code != _NP {
+		t.Errorf("USE without a grant: %s", response.StatusMessage)
+	}
+	if response := alice("GRANT", "ADD", "alice", "public:", "bob"); response.Code != _NP {
+		t.Errorf("A regular user granted keys: %s", response.StatusMessage)
+	}
+	if response := root("GRANT", "ADD", "alice", "public:", "bob"); response.Code != _OK {
+		t.Fatalf("GRANT ADD failed: %s", response.StatusMessage)
+	}
+
+	if response := bob("USE", "alice"); response.Code != _OK {
+		t.Fatalf("USE with a grant failed: %s", response.StatusMessage)
+	}
+	if response := bob("GET", "public:report"); response.Code != _OK || response.Value != "42" {
+		t.Errorf("Bob can't read the granted key: %+v", response)
+	}
+	for _, args := range [][]string{
+		{"GET", "private:diary"}, {"SET", "public:report", "0"}, {"KEYS"},
+		{"PFCOUNT", "public:visits", "private:visits"},
+	} {
+		if response := bob(args[0], args[1:]...); response.Code != _NP {
+			t.Errorf("Expected _NP for %v, got %s", args, response.StatusMessage)
+		}
+	}
+	if response := bob("PFCOUNT", "public:visits", "public:clicks"); response.Code == _NP {
+		t.Errorf("PFCOUNT of granted keys isn't allowed")
+	}
+
+	// Grants are kept in GRANTSPATH and revoked at once
+	restarted := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	if err := restarted.LoadGrants(s.GRANTSPATH); err != nil || len(restarted.users.grants) != 1 {
+		t.Errorf("Grants weren't saved: %v %v", err, restarted.users.grants)
+	}
+	root("GRANT", "DEL", "alice", "public:", "bob")
+	if response := bob("GET", "public:report"); response.Code != _NP {
+		t.Errorf("A revoked grant still works: %s", response.StatusMessage)
+	}
+	bob("USE")
+	bob("SET", "own", "1")
+	if response := bob("GET", "own"); response.Value != "1" {
+		t.Errorf("USE didn't go back to own keys: %+v", response)
+	}
+}
+
+func TestUserLocks(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	a, b := "a", "b"
+	for i := 0; shardOf(a) == shardOf(b); i++ {
+		b = "b" + strconv.Itoa(i)
+	}
+	s.storage.AddUser(a)
+	s.storage.AddUser(b)
+
+	// A held shard doesn't stop users of other shards
+	unlock := s.lockUser(a)
+	other, same := make(chan ResponseMessage), make(chan ResponseMessage)
+	go func() { other <- s.invoke(b, CommandMessage{Name: "SET", Arguments: []string{"k", "v"}, TTL: -1}) }()
+	go func() { same <- s.invoke(a, CommandMessage{Name: "GET", Arguments: []string{"k"}}) }()
+	select {
+	case response := <-other:
+		if response.Code != _OK {
+			t.Errorf("SET failed: %s", response.StatusMessage)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("A user of another shard waited for the lock")
+	}
+	select {
+	case <-same:
+		t.Errorf("A user of the held shard didn't wait")
+	case <-time.After(time.Millisecond * 50):
+	}
+	unlock()
+	<-same
+
+	// Users of the same and of different shards write at once
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			user := "user" + strconv.Itoa(w%4)
+			for i := 0; i < 200; i++ {
+				key := strconv.Itoa(w) + ":" + strconv.Itoa(i%10)
+				s.invoke(user, CommandMessage{Name: "SET", Arguments: []string{key, strconv.Itoa(i)}, TTL: time.Minute})
+				if response := s.invoke(user, CommandMessage{Name: "GET", Arguments: []string{key}}); response.Value != strconv.Itoa(i) {
+					t.Errorf("Expected %d at %s, got %+v", i, key, response)
+					return
+				}
+				if i%3 == 0 {
+					s.invoke(user, CommandMessage{Name: "DEL", Arguments: []string{key}})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.storageMutex.Lock()
+	queued := len(s.scheduled)
+	s.storageMutex.Unlock()
+	if queued == 0 {
+		t.Errorf("Writes under lockUser weren't scheduled to expire")
+	}
+}
+
+func TestReadLocks(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.authConnection(nil)
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "v"}, TTL: -1})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"h", "f", "v"}, TTL: -1})
+
+	// Readers of a user don't wait for each other, writers wait for them
+	unlock := s.rlockUser("user")
+	read, write := make(chan ResponseMessage), make(chan ResponseMessage)
+	go func() {
+		for _, mes := range []CommandMessage{
+			{Name: "GET", Arguments: []string{"k"}},
+			{Name: "HGET", Arguments: []string{"h", "f"}},
+			{Name: "HGETALL", Arguments: []string{"h"}},
+			{Name: "KEYS"},
+		} {
+			read <- s.invoke("user", mes)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		select {
+		case response := <-read:
+			if response.Code != _OK {
+				t.Errorf("Read failed: %s", response.StatusMessage)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("A read waited for another one")
+		}
+	}
+	go func() { write <- s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"k", "w"}, TTL: -1}) }()
+	select {
+	case <-write:
+		t.Errorf("A write didn't wait for a read")
+	case <-time.After(time.Millisecond * 50):
+	}
+	unlock()
+	<-write
+
+	if response := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"k"}}); response.Value != "w" {
+		t.Errorf("Expected the write after the read, got %+v", response)
+	}
+}
+
+func TestConcurrentPush(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.authConnection(nil)
+
+	// Pushes and fields racing for a new key all land in one object
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				s.invoke("user", CommandMessage{Name: "LPUSH", Arguments: []string{"list", "v"}, TTL: -1})
+				s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"hash", strconv.Itoa(w*50 + i), "v"}, TTL: -1})
+				if i%10 == 0 {
+					s.invoke("user", CommandMessage{Name: "DEL", Arguments: []string{"other"}})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if n := len(s.storage.Get("user", "list").(*plist).list); n != 400 {
+		t.Errorf("Expected 400 pushed values, got %d", n)
+	}
+	if n := len(s.storage.Get("user", "hash").(*pmap).ourmap); n != 400 {
+		t.Errorf("Expected 400 fields, got %d", n)
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second, time.Minute, time.Millisecond*100, -1)
+	s.authConnection(nil)
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"s", "v"}, TTL: -1})
+	s.invoke("user", CommandMessage{Name: "HSET", Arguments: []string{"h", "f", "v"}, TTL: -1})
+
+	for _, c := range []struct {
+		mes  CommandMessage
+		code uint
+	}{
+		{CommandMessage{Name: "GET"}, _WA},
+		{CommandMessage{Name: "HGET", Arguments: []string{"h", "f", "g"}}, _WA},
+		{CommandMessage{Name: "GET", Arguments: []string{"h"}}, _WT},
+		{CommandMessage{Name: "LSET", Arguments: []string{"s", "0", "v"}}, _WT},
+		{CommandMessage{Name: "HGETDEL", Arguments: []string{"s", "f"}}, _WT},
+		{CommandMessage{Name: "LGET", Arguments: []string{"none", "0"}}, _NK},
+		{CommandMessage{Name: "HGETEX", Arguments: []string{"none", "f"}}, _NK},
+		// valid is checked before the key
+		{CommandMessage{Name: "HEXPIRE", Arguments: []string{"none", "f", "0"}}, _WA},
+		{CommandMessage{Name: "HEXPIRE", Arguments: []string{"none", "f", "60"}}, _NK},
+		// Writes that create keys don't mind missing ones or other types
+		{CommandMessage{Name: "LPUSH", Arguments: []string{"s", "v"}, TTL: -1}, _OK},
+		{CommandMessage{Name: "LGET", Arguments: []string{"s", "0"}}, _OK},
+		{CommandMessage{Name: "DEL", Arguments: []string{"none"}}, _OK},
+	} {
+		if response := s.invoke("user", c.mes); response.Code != c.code {
+			t.Errorf("%s %v: expected %d, got %s", c.mes.Name, c.mes.Arguments, c.code, response.StatusMessage)
+		}
+	}
+
+	// Every spec names a type typeOf knows
+	for name, spec := range keyCommands {
+		if spec.kind == "" {
+			continue
+		}
+		found := false
+		for _, val := range []potat{&pstring{}, &plist{}, &pmap{}, &pset{}, &pzset{}, &pcounter{}, &pbitmap{}, &papprox{}, &pstream{}, &pjson{}} {
+			found = found || typeOf(val) == spec.kind
+		}
+		if !found {
+			t.Errorf("%s expects an unknown type %s", name, spec.kind)
+		}
+	}
+
+	// A dead key read by a spec is gone after the read
+	s.invoke("user", CommandMessage{Name: "SET", Arguments: []string{"dead", "v"}, TTL: time.Millisecond})
+	time.Sleep(time.Millisecond * 5)
+	if response := s.invoke("user", CommandMessage{Name: "GET", Arguments: []string{"dead"}}); response.Code != _NK {
+		t.Errorf("Expected _NK for a dead key, got %s", response.StatusMessage)
+	}
+	s.storageMutex.Lock()
+	left := s.storage.Get("user", "dead")
+	s.storageMutex.Unlock()
+	if left != nil {
+		t.Errorf("A dead key is left after a read")
+	}
+}
+
+func TestWorkers(t *testing.T) {
+
+	s := NewSlave("localhost", "0", time.Second*5, time.Minute, time.Millisecond*100, -1)
+	s.SetWorkers(1)
+	s.SetMaxConnections(2)
+	s.WORKERWAIT = time.Millisecond * 200
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	resp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+	go s.ServeRESP(resp)
+	go func() {
+		defer func() { recover() }()
+		s.Serve(listener)
+	}()
+
+	type client struct {
+		conn net.Conn
+		set  func() ResponseMessage
+		ping func() ResponseMessage
+	}
+	dial := func() client {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+		send := func(mes CommandMessage) func() ResponseMessage {
+			return func() ResponseMessage {
+				var response ResponseMessage
+				encoder.Encode(mes)
+				decoder.Decode(&response)
+				return response
+			}
+		}
+		return client{
+			conn: conn,
+			set:  send(CommandMessage{Name: "SET", Arguments: []string{"k", "v"}}),
+			ping: send(CommandMessage{Name: "PING"}),
+		}
+	}
+
+	// Connections come back when clients close them, RESP ones too
+	for i := 0; i < 10; i++ {
+		c := dial()
+		if response := c.set(); response.Code != _OK {
+			t.Fatalf("Connection %d wasn't served: %s", i, response.StatusMessage)
+		}
+		c.conn.Close()
+
+		r, err := net.Dial("tcp", resp.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetDeadline(time.Now().Add(time.Second * 10))
+		r.Write([]byte("SET r 1\r\n"))
+		if line, _ := bufio.NewReader(r).ReadString('\n'); line != "+OK\r\n" {
+			t.Fatalf("RESP connection %d got %q", i, line)
+		}
+		r.Close()
+	}
+
+	// Idle connections don't hold the worker
+	a, b := dial(), dial()
+	defer a.conn.Close()
+	defer b.conn.Close()
+	for i, c := range []client{a, b, a, b} {
+		if response := c.set(); response.Code != _OK {
+			t.Fatalf("Command %d waited for an idle connection: %s", i, response.StatusMessage)
+		}
+	}
+	if busy := atomic.LoadInt64(&s.busyWorkers); busy != 0 {
+		t.Errorf("Idle connections hold %d workers", busy)
+	}
+
+	// No more than MAXCONNECTIONS connections are open at once
+	c := dial()
+	if response := c.set(); response.Code != _NW {
+		t.Errorf("Expected _NW for a connection over the limit, got %s", response.StatusMessage)
+	}
+	c.conn.Close()
+
+	// A command waits for a busy worker, cheap ones don't
+	<-s.availableWorkers
+	if response := a.set(); response.Code != _NW {
+		t.Errorf("Expected _NW without workers, got %s", response.StatusMessage)
+	}
+	if response := a.ping(); response.Code != _OK {
+		t.Errorf("PING needed a worker: %s", response.StatusMessage)
+	}
+	s.availableWorkers <- true
+	if response := a.set(); response.Code != _OK {
+		t.Errorf("The worker wasn't taken again: %s", response.StatusMessage)
+	}
+
+	a.conn.Close()
+	d := dial()
+	defer d.conn.Close()
+	if response := d.set(); response.Code != _OK {
+		t.Errorf("A closed connection didn't give its place back: %s", response.StatusMessage)
+	}
+	if s.stats.get("connections_refused") != 1 || s.stats.get("commands_without_worker") != 1 {
+		t.Errorf("Unexpected counters: %v", s.stats.snapshot())
+	}
+}
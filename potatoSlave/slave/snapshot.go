@@ -0,0 +1,899 @@
+package slave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+//////////
+// Snapshots
+//////////
+
+// snapshotObject is a stored object in a form that can be encoded. Fields that
+// are used depend on Type:
+//
+//	string     Strings[0]
+//	list       Strings
+//	hash       Fields, FieldDeath
+//	set        Strings
+//	zset       Strings and Scores of the members in order
+//	counter    Number
+//	bitmap     Bytes
+//	hll        Bytes
+//	stream     Strings and IDs of the entries, LastID, Offsets
+//	json       Strings[0]
+type snapshotObject struct {
+	User        string
+	Key         string
+	Type        string
+	TimeOfDeath time.Time
+
+	Strings    []string
+	Fields     map[string]string
+	FieldDeath map[string]time.Time
+	Scores     []float64
+	Number     int64
+	Bytes      []byte
+	IDs        []uint64
+	LastID     uint64
+	Offsets    map[string]uint64
+}
+
+// snapshotAggregation is a definition of an aggregation, values are computed
+// again on load.
+type snapshotAggregation struct {
+	User   string
+	Name   string
+	Kind   string
+	Prefix string
+	Field  string
+}
+
+// snapshot is everything a slave keeps in memory. LogSeq is the last entry of
+// the append-only log that is already in the snapshot. A delta snapshot only
+// has the keys changed since the full snapshot taken at Base, Deleted are
+// those of them that were gone, see saveDeltaSnapshot.
+type snapshot struct {
+	Taken        time.Time
+	Objects      []snapshotObject
+	Aggregations []snapshotAggregation
+	LogSeq       uint64
+	Base         time.Time
+	Deleted      []UserKey
+}
+
+// Snapshot files start with snapshotMagic and the version of the format, then
+// go the length of the gob of snapshot, the gob itself and its CRC-32:
+//
+//	magic (8) | version (2) | length (8) | gob | crc32 (4)
+//
+// Files without the magic are of version 0, the bare gob before the header
+// was there.
+const (
+	snapshotMagic   = "POTATOSN"
+	snapshotVersion = 1
+)
+
+// encodeSnapshot writes a snapshot in the current format.
+func encodeSnapshot(w io.Writer, snap snapshot) error {
+
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(snap); err != nil {
+		return err
+	}
+
+	header := make([]byte, len(snapshotMagic)+2+8)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[len(snapshotMagic):], snapshotVersion)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+2:], uint64(body.Len()))
+
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, crc32.ChecksumIEEE(body.Bytes()))
+
+	for _, b := range [][]byte{header, body.Bytes(), trailer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSnapshot reads a snapshot of any known version. Truncated and
+// corrupted ones are refused, so nothing is loaded from them.
+func decodeSnapshot(r io.Reader) (snapshot, error) {
+
+	var snap snapshot
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return snap, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap)
+		return snap, err
+	}
+
+	data = data[len(snapshotMagic):]
+	if len(data) < 2+8 {
+		return snap, errors.New("snapshot is truncated")
+	}
+	version := binary.BigEndian.Uint16(data)
+	if version > snapshotVersion {
+		return snap, fmt.Errorf("snapshot format version %d is newer than %d", version, snapshotVersion)
+	}
+	length := binary.BigEndian.Uint64(data[2:])
+	data = data[2+8:]
+	if length > uint64(len(data)) || uint64(len(data))-length < 4 {
+		return snap, errors.New("snapshot is truncated")
+	}
+	body := data[:length]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[length:]) {
+		return snap, errors.New("snapshot checksum doesn't match")
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(body)).Decode(&snap)
+	return snap, err
+}
+
+// snapshotOf copies an object, so that it can be encoded outside of the lock.
+func snapshotOf(user string, key string, val potat) (snapshotObject, error) {
+
+	o := snapshotObject{User: user, Key: key, TimeOfDeath: val.getTimeOfDeath()}
+
+	switch v := val.(type) {
+	case *pstring:
+		o.Type = "string"
+		o.Strings = []string{v.content}
+	case *plist:
+		o.Type = "list"
+		o.Strings = append([]string(nil), v.list...)
+	case *pmap:
+		o.Type = "hash"
+		o.Fields = make(map[string]string, len(v.ourmap))
+		for field, value := range v.ourmap {
+			o.Fields[field] = value
+		}
+		if len(v.fieldDeath) != 0 {
+			o.FieldDeath = make(map[string]time.Time, len(v.fieldDeath))
+			for field, death := range v.fieldDeath {
+				o.FieldDeath[field] = death
+			}
+		}
+	case *pset:
+		o.Type = "set"
+		for member := range v.members {
+			o.Strings = append(o.Strings, member)
+		}
+	case *pzset:
+		o.Type = "zset"
+		for _, m := range v.ordered {
+			o.Strings = append(o.Strings, m.member)
+			o.Scores = append(o.Scores, m.score)
+		}
+	case *pcounter:
+		o.Type = "counter"
+		o.Number = v.value
+	case *pbitmap:
+		o.Type = "bitmap"
+		o.Bytes = append([]byte(nil), v.bits...)
+	case *papprox:
+		o.Type = "hll"
+		o.Bytes = append([]byte(nil), v.registers...)
+	case *pstream:
+		o.Type = "stream"
+		for _, e := range v.entries {
+			o.IDs = append(o.IDs, e.id)
+			o.Strings = append(o.Strings, e.value)
+		}
+		o.LastID = v.lastID
+		o.Offsets = make(map[string]uint64, len(v.offsets))
+		for consumer, offset := range v.offsets {
+			o.Offsets[consumer] = offset
+		}
+	case *pjson:
+		o.Type = "json"
+		document, err := json.Marshal(v.document)
+		if err != nil {
+			return o, err
+		}
+		o.Strings = []string{string(document)}
+	default:
+		return o, errors.New("unknown type of " + key)
+	}
+
+	return o, nil
+}
+
+// restore builds an object back from its snapshot.
+func (o snapshotObject) restore() (potat, error) {
+
+	death := o.TimeOfDeath
+
+	switch o.Type {
+	case "string":
+		if len(o.Strings) != 1 {
+			return nil, errors.New("malformed string " + o.Key)
+		}
+		return &pstring{content: o.Strings[0], timeOfDeath: death}, nil
+	case "list":
+		return &plist{list: o.Strings, timeOfDeath: death}, nil
+	case "hash":
+		m := &pmap{ourmap: o.Fields, timeOfDeath: death, fieldDeath: o.FieldDeath}
+		if m.ourmap == nil {
+			m.ourmap = make(map[string]string)
+		}
+		if m.fieldDeath == nil {
+			m.fieldDeath = make(map[string]time.Time)
+		}
+		return m, nil
+	case "set":
+		set := &pset{members: make(map[string]struct{}, len(o.Strings)), timeOfDeath: death}
+		for _, member := range o.Strings {
+			set.members[member] = struct{}{}
+		}
+		return set, nil
+	case "zset":
+		if len(o.Strings) != len(o.Scores) {
+			return nil, errors.New("malformed sorted set " + o.Key)
+		}
+		zset := &pzset{scores: make(map[string]float64, len(o.Strings)), timeOfDeath: death}
+		for i, member := range o.Strings {
+			if math.IsNaN(o.Scores[i]) {
+				return nil, errors.New("NaN score in sorted set " + o.Key)
+			}
+			zset.add(member, o.Scores[i])
+		}
+		return zset, nil
+	case "counter":
+		return &pcounter{value: o.Number, timeOfDeath: death}, nil
+	case "bitmap":
+		return &pbitmap{bits: o.Bytes, timeOfDeath: death}, nil
+	case "hll":
+		if len(o.Bytes) != hllRegisters {
+			return nil, errors.New("malformed hyperloglog " + o.Key)
+		}
+		return &papprox{registers: o.Bytes, timeOfDeath: death}, nil
+	case "stream":
+		if len(o.Strings) != len(o.IDs) {
+			return nil, errors.New("malformed stream " + o.Key)
+		}
+		stream := &pstream{lastID: o.LastID, offsets: o.Offsets, timeOfDeath: death}
+		for i, id := range o.IDs {
+			stream.entries = append(stream.entries, streamEntry{id: id, value: o.Strings[i]})
+		}
+		if stream.offsets == nil {
+			stream.offsets = make(map[string]uint64)
+		}
+		return stream, nil
+	case "json":
+		if len(o.Strings) != 1 {
+			return nil, errors.New("malformed json " + o.Key)
+		}
+		doc := &pjson{timeOfDeath: death}
+		if err := json.Unmarshal([]byte(o.Strings[0]), &doc.document); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	return nil, errors.New("unknown type " + o.Type + " of " + o.Key)
+}
+
+// snapshotProgress is a snapshot that is being taken. Keys are copied in
+// batches and the lock is released between them, until then they are pending.
+// A logged command copies pending keys it's going to change before it runs,
+// so the snapshot has everything as it was when it was started.
+type snapshotProgress struct {
+	snap snapshot
+	// logOffset is the size of the append-only log when it was started
+	logOffset int64
+	pending   map[string]map[string]bool
+	left      int
+	err       error
+	// delta lists pending keys that are gone in Deleted
+	delta bool
+}
+
+// startSnapshot lists the keys to copy. Only one snapshot can be taken at a
+// time.
+func (s *PotatoSlave) startSnapshot() error {
+	return s.startSnapshotWith(nil)
+}
+
+// startSnapshotWith is startSnapshot that calls attach at the moment the
+// snapshot is of, when no logged command is running.
+func (s *PotatoSlave) startSnapshotWith(attach func()) error {
+	return s.startSnapshotOf(false, func(*snapshotProgress) {
+		if attach != nil {
+			attach()
+		}
+	})
+}
+
+// startSnapshotOf starts a full snapshot or a delta one of the keys changed
+// since the last full one, errNoDeltaBase if there is none. attach is called
+// like with startSnapshotWith.
+func (s *PotatoSlave) startSnapshotOf(delta bool, attach func(*snapshotProgress)) error {
+
+	// No logged command can be half applied when the snapshot starts
+	if s.aof != nil {
+		s.aof.mutex.Lock()
+		defer s.aof.mutex.Unlock()
+	}
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	if s.saving != nil {
+		return errors.New("snapshot is already being taken")
+	}
+
+	p := &snapshotProgress{snap: snapshot{Taken: time.Now()}, pending: make(map[string]map[string]bool), delta: delta}
+	if s.aof != nil {
+		p.snap.LogSeq = s.aof.seq
+		p.logOffset = s.aof.size
+	}
+
+	s.storageMutex.Lock()
+	if delta {
+		var err error
+		if p.snap.Base, err = s.deltas.pending(p); err != nil {
+			s.storageMutex.Unlock()
+			return err
+		}
+	} else {
+		for _, user := range s.storage.Users() {
+			p.pending[user] = make(map[string]bool, s.storage.Len(user))
+			s.storage.Iterate(user, func(key string, _ potat) bool {
+				p.pending[user][key] = true
+				return true
+			})
+			p.left += s.storage.Len(user)
+		}
+	}
+	for user := range s.aggregations {
+		for name, a := range s.aggregations[user] {
+			p.snap.Aggregations = append(p.snap.Aggregations, snapshotAggregation{
+				User: user, Name: name, Kind: a.kind, Prefix: a.prefix, Field: a.field,
+			})
+		}
+	}
+	s.storageMutex.Unlock()
+
+	if attach != nil {
+		attach(p)
+	}
+	s.saving = p
+	return nil
+}
+
+// copyPending copies a pending key into the snapshot, a key that is gone by
+// now was deleted by expiration only and isn't needed in a full snapshot, a
+// delta one lists it as deleted. Must be called under storageMutex and
+// saveMutex.
+func (p *snapshotProgress) copyPending(s *PotatoSlave, user string, key string) {
+
+	if !p.pending[user][key] {
+		return
+	}
+	delete(p.pending[user], key)
+	p.left--
+
+	if val := s.storage.Get(user, key); val != nil {
+		o, err := snapshotOf(user, key, val)
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.snap.Objects = append(p.snap.Objects, o)
+	} else if p.delta {
+		p.snap.Deleted = append(p.snap.Deleted, UserKey{User: user, Key: key})
+	}
+}
+
+// preserve copies pending keys that mes is going to change. It must be called
+// under saveMutex.RLock before a logged command runs, the lock has to be held
+// until the command is done.
+func (s *PotatoSlave) preserve(userID string, mes CommandMessage) {
+
+	p := s.saving
+	if p == nil || len(mes.Arguments) == 0 {
+		return
+	}
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	switch mes.Name {
+	case "MOVEKEYS":
+		if len(mes.Arguments) < 2 {
+			break
+		}
+		for _, user := range mes.Arguments[:2] {
+			for key := range p.pending[user] {
+				p.copyPending(s, user, key)
+			}
+		}
+	case "ERASEUSER":
+		userID = mes.Arguments[0]
+		fallthrough
+	case "EXPIREPREFIX", "PERSISTPREFIX":
+		for key := range p.pending[userID] {
+			p.copyPending(s, userID, key)
+		}
+	default:
+		p.copyPending(s, userID, mes.Arguments[0])
+	}
+}
+
+// takeSnapshot copies everything stored. The lock is only held for a batch of
+// STREAMBATCH keys at a time, so the slave keeps serving meanwhile. A job can
+// cancel it between batches.
+func (s *PotatoSlave) takeSnapshot(j *job) (snapshot, error) {
+
+	if err := s.startSnapshot(); err != nil {
+		return snapshot{}, err
+	}
+	return s.finishSnapshot(j)
+}
+
+// finishSnapshot copies what is still pending after startSnapshot.
+func (s *PotatoSlave) finishSnapshot(j *job) (snapshot, error) {
+
+	p := s.saving
+	total := p.left
+	for {
+		if j.cancelled() && p.err == nil {
+			p.err = errors.New("snapshot was cancelled")
+		}
+
+		s.saveMutex.RLock()
+		s.storageMutex.Lock()
+		copied := 0
+	batch:
+		for user := range p.pending {
+			for key := range p.pending[user] {
+				if copied == s.STREAMBATCH || p.err != nil {
+					break batch
+				}
+				p.copyPending(s, user, key)
+				copied++
+			}
+		}
+		left, err := p.left, p.err
+		s.storageMutex.Unlock()
+		s.saveMutex.RUnlock()
+
+		j.setProgress(total-left, total)
+		if left == 0 || err != nil {
+			break
+		}
+	}
+
+	s.saveMutex.Lock()
+	s.saving = nil
+	s.saveMutex.Unlock()
+
+	return p.snap, p.err
+}
+
+// readSnapshot puts everything from a snapshot into the storage, see
+// loadSnapshot.
+func (s *PotatoSlave) readSnapshot(r io.Reader) error {
+
+	snap, err := decodeSnapshot(r)
+	if err != nil {
+		return err
+	}
+	return s.loadSnapshot(snap)
+}
+
+// loadSnapshot puts everything from a snapshot into the storage, dead objects
+// are skipped and aggregations are computed again.
+func (s *PotatoSlave) loadSnapshot(snap snapshot) error {
+
+	objects := make([]potat, len(snap.Objects))
+	for i, o := range snap.Objects {
+		val, err := o.restore()
+		if err != nil {
+			return err
+		}
+		objects[i] = val
+	}
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	s.snapshotSeq = snap.LogSeq
+
+	now := time.Now()
+	for i, o := range snap.Objects {
+		if !objects[i].getTimeOfDeath().After(now) {
+			continue
+		}
+		s.storage.Set(o.User, o.Key, objects[i])
+		s.schedule(o.User, o.Key)
+	}
+
+	for _, a := range snap.Aggregations {
+		if _, ok := s.aggregations[a.User]; !ok {
+			s.aggregations[a.User] = make(map[string]*aggregation)
+		}
+		s.aggregations[a.User][a.Name] = &aggregation{
+			kind: a.Kind, prefix: a.Prefix, field: a.Field, contrib: make(map[string]float64),
+		}
+	}
+	for user := range s.aggregations {
+		s.storage.Iterate(user, func(key string, _ potat) bool {
+			s.reconcile(user, key)
+			return true
+		})
+	}
+
+	return nil
+}
+
+// SaveSnapshot writes everything stored to a file at path. The file is
+// replaced only when the new snapshot is completely written. Changes are
+// tracked from then on for SaveDeltaSnapshot of the same path.
+func (s *PotatoSlave) SaveSnapshot(path string) error {
+	return s.saveSnapshot(path, nil)
+}
+
+// saveSnapshot is SaveSnapshot that can run as a job.
+func (s *PotatoSlave) saveSnapshot(path string, j *job) error {
+
+	var before deltaBase
+	if err := s.startSnapshotOf(false, func(*snapshotProgress) { before = s.deltas.restart() }); err != nil {
+		return err
+	}
+	snap, err := s.finishSnapshot(j)
+	if err == nil {
+		err = writeSnapshot(path, snap)
+	}
+	if err != nil {
+		s.deltas.keep(before)
+		return err
+	}
+
+	s.deltas.saved(path, snap.Taken)
+	// A delta of the previous snapshot is of no use now
+	if err := os.Remove(deltaPath(path)); err != nil && !os.IsNotExist(err) {
+		log.Printf("snapshot: %s", err)
+	}
+	return nil
+}
+
+// writeSnapshot writes a snapshot to a file at path, which is replaced only
+// when the snapshot is completely written.
+func writeSnapshot(path string, snap snapshot) error {
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = encodeSnapshot(f, snap)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadSnapshot reads a snapshot saved by SaveSnapshot and the delta of it
+// saved by SaveDeltaSnapshot after it if there is one. A missing file isn't an
+// error as there is nothing to load on the first start.
+func (s *PotatoSlave) LoadSnapshot(path string) error {
+
+	snap, err := readSnapshotFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	base := snap.Taken
+	delta, err := readSnapshotFile(deltaPath(path))
+	switch {
+	case os.IsNotExist(err):
+		delta = snapshot{}
+	case err != nil:
+		return err
+	case !delta.Base.Equal(base):
+		// Left from before the last full snapshot was saved
+		log.Printf("snapshot: %s is a delta of another snapshot, ignoring it", deltaPath(path))
+		delta = snapshot{}
+	default:
+		snap = applyDelta(snap, delta)
+	}
+
+	if err := s.loadSnapshot(snap); err != nil {
+		return err
+	}
+	s.deltas.loaded(path, base, delta)
+	return nil
+}
+
+// readSnapshotFile decodes the snapshot in a file.
+func readSnapshotFile(path string) (snapshot, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return snapshot{}, err
+	}
+	defer f.Close()
+
+	return decodeSnapshot(f)
+}
+
+// bgsave starts saving a snapshot to SNAPSHOTPATH in background and returns
+// the ID of the job, see JOB.
+func (s *PotatoSlave) bgsave(userID string, mes CommandMessage) ResponseMessage {
+	return s.startJob(userID, mes)
+}
+
+// bgsaveJob saves a snapshot to SNAPSHOTPATH.
+func (s *PotatoSlave) bgsaveJob(j *job, userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 || s.SNAPSHOTPATH == "" {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	if err := s.saveSnapshot(s.SNAPSHOTPATH, j); err != nil {
+		response.Value = err.Error()
+		setStatus(&response, _SV)
+		s.stats.add("snapshots_failed", 1)
+		return response
+	}
+
+	s.stats.add("snapshots_saved", 1)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// snapshotRoutine saves a snapshot to SNAPSHOTPATH every SNAPSHOTINTERVAL,
+// DELTASNAPSHOTS delta ones between full ones. Serve saves the last one itself
+// when all connections are served.
+func (s *PotatoSlave) snapshotRoutine(shutdownChan chan bool) {
+
+	deltas := 0
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.SNAPSHOTINTERVAL):
+			var err error
+			if deltas < s.DELTASNAPSHOTS {
+				err = s.SaveDeltaSnapshot(s.SNAPSHOTPATH)
+				deltas++
+			} else {
+				err = s.SaveSnapshot(s.SNAPSHOTPATH)
+				deltas = 0
+			}
+			if err != nil {
+				log.Printf("snapshot failed: %s", err)
+				s.stats.add("snapshots_failed", 1)
+			} else {
+				s.stats.add("snapshots_saved", 1)
+			}
+		}
+	}
+}
+
+//// Admin commands
+
+// save saves a snapshot to SNAPSHOTPATH and returns when it's written.
+func (s *PotatoSlave) save(userID string, mes CommandMessage) ResponseMessage {
+	return s.bgsaveJob(nil, userID, mes)
+}
+
+// dump returns the object at a key serialized and base64 encoded, RESTORE
+// puts it back. TTL isn't in the dump. Values of encrypted keys stay sealed,
+// they can only be restored to the same key of the same user with the same
+// encryption key.
+func (s *PotatoSlave) dump(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	val := s.live(userID, mes.Arguments[0])
+	var o snapshotObject
+	var err error
+	if val != nil {
+		o, err = snapshotOf("", "", val)
+	}
+	s.storageMutex.Unlock()
+
+	if val == nil {
+		setStatus(&response, _NK)
+		return response
+	}
+
+	if err == nil {
+		response.Value, err = encodeDump(o)
+	}
+	if err != nil {
+		setStatus(&response, _IE)
+		return response
+	}
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// encodeDump is the dump of an object, without its key and TTL.
+func encodeDump(o snapshotObject) (string, error) {
+
+	o.User, o.Key, o.TimeOfDeath = "", "", time.Time{}
+
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(o); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(body.Bytes()), nil
+}
+
+// backupEntry is a line of BACKUP. TTL is what was left at the time of the
+// backup, negative for keys that never expire, so a line is put back with
+// RESTORE Key Dump and the TTL.
+type backupEntry struct {
+	Key  string
+	Dump string
+	TTL  time.Duration
+}
+
+// backup returns every key of the user in one response, see backupItems.
+func (s *PotatoSlave) backup(userID string, mes CommandMessage) ResponseMessage {
+	return joinItems(s.backupItems, userID, mes)
+}
+
+// backupItems copies every live key of the user under one hold of the lock, so
+// the backup is of a single moment, and gives them as JSON lines of
+// backupEntry. Lines are encoded after the lock is released.
+// TODO: an admin should be able to back up another user.
+func (s *PotatoSlave) backupItems(userID string, mes CommandMessage, out *itemStream) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	var objects []snapshotObject
+	var err error
+	s.storageMutex.Lock()
+	s.storage.Iterate(userID, func(key string, _ potat) bool {
+		if val := s.live(userID, key); val != nil {
+			var o snapshotObject
+			if o, err = snapshotOf(userID, key, val); err != nil {
+				return false
+			}
+			objects = append(objects, o)
+		}
+		return true
+	})
+	s.storageMutex.Unlock()
+
+	now := time.Now()
+	items := make([]string, 0, len(objects))
+	for _, o := range objects {
+		entry := backupEntry{Key: o.Key, TTL: o.TimeOfDeath.Sub(now)}
+		if o.TimeOfDeath.Equal(neverDies) {
+			entry.TTL = -1
+		} else if entry.TTL <= 0 {
+			// Died while the lines were encoded, RESTORE needs a TTL left
+			entry.TTL = time.Millisecond
+		}
+		if err == nil {
+			entry.Dump, err = encodeDump(o)
+		}
+		var line []byte
+		if err == nil {
+			line, err = json.Marshal(entry)
+		}
+		if err != nil {
+			break
+		}
+		items = append(items, string(line)+"\n")
+	}
+
+	if err != nil {
+		setStatus(&response, _IE)
+		return response
+	}
+	for len(items) != 0 {
+		n := len(items)
+		if out.batch != 0 && n > out.batch {
+			n = out.batch
+		}
+		if !out.emit(items[:n]) {
+			break
+		}
+		items = items[n:]
+	}
+	s.stats.add("backups", 1)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// restore is RESTORE key dump [REPLACE], it creates the key from a dump with
+// the TTL of the command. An existing key is only replaced with REPLACE.
+func (s *PotatoSlave) restore(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	replace := len(mes.Arguments) == 3 && strings.ToUpper(mes.Arguments[2]) == "REPLACE"
+	if len(mes.Arguments) != 2 && !replace {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	body, err := base64.StdEncoding.DecodeString(mes.Arguments[1])
+	var o snapshotObject
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(body)).Decode(&o)
+	}
+	if err != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	// Values of a dump are restored as they are, they were sealed if they
+	// had to be
+	if s.isEncrypted(mes.Arguments[0]) && !isSealed(o.Type) {
+		setStatus(&response, _WT)
+		return response
+	}
+
+	o.Key = mes.Arguments[0]
+	o.TimeOfDeath = deathAfter(s.ttlFor(mes.Arguments[0], mes.TTL))
+	val, err := o.restore()
+	if err != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+
+	if s.live(userID, mes.Arguments[0]) != nil && !replace {
+		setStatus(&response, _KE)
+		return response
+	}
+	s.storage.Set(userID, mes.Arguments[0], val)
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,256 @@
+package slave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//////////
+// Warm standby
+//////////
+
+// standbyCommands are served by a standby, everything else gets _SB until
+// it's promoted.
+var standbyCommands = map[string]bool{
+	"PROMOTE":     true,
+	"PING":        true,
+	"TIME":        true,
+	"GOSSIP":      true,
+	"MEMBERS":     true,
+	"VERSION":     true,
+	"HELLO":       true,
+	"STATS":       true,
+	"MEMORYSTATS": true,
+	"AUDIT":       true,
+}
+
+// mirror is MIRROR, what a standby asks its primary for. Without arguments it
+// returns a snapshot in Value, encoded as base64 of a snapshot file. MIRROR seq
+// returns lines of the append-only log that came after seq and _WA if the
+// primary has no log. A rewritten log starts with a base snapshot, so a
+// standby that is behind the rewrite gets everything it needs anyway.
+// TODO: the whole log is read for every request and sent in one response,
+// segments of the log would let it send only what's new.
+func (s *PotatoSlave) mirror(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) > 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	if len(mes.Arguments) == 0 {
+		snap, err := s.takeSnapshot(nil)
+		var file bytes.Buffer
+		if err == nil {
+			err = encodeSnapshot(&file, snap)
+		}
+		if err != nil {
+			response.Value = err.Error()
+			setStatus(&response, _SV)
+			return response
+		}
+		response.Value = base64.StdEncoding.EncodeToString(file.Bytes())
+		setStatus(&response, _OK)
+		return response
+	}
+
+	after, err := strconv.ParseUint(mes.Arguments[0], 10, 64)
+	if err != nil || s.aof == nil {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	f, err := os.Open(s.AOFPATH)
+	if err != nil {
+		setStatus(&response, _IE)
+		return response
+	}
+	defer f.Close()
+
+	var lines strings.Builder
+	reader := bufio.NewReader(f)
+	for {
+		b, err := reader.ReadBytes('\n')
+		// The last line could still be being written
+		if err != nil {
+			break
+		}
+		var entry struct{ Seq uint64 }
+		if json.Unmarshal(b, &entry) == nil && entry.Seq > after {
+			lines.Write(b)
+		}
+	}
+
+	response.Value = lines.String()
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// askPrimary sends a command to STANDBYOF.
+func (s *PotatoSlave) askPrimary(mes CommandMessage) (ResponseMessage, error) {
+	return askNode(s.STANDBYOF, mes, 0)
+}
+
+// askNode sends a command to a node at addr over a new connection and waits
+// for the response for up to timeout, 0 is no limit. A connection isn't kept
+// between requests, as slaves close idle ones after STALETIME.
+func askNode(addr string, mes CommandMessage, timeout time.Duration) (ResponseMessage, error) {
+
+	var response ResponseMessage
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+	if err != nil {
+		return response, err
+	}
+	defer conn.Close()
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if err := json.NewEncoder(conn).Encode(mes); err != nil {
+		return response, err
+	}
+	err = json.NewDecoder(conn).Decode(&response)
+	return response, err
+}
+
+// syncFull replaces everything stored with a snapshot of the primary.
+func (s *PotatoSlave) syncFull() error {
+
+	response, err := s.askPrimary(CommandMessage{Name: "MIRROR"})
+	if err != nil {
+		return err
+	}
+	if response.Code != _OK {
+		return errors.New("primary refused a snapshot: " + response.StatusMessage + " " + response.Value)
+	}
+	file, err := base64.StdEncoding.DecodeString(response.Value)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is thrown away for a broken snapshot
+	if _, err := decodeSnapshot(bytes.NewReader(file)); err != nil {
+		return err
+	}
+	s.resetStorage()
+	return s.readSnapshot(bytes.NewReader(file))
+}
+
+var errNoPrimaryLog = errors.New("primary has no append-only log")
+
+// syncLog applies entries of the primary's log that came after the last one
+// applied.
+func (s *PotatoSlave) syncLog() error {
+
+	response, err := s.askPrimary(CommandMessage{Name: "MIRROR", Arguments: []string{strconv.FormatUint(s.snapshotSeq, 10)}})
+	if err != nil {
+		return err
+	}
+	if response.Code == _WA {
+		return errNoPrimaryLog
+	}
+	if response.Code != _OK {
+		return errors.New("primary refused its log: " + response.StatusMessage)
+	}
+
+	seq, _, err := s.replayLog(strings.NewReader(response.Value))
+	if seq > s.snapshotSeq {
+		s.snapshotSeq = seq
+	}
+	return err
+}
+
+// mirrorRoutine keeps the standby a copy of STANDBYOF every MIRRORINTERVAL
+// until it's promoted or stopped by someone. The log of the primary is
+// followed after the first snapshot, a primary without one is copied by
+// snapshots every time.
+func (s *PotatoSlave) mirrorRoutine(shutdownChan chan bool) {
+
+	synced := false
+	for {
+		s.mirrorMutex.Lock()
+		if atomic.LoadInt32(&s.standby) == 1 {
+			var err error
+			if synced {
+				if err = s.syncLog(); err == errNoPrimaryLog {
+					synced = false
+				}
+			}
+			if !synced {
+				err = s.syncFull()
+			}
+			synced = err == nil
+			if err != nil {
+				log.Printf("standby: %s", err)
+				s.stats.add("mirror_errors", 1)
+			} else {
+				s.stats.add("mirror_syncs", 1)
+			}
+		}
+		s.mirrorMutex.Unlock()
+
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.MIRRORINTERVAL):
+		}
+	}
+}
+
+// promote is PROMOTE: the standby stops mirroring and starts to serve
+// everything with the data it has. A sync that is running is finished first.
+// A replica stops following its primary and takes writes. It's _WA on a node
+// that is neither.
+func (s *PotatoSlave) promote(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) == 0 && s.ROLE == "replica" {
+		if !atomic.CompareAndSwapInt32(&s.replication.promoted, 0, 1) {
+			setStatus(&response, _WA)
+			return response
+		}
+		close(s.replication.stop)
+
+		s.stats.add("promotions", 1)
+		log.Printf("replica: promoted, following of %s stopped", s.REPLICAOF)
+
+		setStatus(&response, _OK)
+		return response
+	}
+
+	s.mirrorMutex.Lock()
+	promoted := len(mes.Arguments) == 0 && atomic.CompareAndSwapInt32(&s.standby, 1, 0)
+	s.mirrorMutex.Unlock()
+
+	if !promoted {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	s.stats.add("promotions", 1)
+	log.Printf("standby: promoted, mirroring of %s stopped", s.STANDBYOF)
+
+	setStatus(&response, _OK)
+	return response
+}
+
+// standbyRefuses tells if a command can't be served while the node is a
+// standby.
+func (s *PotatoSlave) standbyRefuses(mes CommandMessage) bool {
+	return atomic.LoadInt32(&s.standby) == 1 && !standbyCommands[mes.Name]
+}
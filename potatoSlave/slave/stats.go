@@ -0,0 +1,76 @@
+package slave
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+//////////
+// Statistics
+//////////
+
+// counters is a set of named metrics that can be updated concurrently.
+type counters struct {
+	mu     sync.Mutex
+	values map[string]*int64
+}
+
+// counter returns a pointer to the named counter creating it if needed.
+func (c *counters) counter(name string) *int64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]*int64)
+	}
+	if _, ok := c.values[name]; !ok {
+		c.values[name] = new(int64)
+	}
+	return c.values[name]
+}
+
+func (c *counters) add(name string, delta int64) {
+	atomic.AddInt64(c.counter(name), delta)
+}
+
+func (c *counters) get(name string) int64 {
+	return atomic.LoadInt64(c.counter(name))
+}
+
+// snapshot returns current values of all the counters.
+func (c *counters) snapshot() map[string]int64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make(map[string]int64, len(c.values))
+	for name, v := range c.values {
+		values[name] = atomic.LoadInt64(v)
+	}
+	return values
+}
+
+// statscommand returns all the counters as a JSON object.
+func (s *PotatoSlave) statscommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	values := s.stats.snapshot()
+	if s.authRequired() && s.AUTHMAXFAILURES > 0 {
+		values["auth_banned_hosts"] = s.bannedHosts()
+	}
+	values["workers_busy"] = atomic.LoadInt64(&s.busyWorkers)
+	values["connections_open"] = atomic.LoadInt64(&s.openConnections)
+	body, _ := json.Marshal(values)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,115 @@
+package slave
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+)
+
+//////////
+// Status codes and commands registry
+//////////
+
+// Codes below FirstPluginStatus are reserved for the core, plugins register
+// theirs starting from it.
+const FirstPluginStatus uint = 1000
+
+// statusRegistry maps status codes to their messages.
+type statusRegistry struct {
+	mu       sync.RWMutex
+	messages map[uint]string
+}
+
+func (r *statusRegistry) message(code uint) string {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.messages[code]
+}
+
+// catalog returns a copy of all the codes and their messages.
+func (r *statusRegistry) catalog() map[uint]string {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	catalog := make(map[uint]string, len(r.messages))
+	for code, message := range r.messages {
+		catalog[code] = message
+	}
+	return catalog
+}
+
+// RegisterStatus adds a status code for a plugin. The code has to be at least
+// FirstPluginStatus and not taken by someone else.
+func RegisterStatus(code uint, message string) error {
+
+	if code < FirstPluginStatus {
+		return errors.New("status codes below FirstPluginStatus are reserved")
+	}
+
+	statusMessages.mu.Lock()
+	defer statusMessages.mu.Unlock()
+
+	if _, ok := statusMessages.messages[code]; ok {
+		return errors.New("status code is already registered")
+	}
+	statusMessages.messages[code] = message
+
+	return nil
+}
+
+// SetStatus sets a code and its message on a response, for plugin commands.
+func SetStatus(mes *ResponseMessage, code uint) {
+	setStatus(mes, code)
+}
+
+// RegisterCommand adds a command served by a plugin, it has to be called
+// before serving starts. Core commands can't be replaced.
+func (s *PotatoSlave) RegisterCommand(name string, f func(string, CommandMessage) ResponseMessage) error {
+
+	if _, ok := s.functions[name]; ok {
+		return errors.New("command is already registered")
+	}
+	s.functions[name] = f
+
+	return nil
+}
+
+// commandsDocs is what COMMANDS DOCS returns.
+type commandsDocs struct {
+	Commands []string
+	Statuses map[uint]string
+}
+
+// commandscommand returns names of all the commands as JSON, with DOCS also
+// the catalog of status codes.
+func (s *PotatoSlave) commandscommand(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) > 1 || (len(mes.Arguments) == 1 && mes.Arguments[0] != "DOCS") {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	docs := commandsDocs{Commands: make([]string, 0, len(s.functions))}
+	for name := range s.functions {
+		docs.Commands = append(docs.Commands, name)
+	}
+	sort.Strings(docs.Commands)
+
+	var body []byte
+	if len(mes.Arguments) == 1 {
+		docs.Statuses = statusMessages.catalog()
+		body, _ = json.Marshal(docs)
+	} else {
+		body, _ = json.Marshal(docs.Commands)
+	}
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,120 @@
+package slave
+
+import "time"
+
+//////////
+// Storage backends
+//////////
+
+// Storage keeps objects of every user by their keys. Command handlers only go
+// through it, so another backend can be put in place of the map without
+// touching them. Backends aren't safe for concurrent use, calls are made
+// under storageMutex. mapStorage is also called with storageMutex held for
+// reading by commands that lock a user with lockUser or rlockUser, they only
+// touch the keys of users of their shard, see locks.go.
+//
+// Objects are modified in place by handlers after Get, a backend that doesn't
+// keep them in memory has to hold on to objects it returned until they're Set
+// again or the storage lock is released.
+type Storage interface {
+	// Get returns the object at key or nil if there is none. Dead objects are
+	// returned as well, PotatoSlave.live is the one that hides them.
+	Get(user, key string) potat
+	// Set puts an object at key, the user is created if he has no keys yet.
+	Set(user, key string, val potat)
+	// Delete removes the object at key if there is one.
+	Delete(user, key string)
+	// Iterate calls fn for every object of a user, in no particular order,
+	// until fn returns false. fn may delete the key it's given.
+	Iterate(user string, fn func(key string, val potat) bool)
+	// Expire sets the time of death of the object at key, it tells if there
+	// was one.
+	Expire(user, key string, death time.Time) bool
+
+	// AddUser makes a user known to the storage even without keys.
+	AddUser(user string)
+	// HasUser tells if a user was added or has ever had keys.
+	HasUser(user string) bool
+	// Users lists known users.
+	Users() []string
+	// Len is how many objects a user has.
+	Len(user string) int
+	// Reset forgets every user and object.
+	Reset()
+}
+
+// mapStorage is the default Storage: a nested map, where first level is a
+// separation by users (each user's keys are stored in a separate table) and
+// then a data map itself.
+type mapStorage map[string]map[string]potat
+
+func newMapStorage() Storage {
+	return mapStorage(make(map[string]map[string]potat))
+}
+
+func (m mapStorage) Get(user, key string) potat {
+	return m[user][key]
+}
+
+func (m mapStorage) Set(user, key string, val potat) {
+
+	if _, ok := m[user]; !ok {
+		m[user] = make(map[string]potat)
+	}
+	m[user][key] = val
+}
+
+func (m mapStorage) Delete(user, key string) {
+	delete(m[user], key)
+}
+
+func (m mapStorage) Iterate(user string, fn func(key string, val potat) bool) {
+
+	for key, val := range m[user] {
+		if !fn(key, val) {
+			return
+		}
+	}
+}
+
+func (m mapStorage) Expire(user, key string, death time.Time) bool {
+
+	val, ok := m[user][key]
+	if ok {
+		val.setTimeOfDeath(death)
+	}
+	return ok
+}
+
+func (m mapStorage) AddUser(user string) {
+
+	if _, ok := m[user]; !ok {
+		m[user] = make(map[string]potat)
+	}
+}
+
+func (m mapStorage) HasUser(user string) bool {
+
+	_, ok := m[user]
+	return ok
+}
+
+func (m mapStorage) Users() []string {
+
+	users := make([]string, 0, len(m))
+	for user := range m {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (m mapStorage) Len(user string) int {
+	return len(m[user])
+}
+
+func (m mapStorage) Reset() {
+
+	for user := range m {
+		delete(m, user)
+	}
+}
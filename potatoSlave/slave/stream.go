@@ -0,0 +1,256 @@
+package slave
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////////
+// Streamed responses
+//////////
+
+// TODO: a batch looks at every key of the user or every element of the key
+// to find the ones after the cursor, an ordered index would make it cheaper.
+
+// itemStream takes the items of a command from streamFunctions. The command
+// gives them in batches of at most batch items, each taken under a hold of
+// the lock, or all at once if batch is 0, and stops if emit returns false.
+// Items are raw: names, members, fields followed by their values for HGETALL.
+type itemStream struct {
+	batch int
+	emit  func(items []string) bool
+}
+
+// itemsFunc is a command of streamFunctions.
+type itemsFunc func(userID string, mes CommandMessage, out *itemStream) ResponseMessage
+
+// formatItems turns raw items into the ones of a potato list in Value: 'item',
+// and 'field':'value', for HGETALL. Pieces of GET and lines of BACKUP are as
+// they are.
+func formatItems(name string, items []string) []string {
+
+	switch name {
+	case "GET", "BACKUP":
+		return items
+	case "HGETALL":
+		formatted := make([]string, 0, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			formatted = append(formatted, "'"+items[i]+"':'"+items[i+1]+"',")
+		}
+		return formatted
+	}
+	formatted := make([]string, len(items))
+	for i, item := range items {
+		formatted[i] = "'" + item + "',"
+	}
+	return formatted
+}
+
+// collectItems runs a command of streamFunctions in one batch and returns the
+// response with its raw items.
+func collectItems(f itemsFunc, userID string, mes CommandMessage) (ResponseMessage, []string) {
+
+	var items []string
+	response := f(userID, mes, &itemStream{emit: func(batch []string) bool {
+		items = append(items, batch...)
+		return true
+	}})
+	return response, items
+}
+
+// joinItems runs a command of streamFunctions in one batch and puts its items
+// into Value, the way it's answered without Stream.
+func joinItems(f itemsFunc, userID string, mes CommandMessage) ResponseMessage {
+
+	response, items := collectItems(f, userID, mes)
+	response.Value = strings.Join(formatItems(mes.Name, items), "")
+
+	return response
+}
+
+// nextNames returns the names that add gets from iterate that follow after in
+// order, all of them after the first one if first is set. It returns at most
+// n of them, all if n is 0, and tells if there are more.
+func nextNames(iterate func(add func(name string)), after string, first bool, n int) ([]string, bool) {
+
+	var names []string
+	more := false
+	trim := func() {
+		sort.Strings(names)
+		if n != 0 && len(names) > n {
+			names = names[:n]
+			more = true
+		}
+	}
+
+	iterate(func(name string) {
+		if !first && name <= after {
+			return
+		}
+		names = append(names, name)
+		// Only the smallest n are kept, not every name
+		if n != 0 && len(names) >= 2*n {
+			trim()
+		}
+	})
+	trim()
+
+	return names, more
+}
+
+// streamFrames makes the itemStream of a command with Stream that sends its
+// items to the client in frames of at most STREAMBATCH items each. Frames have
+// at most STREAMCHUNK bytes unless an item alone is longer, items aren't
+// split. With Binary every frame is base64 of its own. The response of the
+// command is the terminating frame, with More not set.
+func (s *PotatoSlave) streamFrames(encoder messageEncoder, mes CommandMessage) *itemStream {
+
+	batch := s.STREAMBATCH
+	if batch < 0 {
+		batch = 0
+	}
+
+	return &itemStream{batch: batch, emit: func(items []string) bool {
+
+		items = formatItems(mes.Name, items)
+		for len(items) > 0 {
+
+			n := len(items)
+			if s.STREAMCHUNK > 0 {
+				size := 0
+				for i := 0; i < n; i++ {
+					size += len(items[i])
+					encoded := size
+					if mes.Binary {
+						encoded = base64.StdEncoding.EncodedLen(size)
+					}
+					if i > 0 && encoded > s.STREAMCHUNK {
+						n = i
+						break
+					}
+				}
+			}
+
+			frame := ResponseMessage{More: true, Value: strings.Join(items[:n], ""), Binary: mes.Binary}
+			if mes.Binary {
+				frame.Value = base64.StdEncoding.EncodeToString([]byte(frame.Value))
+			}
+			setStatus(&frame, _OK)
+			if err := encoder.Encode(frame); err != nil {
+				return false
+			}
+
+			items = items[n:]
+		}
+		return true
+	}}
+}
+
+// keyBatch returns the live keys of a user that follow after, see nextNames.
+func (s *PotatoSlave) keyBatch(userID string, after string, first bool, n int) ([]string, bool) {
+
+	var dead []string
+	defer func() { s.dropDead(userID, dead) }()
+	defer s.rlockUser(userID)()
+
+	return nextNames(func(add func(string)) {
+		s.storage.Iterate(userID, func(k string, val potat) bool {
+			if s.peek(userID, k, &dead) != nil {
+				add(k)
+			}
+			return true
+		})
+	}, after, first, n)
+}
+
+// scan is SCAN cursor [count], it returns up to count (10 by default) keys
+// of the user after the cursor, preceded by the cursor to go on from. Scans
+// start and end with the cursor "0". Keys go in order of their names, a key
+// that is there for the whole scan is returned once.
+func (s *PotatoSlave) scan(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 && len(mes.Arguments) != 2 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	count := 10
+	if len(mes.Arguments) == 2 {
+		n, err := strconv.Atoi(mes.Arguments[1])
+		if err != nil || n <= 0 {
+			setStatus(&response, _WA)
+			return response
+		}
+		count = n
+	}
+
+	// Cursors are base64 of the last key, which is never "0"
+	after, first := "", true
+	if cursor := mes.Arguments[0]; cursor != "0" {
+		b, err := base64.StdEncoding.DecodeString(cursor)
+		if err != nil {
+			setStatus(&response, _WA)
+			return response
+		}
+		after, first = string(b), false
+	}
+
+	names, more := s.keyBatch(userID, after, first, count)
+	next := "0"
+	if more {
+		next = base64.StdEncoding.EncodeToString([]byte(names[len(names)-1]))
+	}
+
+	response.Value = strings.Join(formatItems("SCAN", append([]string{next}, names...)), "")
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// streamElements gives the elements of the object at the key of a command in
+// batches, each taken under a hold of the lock of the user. elements returns
+// the items of the batch after the element after, the last element of it and
+// if there are more. The stream ends early if the key is gone or holds
+// another type by the next batch.
+func (s *PotatoSlave) streamElements(userID string, mes CommandMessage, out *itemStream, kind string,
+	elements func(val potat, after string, first bool) ([]string, string, bool)) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	batch := func(after string, first bool) (items []string, last string, more bool, code uint) {
+
+		var dead []string
+		defer func() { s.dropDead(userID, dead) }()
+		defer s.rlockUser(userID)()
+
+		switch val := s.peek(userID, mes.Arguments[0], &dead); {
+		case val == nil:
+			return nil, "", false, _NK
+		case typeOf(val) != kind:
+			return nil, "", false, _WT
+		default:
+			items, last, more = elements(val, after, first)
+			return items, last, more, _OK
+		}
+	}
+
+	items, last, more, code := batch("", true)
+	setStatus(&response, code)
+	for code == _OK {
+		if len(items) != 0 && !out.emit(items) || !more {
+			break
+		}
+		items, last, more, code = batch(last, false)
+	}
+
+	return response
+}
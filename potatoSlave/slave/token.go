@@ -0,0 +1,253 @@
+package slave
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////
+// API tokens
+//////////
+
+// tokenPrefix starts every token, so AUTH tells it from a password.
+const tokenPrefix = "ptk_"
+
+// apiToken is a long-lived credential of a user, it logs in like the user's
+// password does. Only a hash of the secret is kept.
+type apiToken struct {
+	ID      string
+	User    string
+	Hash    string
+	Created time.Time
+	Expires time.Time `json:",omitempty"`
+}
+
+// tokenInfo is what TOKEN LIST returns about a token.
+type tokenInfo struct {
+	ID      string
+	User    string
+	Created time.Time
+	Expires time.Time `json:",omitempty"`
+}
+
+func tokenHash(secret string) string {
+
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadTokens reads tokens saved to TOKENSPATH, a missing file has none.
+func (s *PotatoSlave) LoadTokens(path string) error {
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var tokens []apiToken
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return err
+	}
+
+	s.users.mutex.Lock()
+	s.users.tokens = make(map[string]apiToken, len(tokens))
+	for _, token := range tokens {
+		s.users.tokens[token.ID] = token
+	}
+	s.users.mutex.Unlock()
+	return nil
+}
+
+// saveTokens writes tokens to TOKENSPATH, must be called under the mutex of
+// users. Without TOKENSPATH they live until the slave stops.
+func (s *PotatoSlave) saveTokens() error {
+
+	if s.TOKENSPATH == "" {
+		return nil
+	}
+	tokens := make([]apiToken, 0, len(s.users.tokens))
+	for _, token := range s.users.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	body, _ := json.Marshal(tokens)
+
+	tmp := s.TOKENSPATH + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.TOKENSPATH)
+}
+
+// tokenUser returns the user a token logs in as.
+func (s *PotatoSlave) tokenUser(token string) (string, bool) {
+
+	i := strings.IndexByte(token, '.')
+	if !strings.HasPrefix(token, tokenPrefix) || i < 0 {
+		return "", false
+	}
+	id, secret := token[len(tokenPrefix):i], token[i+1:]
+
+	s.users.mutex.Lock()
+	t, ok := s.users.tokens[id]
+	s.users.mutex.Unlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(tokenHash(secret)), []byte(t.Hash)) != 1 {
+		return "", false
+	}
+	if !t.Expires.IsZero() && s.clock().After(t.Expires) {
+		return "", false
+	}
+	return t.User, true
+}
+
+// managesTokens tells if a session may create and revoke tokens of a user:
+// its own ones or, for an admin, anyone's.
+func (sess *session) managesTokens(name string) bool {
+
+	if sess.login == name {
+		return true
+	}
+	return sess.acl == nil || sess.acl.Admin
+}
+
+// tokencommand is TOKEN CREATE [name [ttl]], TOKEN REVOKE id and TOKEN LIST.
+// CREATE makes a token for the logged in user or for name if it isn't empty,
+// expiring in ttl seconds if it's given and not 0, and returns it in Value.
+// It's shown only once. LIST returns the tokens the session manages as JSON.
+func (s *PotatoSlave) tokencommand(sess *session, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if sess.login == "" {
+		setStatus(&response, _AU)
+		return response
+	}
+	if !s.authRequired() || len(mes.Arguments) == 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	switch mes.Arguments[0] {
+	case "CREATE":
+		if len(mes.Arguments) > 3 {
+			setStatus(&response, _WA)
+			return response
+		}
+		name := sess.login
+		if len(mes.Arguments) > 1 && mes.Arguments[1] != "" {
+			name = mes.Arguments[1]
+		}
+		var ttl int64
+		if len(mes.Arguments) == 3 {
+			var err error
+			if ttl, err = strconv.ParseInt(mes.Arguments[2], 10, 64); err != nil || ttl < 0 {
+				setStatus(&response, _WA)
+				return response
+			}
+		}
+		if !sess.managesTokens(name) {
+			setStatus(&response, _NP)
+			return response
+		}
+
+		id, secret := make([]byte, 8), make([]byte, 24)
+		if _, err := rand.Read(id); err != nil {
+			setStatus(&response, _IE)
+			return response
+		}
+		if _, err := rand.Read(secret); err != nil {
+			setStatus(&response, _IE)
+			return response
+		}
+		t := apiToken{
+			ID:      hex.EncodeToString(id),
+			User:    name,
+			Hash:    tokenHash(base64.RawURLEncoding.EncodeToString(secret)),
+			Created: s.clock(),
+		}
+		if ttl > 0 {
+			t.Expires = t.Created.Add(time.Duration(ttl) * time.Second)
+		}
+
+		s.users.mutex.Lock()
+		_, known := s.users.byName[name]
+		if known {
+			if s.users.tokens == nil {
+				s.users.tokens = make(map[string]apiToken)
+			}
+			s.users.tokens[t.ID] = t
+			if err := s.saveTokens(); err != nil {
+				delete(s.users.tokens, t.ID)
+				known = false
+				setStatus(&response, _IE)
+			}
+		} else {
+			setStatus(&response, _NK)
+		}
+		s.users.mutex.Unlock()
+
+		if known {
+			response.Value = tokenPrefix + t.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+			setStatus(&response, _OK)
+		}
+
+	case "REVOKE":
+		if len(mes.Arguments) != 2 {
+			setStatus(&response, _WA)
+			return response
+		}
+		s.users.mutex.Lock()
+		t, ok := s.users.tokens[mes.Arguments[1]]
+		switch {
+		case !ok:
+			setStatus(&response, _NK)
+		case !sess.managesTokens(t.User):
+			setStatus(&response, _NP)
+		default:
+			delete(s.users.tokens, t.ID)
+			if err := s.saveTokens(); err != nil {
+				s.users.tokens[t.ID] = t
+				setStatus(&response, _IE)
+			} else {
+				setStatus(&response, _OK)
+			}
+		}
+		s.users.mutex.Unlock()
+
+	case "LIST":
+		if len(mes.Arguments) != 1 {
+			setStatus(&response, _WA)
+			return response
+		}
+		list := []tokenInfo{}
+		s.users.mutex.Lock()
+		for _, t := range s.users.tokens {
+			if sess.managesTokens(t.User) {
+				list = append(list, tokenInfo{ID: t.ID, User: t.User, Created: t.Created, Expires: t.Expires})
+			}
+		}
+		s.users.mutex.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		body, _ := json.Marshal(list)
+		response.Value = string(body)
+		setStatus(&response, _OK)
+
+	default:
+		setStatus(&response, _WA)
+	}
+
+	return response
+}
@@ -0,0 +1,268 @@
+package slave
+
+import (
+	"container/heap"
+	"encoding/json"
+	"time"
+)
+
+//////////
+// Expiry queue
+//////////
+
+// expiryEntry says that the key of the user is due at death.
+type expiryEntry struct {
+	death time.Time
+	user  string
+	key   string
+}
+
+// expiryHeap is a min-heap of entries by death, for container/heap.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].death.Before(h[j].death) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// nextDeath is when something of the object expires: the object itself or one
+// of its fields.
+func nextDeath(val potat) time.Time {
+
+	death := val.getTimeOfDeath()
+	if m, ok := val.(*pmap); ok {
+		for _, d := range m.fieldDeath {
+			if d.Before(death) {
+				death = d
+			}
+		}
+	}
+	return death
+}
+
+// schedule puts the key into the expiry queue, it must be called under
+// storageMutex or lockUser whenever the key could start to expire earlier
+// than before.
+// Only the earliest death of a key is kept in scheduled, entries that don't
+// match it are stale and skipped when popped. Later deaths are found when the
+// earlier entry is popped, so making TTL longer needs no scheduling.
+func (s *PotatoSlave) schedule(user string, key string) {
+
+	if val := s.storage.Get(user, key); val != nil {
+		s.scheduleObject(user, key, val)
+	}
+}
+
+// scheduleObject is schedule for an object that is already at hand.
+func (s *PotatoSlave) scheduleObject(user string, key string, val potat) {
+
+	death := nextDeath(val)
+	if death.Equal(neverDies) {
+		return
+	}
+
+	id := user + "\x00" + key
+	s.expiryMutex.Lock()
+	defer s.expiryMutex.Unlock()
+	if d, ok := s.scheduled[id]; ok && !death.Before(d) {
+		return
+	}
+
+	s.scheduled[id] = death
+	heap.Push(&s.expiries, expiryEntry{death: death, user: user, key: key})
+}
+
+// expireDue deletes keys and fields that are due by now, only the keys from
+// the head of the queue are touched. It stops after maxKeys entries or after
+// maxHold, 0 means no limit, and tells how many entries were handled, how many
+// keys were deleted and if some due entries are left. Must be called under
+// storageMutex.
+func (s *PotatoSlave) expireDue(now time.Time, maxKeys int, maxHold time.Duration) (handled int, expired int, more bool) {
+
+	started := time.Now()
+
+	for len(s.expiries) != 0 && !s.expiries[0].death.After(now) {
+
+		// At least one entry is handled, so sweeps always make progress
+		if handled != 0 && ((maxKeys != 0 && handled == maxKeys) || (maxHold != 0 && time.Since(started) > maxHold)) {
+			return handled, expired, true
+		}
+		handled++
+
+		e := heap.Pop(&s.expiries).(expiryEntry)
+
+		id := e.user + "\x00" + e.key
+		if d, ok := s.scheduled[id]; !ok || !d.Equal(e.death) {
+			continue
+		}
+		delete(s.scheduled, id)
+
+		val := s.storage.Get(e.user, e.key)
+		if val == nil {
+			continue
+		}
+
+		if !val.getTimeOfDeath().After(now) {
+			s.storage.Delete(e.user, e.key)
+			s.reconcile(e.user, e.key)
+			s.notifyExpired(e.user, e.key)
+			expired++
+			continue
+		}
+
+		// Hashes can have fields with their own TTL
+		if m, ok := val.(*pmap); ok && len(m.fieldDeath) != 0 {
+			m.pruneFields(now)
+			if len(m.ourmap) == 0 {
+				s.storage.Delete(e.user, e.key)
+				s.notifyExpired(e.user, e.key)
+				expired++
+			}
+			s.reconcile(e.user, e.key)
+		}
+
+		s.schedule(e.user, e.key)
+	}
+
+	return handled, expired, false
+}
+
+// sampleExpired checks up to n keys picked at random and deletes the dead
+// ones, like Redis does. It catches keys that were never scheduled. Must be
+// called under storageMutex.
+func (s *PotatoSlave) sampleExpired(now time.Time, n int) (checked int, expired int) {
+
+	// Map iteration starts at a random place, so with mapStorage it's a cheap
+	// random sample
+	for _, user := range s.storage.Users() {
+		if checked == n {
+			break
+		}
+		s.storage.Iterate(user, func(key string, val potat) bool {
+			if checked == n {
+				return false
+			}
+			checked++
+			if !val.getTimeOfDeath().After(now) {
+				s.storage.Delete(user, key)
+				s.reconcile(user, key)
+				s.notifyExpired(user, key)
+				expired++
+			}
+			return true
+		})
+	}
+
+	return checked, expired
+}
+
+// sampleRounds runs sampleExpired while more than a quarter of a sample turns
+// out to be expired, but no longer than EXPIRESAMPLETIME. The lock is taken
+// for every round separately to keep pauses short.
+func (s *PotatoSlave) sampleRounds(cycle *expiryCycle) {
+
+	deadline := time.Now().Add(s.EXPIRESAMPLETIME)
+	for {
+		s.storageMutex.Lock()
+		locked := time.Now()
+		checked, expired := s.sampleExpired(time.Now(), s.EXPIRESAMPLE)
+		cycle.held(time.Since(locked))
+		s.storageMutex.Unlock()
+
+		cycle.Sampled += checked
+		cycle.SampledExpired += expired
+		s.stats.add("expired_sampled", int64(expired))
+		if checked == 0 || expired*4 <= checked || time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// overdue counts queued entries that are due by now, stale ones included.
+// Only the part of the heap above now is visited. Must be called under
+// storageMutex.
+func (s *PotatoSlave) overdue(now time.Time, i int) int {
+
+	if i >= len(s.expiries) || s.expiries[i].death.After(now) {
+		return 0
+	}
+	return 1 + s.overdue(now, 2*i+1) + s.overdue(now, 2*i+2)
+}
+
+// expiryCycle describes one run of ttlCheckRoutine.
+type expiryCycle struct {
+	Started time.Time
+	// Scanned entries of the queue and Expired keys out of them
+	Scanned int
+	Expired int
+	// Sampled random keys and SampledExpired out of them
+	Sampled        int
+	SampledExpired int
+	Duration       time.Duration
+	// LockHeld is the total time storageMutex was held and MaxLockHeld is the
+	// longest single hold
+	LockHeld    time.Duration
+	MaxLockHeld time.Duration
+	// Backlog are entries that were already due when the sweep ended
+	Backlog int
+}
+
+func (c *expiryCycle) held(d time.Duration) {
+
+	c.LockHeld += d
+	if d > c.MaxLockHeld {
+		c.MaxLockHeld = d
+	}
+}
+
+// expiryStats is what EXPIRESTATS returns.
+type expiryStats struct {
+	Cycles    int64
+	Expired   int64
+	LastCycle expiryCycle
+	Queued    int
+}
+
+// recordCycle keeps the cycle for EXPIRESTATS and adds it to the counters.
+func (s *PotatoSlave) recordCycle(cycle expiryCycle) {
+
+	s.stats.add("ttl_cycles", 1)
+	s.stats.add("ttl_expired", int64(cycle.Expired+cycle.SampledExpired))
+	s.stats.add("ttl_lock_held_us", int64(cycle.LockHeld/time.Microsecond))
+	s.lastCycle.Store(cycle)
+}
+
+// expirestats returns the last cycle of the ttl checker and totals as JSON.
+func (s *PotatoSlave) expirestats(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	stats := expiryStats{
+		Cycles:  s.stats.get("ttl_cycles"),
+		Expired: s.stats.get("ttl_expired"),
+	}
+	if cycle, ok := s.lastCycle.Load().(expiryCycle); ok {
+		stats.LastCycle = cycle
+	}
+
+	s.storageMutex.Lock()
+	stats.Queued = len(s.scheduled)
+	s.storageMutex.Unlock()
+
+	body, _ := json.Marshal(stats)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
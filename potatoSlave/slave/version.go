@@ -0,0 +1,140 @@
+package slave
+
+import (
+	"encoding/json"
+	"runtime"
+	"strconv"
+)
+
+// Build info, set at link time:
+//
+//	go build -ldflags "-X potatoSlave/slave.Commit=$(git rev-parse --short HEAD) -X potatoSlave/slave.BuildDate=$(date -u +%F)"
+var (
+	Version   = "0.1.0"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// protocolVersions are the wire protocols this slave speaks.
+var protocolVersions = []string{"json/1", "json/2", "frames/1", "frames/2"}
+
+// minProtocol and maxProtocol are the versions of the protocol HELLO can agree
+// on, see CommandMessage.Protocol.
+const (
+	minProtocol = 1
+	maxProtocol = 2
+)
+
+// versionInfo is what VERSION returns.
+type versionInfo struct {
+	NodeID    string `json:",omitempty"`
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+	Protocols []string
+	Features  map[string]bool
+}
+
+// features tells which optional subsystems are enabled. The ones that don't
+// exist yet are always false so clients can already check for them.
+func (s *PotatoSlave) features() map[string]bool {
+
+	return map[string]bool{
+		"encryption":     s.encryptionKey != nil,
+		"panic_recovery": s.RECOVERPANICS,
+		"persistence":    s.SNAPSHOTPATH != "" || s.AOFPATH != "" || s.DISKPATH != "",
+		"cluster":        false,
+		"tls":            s.TLSPORT != "",
+		"frames":         true,
+		"hello":          true,
+	}
+}
+
+// version returns build info and enabled features as a JSON object.
+func (s *PotatoSlave) version(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) != 0 {
+		setStatus(&response, _WA)
+		return response
+	}
+
+	body, _ := json.Marshal(versionInfo{
+		NodeID:    s.NODEID,
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Protocols: protocolVersions,
+		Features:  s.features(),
+	})
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
+
+// helloInfo is what HELLO returns.
+type helloInfo struct {
+	Protocol uint
+	Format   string
+	Version  string
+	Features map[string]bool
+}
+
+// hello is HELLO version [feature ...], the first command of a client. The
+// client tells the newest version of the protocol it speaks and the slave
+// answers with the one they agree on, which the client then sends in Protocol
+// of every command, the format of the connection and the features. With
+// features only those are returned, false if the slave doesn't know them. A
+// client that is too old for the slave gets _PV, protocolVersions are in
+// Value.
+func (s *PotatoSlave) hello(userID string, mes CommandMessage) ResponseMessage {
+
+	var response ResponseMessage
+
+	if len(mes.Arguments) < 1 {
+		setStatus(&response, _WA)
+		return response
+	}
+	version, err := strconv.ParseUint(mes.Arguments[0], 10, 32)
+	if err != nil {
+		setStatus(&response, _WA)
+		return response
+	}
+	if version < minProtocol {
+		body, _ := json.Marshal(protocolVersions)
+		response.Value = string(body)
+		setStatus(&response, _PV)
+		return response
+	}
+	if version > maxProtocol {
+		version = maxProtocol
+	}
+
+	features := s.features()
+	if len(mes.Arguments) > 1 {
+		asked := map[string]bool{}
+		for _, name := range mes.Arguments[1:] {
+			asked[name] = features[name]
+		}
+		features = asked
+	}
+
+	info := helloInfo{
+		Protocol: uint(version),
+		Format:   "json",
+		Version:  Version,
+		Features: features,
+	}
+	if mes.framed {
+		info.Format = "frames"
+	}
+	body, _ := json.Marshal(info)
+	response.Value = string(body)
+	setStatus(&response, _OK)
+
+	return response
+}
@@ -0,0 +1,171 @@
+package slave
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////
+// Lock watchdog
+//////////
+
+// watchedMutex is a mutex that remembers since when it's held and the longest
+// time someone waited for it, so that the watchdog can report stalls. It can
+// be held for reading too, such waits are counted but readers aren't
+// remembered, a reader that never lets go shows as a Lock that waits.
+type watchedMutex struct {
+	sync.RWMutex
+	// lockedAt is UnixNano of the last Lock, 0 if the mutex is free.
+	lockedAt int64
+	// maxWait is the longest wait in nanoseconds since the last sample.
+	maxWait int64
+	// holder is the id of the goroutine that holds the mutex.
+	holder int64
+	// waitingSince is UnixNano of the start of a Lock that still waits, 0 if
+	// none does.
+	waitingSince int64
+}
+
+// goid returns the id of the current goroutine, which is only exposed in the
+// first line of its stack trace: "goroutine 42 [running]:".
+func goid() int64 {
+
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+
+	id, _ := strconv.ParseInt(string(buf[:bytes.IndexByte(buf, ' ')]), 10, 64)
+	return id
+}
+
+func (m *watchedMutex) Lock() {
+
+	start := time.Now()
+	waiting := atomic.CompareAndSwapInt64(&m.waitingSince, 0, start.UnixNano())
+	m.RWMutex.Lock()
+	now := time.Now()
+	if waiting {
+		atomic.StoreInt64(&m.waitingSince, 0)
+	}
+	m.waited(now.Sub(start))
+
+	atomic.StoreInt64(&m.lockedAt, now.UnixNano())
+	atomic.StoreInt64(&m.holder, goid())
+}
+
+func (m *watchedMutex) Unlock() {
+	atomic.StoreInt64(&m.holder, 0)
+	atomic.StoreInt64(&m.lockedAt, 0)
+	m.RWMutex.Unlock()
+}
+
+func (m *watchedMutex) RLock() {
+
+	start := time.Now()
+	m.RWMutex.RLock()
+	m.waited(time.Since(start))
+}
+
+// waited keeps the longest wait in maxWait.
+func (m *watchedMutex) waited(d time.Duration) {
+
+	wait := int64(d)
+	for {
+		old := atomic.LoadInt64(&m.maxWait)
+		if wait <= old || atomic.CompareAndSwapInt64(&m.maxWait, old, wait) {
+			break
+		}
+	}
+}
+
+// heldBy checks if the mutex is held by the goroutine with the given id.
+func (m *watchedMutex) heldBy(id int64) bool {
+	return atomic.LoadInt64(&m.holder) == id
+}
+
+// heldFor returns for how long the mutex is held and since when.
+func (m *watchedMutex) heldFor() (time.Duration, int64) {
+
+	lockedAt := atomic.LoadInt64(&m.lockedAt)
+	if lockedAt == 0 {
+		return 0, 0
+	}
+	return time.Since(time.Unix(0, lockedAt)), lockedAt
+}
+
+// waitingFor returns for how long a Lock waits and since when.
+func (m *watchedMutex) waitingFor() (time.Duration, int64) {
+
+	since := atomic.LoadInt64(&m.waitingSince)
+	if since == 0 {
+		return 0, 0
+	}
+	return time.Since(time.Unix(0, since)), since
+}
+
+// sampleWait returns the longest wait since the previous call.
+func (m *watchedMutex) sampleWait() time.Duration {
+	return time.Duration(atomic.SwapInt64(&m.maxWait, 0))
+}
+
+// watchdogRoutine checks storageMutex and userLocks every WATCHDOGINTERVAL
+// until stopped by someone. If a mutex is held longer than WATCHDOGTHRESHOLD,
+// or a Lock of it waits that long, e. g. for a reader, the stall is logged
+// once with the most recent command and stacks of all goroutines, the holder
+// is among them.
+func (s *PotatoSlave) watchdogRoutine(shutdownChan chan bool) {
+
+	var reported [userShards + 1]stall
+
+	for {
+		select {
+		case <-shutdownChan:
+			return
+		case <-time.After(s.WATCHDOGINTERVAL):
+		}
+
+		if wait := s.storageMutex.sampleWait(); wait > s.WATCHDOGTHRESHOLD {
+			log.Printf("watchdog: storage lock wait of %s", wait)
+		}
+		s.watch("storage lock", &s.storageMutex, &reported[0])
+		for i := range s.userLocks {
+			s.watch("lock of shard "+strconv.Itoa(i), &s.userLocks[i], &reported[i+1])
+		}
+	}
+}
+
+// stall is when the stalls of a mutex that were logged began.
+type stall struct {
+	held, waiting int64
+}
+
+// watch logs a stall of a mutex if it's new.
+func (s *PotatoSlave) watch(name string, m *watchedMutex, reported *stall) {
+
+	held, lockedAt := m.heldFor()
+	waiting, since := m.waitingFor()
+
+	var what string
+	switch {
+	case held > s.WATCHDOGTHRESHOLD && lockedAt != reported.held:
+		reported.held = lockedAt
+		what = fmt.Sprintf("is held by goroutine %d for %s", atomic.LoadInt64(&m.holder), held)
+	case waiting > s.WATCHDOGTHRESHOLD && since != reported.waiting && held <= s.WATCHDOGTHRESHOLD:
+		reported.waiting = since
+		what = fmt.Sprintf("is waited for for %s, it's held for reading", waiting)
+	default:
+		return
+	}
+
+	recent, _ := s.recentCommand.Load().(string)
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	log.Printf("watchdog: %s %s, recent command: %s\n%s", name, what, recent, buf)
+}
@@ -0,0 +1,303 @@
+package slave
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////
+// WebSocket
+//////////
+
+// TODO: there is no compression, permessage-deflate isn't offered.
+
+// websocketGUID is what the key of a handshake is hashed with, RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsConn is a WebSocket connection of a client, frames are written under
+// mutex so notifications and responses don't mix.
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+	max    int
+}
+
+// writeFrame sends a frame, frames of a server aren't masked.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readMessage returns the next text or binary message of the client. Pings
+// are answered on the way, a close frame is answered and returns io.EOF.
+func (c *wsConn) readMessage() ([]byte, error) {
+
+	var message []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0F
+		if head[1]&0x80 == 0 {
+			return nil, errors.New("websocket: frame of a client isn't masked")
+		}
+
+		n := uint64(head[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > uint64(c.max) || len(message)+int(n) > c.max {
+			c.writeFrame(wsClose, []byte{0x03, 0xF1}) // 1009, message too big
+			return nil, errors.New("websocket: message is too big")
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if (opcode == wsContinuation) != (message != nil) {
+				return nil, errors.New("websocket: unexpected continuation")
+			}
+			message = append(message, payload...)
+			if message == nil {
+				message = []byte{}
+			}
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, errors.New("websocket: unknown opcode")
+		}
+	}
+}
+
+// originAllowed tells if a page at origin may connect. A request without
+// Origin doesn't come from a browser.
+func (p *Proxy) originAllowed(r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range p.ORIGINS {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return len(p.ORIGINS) == 0 && err == nil && u.Host == r.Host
+}
+
+func headerHas(h http.Header, name string, token string) bool {
+
+	for _, value := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWebSocket upgrades a request at /ws to a WebSocket, every text message
+// of the client is a CommandMessage and every response is a message of its
+// own, a stream sends one for every part. SUBSCRIBE turns the connection into
+// a stream of notifications, like on Serve.
+func (p *Proxy) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet || !headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "a WebSocket handshake is expected", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !p.originAllowed(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &wsConn{conn: conn, reader: rw.Reader, max: p.WSMAXMESSAGE}
+	var mes CommandMessage
+	send := func(response ResponseMessage) error {
+		response.RequestID = mes.RequestID
+		body, _ := json.Marshal(response)
+		return c.writeFrame(wsText, body)
+	}
+
+	bucket := &tokenBucket{}
+	var seq uint64
+	for {
+		message, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		mes = CommandMessage{}
+		if err := json.Unmarshal(message, &mes); err != nil {
+			var response ResponseMessage
+			setStatus(&response, _WA)
+			response.Value = err.Error()
+			send(response)
+			continue
+		}
+
+		if mes.Name == "SUBSCRIBE" {
+			p.subscribeWebSocket(c, mes)
+			return
+		}
+
+		if !bucket.allow(time.Now(), p.RATELIMIT, p.RATEBURST) {
+			var response ResponseMessage
+			setStatus(&response, _RL)
+			send(response)
+			continue
+		}
+
+		if response, ok := SequenceWrite(&seq, &mes); !ok {
+			send(response)
+			continue
+		}
+
+		failed := false
+		p.roundTripEach(mes, func(response ResponseMessage) error {
+			err := send(response)
+			failed = err != nil
+			return err
+		})
+		if failed {
+			return
+		}
+	}
+}
+
+// subscribeWebSocket sends the client the notifications of a connection of
+// its own to the slave, and the slave the rest of client's messages.
+func (p *Proxy) subscribeWebSocket(c *wsConn, mes CommandMessage) {
+
+	upstream, err := p.dial()
+	if err != nil {
+		var response ResponseMessage
+		setStatus(&response, _UP)
+		body, _ := json.Marshal(response)
+		c.writeFrame(wsText, body)
+		return
+	}
+	defer upstream.Close()
+
+	encoder := json.NewEncoder(upstream)
+	encoder.Encode(mes)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		decoder := json.NewDecoder(upstream)
+		for {
+			var notification json.RawMessage
+			if decoder.Decode(&notification) != nil || c.writeFrame(wsText, notification) != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		for {
+			message, err := c.readMessage()
+			if err != nil {
+				break
+			}
+			var mes CommandMessage
+			if json.Unmarshal(message, &mes) == nil && encoder.Encode(mes) != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	<-done
+}
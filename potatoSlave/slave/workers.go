@@ -0,0 +1,116 @@
+package slave
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//////////
+// Workers
+//////////
+
+// A connection takes one of availableConnections while it's open and one of
+// availableWorkers only while a command of it is served, so idle connections
+// don't keep commands of others waiting. SUBSCRIBE and SYNC turn a connection
+// into a stream of notifications, they give the worker back too.
+
+// SetWorkers sets how many commands are served at once, it must be called
+// before any listener is served.
+func (s *PotatoSlave) SetWorkers(n int) {
+
+	s.NUMWORKERS = n
+	s.availableWorkers = make(chan bool, n)
+	for i := 0; i < n; i++ {
+		s.availableWorkers <- true
+	}
+}
+
+// SetMaxConnections sets how many connections are open at once, it must be
+// called before any listener is served.
+func (s *PotatoSlave) SetMaxConnections(n int) {
+
+	s.MAXCONNECTIONS = n
+	s.availableConnections = make(chan bool, n)
+	for i := 0; i < n; i++ {
+		s.availableConnections <- true
+	}
+}
+
+// acquire takes a token of a semaphore, waiting for one for WORKERWAIT at
+// most.
+func (s *PotatoSlave) acquire(semaphore chan bool) bool {
+
+	select {
+	case <-semaphore:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(s.WORKERWAIT)
+	defer timer.Stop()
+
+	select {
+	case <-semaphore:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// worker is the worker a connection holds while one of its commands is
+// served.
+type worker struct {
+	s    *PotatoSlave
+	held bool
+}
+
+// take gets a worker if the connection doesn't hold one yet.
+func (w *worker) take() bool {
+
+	if w.held {
+		return true
+	}
+	if !w.s.acquire(w.s.availableWorkers) {
+		w.s.stats.add("commands_without_worker", 1)
+		return false
+	}
+	atomic.AddInt64(&w.s.busyWorkers, 1)
+	w.held = true
+	return true
+}
+
+// release gives the worker back if the connection holds one.
+func (w *worker) release() {
+
+	if !w.held {
+		return
+	}
+	w.held = false
+	atomic.AddInt64(&w.s.busyWorkers, -1)
+	w.s.availableWorkers <- true
+}
+
+// admit serves an accepted connection with serve in a goroutine of its own,
+// the connection is counted as open until serve ends, however it does: a
+// clean close of the client, a stale connection or a panic. A connection that
+// doesn't fit into MAXCONNECTIONS in WORKERWAIT goes to refuse in the accept
+// loop.
+func (s *PotatoSlave) admit(connection net.Conn, serve func(net.Conn, string), refuse func(net.Conn)) {
+
+	if !s.acquire(s.availableConnections) {
+		s.stats.add("connections_refused", 1)
+		refuse(connection)
+		return
+	}
+	atomic.AddInt64(&s.openConnections, 1)
+
+	name, _ := s.authConnection(connection)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&s.openConnections, -1)
+			s.availableConnections <- true
+		}()
+		serve(connection, name)
+	}()
+}